@@ -29,6 +29,7 @@ var (
 		`(ATTACH|CREATE) LIVE VIEW (IF NOT EXISTS)? \S+`,
 		`(ATTACH|CREATE) MATERIALIZED VIEW( IF NOT EXISTS)? \S+`,
 		`(ATTACH|CREATE( OR REPLACE)?|REPLACE)( TEMPORARY)? TABLE( IF NOT EXISTS)? \S+`,
+		`(ATTACH|CREATE)( OR REPLACE)? VIEW( IF NOT EXISTS)? \S+`,
 		`(DETACH|DROP) DATABASE( IF EXISTS)? \S+`,
 		`(DETACH|DROP) (DICTIONARY|(TEMPORARY )?TABLE|VIEW)( IF EXISTS?) \S+`,
 		`KILL MUTATION`,
@@ -36,6 +37,8 @@ var (
 		`RENAME TABLE \S+ TO \S+`, // this is incomplete
 		`TRUNCATE( TEMPORARY)?( TABLE)?( IF EXISTS)? \S+`,
 		// not part of the grammar
+		`CREATE( ROW)? POLICY( IF NOT EXISTS| OR REPLACE)? \S+`,
+		`EXCHANGE (TABLES|DICTIONARIES) \S+ AND \S+`,
 		`SYSTEM RELOAD DICTIONARIES`,
 		`SYSTEM RELOAD DICTIONARY`,
 	}, "|")))
@@ -70,6 +70,21 @@ FROM queue GROUP BY day, level
 `,
 			`CREATE MATERIALIZED VIEW consumer ON CLUSTER akvorado TO daily AS SELECT toDate(toDateTime(timestamp)) AS day, level, count() as total FROM queue GROUP BY day, level`,
 		},
+		{
+			helpers.Mark(),
+			"CREATE ROW POLICY OR REPLACE akvorado_customer1 ON default.flows FOR SELECT USING ExporterTenant IN ('customer1') TO customer1",
+			"CREATE ROW POLICY OR REPLACE akvorado_customer1 ON CLUSTER akvorado ON default.flows FOR SELECT USING ExporterTenant IN ('customer1') TO customer1",
+		},
+		{
+			helpers.Mark(),
+			"CREATE OR REPLACE VIEW default.stats AS SELECT 1",
+			"CREATE OR REPLACE VIEW default.stats ON CLUSTER akvorado AS SELECT 1",
+		},
+		{
+			helpers.Mark(),
+			"EXCHANGE TABLES flows AND flows_new",
+			"EXCHANGE TABLES flows AND flows_new ON CLUSTER akvorado",
+		},
 		// Not modified
 		{helpers.Mark(), "SELECT 1", "SELECT 1"},
 	}
@@ -4,11 +4,18 @@
 package helpers
 
 import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
+	"maps"
 	"net"
 	"net/netip"
 	"reflect"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 
 	"github.com/gin-gonic/gin"
@@ -17,34 +24,478 @@ import (
 	tree "github.com/kentik/patricia/generics_tree"
 )
 
+var v4Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
 // SubnetMap maps subnets to values and allow to lookup by IP address.
 // Internally, everything is stored as an IPv6 (using v6-mapped IPv4
-// addresses).
+// addresses). Disabled subnets are kept aside and ignored by lookups.
 type SubnetMap[V any] struct {
-	tree *tree.TreeV6[V]
+	tree     *tree.TreeV6[V]
+	disabled map[patricia.IPv6Address]V
+	origins  map[patricia.IPv6Address]string
+	direct   map[uint32]V         // optional index of IPv4 /24 subnets, see Optimize()
+	misses   *subnetMapMissFilter // optional filter for misses, see OptimizeMisses()
+	ids      *tree.TreeV6[uint32] // optional IDs of the subnets, see AssignIDs()
+
+	collisions    []Collision            // collisions when built, see NewSubnetMapStrict()
+	defaultPolicy SubnetMapDefaultPolicy // see SetDefaultPolicy()
+	defaultValue  *V                     // see SetDefault()
+	includedFrom  string                 // file the entries were read from, see IncludedFrom()
+}
+
+// SubnetMapDefaultPolicy tells how Lookup handles an IP address only matching
+// a default route (::/0 or 0.0.0.0/0).
+type SubnetMapDefaultPolicy int
+
+const (
+	// SubnetMapDefaultMatch makes a default route match like any other subnet.
+	SubnetMapDefaultMatch SubnetMapDefaultPolicy = iota
+	// SubnetMapDefaultMiss makes a default route never match.
+	SubnetMapDefaultMiss
+	// SubnetMapDefaultError makes a default route never match. Moreover,
+	// LookupChecked returns ErrSubnetMapDefaultRoute.
+	SubnetMapDefaultError
+)
+
+// ErrSubnetMapDefaultRoute is returned by LookupChecked when the IP address only
+// matches a default route and the policy is SubnetMapDefaultError.
+var ErrSubnetMapDefaultRoute = errors.New("only the default route matches")
+
+// ErrSubnetMapInvalidKey matches any SubnetMapKeyError with errors.Is.
+var ErrSubnetMapInvalidKey = errors.New("invalid subnet")
+
+// SubnetMapKeyError is returned when decoding a SubnetMap with an invalid
+// subnet. Index is the position of the entry in the list form. It is -1 for
+// the map form as the order of a map is not known.
+type SubnetMapKeyError struct {
+	Key   string
+	Index int
+	Err   error
+}
+
+// Error returns the error message.
+func (e *SubnetMapKeyError) Error() string {
+	if e.Index >= 0 {
+		return fmt.Sprintf("invalid subnet %q (entry %d): %s", e.Key, e.Index, e.Err)
+	}
+	return fmt.Sprintf("invalid subnet %q: %s", e.Key, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *SubnetMapKeyError) Unwrap() error {
+	return e.Err
+}
+
+// Is tells if the error matches ErrSubnetMapInvalidKey.
+func (e *SubnetMapKeyError) Is(target error) bool {
+	return target == ErrSubnetMapInvalidKey
 }
 
 // Lookup will search for the most specific subnet matching the
-// provided IP address and return the value associated with it.
+// provided IP address and return the value associated with it. IPv4 addresses
+// should be mapped to IPv6. Otherwise, only ::/0 matches them.
 func (sm *SubnetMap[V]) Lookup(ip netip.Addr) (V, bool) {
+	if ip.Is4() {
+		var value V
+		if sm == nil || sm.tree == nil || sm.defaultPolicy != SubnetMapDefaultMatch {
+			return value, false
+		}
+		ok, value := sm.tree.FindDeepestTag(patricia.NewIPv6Address(nil, 0))
+		return value, ok
+	}
+	return sm.LookupAddr(ip)
+}
+
+// LookupAddr is like Lookup but it also accepts IPv4 addresses which are not
+// mapped to IPv6. It works on the 16-byte representation of the address and
+// does not allocate.
+func (sm *SubnetMap[V]) LookupAddr(ip netip.Addr) (V, bool) {
 	if sm == nil || sm.tree == nil {
 		var value V
 		return value, false
 	}
-	ok, value := sm.tree.FindDeepestTag(patricia.NewIPv6Address(ip.AsSlice(), 128))
+	if ip.Is4() {
+		ip = netip.AddrFrom16(ip.As16())
+	}
+	if sm.misses != nil && !sm.misses.mayContain(ip) {
+		var value V
+		return value, false
+	}
+	raw := ip.As16()
+	if sm.direct != nil && ip.Is4In6() {
+		if value, ok := sm.direct[uint32(raw[12])<<16|uint32(raw[13])<<8|uint32(raw[14])]; ok {
+			return value, true
+		}
+	}
+	ok, value := sm.tree.FindDeepestTag(patricia.NewIPv6Address(raw[:], 128))
+	if ok && sm.defaultPolicy != SubnetMapDefaultMatch && sm.onlyDefaultRouteMatches(ip) {
+		var value V
+		return value, false
+	}
 	return value, ok
 }
 
-// LookupOrDefault calls lookup and if not found, will return the
-// provided default value.
+// SetDefaultPolicy sets how Lookup and LookupChecked handle an IP address only
+// matching a default route. Other lookup functions are not affected.
+func (sm *SubnetMap[V]) SetDefaultPolicy(policy SubnetMapDefaultPolicy) {
+	sm.defaultPolicy = policy
+}
+
+// LookupChecked is like Lookup but it returns ErrSubnetMapDefaultRoute when the
+// IP address only matches a default route and the default policy is
+// SubnetMapDefaultError.
+func (sm *SubnetMap[V]) LookupChecked(ip netip.Addr) (V, bool, error) {
+	value, ok := sm.Lookup(ip)
+	if !ok && sm != nil && sm.tree != nil && sm.defaultPolicy == SubnetMapDefaultError && sm.onlyDefaultRouteMatches(ip) {
+		return value, false, ErrSubnetMapDefaultRoute
+	}
+	return value, ok, nil
+}
+
+// onlyDefaultRouteMatches tells if the provided IP address matches a default
+// route (::/0 or 0.0.0.0/0) and no more specific subnet.
+func (sm *SubnetMap[V]) onlyDefaultRouteMatches(ip netip.Addr) bool {
+	raw := ip.As16()
+	ip = netip.AddrFrom16(raw)
+	matches := len(sm.tree.FindTags(patricia.NewIPv6Address(raw[:], 128)))
+	if matches == 0 {
+		return false
+	}
+	defaultRoute := netip.PrefixFrom(netip.IPv6Unspecified(), 0)
+	if ip.Is4In6() {
+		defaultRoute = netip.PrefixFrom(netip.AddrFrom16([16]byte{10: 0xff, 11: 0xff}), 96)
+	}
+	return len(sm.tree.FindTags(patricia.NewIPv6Address(
+		defaultRoute.Addr().AsSlice(), uint(defaultRoute.Bits())))) == matches
+}
+
+// invalidate drops the optional indexes. It should be called on any
+// modification.
+func (sm *SubnetMap[V]) invalidate() {
+	sm.direct = nil
+	sm.misses = nil
+	sm.ids = nil
+}
+
+// AssignIDs assigns a numeric ID to each subnet, starting from 1, in the order
+// of the sorted subnets. The IDs are stable as long as the set of subnets does
+// not change. They are used by LookupID. Any modification of the SubnetMap
+// drops them.
+func (sm *SubnetMap[V]) AssignIDs() {
+	sm.ids = nil
+	if sm.tree == nil {
+		return
+	}
+	addresses := []patricia.IPv6Address{}
+	iter := sm.tree.Iterate()
+	for iter.Next() {
+		addresses = append(addresses, iter.Address())
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return subnetMapComparePrefixes(
+			subnetMapAddressToPrefix(addresses[i]),
+			subnetMapAddressToPrefix(addresses[j])) < 0
+	})
+	ids := tree.NewTreeV6[uint32]()
+	for i, address := range addresses {
+		ids.Set(address, uint32(i+1))
+	}
+	sm.ids = ids
+}
+
+// LookupID is like Lookup but returns the ID of the most specific subnet
+// matching the provided IP address. AssignIDs should have been called first.
+func (sm *SubnetMap[V]) LookupID(ip netip.Addr) (uint32, bool) {
+	if sm == nil || sm.ids == nil {
+		return 0, false
+	}
+	ok, id := sm.ids.FindDeepestTag(lookupAddress(ip))
+	return id, ok
+}
+
+// lookupAddress turns the provided IP address into a tree key. IPv4 addresses
+// are mapped to IPv6, like with LookupAddr.
+func lookupAddress(ip netip.Addr) patricia.IPv6Address {
+	raw := ip.As16()
+	return patricia.NewIPv6Address(raw[:], 128)
+}
+
+// Optimize builds an index of the IPv4 /24 subnets without more specific
+// subnets when they are at least half of the entries. This index is consulted
+// before the tree by Lookup. It returns true if the index was built. Any
+// modification of the SubnetMap drops the index.
+func (sm *SubnetMap[V]) Optimize() bool {
+	sm.direct = nil
+	if sm.tree == nil {
+		return false
+	}
+	total := 0
+	candidates := map[uint32]V{}
+	excluded := map[uint32]struct{}{}
+	iter := sm.tree.Iterate()
+	for iter.Next() {
+		total++
+		address := iter.Address()
+		if address.Left != 0 || address.Right>>32 != 0xffff || address.Length < 120 {
+			continue
+		}
+		key := uint32(address.Right) >> 8
+		if address.Length == 120 {
+			candidates[key] = iter.Tags()[0]
+		} else {
+			excluded[key] = struct{}{}
+		}
+	}
+	for key := range excluded {
+		delete(candidates, key)
+	}
+	if len(candidates) == 0 || len(candidates)*2 < total {
+		return false
+	}
+	sm.direct = candidates
+	return true
+}
+
+// CountByPrefix counts the provided IP addresses by the most specific subnet
+// matching them. Counts are keyed like with ToMap. Addresses without a
+// matching subnet are counted in other. Only subnets with a non-zero count are
+// present in the returned map.
+func (sm *SubnetMap[V]) CountByPrefix(ips iter.Seq[netip.Addr]) (counts map[string]uint64, other uint64) {
+	counts = map[string]uint64{}
+	if sm == nil || sm.tree == nil {
+		for range ips {
+			other++
+		}
+		return
+	}
+	// Index each subnet to count them with a single traversal per IP.
+	addresses := []patricia.IPv6Address{}
+	indexes := tree.NewTreeV6[int]()
+	entries := sm.tree.Iterate()
+	for entries.Next() {
+		indexes.Set(entries.Address(), len(addresses))
+		addresses = append(addresses, entries.Address())
+	}
+	perIndex := make([]uint64, len(addresses))
+	for ip := range ips {
+		if ok, index := indexes.FindDeepestTag(lookupAddress(ip)); ok {
+			perIndex[index]++
+		} else {
+			other++
+		}
+	}
+	for index, count := range perIndex {
+		if count > 0 {
+			counts[addresses[index].String()] = count
+		}
+	}
+	return
+}
+
+// LookupInto is like Lookup but for a net.IP. The provided scratch buffer is
+// used to store the IPv6 version of the address to avoid allocations.
+func (sm *SubnetMap[V]) LookupInto(ip net.IP, scratch *[16]byte) (V, bool) {
+	if sm == nil || sm.tree == nil {
+		var value V
+		return value, false
+	}
+	if !ipInto(ip, scratch) {
+		var value V
+		return value, false
+	}
+	ok, value := sm.tree.FindDeepestTag(patricia.NewIPv6Address(scratch[:], 128))
+	return value, ok
+}
+
+// LookupPair looks up both a source and a destination IP. This is like calling
+// LookupInto twice but with a shared setup.
+func (sm *SubnetMap[V]) LookupPair(src, dst net.IP) (srcV V, srcOK bool, dstV V, dstOK bool) {
+	if sm == nil || sm.tree == nil {
+		return
+	}
+	var scratch [16]byte
+	if ipInto(src, &scratch) {
+		srcOK, srcV = sm.tree.FindDeepestTag(patricia.NewIPv6Address(scratch[:], 128))
+	}
+	if ipInto(dst, &scratch) {
+		dstOK, dstV = sm.tree.FindDeepestTag(patricia.NewIPv6Address(scratch[:], 128))
+	}
+	return
+}
+
+// LookupInherit is like LookupInto but it merges the values of all the subnets
+// matching the provided IP address. Walking from the most specific subnet to
+// the least specific one, inherit is called with the current value and the
+// value of the parent subnet and returns the new current value. This enables
+// a subnet to inherit some attributes from a larger subnet.
+func (sm *SubnetMap[V]) LookupInherit(ip net.IP, inherit func(child, parent V) V) (V, bool) {
+	var value V
+	var scratch [16]byte
+	if sm == nil || sm.tree == nil || !ipInto(ip, &scratch) {
+		return value, false
+	}
+	tags := sm.tree.FindTags(patricia.NewIPv6Address(scratch[:], 128))
+	if len(tags) == 0 {
+		return value, false
+	}
+	value = tags[len(tags)-1]
+	for i := len(tags) - 2; i >= 0; i-- {
+		value = inherit(value, tags[i])
+	}
+	return value, true
+}
+
+// ipInto stores the IPv6 version of the provided IP into the scratch buffer.
+// It returns false if the IP is invalid.
+func ipInto(ip net.IP, scratch *[16]byte) bool {
+	switch len(ip) {
+	case net.IPv4len:
+		copy(scratch[:], v4Prefix)
+		copy(scratch[12:], ip)
+	case net.IPv6len:
+		copy(scratch[:], ip)
+	default:
+		return false
+	}
+	return true
+}
+
+// LookupDepth is like Lookup but also returns the number of matching subnets
+// traversed in the tree to find the value. This is meant for diagnostics and it
+// is slower than Lookup.
+func (sm *SubnetMap[V]) LookupDepth(ip netip.Addr) (V, bool, int) {
+	var value V
+	if sm == nil || sm.tree == nil {
+		return value, false, 0
+	}
+	tags := sm.tree.FindTags(lookupAddress(ip))
+	if len(tags) == 0 {
+		return value, false, 0
+	}
+	return tags[len(tags)-1], true, len(tags)
+}
+
+// LookupOrDefault calls lookup and if not found, will return the default
+// value configured with SetDefault or, if there is none, the provided default
+// value. A subnet matching the IP address, including an explicit ::/0 subnet,
+// always wins over the default values.
 func (sm *SubnetMap[V]) LookupOrDefault(ip netip.Addr, fallback V) V {
 	if value, ok := sm.Lookup(ip); ok {
 		return value
 	}
+	if sm != nil && sm.defaultValue != nil {
+		return *sm.defaultValue
+	}
 	return fallback
 }
 
-// ToMap return a map of the tree.
+// SetDefault configures the value returned by LookupOrDefault when no subnet
+// matches. Unlike setting a value for ::/0, it does not change the result of
+// the other lookup functions.
+func (sm *SubnetMap[V]) SetDefault(v V) {
+	sm.defaultValue = &v
+}
+
+// LookupOrFallback is like LookupInto but, when no subnet matches the provided
+// IP address, it returns the result of the fallback function instead. The
+// fallback is only called on a miss.
+func (sm *SubnetMap[V]) LookupOrFallback(ip net.IP, fallback func(net.IP) (V, bool)) (V, bool) {
+	var scratch [16]byte
+	if value, ok := sm.LookupInto(ip, &scratch); ok {
+		return value, true
+	}
+	return fallback(ip)
+}
+
+// LookupWithOrigin is like Lookup but also returns the origin of the most
+// specific subnet matching the provided IP address, as set by SetWithOrigin.
+// The origin is empty when unknown. This is meant for diagnostics and it is
+// slower than Lookup.
+func (sm *SubnetMap[V]) LookupWithOrigin(ip netip.Addr) (V, string, bool) {
+	var value V
+	if sm == nil || sm.tree == nil {
+		return value, "", false
+	}
+	if ip.Is4() {
+		ip = netip.AddrFrom16(ip.As16())
+	}
+	tags := sm.tree.FindTags(lookupAddress(ip))
+	if len(tags) == 0 {
+		return value, "", false
+	}
+	value = tags[len(tags)-1]
+	if len(sm.origins) == 0 {
+		return value, "", true
+	}
+	prefix := sm.deepestPrefix(ip, len(tags))
+	return value, sm.origins[patricia.NewIPv6Address(prefix.Addr().AsSlice(), uint(prefix.Bits()))], true
+}
+
+// deepestPrefix returns the subnet matching the provided IP address at the
+// provided depth: with matches set to the number of subnets matching the IP
+// address, this is the most specific one.
+func (sm *SubnetMap[V]) deepestPrefix(ip netip.Addr, matches int) netip.Prefix {
+	// The matching subnet is the shortest prefix of the IP address with at
+	// least the requested number of matching subnets.
+	length := sort.Search(128, func(length int) bool {
+		prefix := netip.PrefixFrom(ip, length).Masked()
+		return len(sm.tree.FindTags(patricia.NewIPv6Address(prefix.Addr().AsSlice(), uint(length)))) >= matches
+	})
+	return netip.PrefixFrom(ip, length).Masked()
+}
+
+// LookupEx is like LookupInto but it also returns the most specific subnet
+// matching the provided IP address. IPv4 subnets are returned as IPv4
+// networks. This is meant for diagnostics and it is slower than LookupInto.
+func (sm *SubnetMap[V]) LookupEx(ip net.IP) (V, net.IPNet, bool) {
+	var value V
+	var scratch [16]byte
+	if sm == nil || sm.tree == nil || !ipInto(ip, &scratch) {
+		return value, net.IPNet{}, false
+	}
+	tags := sm.tree.FindTags(patricia.NewIPv6Address(scratch[:], 128))
+	if len(tags) == 0 {
+		return value, net.IPNet{}, false
+	}
+	prefix := sm.deepestPrefix(netip.AddrFrom16(scratch), len(tags))
+	return tags[len(tags)-1], subnetMapPrefixToIPNet(prefix), true
+}
+
+// SubnetMapEntry is a subnet with its associated value.
+type SubnetMapEntry[V any] struct {
+	Prefix net.IPNet
+	Value  V
+}
+
+// Supernets returns all the subnets matching the provided IP address with
+// their values, from the least specific to the most specific. IPv4 subnets are
+// returned as IPv4 networks. This is slower than LookupInto.
+func (sm *SubnetMap[V]) Supernets(ip net.IP) []SubnetMapEntry[V] {
+	var scratch [16]byte
+	if sm == nil || sm.tree == nil || !ipInto(ip, &scratch) {
+		return nil
+	}
+	tags := sm.tree.FindTags(patricia.NewIPv6Address(scratch[:], 128))
+	addr := netip.AddrFrom16(scratch)
+	entries := make([]SubnetMapEntry[V], len(tags))
+	for i, tag := range tags {
+		entries[i] = SubnetMapEntry[V]{
+			Prefix: subnetMapPrefixToIPNet(sm.deepestPrefix(addr, i+1)),
+			Value:  tag,
+		}
+	}
+	return entries
+}
+
+// Len returns the number of enabled subnets in the SubnetMap.
+func (sm *SubnetMap[V]) Len() int {
+	if sm == nil || sm.tree == nil {
+		return 0
+	}
+	return sm.tree.CountTags()
+}
+
+// ToMap return a map of the tree. IPv4 subnets are returned as IPv4 prefixes.
 func (sm *SubnetMap[V]) ToMap() map[string]V {
 	output := map[string]V{}
 	if sm == nil || sm.tree == nil {
@@ -52,48 +503,355 @@ func (sm *SubnetMap[V]) ToMap() map[string]V {
 	}
 	iter := sm.tree.Iterate()
 	for iter.Next() {
-		output[iter.Address().String()] = iter.Tags()[0]
+		output[subnetMapFormatAddress(iter.Address())] = iter.Tags()[0]
 	}
 	return output
 }
 
 // Set inserts the given key k into the SubnetMap, replacing any existing value if it exists.
 func (sm *SubnetMap[V]) Set(k string, v V) error {
-	subnetK, err := SubnetMapParseKey(k)
+	address, err := subnetMapParseAddress(k)
 	if err != nil {
 		return err
 	}
-	_, ipNet, err := net.ParseCIDR(subnetK)
+	delete(sm.disabled, address)
+	delete(sm.origins, address)
+	sm.invalidate()
+	sm.tree.Set(address, v)
+	return nil
+}
+
+// SetWithOrigin is like Set but also records the origin of the entry, for
+// example the file it comes from. It is returned by LookupWithOrigin.
+func (sm *SubnetMap[V]) SetWithOrigin(k string, v V, origin string) error {
+	if err := sm.Set(k, v); err != nil {
+		return err
+	}
+	return sm.setOrigin(k, origin)
+}
+
+// setOrigin records the origin of an entry, enabled or not.
+func (sm *SubnetMap[V]) setOrigin(k string, origin string) error {
+	address, err := subnetMapParseAddress(k)
 	if err != nil {
-		// Should not happen
 		return err
 	}
-	_, bits := ipNet.Mask.Size()
-	if bits != 128 {
-		return fmt.Errorf("%q is not an IPv6 subnet", ipNet)
+	if origin == "" {
+		delete(sm.origins, address)
+		return nil
+	}
+	if sm.origins == nil {
+		sm.origins = map[patricia.IPv6Address]string{}
 	}
-	plen, _ := ipNet.Mask.Size()
-	sm.tree.Set(patricia.NewIPv6Address(ipNet.IP.To16(), uint(plen)), v)
+	sm.origins[address] = origin
 	return nil
 }
 
-// Update inserts the given key k into the SubnetMap, calling updateFunc with the existing value.
-func (sm *SubnetMap[V]) Update(k string, v V, updateFunc tree.UpdatesFunc[V]) error {
-	subnetK, err := SubnetMapParseKey(k)
+// SetDisabled inserts the given key k into the SubnetMap as a disabled entry.
+// It is ignored by lookups until enabled with Enable. Any enabled entry for
+// the same key is removed.
+func (sm *SubnetMap[V]) SetDisabled(k string, v V) error {
+	address, err := subnetMapParseAddress(k)
 	if err != nil {
 		return err
 	}
+	delete(sm.origins, address)
+	sm.invalidate()
+	sm.tree.Delete(address, func(V, V) bool { return true }, v)
+	if sm.disabled == nil {
+		sm.disabled = map[patricia.IPv6Address]V{}
+	}
+	sm.disabled[address] = v
+	return nil
+}
+
+// Enable enables back a disabled entry. It returns true if an entry was
+// enabled.
+func (sm *SubnetMap[V]) Enable(k string) (bool, error) {
+	address, err := subnetMapParseAddress(k)
+	if err != nil {
+		return false, err
+	}
+	v, ok := sm.disabled[address]
+	if !ok {
+		return false, nil
+	}
+	delete(sm.disabled, address)
+	sm.invalidate()
+	sm.tree.Set(address, v)
+	return true, nil
+}
+
+// Disable disables an enabled entry. It is kept in the SubnetMap but ignored
+// by lookups, which fall through to the next most specific enabled entry. It
+// returns true if an entry was disabled.
+func (sm *SubnetMap[V]) Disable(k string) (bool, error) {
+	address, err := subnetMapParseAddress(k)
+	if err != nil {
+		return false, err
+	}
+	var value V
+	sm.invalidate()
+	if sm.tree.Delete(address, func(payload, _ V) bool {
+		value = payload
+		return true
+	}, value) == 0 {
+		return false, nil
+	}
+	if sm.disabled == nil {
+		sm.disabled = map[patricia.IPv6Address]V{}
+	}
+	sm.disabled[address] = value
+	return true, nil
+}
+
+// Delete removes the given key k from the SubnetMap, including when it is
+// disabled. It returns true if the key was present.
+func (sm *SubnetMap[V]) Delete(k string) (bool, error) {
+	address, err := subnetMapParseAddress(k)
+	if err != nil {
+		return false, err
+	}
+	_, disabled := sm.disabled[address]
+	delete(sm.disabled, address)
+	delete(sm.origins, address)
+	if sm.tree == nil {
+		return disabled, nil
+	}
+	sm.invalidate()
+	deleted := sm.tree.Delete(address, func(_, _ V) bool { return true }, *new(V)) > 0
+	return deleted || disabled, nil
+}
+
+// DeletePrefix is like Delete but for a subnet provided as a net.IPNet. IPv4
+// subnets are mapped to IPv6 like the keys of a configuration. Less specific
+// subnets are not affected and match again the addresses of the removed
+// subnet. It returns true if the subnet was present.
+func (sm *SubnetMap[V]) DeletePrefix(prefix net.IPNet) bool {
+	deleted, err := sm.Delete(prefix.String())
+	return err == nil && deleted
+}
+
+// Clone returns an independent copy of the SubnetMap. Modifying the copy does
+// not affect the original. Values are copied by assignment: when they are
+// pointers, maps or slices, the underlying data is shared. The optional indexes
+// are not copied. The clone of a nil SubnetMap is an empty SubnetMap.
+func (sm *SubnetMap[V]) Clone() *SubnetMap[V] {
+	if sm == nil || sm.tree == nil {
+		return &SubnetMap[V]{tree: tree.NewTreeV6[V]()}
+	}
+	clone := &SubnetMap[V]{
+		tree:          sm.tree.Clone(),
+		disabled:      maps.Clone(sm.disabled),
+		origins:       maps.Clone(sm.origins),
+		collisions:    slices.Clone(sm.collisions),
+		defaultPolicy: sm.defaultPolicy,
+		includedFrom:  sm.includedFrom,
+	}
+	if sm.defaultValue != nil {
+		clone.SetDefault(*sm.defaultValue)
+	}
+	return clone
+}
+
+// IncludedFrom returns the path of the file the entries were read from when
+// the SubnetMap was decoded from an `!include` directive. Otherwise, it
+// returns an empty string.
+func (sm *SubnetMap[V]) IncludedFrom() string {
+	if sm == nil {
+		return ""
+	}
+	return sm.includedFrom
+}
+
+// Merge inserts the enabled entries of another SubnetMap into this one. When a
+// subnet is present in both, onConflict is called with the existing and the
+// incoming values and returns the value to keep. Without onConflict, the
+// incoming value is kept. Merging a nil SubnetMap is a no-op.
+func (sm *SubnetMap[V]) Merge(other *SubnetMap[V], onConflict func(existing, incoming V) V) error {
+	if other == nil || other.tree == nil {
+		return nil
+	}
+	if sm == nil {
+		return errors.New("cannot merge into a nil SubnetMap")
+	}
+	if sm.tree == nil {
+		sm.tree = tree.NewTreeV6[V]()
+	}
+	existing := map[patricia.IPv6Address]V{}
+	entries := sm.tree.Iterate()
+	for entries.Next() {
+		existing[entries.Address()] = entries.Tags()[0]
+	}
+	sm.invalidate()
+	incoming := other.tree.Iterate()
+	for incoming.Next() {
+		address := incoming.Address()
+		value := incoming.Tags()[0]
+		if current, ok := existing[address]; ok && onConflict != nil {
+			value = onConflict(current, value)
+		}
+		delete(sm.disabled, address)
+		delete(sm.origins, address)
+		if origin, ok := other.origins[address]; ok {
+			if sm.origins == nil {
+				sm.origins = map[patricia.IPv6Address]string{}
+			}
+			sm.origins[address] = origin
+		}
+		sm.tree.Set(address, value)
+	}
+	return nil
+}
+
+// Shrink rebuilds the SubnetMap from its current entries to release the memory
+// retained after deletions. Lookups are not affected. Like any modification, it
+// drops the optional indexes.
+func (sm *SubnetMap[V]) Shrink() {
+	if sm == nil || sm.tree == nil {
+		return
+	}
+	sm.invalidate()
+	shrunk := tree.NewTreeV6[V]()
+	iter := sm.tree.Iterate()
+	for iter.Next() {
+		shrunk.Set(iter.Address(), iter.Tags()[0])
+	}
+	sm.tree = shrunk
+	if sm.disabled != nil {
+		disabled := make(map[patricia.IPv6Address]V, len(sm.disabled))
+		for address, v := range sm.disabled {
+			disabled[address] = v
+		}
+		sm.disabled = disabled
+	}
+	if sm.origins != nil {
+		origins := make(map[patricia.IPv6Address]string, len(sm.origins))
+		for address, origin := range sm.origins {
+			origins[address] = origin
+		}
+		sm.origins = origins
+	}
+}
+
+// ToDisabledMap return a map of the disabled entries.
+func (sm *SubnetMap[V]) ToDisabledMap() map[string]V {
+	output := map[string]V{}
+	if sm == nil {
+		return output
+	}
+	for address, v := range sm.disabled {
+		output[subnetMapFormatAddress(address)] = v
+	}
+	return output
+}
+
+// ToSQLCase renders the SubnetMap as a ClickHouse expression returning the
+// value of the most specific subnet containing the IP address in the provided
+// column, or an empty string. Values are rendered as strings. Subnets are
+// rendered as IPv6 subnets, like the IP addresses stored by ClickHouse.
+func (sm *SubnetMap[V]) ToSQLCase(column string) string {
+	type entry struct {
+		prefix netip.Prefix
+		value  V
+	}
+	entries := []entry{}
+	if sm != nil && sm.tree != nil {
+		iter := sm.tree.Iterate()
+		for iter.Next() {
+			entries = append(entries, entry{subnetMapAddressToPrefix(iter.Address()), iter.Tags()[0]})
+		}
+	}
+	if len(entries) == 0 {
+		return "''"
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].prefix.Bits() != entries[j].prefix.Bits() {
+			return entries[i].prefix.Bits() > entries[j].prefix.Bits()
+		}
+		return entries[i].prefix.Addr().Less(entries[j].prefix.Addr())
+	})
+	quoteEscaper := strings.NewReplacer(`'`, `\'`, `\`, `\\`)
+	quote := func(s string) string {
+		return fmt.Sprintf("'%s'", quoteEscaper.Replace(s))
+	}
+	conditions := make([]string, 0, len(entries))
+	for _, e := range entries {
+		conditions = append(conditions, fmt.Sprintf("isIPAddressInRange(toString(%s), %s), %s",
+			column, quote(e.prefix.String()), quote(fmt.Sprint(e.value))))
+	}
+	return fmt.Sprintf("multiIf(%s, '')", strings.Join(conditions, ", "))
+}
+
+// subnetMapAddressToPrefix turns a patricia address into an IPv6 prefix.
+func subnetMapAddressToPrefix(address patricia.IPv6Address) netip.Prefix {
+	var raw [16]byte
+	binary.BigEndian.PutUint64(raw[:8], address.Left)
+	binary.BigEndian.PutUint64(raw[8:], address.Right)
+	return netip.PrefixFrom(netip.AddrFrom16(raw), int(address.Length))
+}
+
+// subnetMapPrefixToIPNet turns an IPv6 prefix into a network. IPv4-mapped
+// prefixes are turned into IPv4 networks.
+func subnetMapPrefixToIPNet(prefix netip.Prefix) net.IPNet {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		return net.IPNet{
+			IP:   prefix.Addr().Unmap().AsSlice(),
+			Mask: net.CIDRMask(prefix.Bits()-96, 32),
+		}
+	}
+	return net.IPNet{
+		IP:   prefix.Addr().AsSlice(),
+		Mask: net.CIDRMask(prefix.Bits(), 128),
+	}
+}
+
+// subnetMapFormatAddress turns a patricia address into a string. IPv4-mapped
+// prefixes are rendered as IPv4 prefixes, as they are usually written in the
+// configuration.
+func subnetMapFormatAddress(address patricia.IPv6Address) string {
+	prefix := subnetMapAddressToPrefix(address)
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.String()
+}
+
+// subnetMapComparePrefixes compares two prefixes by address, then by length.
+// Once sorted, parents come before their children.
+func subnetMapComparePrefixes(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return a.Bits() - b.Bits()
+}
+
+// subnetMapParseAddress turns a key into a patricia address.
+func subnetMapParseAddress(k string) (patricia.IPv6Address, error) {
+	subnetK, err := SubnetMapParseKey(k)
+	if err != nil {
+		return patricia.IPv6Address{}, err
+	}
 	_, ipNet, err := net.ParseCIDR(subnetK)
 	if err != nil {
 		// Should not happen
-		return err
+		return patricia.IPv6Address{}, err
 	}
-	_, bits := ipNet.Mask.Size()
+	plen, bits := ipNet.Mask.Size()
 	if bits != 128 {
-		return fmt.Errorf("%q is not an IPv6 subnet", ipNet)
+		return patricia.IPv6Address{}, fmt.Errorf("%q is not an IPv6 subnet", ipNet)
 	}
-	plen, _ := ipNet.Mask.Size()
-	sm.tree.SetOrUpdate(patricia.NewIPv6Address(ipNet.IP.To16(), uint(plen)), v, updateFunc)
+	return patricia.NewIPv6Address(ipNet.IP.To16(), uint(plen)), nil
+}
+
+// Update inserts the given key k into the SubnetMap, calling updateFunc with the existing value.
+func (sm *SubnetMap[V]) Update(k string, v V, updateFunc tree.UpdatesFunc[V]) error {
+	address, err := subnetMapParseAddress(k)
+	if err != nil {
+		return err
+	}
+	sm.invalidate()
+	sm.tree.SetOrUpdate(address, v, updateFunc)
 	return nil
 }
 
@@ -108,20 +866,242 @@ func (sm *SubnetMap[V]) Iter(f func(address patricia.IPv6Address, tags [][]V) er
 	return nil
 }
 
-// NewSubnetMap creates a subnetmap from a map. Unlike user-provided
-// configuration, this function is stricter and require everything to
-// be IPv6 subnets.
+// IterSorted calls f for every entry of the SubnetMap, sorted by address, then
+// by prefix length. IPv4 subnets are provided as IPv4 networks. If f returns
+// false, the iteration is stopped. Unlike Iter, the order does not depend on
+// the internal structure of the tree.
+func (sm *SubnetMap[V]) IterSorted(f func(prefix net.IPNet, value V) bool) {
+	if sm == nil || sm.tree == nil {
+		return
+	}
+	type entry struct {
+		prefix netip.Prefix
+		value  V
+	}
+	entries := make([]entry, 0, sm.tree.CountTags())
+	iter := sm.tree.Iterate()
+	for iter.Next() {
+		entries = append(entries, entry{subnetMapAddressToPrefix(iter.Address()), iter.Tags()[0]})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return subnetMapComparePrefixes(entries[i].prefix, entries[j].prefix) < 0
+	})
+	for _, e := range entries {
+		if !f(subnetMapPrefixToIPNet(e.prefix), e.value) {
+			return
+		}
+	}
+}
+
+// WalkLengthRange calls fn for every entry whose prefix length is between
+// minLen and maxLen (inclusive). Lengths are for the native family: an IPv4
+// subnet has a length between 0 and 32. If fn returns an error, the walk is
+// aborted.
+func (sm *SubnetMap[V]) WalkLengthRange(minLen, maxLen int, fn func(prefix string, v V) error) error {
+	if sm == nil || sm.tree == nil {
+		return nil
+	}
+	iter := sm.tree.Iterate()
+	for iter.Next() {
+		prefix := iter.Address().String()
+		parsed, err := netip.ParsePrefix(prefix)
+		if err != nil {
+			// Should not happen
+			return fmt.Errorf("failed to parse prefix %s: %w", prefix, err)
+		}
+		if parsed.Bits() < minLen || parsed.Bits() > maxLen {
+			continue
+		}
+		if err := fn(prefix, iter.Tags()[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Dot returns a Graphviz representation of the SubnetMap. Each subnet is a
+// node labeled with its value and it is linked to its most specific parent.
+func (sm *SubnetMap[V]) Dot() string {
+	type node struct {
+		prefix netip.Prefix
+		name   string
+		value  V
+	}
+	nodes := []node{}
+	if sm != nil && sm.tree != nil {
+		iter := sm.tree.Iterate()
+		for iter.Next() {
+			address := iter.Address()
+			nodes = append(nodes, node{
+				prefix: subnetMapAddressToPrefix(address),
+				name:   address.String(),
+				value:  iter.Tags()[0],
+			})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return subnetMapComparePrefixes(nodes[i].prefix, nodes[j].prefix) < 0
+	})
+
+	var b strings.Builder
+	b.WriteString("digraph SubnetMap {\n")
+	for _, n := range nodes {
+		fmt.Fprintf(&b, "  %q [label=%q];\n", n.name, fmt.Sprintf("%s\n%v", n.name, n.value))
+	}
+	// Once sorted, parents come before their children
+	parents := []node{}
+	for _, n := range nodes {
+		for len(parents) > 0 && !parents[len(parents)-1].prefix.Contains(n.prefix.Addr()) {
+			parents = parents[:len(parents)-1]
+		}
+		if len(parents) > 0 {
+			fmt.Fprintf(&b, "  %q -> %q;\n", parents[len(parents)-1].name, n.name)
+		}
+		parents = append(parents, n)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// NewSubnetMap creates a subnetmap from a map. Keys are parsed like in
+// user-provided configuration: IPv4 subnets and IP addresses are accepted and
+// turned into IPv6 subnets. An error is returned if a key is invalid.
 func NewSubnetMap[V any](from map[string]V) (*SubnetMap[V], error) {
-	trie := &SubnetMap[V]{tree.NewTreeV6[V]()}
+	trie := &SubnetMap[V]{tree: tree.NewTreeV6[V]()}
 	if from == nil {
 		return trie, nil
 	}
 	for k, v := range from {
-		trie.Set(k, v)
+		if err := trie.Set(k, v); err != nil {
+			return nil, fmt.Errorf("failed to parse key %s: %w", k, err)
+		}
 	}
 	return trie, nil
 }
 
+// SubnetEntry is a subnet with its associated value. It is used to build a
+// SubnetMap from an ordered source. When several entries are provided for the
+// same subnet, the one with the highest priority wins.
+type SubnetEntry[V any] struct {
+	Prefix   string
+	Value    V
+	Priority int
+}
+
+// Collision describes a subnet provided several times with different values.
+// Prefix is the subnet as provided in the first entry, Indexes are the
+// positions of all the entries for this subnet and Chosen is the position of
+// the entry used by lookups.
+type Collision struct {
+	Prefix  string
+	Indexes []int
+	Chosen  int
+}
+
+// IndexedSubnetMap maps subnets to values like SubnetMap but the tree only
+// stores indexes into a slice of distinct values. This saves memory when many
+// subnets share a few large values.
+type IndexedSubnetMap[V comparable] struct {
+	index  *SubnetMap[uint32]
+	values []V
+}
+
+// NewIndexedSubnetMap creates an indexed subnetmap from a map. Like
+// NewSubnetMap, it requires everything to be IPv6 subnets.
+func NewIndexedSubnetMap[V comparable](from map[string]V) (*IndexedSubnetMap[V], error) {
+	ism := &IndexedSubnetMap[V]{
+		index:  &SubnetMap[uint32]{tree: tree.NewTreeV6[uint32]()},
+		values: []V{},
+	}
+	indexes := map[V]uint32{}
+	for k, v := range from {
+		idx, ok := indexes[v]
+		if !ok {
+			idx = uint32(len(ism.values))
+			indexes[v] = idx
+			ism.values = append(ism.values, v)
+		}
+		if err := ism.index.Set(k, idx); err != nil {
+			return nil, err
+		}
+	}
+	return ism, nil
+}
+
+// Lookup will search for the most specific subnet matching the
+// provided IP address and return the value associated with it.
+func (ism *IndexedSubnetMap[V]) Lookup(ip netip.Addr) (V, bool) {
+	if ism == nil {
+		var value V
+		return value, false
+	}
+	idx, ok := ism.index.Lookup(ip)
+	if !ok {
+		var value V
+		return value, false
+	}
+	return ism.values[idx], true
+}
+
+// Values returns the distinct values stored in the indexed subnetmap.
+func (ism *IndexedSubnetMap[V]) Values() []V {
+	return ism.values
+}
+
+// NewSubnetMapStrict creates a subnetmap from a list of entries. Entries for
+// the same subnet with a different value are reported as collisions. The
+// entry with the highest priority wins. For the same priority, as with Set,
+// the last value wins. Subnets can be IPv4 or IPv6. The collisions are also
+// available with Ambiguities.
+func NewSubnetMapStrict[V any](entries []SubnetEntry[V]) (*SubnetMap[V], []Collision, error) {
+	trie := &SubnetMap[V]{tree: tree.NewTreeV6[V]()}
+	keys := []string{}
+	indexes := map[string][]int{}
+	chosen := map[string]int{}
+	for idx, entry := range entries {
+		key, err := SubnetMapParseKey(entry.Prefix)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse key %s: %w", entry.Prefix, err)
+		}
+		if _, ok := indexes[key]; !ok {
+			keys = append(keys, key)
+		}
+		indexes[key] = append(indexes[key], idx)
+		if current, ok := chosen[key]; !ok || entry.Priority >= entries[current].Priority {
+			chosen[key] = idx
+		}
+	}
+	collisions := []Collision{}
+	for _, key := range keys {
+		if err := trie.Set(key, entries[chosen[key]].Value); err != nil {
+			return nil, nil, err
+		}
+		first := indexes[key][0]
+		for _, idx := range indexes[key][1:] {
+			if !reflect.DeepEqual(entries[first].Value, entries[idx].Value) {
+				collisions = append(collisions, Collision{
+					Prefix:  entries[first].Prefix,
+					Indexes: indexes[key],
+					Chosen:  chosen[key],
+				})
+				break
+			}
+		}
+	}
+	trie.collisions = collisions
+	return trie, collisions, nil
+}
+
+// Ambiguities returns the subnets provided several times with different values
+// when building the SubnetMap with NewSubnetMapStrict. They are not updated on
+// modifications.
+func (sm *SubnetMap[V]) Ambiguities() []Collision {
+	if sm == nil {
+		return nil
+	}
+	return sm.collisions
+}
+
 // MustNewSubnetMap creates a subnet from a map and panic in case of a
 // problem. This should only be used with tests.
 func MustNewSubnetMap[V any](from map[string]V) *SubnetMap[V] {
@@ -157,10 +1137,216 @@ func LooksLikeSubnetMap(v reflect.Value) (result bool) {
 	return
 }
 
+// subnetMapDefaultKey is the key of a SubnetMap in map form setting the value
+// for ::/0.
+const subnetMapDefaultKey = "default"
+
+// looksLikeSubnetMapWithDefault is like LooksLikeSubnetMap but it also accepts
+// the default key. A map with only the default key is not accepted when V is a
+// struct or a map as it may be a single value with a Default field.
+func looksLikeSubnetMapWithDefault[V any](v reflect.Value) bool {
+	if v.Kind() != reflect.Map {
+		return false
+	}
+	hasDefault := false
+	for _, key := range v.MapKeys() {
+		key = ElemOrIdentity(key)
+		if key.Kind() != reflect.String {
+			return false
+		}
+		if key.String() == subnetMapDefaultKey {
+			hasDefault = true
+		} else if !subnetLookAlikeRegex.MatchString(key.String()) {
+			return false
+		}
+	}
+	if hasDefault && v.Len() == 1 {
+		t := reflect.TypeFor[V]()
+		if t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		return t.Kind() != reflect.Struct && t.Kind() != reflect.Map
+	}
+	return true
+}
+
+// looksLikeSubnetList returns true iff the provided value could be a list of
+// SubnetMap entries: each item should be a map with a "prefix" key.
+func looksLikeSubnetList(v reflect.Value) bool {
+	if v.Kind() != reflect.Slice || v.Len() == 0 {
+		return false
+	}
+	for i := range v.Len() {
+		item := ElemOrIdentity(v.Index(i))
+		if item.Kind() != reflect.Map {
+			return false
+		}
+		found := false
+		for _, key := range item.MapKeys() {
+			key = ElemOrIdentity(key)
+			if key.Kind() == reflect.String && MapStructureMatchName(key.String(), "prefix") {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// subnetListEntry is an entry of the list form of a SubnetMap, before decoding
+// its value.
+type subnetListEntry struct {
+	key     string
+	prefix  string
+	value   interface{}
+	enabled bool
+	origin  string
+}
+
+// decodeSubnetList decodes the list form of a SubnetMap. Each entry should
+// have a `prefix`, a `value`, an optional `enabled` key and an optional
+// `origin` key. The order of the entries is kept.
+func decodeSubnetList(from reflect.Value) ([]subnetListEntry, error) {
+	entries := make([]subnetListEntry, 0, from.Len())
+	for i := range from.Len() {
+		item := ElemOrIdentity(from.Index(i))
+		var prefix string
+		entry := subnetListEntry{enabled: true}
+		iter := item.MapRange()
+		for iter.Next() {
+			k := ElemOrIdentity(iter.Key())
+			v := ElemOrIdentity(iter.Value())
+			if k.Kind() != reflect.String {
+				return nil, fmt.Errorf("entry %d has a key which is not a string (%s)", i, k.Kind())
+			}
+			switch {
+			case MapStructureMatchName(k.String(), "prefix"):
+				if v.Kind() != reflect.String {
+					return nil, fmt.Errorf("prefix of entry %d is not a string (%s)", i, v.Kind())
+				}
+				prefix = v.String()
+			case MapStructureMatchName(k.String(), "value"):
+				entry.value = iter.Value().Interface()
+			case MapStructureMatchName(k.String(), "enabled"):
+				if v.Kind() != reflect.Bool {
+					return nil, fmt.Errorf("enabled of entry %d is not a boolean (%s)", i, v.Kind())
+				}
+				entry.enabled = v.Bool()
+			case MapStructureMatchName(k.String(), "origin"):
+				if v.Kind() != reflect.String {
+					return nil, fmt.Errorf("origin of entry %d is not a string (%s)", i, v.Kind())
+				}
+				entry.origin = v.String()
+			default:
+				return nil, fmt.Errorf("entry %d has an unknown key %q", i, k.String())
+			}
+		}
+		key, err := SubnetMapParseKey(prefix)
+		if err != nil {
+			return nil, &SubnetMapKeyError{Key: prefix, Index: i, Err: err}
+		}
+		entry.key = key
+		entry.prefix = prefix
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
 // SubnetMapUnmarshallerHook decodes SubnetMap and notably check that
 // valid networks are provided as key. It also accepts a single value
-// instead of a map for backward compatibility.
+// instead of a map for backward compatibility. Alternatively, a list of
+// entries with a `prefix`, a `value` and optional `enabled` and `origin` keys
+// is accepted. Disabled entries are kept but ignored by lookups. The origin,
+// like the name of the included file an entry comes from, is returned by
+// LookupWithOrigin. Lastly, a `!include path.csv` string reads the entries
+// from a CSV file with a subnet and a value on each row. See LoadSubnetMapFile
+// to read them again when the file changes.
 func SubnetMapUnmarshallerHook[V any]() mapstructure.DecodeHookFunc {
+	return SubnetMapUnmarshallerHookWithValidation[V](nil)
+}
+
+// SubnetMapUnmarshallerHookWithValidation is like SubnetMapUnmarshallerHook
+// but it also calls validate for each decoded entry. All the failures are
+// reported in the returned error.
+func SubnetMapUnmarshallerHookWithValidation[V any](validate func(prefix string, v V) error) mapstructure.DecodeHookFunc {
+	return subnetMapUnmarshallerHook[V](validate, nil, false, nil)
+}
+
+// SubnetMapUnmarshallerHookStrict is like SubnetMapUnmarshallerHook but it
+// returns an error when the same subnet is provided several times, for
+// example as 192.0.2.0/24 and ::ffff:192.0.2.0/120, or twice in the list form.
+// Nested subnets are still accepted as this is how exceptions are expressed.
+func SubnetMapUnmarshallerHookStrict[V any]() mapstructure.DecodeHookFunc {
+	return subnetMapUnmarshallerHook[V](nil, nil, true, nil)
+}
+
+// SubnetMapUnmarshallerHookWithDefaults is like SubnetMapUnmarshallerHook
+// for a struct V. Each value, including a single value applying to ::/0, is
+// completed with the non-zero fields of the provided default value.
+func SubnetMapUnmarshallerHookWithDefaults[V any](defaultValue V) mapstructure.DecodeHookFunc {
+	return subnetMapUnmarshallerHook[V](nil, nil, false,
+		[]mapstructure.DecodeHookFunc{DefaultValuesUnmarshallerHook(defaultValue)})
+}
+
+// SubnetMapTypeRegistry maps the values of the `type` field of an entry to a
+// function returning a pointer to a new value of the matching concrete type.
+type SubnetMapTypeRegistry[V any] map[string]func() V
+
+// SubnetMapUnmarshallerHookWithTypes is like SubnetMapUnmarshallerHook but for
+// an interface V. Each value should have a `type` field used to select the
+// concrete type to decode the remaining fields into.
+func SubnetMapUnmarshallerHookWithTypes[V any](types SubnetMapTypeRegistry[V]) mapstructure.DecodeHookFunc {
+	return subnetMapUnmarshallerHook[V](nil, types, false, nil)
+}
+
+// decodeTypedSubnetValue decodes a value for a SubnetMap using the provided
+// type registry.
+func decodeTypedSubnetValue[V any](key string, input interface{}, types SubnetMapTypeRegistry[V]) (V, error) {
+	var zero V
+	from := ElemOrIdentity(reflect.ValueOf(input))
+	if from.Kind() != reflect.Map {
+		return zero, fmt.Errorf("value for %s is not a map (%s)", key, from.Kind())
+	}
+	fields := gin.H{}
+	var kind string
+	iter := from.MapRange()
+	for iter.Next() {
+		k := ElemOrIdentity(iter.Key())
+		if k.Kind() != reflect.String {
+			return zero, fmt.Errorf("value for %s has a key which is not a string (%s)", key, k.Kind())
+		}
+		if MapStructureMatchName(k.String(), "type") {
+			v := ElemOrIdentity(iter.Value())
+			if v.Kind() != reflect.String {
+				return zero, fmt.Errorf("type for %s is not a string (%s)", key, v.Kind())
+			}
+			kind = v.String()
+			continue
+		}
+		fields[k.String()] = iter.Value().Interface()
+	}
+	newValue, ok := types[kind]
+	if !ok {
+		return zero, fmt.Errorf("unknown type %q for %s", kind, key)
+	}
+	value := newValue()
+	decoder, err := mapstructure.NewDecoder(GetMapStructureDecoderConfig(value))
+	if err != nil {
+		return zero, fmt.Errorf("cannot create subdecoder: %w", err)
+	}
+	if err := decoder.Decode(fields); err != nil {
+		return zero, fmt.Errorf("unable to decode %q for %s: %w", kind, key, err)
+	}
+	return value, nil
+}
+
+// subnetMapUnmarshallerHook decodes a SubnetMap, with an optional validation
+// function and an optional type registry. When strict is true, duplicate
+// subnets are rejected. The provided hooks are used when decoding values.
+func subnetMapUnmarshallerHook[V any](validate func(prefix string, v V) error, types SubnetMapTypeRegistry[V], strict bool, hooks []mapstructure.DecodeHookFunc) mapstructure.DecodeHookFunc {
 	return func(from, to reflect.Value) (interface{}, error) {
 		if to.Type() != reflect.TypeOf(SubnetMap[V]{}) {
 			return from.Interface(), nil
@@ -169,9 +1355,54 @@ func SubnetMapUnmarshallerHook[V any]() mapstructure.DecodeHookFunc {
 			return from.Interface(), nil
 		}
 		output := gin.H{}
+		disabledOutput := gin.H{}
+		origins := map[string]string{}
+		seen := map[string]string{}
+		checkDuplicate := func(key, prefix string) error {
+			if previous, ok := seen[key]; ok && strict {
+				return fmt.Errorf("subnet %s is a duplicate of %s", prefix, previous)
+			}
+			seen[key] = prefix
+			return nil
+		}
 		var zero V
-		if LooksLikeSubnetMap(from) {
+		var includedFrom string
+		if path, ok := subnetMapIncludePath(from); ok {
+			// Entries from a file
+			entries, err := readSubnetMapFile(path)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if err := checkDuplicate(entry.key, entry.prefix); err != nil {
+					return nil, err
+				}
+				origins[entry.key] = entry.origin
+				output[entry.key] = entry.value
+			}
+			includedFrom = path
+		} else if looksLikeSubnetList(from) {
+			// List of entries
+			entries, err := decodeSubnetList(from)
+			if err != nil {
+				return nil, err
+			}
+			for i, entry := range entries {
+				if err := checkDuplicate(entry.key, fmt.Sprintf("%s (entry %d)", entry.prefix, i)); err != nil {
+					return nil, err
+				}
+				if entry.origin != "" {
+					origins[entry.key] = entry.origin
+				}
+				if entry.enabled {
+					output[entry.key] = entry.value
+				} else {
+					disabledOutput[entry.key] = entry.value
+				}
+			}
+		} else if looksLikeSubnetMapWithDefault[V](from) {
 			// First case, we have a map
+			var defaultValue *reflect.Value
 			iter := from.MapRange()
 			for i := 0; iter.Next(); i++ {
 				k := ElemOrIdentity(iter.Key())
@@ -179,33 +1410,107 @@ func SubnetMapUnmarshallerHook[V any]() mapstructure.DecodeHookFunc {
 				if k.Kind() != reflect.String {
 					return nil, fmt.Errorf("key %d is not a string (%s)", i, k.Kind())
 				}
+				if k.String() == subnetMapDefaultKey {
+					defaultValue = &v
+					continue
+				}
 				// Parse key
 				key, err := SubnetMapParseKey(k.String())
 				if err != nil {
-					return nil, fmt.Errorf("failed to parse key %s: %w", key, err)
+					return nil, &SubnetMapKeyError{Key: k.String(), Index: -1, Err: err}
+				}
+				if err := checkDuplicate(key, k.String()); err != nil {
+					return nil, err
 				}
 				output[key] = v.Interface()
 			}
+			// An explicit ::/0 takes precedence over the default key
+			if defaultValue != nil {
+				if err := checkDuplicate("::/0", subnetMapDefaultKey); err != nil {
+					return nil, err
+				}
+				if _, ok := output["::/0"]; !ok {
+					output["::/0"] = defaultValue.Interface()
+				}
+			}
 		} else {
 			// Second case, we have a single value and we let mapstructure handles it
 			output["::/0"] = from.Interface()
 		}
 
-		// We have to decode output map, then turn it into a SubnetMap[V]
-		var intermediate map[string]V
-		intermediateDecoder, err := mapstructure.NewDecoder(
-			GetMapStructureDecoderConfig(&intermediate))
-		if err != nil {
-			return nil, fmt.Errorf("cannot create subdecoder: %w", err)
+		// We have to decode output maps, then turn them into a SubnetMap[V]
+		decode := func(input gin.H) (map[string]V, error) {
+			if types != nil {
+				intermediate := make(map[string]V, len(input))
+				for k, v := range input {
+					value, err := decodeTypedSubnetValue(k, v, types)
+					if err != nil {
+						return nil, err
+					}
+					intermediate[k] = value
+				}
+				return intermediate, nil
+			}
+			var intermediate map[string]V
+			intermediateDecoder, err := mapstructure.NewDecoder(
+				GetMapStructureDecoderConfig(&intermediate, hooks...))
+			if err != nil {
+				return nil, fmt.Errorf("cannot create subdecoder: %w", err)
+			}
+			if err := intermediateDecoder.Decode(input); err != nil {
+				return nil, fmt.Errorf("unable to decode %q: %w", reflect.TypeOf(zero).Name(), err)
+			}
+			return intermediate, nil
 		}
-		if err := intermediateDecoder.Decode(output); err != nil {
-			return nil, fmt.Errorf("unable to decode %q: %w", reflect.TypeOf(zero).Name(), err)
+		intermediate, err := decode(output)
+		if err != nil {
+			return nil, err
 		}
 		trie, err := NewSubnetMap(intermediate)
 		if err != nil {
 			// Should not happen
 			return nil, err
 		}
+		if len(disabledOutput) > 0 {
+			disabled, err := decode(disabledOutput)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range disabled {
+				if err := trie.SetDisabled(k, v); err != nil {
+					// Should not happen
+					return nil, err
+				}
+			}
+		}
+		for k, origin := range origins {
+			if err := trie.setOrigin(k, origin); err != nil {
+				// Should not happen
+				return nil, err
+			}
+		}
+		trie.includedFrom = includedFrom
+
+		if validate != nil {
+			entries := trie.ToMap()
+			for k, v := range trie.ToDisabledMap() {
+				entries[k] = v
+			}
+			prefixes := make([]string, 0, len(entries))
+			for prefix := range entries {
+				prefixes = append(prefixes, prefix)
+			}
+			sort.Strings(prefixes)
+			errs := []error{}
+			for _, prefix := range prefixes {
+				if err := validate(prefix, entries[prefix]); err != nil {
+					errs = append(errs, fmt.Errorf("invalid value for %s: %w", prefix, err))
+				}
+			}
+			if err := errors.Join(errs...); err != nil {
+				return nil, err
+			}
+		}
 
 		return trie, nil
 	}
@@ -247,9 +1552,57 @@ func SubnetMapParseKey(k string) (string, error) {
 	return key, nil
 }
 
-// MarshalYAML turns a subnet into a map that can be marshaled.
+// MarshalYAML turns a subnet into a map that can be marshaled. When some
+// entries are disabled, it is turned into a list of entries instead.
 func (sm SubnetMap[V]) MarshalYAML() (interface{}, error) {
-	return sm.ToMap(), nil
+	if len(sm.disabled) == 0 {
+		return sm.ToMap(), nil
+	}
+	output := []gin.H{}
+	for _, m := range []struct {
+		entries map[string]V
+		enabled bool
+	}{
+		{sm.ToMap(), true},
+		{sm.ToDisabledMap(), false},
+	} {
+		for prefix, value := range m.entries {
+			output = append(output, gin.H{
+				"prefix":  prefix,
+				"value":   value,
+				"enabled": m.enabled,
+			})
+		}
+	}
+	sort.Slice(output, func(i, j int) bool {
+		return output[i]["prefix"].(string) < output[j]["prefix"].(string)
+	})
+	return output, nil
+}
+
+// MarshalJSON turns a subnet into a JSON object keyed by prefix, or a list of
+// entries when some of them are disabled, like MarshalYAML.
+func (sm SubnetMap[V]) MarshalJSON() ([]byte, error) {
+	output, err := sm.MarshalYAML()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(output)
+}
+
+// UnmarshalJSON decodes a subnet from JSON. It accepts the same inputs as
+// SubnetMapUnmarshallerHook(): an object keyed by prefix, a list of entries
+// or a single value for ::/0.
+func (sm *SubnetMap[V]) UnmarshalJSON(data []byte) error {
+	var input interface{}
+	if err := json.Unmarshal(data, &input); err != nil {
+		return err
+	}
+	decoder, err := mapstructure.NewDecoder(GetMapStructureDecoderConfig(sm, SubnetMapUnmarshallerHook[V]()))
+	if err != nil {
+		return fmt.Errorf("cannot create decoder: %w", err)
+	}
+	return decoder.Decode(input)
 }
 
 func (sm SubnetMap[V]) String() string {
@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers
+
+import (
+	"net/netip"
+	"sync/atomic"
+)
+
+// AtomicSubnetMap holds a SubnetMap that can be replaced while other
+// goroutines are reading it. A SubnetMap is not safe for concurrent
+// modifications: on reload, a new SubnetMap should be built and swapped in
+// with Replace. Readers always see either the old or the new content, never
+// a partially updated one. The SubnetMap given to Replace should not be
+// modified afterwards.
+type AtomicSubnetMap[V any] struct {
+	p atomic.Pointer[SubnetMap[V]]
+}
+
+// NewAtomicSubnetMap returns a new AtomicSubnetMap holding the provided
+// SubnetMap. It may be nil.
+func NewAtomicSubnetMap[V any](sm *SubnetMap[V]) *AtomicSubnetMap[V] {
+	var am AtomicSubnetMap[V]
+	am.p.Store(sm)
+	return &am
+}
+
+// Load returns the current SubnetMap. It should only be used for reading.
+func (am *AtomicSubnetMap[V]) Load() *SubnetMap[V] {
+	return am.p.Load()
+}
+
+// Replace atomically swaps the current SubnetMap with the provided one.
+func (am *AtomicSubnetMap[V]) Replace(sm *SubnetMap[V]) {
+	am.p.Store(sm)
+}
+
+// Lookup will search for the most specific subnet matching the provided IP
+// address in the current SubnetMap and return the value associated with it.
+func (am *AtomicSubnetMap[V]) Lookup(ip netip.Addr) (V, bool) {
+	return am.p.Load().Lookup(ip)
+}
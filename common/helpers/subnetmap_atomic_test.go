@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers_test
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"akvorado/common/helpers"
+)
+
+func TestAtomicSubnetMap(t *testing.T) {
+	am := helpers.NewAtomicSubnetMap[string](nil)
+	ip := netip.MustParseAddr("::ffff:192.0.2.10")
+	if got, ok := am.Lookup(ip); ok {
+		t.Fatalf("Lookup(%s) == %q, expected a miss", ip, got)
+	}
+
+	maps := make([]*helpers.SubnetMap[string], 10)
+	for i := range maps {
+		maps[i] = helpers.MustNewSubnetMap(map[string]string{
+			"::ffff:192.0.2.0/120":    fmt.Sprintf("customer%d", i),
+			"::ffff:198.51.100.0/120": fmt.Sprintf("customer%d", i),
+		})
+	}
+	am.Replace(maps[0])
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	errs := make(chan error, 4)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				sm := am.Load()
+				got1, ok1 := sm.Lookup(ip)
+				got2, ok2 := sm.Lookup(netip.MustParseAddr("::ffff:198.51.100.10"))
+				if !ok1 || !ok2 || got1 != got2 {
+					errs <- fmt.Errorf("inconsistent lookups: %q (%v) and %q (%v)", got1, ok1, got2, ok2)
+					return
+				}
+				if _, ok := am.Lookup(ip); !ok {
+					errs <- fmt.Errorf("Lookup(%s) missed", ip)
+					return
+				}
+			}
+		}()
+	}
+	for i := range 1000 {
+		am.Replace(maps[i%len(maps)])
+	}
+	close(done)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if got, _ := am.Lookup(ip); got != "customer9" {
+		t.Fatalf("Lookup(%s) == %q, expected %q", ip, got, "customer9")
+	}
+}
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// CachedSubnetMap wraps a SubnetMap with a cache of the lookup results. This
+// is useful when a few IP addresses are looked up very often. The wrapped
+// SubnetMap should only be modified through the wrapper, otherwise, the cache
+// will return stale results.
+//
+// Entries are evicted with the CLOCK algorithm, an approximation of LRU: a
+// hit only marks the entry as recently used, so that concurrent hits only
+// need a read lock.
+type CachedSubnetMap[V any] struct {
+	sm      *SubnetMap[V]
+	size    int
+	mu      sync.RWMutex
+	entries []*cachedLookup[V] // circular buffer scanned by hand on eviction
+	hand    int
+	items   map[netip.Addr]*cachedLookup[V]
+}
+
+// cachedLookup is a lookup result stored in the cache.
+type cachedLookup[V any] struct {
+	key        netip.Addr
+	value      V
+	ok         bool
+	referenced atomic.Bool // hit since the hand last passed over it
+}
+
+// WithCache returns a wrapper around the SubnetMap caching the results of
+// up to size lookups.
+func (sm *SubnetMap[V]) WithCache(size int) *CachedSubnetMap[V] {
+	return &CachedSubnetMap[V]{
+		sm:      sm,
+		size:    size,
+		entries: make([]*cachedLookup[V], 0, max(size, 0)),
+		items:   make(map[netip.Addr]*cachedLookup[V], max(size, 0)),
+	}
+}
+
+// Lookup will search for the most specific subnet matching the provided IP
+// address and return the value associated with it. The result is cached.
+func (cm *CachedSubnetMap[V]) Lookup(ip netip.Addr) (V, bool) {
+	// An IPv4 address and its IPv6-mapped version are different keys as
+	// they do not match the same subnets.
+	key := ip.WithZone("")
+	cm.mu.RLock()
+	if result, ok := cm.items[key]; ok {
+		result.referenced.Store(true)
+		cm.mu.RUnlock()
+		return result.value, result.ok
+	}
+	cm.mu.RUnlock()
+
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	// Another goroutine may have inserted the result in the meantime.
+	if result, ok := cm.items[key]; ok {
+		return result.value, result.ok
+	}
+	value, ok := cm.sm.Lookup(ip)
+	if cm.size <= 0 {
+		return value, ok
+	}
+	result := &cachedLookup[V]{key: key, value: value, ok: ok}
+	if len(cm.entries) < cm.size {
+		cm.entries = append(cm.entries, result)
+	} else {
+		// Give a second chance to the entries hit since the last pass.
+		for cm.entries[cm.hand].referenced.Swap(false) {
+			cm.hand = (cm.hand + 1) % len(cm.entries)
+		}
+		delete(cm.items, cm.entries[cm.hand].key)
+		cm.entries[cm.hand] = result
+		cm.hand = (cm.hand + 1) % len(cm.entries)
+	}
+	cm.items[key] = result
+	return value, ok
+}
+
+// Set inserts the given key k into the wrapped SubnetMap and invalidates the
+// cache.
+func (cm *CachedSubnetMap[V]) Set(k string, v V) error {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	defer cm.invalidate()
+	return cm.sm.Set(k, v)
+}
+
+// Delete removes the given key k from the wrapped SubnetMap and invalidates
+// the cache.
+func (cm *CachedSubnetMap[V]) Delete(k string) (bool, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	defer cm.invalidate()
+	return cm.sm.Delete(k)
+}
+
+// ReplaceAll replaces the wrapped SubnetMap with a new one built from the
+// provided map and invalidates the cache.
+func (cm *CachedSubnetMap[V]) ReplaceAll(from map[string]V) error {
+	sm, err := NewSubnetMap(from)
+	if err != nil {
+		return err
+	}
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	defer cm.invalidate()
+	cm.sm = sm
+	return nil
+}
+
+// invalidate empties the cache. The lock should be held.
+func (cm *CachedSubnetMap[V]) invalidate() {
+	clear(cm.entries)
+	cm.entries = cm.entries[:0]
+	cm.hand = 0
+	clear(cm.items)
+}
@@ -0,0 +1,178 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers_test
+
+import (
+	"fmt"
+	"net/netip"
+	"sync"
+	"testing"
+
+	"akvorado/common/helpers"
+)
+
+func TestCachedSubnetMap(t *testing.T) {
+	cm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+	}).WithCache(2)
+	ip1 := netip.MustParseAddr("::ffff:192.0.2.10")
+	ip2 := netip.MustParseAddr("::ffff:198.51.100.10")
+	ip3 := netip.MustParseAddr("::ffff:203.0.113.10")
+	check := func(pos helpers.Pos, ip netip.Addr, expected string) {
+		t.Helper()
+		got, _ := cm.Lookup(ip)
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Fatalf("%sLookup(%s) (-got, +want):\n%s", pos, ip, diff)
+		}
+	}
+
+	check(helpers.Mark(), ip1, "customer1")
+	check(helpers.Mark(), ip2, "")
+	check(helpers.Mark(), ip3, "") // evicts ip1
+	check(helpers.Mark(), ip1, "customer1")
+
+	// Set should invalidate the cache
+	if err := cm.Set("::ffff:198.51.100.0/120", "customer2"); err != nil {
+		t.Fatalf("Set() error:\n%+v", err)
+	}
+	check(helpers.Mark(), ip2, "customer2")
+
+	// Delete should invalidate the cache
+	if ok, err := cm.Delete("::ffff:192.0.2.0/120"); err != nil || !ok {
+		t.Fatalf("Delete() = %v, %v", ok, err)
+	}
+	check(helpers.Mark(), ip1, "")
+
+	// ReplaceAll should invalidate the cache
+	if err := cm.ReplaceAll(map[string]string{
+		"::ffff:203.0.113.0/120": "customer3",
+	}); err != nil {
+		t.Fatalf("ReplaceAll() error:\n%+v", err)
+	}
+	check(helpers.Mark(), ip1, "")
+	check(helpers.Mark(), ip2, "")
+	check(helpers.Mark(), ip3, "customer3")
+}
+
+func TestCachedSubnetMapSecondChance(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+	})
+	cm := sm.WithCache(2)
+	ip1 := netip.MustParseAddr("::ffff:192.0.2.10")
+	ip2 := netip.MustParseAddr("::ffff:192.0.2.20")
+	ip3 := netip.MustParseAddr("::ffff:192.0.2.30")
+	cm.Lookup(ip1)
+	cm.Lookup(ip2)
+	cm.Lookup(ip1) // ip1 is recently used
+	cm.Lookup(ip3) // evicts ip2
+
+	// Modify the wrapped SubnetMap directly: only evicted entries see it.
+	sm.Set("::ffff:192.0.2.0/120", "customer2")
+	for _, tc := range []struct {
+		Pos      helpers.Pos
+		IP       netip.Addr
+		Expected string
+	}{
+		{helpers.Mark(), ip1, "customer1"},
+		{helpers.Mark(), ip3, "customer1"},
+		{helpers.Mark(), ip2, "customer2"},
+	} {
+		got, _ := cm.Lookup(tc.IP)
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sLookup(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+}
+
+func TestCachedSubnetMapConcurrent(t *testing.T) {
+	cm := helpers.MustNewSubnetMap(map[string]int{
+		"::ffff:192.0.2.0/120": 1,
+	}).WithCache(10)
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 1000 {
+				ip := netip.AddrFrom4([4]byte{192, 0, 2, byte(i % 20)})
+				if got, _ := cm.Lookup(netip.AddrFrom16(ip.As16())); got != 1 {
+					t.Errorf("Lookup(%s) == %d, expected 1", ip, got)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCachedSubnetMapUnmappedIPv4(t *testing.T) {
+	cm := helpers.MustNewSubnetMap(map[string]int{
+		"192.0.2.0/24": 1,
+	}).WithCache(10)
+	if got, ok := cm.Lookup(netip.MustParseAddr("192.0.2.1")); ok {
+		t.Fatalf("Lookup(192.0.2.1) == %d, expected a miss", got)
+	}
+	got, ok := cm.Lookup(netip.MustParseAddr("::ffff:192.0.2.1"))
+	if diff := helpers.Diff([]any{got, ok}, []any{1, true}); diff != "" {
+		t.Fatalf("Lookup(::ffff:192.0.2.1) (-got, +want):\n%s", diff)
+	}
+}
+
+func TestCachedSubnetMapReplaceAll(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+	})
+	cm := sm.WithCache(10)
+	if err := cm.ReplaceAll(map[string]string{
+		"::ffff:192.0.2.0/120": "customer2",
+	}); err != nil {
+		t.Fatalf("ReplaceAll() error:\n%+v", err)
+	}
+	ip := netip.MustParseAddr("::ffff:192.0.2.10")
+	if got, _ := cm.Lookup(ip); got != "customer2" {
+		t.Errorf("Lookup(%s) == %q, expected %q", ip, got, "customer2")
+	}
+	// The original subnet map is left untouched
+	if got, _ := sm.Lookup(ip); got != "customer1" {
+		t.Errorf("Lookup(%s) == %q, expected %q", ip, got, "customer1")
+	}
+}
+
+func BenchmarkCachedSubnetMap(b *testing.B) {
+	from := map[string]string{}
+	for i := range 10000 {
+		from[fmt.Sprintf("2001:db8:%x::/48", i)] = fmt.Sprintf("customer%d", i)
+		from[fmt.Sprintf("2001:db8:%x:%x::/64", i, i)] = fmt.Sprintf("customer%d", i)
+	}
+	sm := helpers.MustNewSubnetMap(from)
+	// Skewed access pattern: 90% of lookups hit 10 addresses
+	ips := []netip.Addr{}
+	for i := range 1000 {
+		idx := i
+		if i%10 != 0 {
+			idx = i % 10
+		}
+		ips = append(ips, netip.MustParseAddr(fmt.Sprintf("2001:db8:%x:%x::1", idx, idx)))
+	}
+	b.Run("uncached", func(b *testing.B) {
+		for i := range b.N {
+			sm.Lookup(ips[i%len(ips)])
+		}
+	})
+	b.Run("cached", func(b *testing.B) {
+		cm := sm.WithCache(100)
+		for i := range b.N {
+			cm.Lookup(ips[i%len(ips)])
+		}
+	})
+	b.Run("cached parallel", func(b *testing.B) {
+		cm := sm.WithCache(100)
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				cm.Lookup(ips[i%len(ips)])
+			}
+		})
+	})
+}
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// subnetMapIncludeDirective is the prefix of a string value for a SubnetMap
+// telling to read the entries from a CSV file.
+const subnetMapIncludeDirective = "!include "
+
+// subnetMapIncludePath returns the path of the file to include if the provided
+// value is an include directive.
+func subnetMapIncludePath(from reflect.Value) (string, bool) {
+	from = ElemOrIdentity(from)
+	if from.Kind() != reflect.String {
+		return "", false
+	}
+	path, ok := strings.CutPrefix(from.String(), subnetMapIncludeDirective)
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSpace(path), true
+}
+
+// readSubnetMapFile reads the entries of a SubnetMap from a CSV file. Each row
+// is a subnet and a value. Empty lines and lines starting with `#` are
+// ignored. The origin of each entry is the path of the file.
+func readSubnetMapFile(path string) ([]subnetListEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	defer f.Close()
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	entries := []subnetListEntry{}
+	for i := 0; ; i++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", path, err)
+		}
+		prefix := strings.TrimSpace(record[0])
+		key, err := SubnetMapParseKey(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", path,
+				&SubnetMapKeyError{Key: prefix, Index: i, Err: err})
+		}
+		entries = append(entries, subnetListEntry{
+			key:     key,
+			prefix:  prefix,
+			value:   strings.TrimSpace(record[1]),
+			enabled: true,
+			origin:  path,
+		})
+	}
+	return entries, nil
+}
+
+// LoadSubnetMapFile builds a SubnetMap from the provided CSV file, like the
+// `!include` directive accepted by SubnetMapUnmarshallerHook. When not nil,
+// validate is called for each entry, like with
+// SubnetMapUnmarshallerHookWithValidation.
+func LoadSubnetMapFile[V any](path string, validate func(prefix string, v V) error) (*SubnetMap[V], error) {
+	var sm SubnetMap[V]
+	decoder, err := mapstructure.NewDecoder(
+		GetMapStructureDecoderConfig(&sm, SubnetMapUnmarshallerHookWithValidation(validate)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create decoder: %w", err)
+	}
+	if err := decoder.Decode(subnetMapIncludeDirective + path); err != nil {
+		return nil, err
+	}
+	return &sm, nil
+}
@@ -0,0 +1,90 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-viper/mapstructure/v2"
+)
+
+func writeSubnetMapFile(t *testing.T, path string, content string) {
+	t.Helper()
+	// Write then rename to not expose a partial file to the watcher
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		t.Fatalf("WriteFile() error:\n%+v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatalf("Rename() error:\n%+v", err)
+	}
+}
+
+func TestSubnetMapInclude(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "customers.csv")
+	writeSubnetMapFile(t, path, `# Customers
+192.0.2.0/24,customer1
+198.51.100.0/24, customer2
+
+2001:db8::/64,customer3
+`)
+
+	var got struct {
+		Customers SubnetMap[string]
+	}
+	decoder, err := mapstructure.NewDecoder(
+		GetMapStructureDecoderConfig(&got, SubnetMapUnmarshallerHook[string]()))
+	if err != nil {
+		t.Fatalf("NewDecoder() error:\n%+v", err)
+	}
+	if err := decoder.Decode(map[string]any{"customers": "!include " + path}); err != nil {
+		t.Fatalf("Decode() error:\n%+v", err)
+	}
+	expected := map[string]string{
+		"192.0.2.0/24":    "customer1",
+		"198.51.100.0/24": "customer2",
+		"2001:db8::/64":   "customer3",
+	}
+	if diff := Diff(got.Customers.ToMap(), expected); diff != "" {
+		t.Fatalf("Decode() (-got, +want):\n%s", diff)
+	}
+	if got := got.Customers.IncludedFrom(); got != path {
+		t.Errorf("IncludedFrom() == %q, expected %q", got, path)
+	}
+	if _, origin, _ := got.Customers.LookupWithOrigin(netip.MustParseAddr("::ffff:192.0.2.10")); origin != path {
+		t.Errorf("LookupWithOrigin() origin == %q, expected %q", origin, path)
+	}
+
+	// Values are decoded to the type of the SubnetMap
+	writeSubnetMapFile(t, path, "192.0.2.0/24,100\n")
+	rates, err := LoadSubnetMapFile[uint](path, nil)
+	if err != nil {
+		t.Fatalf("LoadSubnetMapFile() error:\n%+v", err)
+	}
+	if diff := Diff(rates.ToMap(), map[string]uint{"192.0.2.0/24": 100}); diff != "" {
+		t.Fatalf("LoadSubnetMapFile() (-got, +want):\n%s", diff)
+	}
+
+	// Invalid files
+	writeSubnetMapFile(t, path, "192.0.2.0/24,customer1\n192.0.2.0/38,customer2\n")
+	_, err = LoadSubnetMapFile[string](path, nil)
+	var keyErr *SubnetMapKeyError
+	if !errors.As(err, &keyErr) {
+		t.Fatalf("LoadSubnetMapFile() error is not a SubnetMapKeyError:\n%+v", err)
+	}
+	if keyErr.Key != "192.0.2.0/38" || keyErr.Index != 1 {
+		t.Errorf("LoadSubnetMapFile() error is for %q (entry %d)", keyErr.Key, keyErr.Index)
+	}
+	writeSubnetMapFile(t, path, "192.0.2.0/24,customer1,extra\n")
+	if _, err := LoadSubnetMapFile[string](path, nil); err == nil {
+		t.Error("LoadSubnetMapFile() did not error on an extra field")
+	}
+	if _, err := LoadSubnetMapFile[string](filepath.Join(t.TempDir(), "missing.csv"), nil); err == nil {
+		t.Error("LoadSubnetMapFile() did not error on a missing file")
+	}
+}
@@ -0,0 +1,114 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// subnetMapMissFilter is a Bloom filter over the buckets covered by the
+// subnets of a SubnetMap. A bucket is an IPv4 /16 or an IPv6 /32. When the
+// bucket of an IP address is not in the filter, the lookup is a miss. There is
+// no false negative: the filter can only say a bucket may be covered.
+type subnetMapMissFilter struct {
+	bits []uint64
+	mask uint64
+}
+
+const (
+	subnetMapMissFilterHashes     = 3
+	subnetMapMissFilterMaxBuckets = 1 << 16
+)
+
+// subnetMapBucket returns the bucket of an IPv6 address: the first 16 bits of
+// an IPv4-mapped address or the first 32 bits of an IPv6 address.
+func subnetMapBucket(raw [16]byte) uint64 {
+	if netip.AddrFrom16(raw).Is4In6() {
+		return 1<<63 | uint64(raw[12])<<8 | uint64(raw[13])
+	}
+	return uint64(raw[0])<<24 | uint64(raw[1])<<16 | uint64(raw[2])<<8 | uint64(raw[3])
+}
+
+// newSubnetMapMissFilter builds a filter for the provided buckets.
+func newSubnetMapMissFilter(buckets []uint64) *subnetMapMissFilter {
+	size := max(1024, 1<<bits.Len(uint(len(buckets)*8)))
+	f := &subnetMapMissFilter{
+		bits: make([]uint64, size/64),
+		mask: uint64(size - 1),
+	}
+	for _, bucket := range buckets {
+		h1, h2 := subnetMapMissFilterHash(bucket)
+		for i := range uint64(subnetMapMissFilterHashes) {
+			bit := (h1 + i*h2) & f.mask
+			f.bits[bit/64] |= 1 << (bit % 64)
+		}
+	}
+	return f
+}
+
+// subnetMapMissFilterHash returns two hashes for a bucket (splitmix64).
+func subnetMapMissFilterHash(bucket uint64) (uint64, uint64) {
+	z := bucket + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return z, (z >> 32) | 1
+}
+
+// mayContain returns false if the IP address is not covered by any subnet.
+func (f *subnetMapMissFilter) mayContain(ip netip.Addr) bool {
+	h1, h2 := subnetMapMissFilterHash(subnetMapBucket(ip.As16()))
+	for i := range uint64(subnetMapMissFilterHashes) {
+		bit := (h1 + i*h2) & f.mask
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// OptimizeMisses builds a filter to quickly conclude that an IP address does
+// not match any subnet. This speeds up lookups when most of them are misses.
+// It returns false when the subnets cover a too large space for the filter to
+// be useful. Any modification of the SubnetMap drops the filter.
+func (sm *SubnetMap[V]) OptimizeMisses() bool {
+	sm.misses = nil
+	if sm.tree == nil {
+		return false
+	}
+	buckets := []uint64{}
+	iter := sm.tree.Iterate()
+	for iter.Next() {
+		address := iter.Address()
+		var raw [16]byte
+		for i := range 8 {
+			raw[i] = byte(address.Left >> (56 - 8*i))
+			raw[8+i] = byte(address.Right >> (56 - 8*i))
+		}
+		var bucketBits, length int
+		if netip.AddrFrom16(raw).Is4In6() && address.Length >= 96 {
+			bucketBits, length = 16, int(address.Length)-96
+		} else if address.Left>>32 == 0 {
+			// This may cover IPv4-mapped addresses
+			return false
+		} else {
+			bucketBits, length = 32, int(address.Length)
+		}
+		first := subnetMapBucket(raw)
+		if length >= bucketBits {
+			buckets = append(buckets, first)
+			continue
+		}
+		count := 1 << (bucketBits - length)
+		if count > subnetMapMissFilterMaxBuckets {
+			return false
+		}
+		for i := range count {
+			buckets = append(buckets, first+uint64(i))
+		}
+	}
+	sm.misses = newSubnetMapMissFilter(buckets)
+	return true
+}
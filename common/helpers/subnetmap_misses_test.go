@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers_test
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"akvorado/common/helpers"
+)
+
+func TestOptimizeMisses(t *testing.T) {
+	from := map[string]string{
+		"::ffff:10.0.0.0/104":     "large",
+		"::ffff:192.0.2.0/120":    "customer1",
+		"::ffff:198.51.100.1/128": "customer2",
+		"2001:db8::/48":           "customer3",
+		"2001:db0::/28":           "customer4",
+	}
+	reference := helpers.MustNewSubnetMap(from)
+	optimized := helpers.MustNewSubnetMap(from)
+	if !optimized.OptimizeMisses() {
+		t.Fatal("OptimizeMisses() should have built the filter")
+	}
+	ips := []string{
+		"::ffff:10.0.0.1", "::ffff:10.255.255.255", "::ffff:11.0.0.1",
+		"::ffff:192.0.2.1", "::ffff:192.0.3.1", "::ffff:198.51.100.1",
+		"::ffff:198.51.100.2", "2001:db8::1", "2001:db8:1::1", "2001:db7::1",
+		"2001:db1::1", "2001:dc0::1",
+	}
+	for i := range 1000 {
+		ips = append(ips, fmt.Sprintf("::ffff:172.%d.%d.1", i/256, i%256))
+	}
+	for _, ip := range ips {
+		expected, _ := reference.Lookup(netip.MustParseAddr(ip))
+		got, _ := optimized.Lookup(netip.MustParseAddr(ip))
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Errorf("Lookup(%s) (-got, +want):\n%s", ip, diff)
+		}
+	}
+
+	// Any modification drops the filter
+	optimized.Set("::ffff:172.16.0.0/108", "new")
+	if got, _ := optimized.Lookup(netip.MustParseAddr("::ffff:172.16.0.1")); got != "new" {
+		t.Errorf("Lookup() after Set() == %q, expected %q", got, "new")
+	}
+
+	// Too large subnets
+	for _, subnet := range []string{"::/0", "::ffff:0.0.0.0/96", "2000::/8"} {
+		sm := helpers.MustNewSubnetMap(map[string]string{subnet: "large"})
+		if subnet == "::ffff:0.0.0.0/96" {
+			// This one is fine
+			if !sm.OptimizeMisses() {
+				t.Errorf("OptimizeMisses() should have built the filter for %s", subnet)
+			}
+			continue
+		}
+		if sm.OptimizeMisses() {
+			t.Errorf("OptimizeMisses() should not have built the filter for %s", subnet)
+		}
+	}
+}
+
+func BenchmarkOptimizeMisses(b *testing.B) {
+	// Customer prefixes spread over the IPv4 space
+	from := map[string]string{}
+	for i := range 10000 {
+		from[fmt.Sprintf("::ffff:%d.%d.%d.0/120", 1+i%200, (i*7)%256, i%256)] = fmt.Sprintf("customer%d", i)
+	}
+	// Miss-heavy workload: only 5% of the lookups are hits
+	ips := []netip.Addr{}
+	for i := range 1000 {
+		if i%20 == 0 {
+			ips = append(ips, netip.MustParseAddr(fmt.Sprintf("::ffff:%d.%d.%d.10", 1+i%200, (i*7)%256, i%256)))
+			continue
+		}
+		ips = append(ips, netip.MustParseAddr(fmt.Sprintf("::ffff:%d.%d.%d.10", 1+i%200, (i*13+1)%256, (i*3)%256)))
+	}
+	b.Run("tree", func(b *testing.B) {
+		sm := helpers.MustNewSubnetMap(from)
+		for i := range b.N {
+			sm.Lookup(ips[i%len(ips)])
+		}
+	})
+	b.Run("filter", func(b *testing.B) {
+		sm := helpers.MustNewSubnetMap(from)
+		sm.OptimizeMisses()
+		for i := range b.N {
+			sm.Lookup(ips[i%len(ips)])
+		}
+	})
+}
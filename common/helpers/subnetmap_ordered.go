@@ -0,0 +1,160 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-viper/mapstructure/v2"
+)
+
+// OrderedSubnetMap maps subnets to values like SubnetMap but a lookup returns
+// the first entry, in declaration order, containing the IP address, regardless
+// of its specificity. Like for SubnetMap, everything is stored as IPv6.
+type OrderedSubnetMap[V any] struct {
+	entries []orderedSubnetEntry[V]
+}
+
+// orderedSubnetEntry is an entry of an OrderedSubnetMap.
+type orderedSubnetEntry[V any] struct {
+	prefix  netip.Prefix
+	value   V
+	enabled bool
+}
+
+// NewOrderedSubnetMap creates an ordered subnetmap from a list of entries.
+// Subnets can be IPv4 or IPv6.
+func NewOrderedSubnetMap[V any](entries []SubnetEntry[V]) (*OrderedSubnetMap[V], error) {
+	osm := &OrderedSubnetMap[V]{}
+	for _, entry := range entries {
+		if err := osm.append(entry.Prefix, entry.Value, true); err != nil {
+			return nil, err
+		}
+	}
+	return osm, nil
+}
+
+// append adds a new entry at the end of the ordered subnetmap.
+func (osm *OrderedSubnetMap[V]) append(k string, v V, enabled bool) error {
+	key, err := SubnetMapParseKey(k)
+	if err != nil {
+		return fmt.Errorf("failed to parse key %s: %w", k, err)
+	}
+	prefix, err := netip.ParsePrefix(key)
+	if err != nil {
+		// Should not happen
+		return fmt.Errorf("failed to parse key %s: %w", k, err)
+	}
+	osm.entries = append(osm.entries, orderedSubnetEntry[V]{
+		prefix:  prefix,
+		value:   v,
+		enabled: enabled,
+	})
+	return nil
+}
+
+// Lookup returns the value of the first enabled entry containing the
+// provided IP address.
+func (osm *OrderedSubnetMap[V]) Lookup(ip netip.Addr) (V, bool) {
+	if osm != nil {
+		ip = netip.AddrFrom16(ip.As16())
+		for _, entry := range osm.entries {
+			if entry.enabled && entry.prefix.Contains(ip) {
+				return entry.value, true
+			}
+		}
+	}
+	var value V
+	return value, false
+}
+
+// ToList returns the entries of the ordered subnetmap, in declaration order.
+// Disabled entries are omitted.
+func (osm *OrderedSubnetMap[V]) ToList() []SubnetEntry[V] {
+	output := []SubnetEntry[V]{}
+	if osm == nil {
+		return output
+	}
+	for _, entry := range osm.entries {
+		if entry.enabled {
+			output = append(output, SubnetEntry[V]{
+				Prefix: subnetMapUnmapPrefix(entry.prefix).String(),
+				Value:  entry.value,
+			})
+		}
+	}
+	return output
+}
+
+// MarshalYAML turns an ordered subnetmap into a list that can be marshaled.
+func (osm OrderedSubnetMap[V]) MarshalYAML() (interface{}, error) {
+	output := []gin.H{}
+	for _, entry := range osm.entries {
+		output = append(output, gin.H{
+			"prefix":  subnetMapUnmapPrefix(entry.prefix).String(),
+			"value":   entry.value,
+			"enabled": entry.enabled,
+		})
+	}
+	return output, nil
+}
+
+// subnetMapUnmapPrefix turns an IPv4-mapped prefix into an IPv4 prefix.
+func subnetMapUnmapPrefix(prefix netip.Prefix) netip.Prefix {
+	if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+		return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix
+}
+
+// OrderedSubnetMapUnmarshallerHook decodes OrderedSubnetMap. Only the list
+// form of SubnetMap is accepted as it keeps the declaration order.
+func OrderedSubnetMapUnmarshallerHook[V any]() mapstructure.DecodeHookFunc {
+	return func(from, to reflect.Value) (interface{}, error) {
+		if to.Type() != reflect.TypeOf(OrderedSubnetMap[V]{}) {
+			return from.Interface(), nil
+		}
+		if from.Type() == reflect.TypeOf(&OrderedSubnetMap[V]{}) {
+			return from.Interface(), nil
+		}
+		from = ElemOrIdentity(from)
+		if from.Kind() != reflect.Slice {
+			return nil, fmt.Errorf("ordered subnet map should be a list (%s)", from.Kind())
+		}
+		if from.Len() > 0 && !looksLikeSubnetList(from) {
+			return nil, fmt.Errorf("ordered subnet map entries should have a prefix")
+		}
+		entries, err := decodeSubnetList(from)
+		if err != nil {
+			return nil, err
+		}
+
+		// Decode values
+		input := make([]interface{}, 0, len(entries))
+		for _, entry := range entries {
+			input = append(input, entry.value)
+		}
+		var values []V
+		decoder, err := mapstructure.NewDecoder(GetMapStructureDecoderConfig(&values))
+		if err != nil {
+			return nil, fmt.Errorf("cannot create subdecoder: %w", err)
+		}
+		if err := decoder.Decode(input); err != nil {
+			var zero V
+			return nil, fmt.Errorf("unable to decode %q: %w", reflect.TypeOf(zero).Name(), err)
+		}
+
+		osm := &OrderedSubnetMap[V]{}
+		for idx, entry := range entries {
+			if err := osm.append(entry.key, values[idx], entry.enabled); err != nil {
+				// Should not happen
+				return nil, err
+			}
+		}
+		return osm, nil
+	}
+}
@@ -0,0 +1,67 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package helpers_test
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-viper/mapstructure/v2"
+
+	"akvorado/common/helpers"
+)
+
+func TestOrderedSubnetMap(t *testing.T) {
+	var osm helpers.OrderedSubnetMap[string]
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:      &osm,
+		ErrorUnused: true,
+		Metadata:    nil,
+		DecodeHook:  helpers.OrderedSubnetMapUnmarshallerHook[string](),
+	})
+	if err != nil {
+		t.Fatalf("NewDecoder() error:\n%+v", err)
+	}
+	if err := decoder.Decode([]gin.H{
+		{"prefix": "192.0.2.0/26", "value": "disabled", "enabled": false},
+		{"prefix": "192.0.0.0/16", "value": "deny"},
+		{"prefix": "192.0.2.0/24", "value": "allow"},
+		{"prefix": "2001:db8::/64", "value": "allow"},
+	}); err != nil {
+		t.Fatalf("Decode() error:\n%+v", err)
+	}
+
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected string
+	}{
+		{helpers.Mark(), "::ffff:192.0.2.10", "deny"},
+		{helpers.Mark(), "192.0.2.10", "deny"},
+		{helpers.Mark(), "::ffff:192.0.3.10", "deny"},
+		{helpers.Mark(), "2001:db8::1", "allow"},
+		{helpers.Mark(), "::ffff:198.51.100.10", ""},
+	}
+	for _, tc := range cases {
+		got, _ := osm.Lookup(netip.MustParseAddr(tc.IP))
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sLookup(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+
+	expected := []helpers.SubnetEntry[string]{
+		{Prefix: "192.0.0.0/16", Value: "deny"},
+		{Prefix: "192.0.2.0/24", Value: "allow"},
+		{Prefix: "2001:db8::/64", Value: "allow"},
+	}
+	if diff := helpers.Diff(osm.ToList(), expected); diff != "" {
+		t.Errorf("ToList() (-got, +want):\n%s", diff)
+	}
+
+	// A map is not accepted
+	if err := decoder.Decode(gin.H{"192.0.2.0/24": "allow"}); err == nil {
+		t.Error("Decode() did not return an error")
+	}
+}
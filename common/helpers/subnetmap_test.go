@@ -4,7 +4,15 @@
 package helpers_test
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"net/netip"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/gin-gonic/gin"
@@ -22,6 +30,8 @@ func TestSubnetMapUnmarshalHook(t *testing.T) {
 		Input       interface{}
 		Tests       map[string]string
 		Error       bool
+		Key         string // offending key for a SubnetMapKeyError
+		Index       int
 		YAML        interface{}
 	}{
 		{
@@ -80,10 +90,41 @@ func TestSubnetMapUnmarshalHook(t *testing.T) {
 				"2001:db8:2::2": "",
 			},
 			YAML: gin.H{"2001:db8:1::1/128": "customer2"},
+		}, {
+			Description: "IPv4 and IPv6 subnets",
+			Input: gin.H{
+				"203.0.113.0/24":        "customer1",
+				"::ffff:192.0.2.0/120":  "customer2",
+				"2001:db8:1::/64":       "customer3",
+				"::ffff:198.51.100.1":   "customer4",
+				"0.0.0.0/0":             "customer5",
+				"::/0":                  "customer6",
+				"64:ff9b::c000:200/120": "customer7",
+			},
+			Tests: map[string]string{
+				"::ffff:203.0.113.18": "customer1",
+				"::ffff:192.0.2.18":   "customer2",
+				"2001:db8:1::1":       "customer3",
+				"::ffff:198.51.100.1": "customer4",
+				"::ffff:198.51.100.2": "customer5",
+				"2001:db8:2::1":       "customer6",
+				"64:ff9b::c000:201":   "customer7",
+			},
+			YAML: gin.H{
+				"203.0.113.0/24":        "customer1",
+				"192.0.2.0/24":          "customer2",
+				"2001:db8:1::/64":       "customer3",
+				"198.51.100.1/32":       "customer4",
+				"0.0.0.0/0":             "customer5",
+				"::/0":                  "customer6",
+				"64:ff9b::c000:200/120": "customer7",
+			},
 		}, {
 			Description: "Invalid subnet (1)",
 			Input:       gin.H{"192.0.2.1/38": "customer"},
 			Error:       true,
+			Key:         "192.0.2.1/38",
+			Index:       -1,
 		}, {
 			Description: "Invalid subnet (2)",
 			Input:       gin.H{"192.0.2.1/255.0.255.0": "customer"},
@@ -92,10 +133,23 @@ func TestSubnetMapUnmarshalHook(t *testing.T) {
 			Description: "Invalid subnet (3)",
 			Input:       gin.H{"2001:db8::/1000": "customer"},
 			Error:       true,
+			Key:         "2001:db8::/1000",
+			Index:       -1,
 		}, {
 			Description: "Invalid IP",
 			Input:       gin.H{"200.33.300.1": "customer"},
 			Error:       true,
+			Key:         "200.33.300.1",
+			Index:       -1,
+		}, {
+			Description: "Invalid subnet in list",
+			Input: []gin.H{
+				{"prefix": "192.0.2.0/24", "value": "customer1"},
+				{"prefix": "192.0.2.1/38", "value": "customer2"},
+			},
+			Error: true,
+			Key:   "192.0.2.1/38",
+			Index: 1,
 		}, {
 			Description: "Random key",
 			Input:       gin.H{"kfgdjgkfj": "customer"},
@@ -137,6 +191,18 @@ func TestSubnetMapUnmarshalHook(t *testing.T) {
 			} else if err == nil && tc.Error {
 				t.Fatal("Decode() did not return an error")
 			}
+			if tc.Key != "" {
+				var keyErr *helpers.SubnetMapKeyError
+				if !errors.As(err, &keyErr) {
+					t.Fatalf("Decode() error is not a SubnetMapKeyError:\n%+v", err)
+				}
+				if diff := helpers.Diff([]any{keyErr.Key, keyErr.Index}, []any{tc.Key, tc.Index}); diff != "" {
+					t.Errorf("Decode() SubnetMapKeyError (-got, +want):\n%s", diff)
+				}
+				if !errors.Is(err, helpers.ErrSubnetMapInvalidKey) {
+					t.Errorf("Decode() error is not ErrSubnetMapInvalidKey:\n%+v", err)
+				}
+			}
 			got := map[string]string{}
 			for k := range tc.Tests {
 				v, _ := tree.Lookup(netip.MustParseAddr(k))
@@ -231,6 +297,367 @@ func TestSubnetMapUnmarshalHookWithMapValue(t *testing.T) {
 	}
 }
 
+func TestSubnetMapUnmarshalHookWithDefaults(t *testing.T) {
+	type SomeStruct struct {
+		Sampling   int
+		Classifier string
+		Disabled   bool
+	}
+	defaultValue := SomeStruct{Sampling: 1000, Classifier: "external"}
+	cases := []struct {
+		Pos      helpers.Pos
+		Input    gin.H
+		Expected map[string]SomeStruct
+	}{
+		{
+			Pos: helpers.Mark(),
+			Input: gin.H{
+				"sampling": 100,
+			},
+			Expected: map[string]SomeStruct{
+				"::/0": {Sampling: 100, Classifier: "external"},
+			},
+		}, {
+			Pos: helpers.Mark(),
+			Input: gin.H{
+				"10.0.0.0/8": gin.H{
+					"sampling":   100,
+					"classifier": "internal",
+				},
+				"10.1.0.0/16": gin.H{
+					"classifier": "lab",
+					"disabled":   true,
+				},
+				"2001:db8::/64": gin.H{},
+			},
+			Expected: map[string]SomeStruct{
+				"10.0.0.0/8":    {Sampling: 100, Classifier: "internal"},
+				"10.1.0.0/16":   {Sampling: 1000, Classifier: "lab", Disabled: true},
+				"2001:db8::/64": {Sampling: 1000, Classifier: "external"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		var tree helpers.SubnetMap[SomeStruct]
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:      &tree,
+			ErrorUnused: true,
+			Metadata:    nil,
+			DecodeHook:  helpers.SubnetMapUnmarshallerHookWithDefaults(defaultValue),
+		})
+		if err != nil {
+			t.Fatalf("%sNewDecoder() error:\n%+v", tc.Pos, err)
+		}
+		if err := decoder.Decode(tc.Input); err != nil {
+			t.Fatalf("%sDecode() error:\n%+v", tc.Pos, err)
+		}
+		if diff := helpers.Diff(tree.ToMap(), tc.Expected); diff != "" {
+			t.Fatalf("%sDecode() (-got, +want):\n%s", tc.Pos, diff)
+		}
+	}
+}
+
+func TestSubnetMapUnmarshalHookWithDefaultKey(t *testing.T) {
+	decode := func(input interface{}, strict bool) (map[string]string, error) {
+		var tree helpers.SubnetMap[string]
+		hook := helpers.SubnetMapUnmarshallerHook[string]()
+		if strict {
+			hook = helpers.SubnetMapUnmarshallerHookStrict[string]()
+		}
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:      &tree,
+			ErrorUnused: true,
+			Metadata:    nil,
+			DecodeHook:  hook,
+		})
+		if err != nil {
+			t.Fatalf("NewDecoder() error:\n%+v", err)
+		}
+		err = decoder.Decode(input)
+		return tree.ToMap(), err
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		Input    interface{}
+		Expected map[string]string
+	}{
+		{helpers.Mark(), "customer1", map[string]string{"::/0": "customer1"}},
+		{helpers.Mark(), gin.H{"default": "customer1"}, map[string]string{"::/0": "customer1"}},
+		{
+			helpers.Mark(),
+			gin.H{"default": "customer1", "10.0.0.0/8": "customer2"},
+			map[string]string{"::/0": "customer1", "10.0.0.0/8": "customer2"},
+		}, {
+			helpers.Mark(),
+			gin.H{"default": "customer1", "::/0": "customer3", "10.0.0.0/8": "customer2"},
+			map[string]string{"::/0": "customer3", "10.0.0.0/8": "customer2"},
+		}, {
+			helpers.Mark(),
+			gin.H{"default": "customer1", "0.0.0.0/0": "customer4"},
+			map[string]string{"::/0": "customer1", "0.0.0.0/0": "customer4"},
+		},
+	}
+	for _, tc := range cases {
+		got, err := decode(tc.Input, false)
+		if err != nil {
+			t.Fatalf("%sDecode() error:\n%+v", tc.Pos, err)
+		}
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sDecode() (-got, +want):\n%s", tc.Pos, diff)
+		}
+	}
+
+	// In strict mode, default and ::/0 are duplicates
+	if _, err := decode(gin.H{"default": "customer1", "::/0": "customer3"}, true); err == nil {
+		t.Error("Decode() in strict mode did not error")
+	}
+
+	// A struct with a Default field is still decoded as a single value
+	type SomeStruct struct {
+		Default string
+		Other   string
+	}
+	for _, input := range []gin.H{
+		{"default": "some"},
+		{"default": "some", "other": "thing"},
+	} {
+		var tree helpers.SubnetMap[SomeStruct]
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:      &tree,
+			ErrorUnused: true,
+			Metadata:    nil,
+			DecodeHook:  helpers.SubnetMapUnmarshallerHook[SomeStruct](),
+		})
+		if err != nil {
+			t.Fatalf("NewDecoder() error:\n%+v", err)
+		}
+		if err := decoder.Decode(input); err != nil {
+			t.Fatalf("Decode(%v) error:\n%+v", input, err)
+		}
+		if got, _ := tree.Lookup(netip.MustParseAddr("::1")); got.Default != "some" {
+			t.Errorf("Decode(%v) == %+v, expected a single value", input, got)
+		}
+	}
+}
+
+func TestSubnetMapUnmarshalHookWithValidation(t *testing.T) {
+	customerRegex := regexp.MustCompile(`^customer[0-9]+$`)
+	var tree helpers.SubnetMap[string]
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:      &tree,
+		ErrorUnused: true,
+		Metadata:    nil,
+		DecodeHook: helpers.SubnetMapUnmarshallerHookWithValidation(func(_ string, v string) error {
+			if !customerRegex.MatchString(v) {
+				return fmt.Errorf("%q is not a valid customer name", v)
+			}
+			return nil
+		}),
+	})
+	if err != nil {
+		t.Fatalf("NewDecoder() error:\n%+v", err)
+	}
+	err = decoder.Decode(gin.H{
+		"192.0.2.0/24":    "customer1",
+		"198.51.100.0/24": "Customer2",
+		"2001:db8::/64":   "customer3",
+		"203.0.113.0/24":  "customer 4",
+	})
+	if err == nil {
+		t.Fatal("Decode() did not return an error")
+	}
+	for _, expected := range []string{
+		`invalid value for 198.51.100.0/24: "Customer2" is not a valid customer name`,
+		`invalid value for 203.0.113.0/24: "customer 4" is not a valid customer name`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Decode() error does not contain %q:\n%s", expected, err)
+		}
+	}
+	for _, unexpected := range []string{"customer1", "customer3"} {
+		if strings.Contains(err.Error(), unexpected) {
+			t.Errorf("Decode() error contains %q:\n%s", unexpected, err)
+		}
+	}
+}
+
+func TestSubnetMapUnmarshalHookStrict(t *testing.T) {
+	cases := []struct {
+		Pos   helpers.Pos
+		Input interface{}
+		Error string
+		Tests map[string]string
+	}{
+		{
+			Pos: helpers.Mark(),
+			Input: gin.H{
+				"10.0.0.0/8":  "customer1",
+				"10.1.0.0/16": "customer2",
+				"10.1.2.0/24": "customer1",
+			},
+			Tests: map[string]string{
+				"::ffff:10.0.0.1": "customer1",
+				"::ffff:10.1.0.1": "customer2",
+				"::ffff:10.1.2.1": "customer1",
+			},
+		}, {
+			Pos: helpers.Mark(),
+			Input: gin.H{
+				"10.0.0.0/8":          "customer1",
+				"::ffff:10.0.0.0/104": "customer2",
+			},
+			Error: "is a duplicate of",
+		}, {
+			Pos: helpers.Mark(),
+			Input: gin.H{
+				"10.0.0.0/8": "customer1",
+				"10.0.0.1/8": "customer1",
+			},
+			Error: "is a duplicate of",
+		}, {
+			Pos: helpers.Mark(),
+			Input: []gin.H{
+				{"prefix": "10.0.0.0/8", "value": "customer1", "origin": "a.yaml"},
+				{"prefix": "10.1.0.0/16", "value": "customer2", "origin": "a.yaml"},
+				{"prefix": "10.0.0.0/8", "value": "customer3", "origin": "b.yaml"},
+			},
+			Error: "subnet 10.0.0.0/8 (entry 2) is a duplicate of 10.0.0.0/8 (entry 0)",
+		}, {
+			Pos: helpers.Mark(),
+			Input: []gin.H{
+				{"prefix": "10.0.0.0/8", "value": "customer1", "enabled": false},
+				{"prefix": "10.0.0.0/8", "value": "customer2"},
+			},
+			Error: "subnet 10.0.0.0/8 (entry 1) is a duplicate of 10.0.0.0/8 (entry 0)",
+		},
+	}
+	for _, tc := range cases {
+		var tree helpers.SubnetMap[string]
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:      &tree,
+			ErrorUnused: true,
+			Metadata:    nil,
+			DecodeHook:  helpers.SubnetMapUnmarshallerHookStrict[string](),
+		})
+		if err != nil {
+			t.Fatalf("%sNewDecoder() error:\n%+v", tc.Pos, err)
+		}
+		err = decoder.Decode(tc.Input)
+		if tc.Error != "" {
+			if err == nil {
+				t.Errorf("%sDecode() did not return an error", tc.Pos)
+			} else if !strings.Contains(err.Error(), tc.Error) {
+				t.Errorf("%sDecode() error does not contain %q:\n%s", tc.Pos, tc.Error, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%sDecode() error:\n%+v", tc.Pos, err)
+			continue
+		}
+		got := map[string]string{}
+		for k := range tc.Tests {
+			got[k], _ = tree.Lookup(netip.MustParseAddr(k))
+		}
+		if diff := helpers.Diff(got, tc.Tests); diff != "" {
+			t.Errorf("%sDecode() (-got, +want):\n%s", tc.Pos, diff)
+		}
+	}
+
+	// The regular hook keeps the last value
+	var tree helpers.SubnetMap[string]
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:     &tree,
+		DecodeHook: helpers.SubnetMapUnmarshallerHook[string](),
+	})
+	if err != nil {
+		t.Fatalf("NewDecoder() error:\n%+v", err)
+	}
+	if err := decoder.Decode([]gin.H{
+		{"prefix": "10.0.0.0/8", "value": "customer1"},
+		{"prefix": "10.0.0.0/8", "value": "customer2"},
+	}); err != nil {
+		t.Fatalf("Decode() error:\n%+v", err)
+	}
+	if got, _ := tree.Lookup(netip.MustParseAddr("::ffff:10.0.0.1")); got != "customer2" {
+		t.Fatalf("Lookup() == %q, expected %q", got, "customer2")
+	}
+}
+
+type testShape interface {
+	Area() float64
+}
+
+type testSquare struct {
+	Side float64
+}
+
+func (s *testSquare) Area() float64 { return s.Side * s.Side }
+
+type testRectangle struct {
+	Width  float64
+	Height float64
+}
+
+func (r *testRectangle) Area() float64 { return r.Width * r.Height }
+
+func TestSubnetMapUnmarshalHookWithTypes(t *testing.T) {
+	types := helpers.SubnetMapTypeRegistry[testShape]{
+		"square":    func() testShape { return &testSquare{} },
+		"rectangle": func() testShape { return &testRectangle{} },
+	}
+	decode := func(input interface{}) (*helpers.SubnetMap[testShape], error) {
+		var tree helpers.SubnetMap[testShape]
+		decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+			Result:      &tree,
+			ErrorUnused: true,
+			Metadata:    nil,
+			DecodeHook:  helpers.SubnetMapUnmarshallerHookWithTypes(types),
+		})
+		if err != nil {
+			t.Fatalf("NewDecoder() error:\n%+v", err)
+		}
+		return &tree, decoder.Decode(input)
+	}
+
+	tree, err := decode(gin.H{
+		"192.0.2.0/24":  gin.H{"type": "square", "side": 3},
+		"2001:db8::/64": gin.H{"type": "rectangle", "width": 2, "height": 5},
+	})
+	if err != nil {
+		t.Fatalf("Decode() error:\n%+v", err)
+	}
+	expected := map[string]testShape{
+		"192.0.2.0/24":  &testSquare{Side: 3},
+		"2001:db8::/64": &testRectangle{Width: 2, Height: 5},
+	}
+	if diff := helpers.Diff(tree.ToMap(), expected); diff != "" {
+		t.Fatalf("Decode() (-got, +want):\n%s", diff)
+	}
+	if got, _ := tree.Lookup(netip.MustParseAddr("::ffff:192.0.2.10")); got.Area() != 9 {
+		t.Errorf("Lookup().Area() == %f, expected 9", got.Area())
+	}
+
+	cases := []struct {
+		Pos   helpers.Pos
+		Input gin.H
+		Error string
+	}{
+		{helpers.Mark(), gin.H{"192.0.2.0/24": gin.H{"type": "circle", "radius": 3}}, `unknown type "circle"`},
+		{helpers.Mark(), gin.H{"192.0.2.0/24": gin.H{"side": 3}}, `unknown type ""`},
+		{helpers.Mark(), gin.H{"192.0.2.0/24": gin.H{"type": "square", "radius": 3}}, `unable to decode "square"`},
+		{helpers.Mark(), gin.H{"192.0.2.0/24": "square"}, "is not a map"},
+	}
+	for _, tc := range cases {
+		_, err := decode(tc.Input)
+		if err == nil {
+			t.Errorf("%sDecode(%v) did not return an error", tc.Pos, tc.Input)
+		} else if !strings.Contains(err.Error(), tc.Error) {
+			t.Errorf("%sDecode(%v) error does not contain %q:\n%s", tc.Pos, tc.Input, tc.Error, err)
+		}
+	}
+}
+
 func TestSubnetMapParseKey(t *testing.T) {
 	cases := []struct {
 		Description string
@@ -303,3 +730,1400 @@ func TestToMap(t *testing.T) {
 		t.Fatalf("ToMap() (-got, +want):\n%s", diff)
 	}
 }
+
+func TestLen(t *testing.T) {
+	var empty helpers.SubnetMap[string]
+	cases := []struct {
+		Pos      helpers.Pos
+		Map      helpers.SubnetMap[string]
+		Expected int
+	}{
+		{helpers.Mark(), empty, 0},
+		{helpers.Mark(), *helpers.MustNewSubnetMap(map[string]string{"::/0": "default"}), 1},
+		{helpers.Mark(), *helpers.MustNewSubnetMap(map[string]string{
+			"::/0":                 "default",
+			"2001:db8::/64":        "hello",
+			"2001:db8:1::/64":      "hello",
+			"::ffff:192.0.2.0/120": "bye",
+		}), 4},
+	}
+	for _, tc := range cases {
+		if got := tc.Map.Len(); got != tc.Expected {
+			t.Errorf("%sLen() == %d, expected %d", tc.Pos, got, tc.Expected)
+		}
+	}
+}
+
+func TestLookupDepth(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"192.0.0.0/8":  "first",
+		"192.0.0.0/16": "second",
+		"192.0.2.0/24": "third",
+	})
+	cases := []struct {
+		Pos           helpers.Pos
+		IP            string
+		ExpectedValue string
+		ExpectedDepth int
+	}{
+		{helpers.Mark(), "::ffff:198.51.100.1", "", 0},
+		{helpers.Mark(), "::ffff:192.168.0.1", "first", 1},
+		{helpers.Mark(), "::ffff:192.0.3.1", "second", 2},
+		{helpers.Mark(), "::ffff:192.0.2.1", "third", 3},
+		{helpers.Mark(), "192.0.2.1", "third", 3},
+		{helpers.Mark(), "198.51.100.1", "", 0},
+	}
+	for _, tc := range cases {
+		value, _, depth := sm.LookupDepth(netip.MustParseAddr(tc.IP))
+		if diff := helpers.Diff([]any{value, depth}, []any{tc.ExpectedValue, tc.ExpectedDepth}); diff != "" {
+			t.Errorf("%sLookupDepth(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+}
+
+func TestLookupInto(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"192.0.2.0/24":  "customer1",
+		"2001:db8::/64": "customer2",
+	})
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       net.IP
+		Expected string
+	}{
+		{helpers.Mark(), net.ParseIP("192.0.2.10").To4(), "customer1"},
+		{helpers.Mark(), net.ParseIP("192.0.2.10"), "customer1"},
+		{helpers.Mark(), net.ParseIP("198.51.100.10").To4(), ""},
+		{helpers.Mark(), net.ParseIP("2001:db8::1"), "customer2"},
+		{helpers.Mark(), net.IP{1, 2, 3}, ""},
+	}
+	var scratch [16]byte
+	for _, tc := range cases {
+		got, _ := sm.LookupInto(tc.IP, &scratch)
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sLookupInto(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+
+	ip := net.ParseIP("192.0.2.10").To4()
+	if allocs := testing.AllocsPerRun(100, func() { sm.LookupInto(ip, &scratch) }); allocs != 0 {
+		t.Errorf("LookupInto() allocations: %f", allocs)
+	}
+}
+
+func BenchmarkSubnetMapLookup(b *testing.B) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"192.0.2.0/24":  "customer1",
+		"2001:db8::/64": "customer2",
+	})
+	ip := net.ParseIP("192.0.2.10").To4()
+	b.Run("Lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			addr, _ := netip.AddrFromSlice(ip.To16())
+			sm.Lookup(addr)
+		}
+	})
+	b.Run("LookupInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var scratch [16]byte
+		for range b.N {
+			sm.LookupInto(ip, &scratch)
+		}
+	})
+	b.Run("LookupAddr", func(b *testing.B) {
+		b.ReportAllocs()
+		addr := netip.MustParseAddr("192.0.2.10")
+		for range b.N {
+			sm.LookupAddr(addr)
+		}
+	})
+}
+
+func TestLookupAddr(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"192.0.2.0/24":  "customer1",
+		"2001:db8::/64": "customer2",
+	})
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected string
+		OK       bool
+	}{
+		{helpers.Mark(), "192.0.2.10", "customer1", true},
+		{helpers.Mark(), "::ffff:192.0.2.10", "customer1", true},
+		{helpers.Mark(), "2001:db8::1", "customer2", true},
+		{helpers.Mark(), "198.51.100.1", "", false},
+	}
+	for _, tc := range cases {
+		got, ok := sm.LookupAddr(netip.MustParseAddr(tc.IP))
+		if diff := helpers.Diff([]any{got, ok}, []any{tc.Expected, tc.OK}); diff != "" {
+			t.Errorf("%sLookupAddr(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+	if allocs := testing.AllocsPerRun(100, func() {
+		sm.LookupAddr(netip.MustParseAddr("192.0.2.10"))
+	}); allocs != 0 {
+		t.Errorf("LookupAddr() allocations == %v, expected 0", allocs)
+	}
+}
+
+func TestLookupUnmappedIPv4(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::/0":         "default",
+		"192.0.2.0/24": "customer1",
+	})
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected string
+		OK       bool
+	}{
+		{helpers.Mark(), "192.0.2.10", "default", true},
+		{helpers.Mark(), "::ffff:192.0.2.10", "customer1", true},
+		{helpers.Mark(), "198.51.100.1", "default", true},
+	}
+	for _, tc := range cases {
+		got, ok := sm.Lookup(netip.MustParseAddr(tc.IP))
+		if diff := helpers.Diff([]any{got, ok}, []any{tc.Expected, tc.OK}); diff != "" {
+			t.Errorf("%sLookup(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+
+	sm.SetDefaultPolicy(helpers.SubnetMapDefaultMiss)
+	if got, ok := sm.Lookup(netip.MustParseAddr("192.0.2.10")); ok {
+		t.Errorf("Lookup(192.0.2.10) == %q, expected a miss", got)
+	}
+	sm = helpers.MustNewSubnetMap(map[string]string{
+		"192.0.2.0/24": "customer1",
+	})
+	if got, ok := sm.Lookup(netip.MustParseAddr("192.0.2.10")); ok {
+		t.Errorf("Lookup(192.0.2.10) == %q, expected a miss", got)
+	}
+}
+
+func TestLookupPair(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"192.0.2.0/24":    "customer1",
+		"198.51.100.0/24": "customer2",
+		"2001:db8::/64":   "customer3",
+	})
+	cases := []struct {
+		Pos         helpers.Pos
+		Src, Dst    net.IP
+		ExpectedSrc string
+		ExpectedDst string
+		SrcOK       bool
+		DstOK       bool
+	}{
+		{helpers.Mark(), net.ParseIP("192.0.2.10").To4(), net.ParseIP("198.51.100.10"), "customer1", "customer2", true, true},
+		{helpers.Mark(), net.ParseIP("192.0.2.10"), net.ParseIP("203.0.113.10"), "customer1", "", true, false},
+		{helpers.Mark(), net.ParseIP("203.0.113.10"), net.ParseIP("2001:db8::1"), "", "customer3", false, true},
+		{helpers.Mark(), net.IP{1, 2, 3}, net.ParseIP("198.51.100.10").To4(), "", "customer2", false, true},
+		{helpers.Mark(), net.ParseIP("2001:db8:1::1"), nil, "", "", false, false},
+	}
+	for _, tc := range cases {
+		srcV, srcOK, dstV, dstOK := sm.LookupPair(tc.Src, tc.Dst)
+		got := []any{srcV, srcOK, dstV, dstOK}
+		expected := []any{tc.ExpectedSrc, tc.SrcOK, tc.ExpectedDst, tc.DstOK}
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Errorf("%sLookupPair(%s, %s) (-got, +want):\n%s", tc.Pos, tc.Src, tc.Dst, diff)
+		}
+	}
+
+	var empty *helpers.SubnetMap[string]
+	if _, srcOK, _, dstOK := empty.LookupPair(net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.10")); srcOK || dstOK {
+		t.Error("LookupPair() on nil map should not match")
+	}
+}
+
+func TestLookupOrFallback(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+	})
+	calls := 0
+	fallback := func(ip net.IP) (string, bool) {
+		calls++
+		if ip.Equal(net.ParseIP("198.51.100.1")) {
+			return "zone1", true
+		}
+		return "", false
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected string
+		OK       bool
+		Calls    int
+	}{
+		{helpers.Mark(), "192.0.2.10", "customer1", true, 0},
+		{helpers.Mark(), "198.51.100.1", "zone1", true, 1},
+		{helpers.Mark(), "203.0.113.1", "", false, 1},
+	}
+	for _, tc := range cases {
+		calls = 0
+		got, ok := sm.LookupOrFallback(net.ParseIP(tc.IP).To4(), fallback)
+		if diff := helpers.Diff([]any{got, ok, calls}, []any{tc.Expected, tc.OK, tc.Calls}); diff != "" {
+			t.Errorf("%sLookupOrFallback(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+}
+
+func TestLookupOrDefault(t *testing.T) {
+	explicit := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+		"::/0":                 "catch-all",
+	})
+	explicit.SetDefault("default")
+	programmatic := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+	})
+	programmatic.SetDefault("default")
+	neither := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+	})
+	cases := []struct {
+		Pos      helpers.Pos
+		Map      *helpers.SubnetMap[string]
+		IP       string
+		Expected string
+	}{
+		{helpers.Mark(), explicit, "::ffff:192.0.2.10", "customer1"},
+		{helpers.Mark(), explicit, "::ffff:198.51.100.1", "catch-all"},
+		{helpers.Mark(), programmatic, "::ffff:192.0.2.10", "customer1"},
+		{helpers.Mark(), programmatic, "::ffff:198.51.100.1", "default"},
+		{helpers.Mark(), neither, "::ffff:192.0.2.10", "customer1"},
+		{helpers.Mark(), neither, "::ffff:198.51.100.1", "fallback"},
+		{helpers.Mark(), nil, "::ffff:198.51.100.1", "fallback"},
+	}
+	for _, tc := range cases {
+		got := tc.Map.LookupOrDefault(netip.MustParseAddr(tc.IP), "fallback")
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sLookupOrDefault(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+
+	// The default value is not used by Lookup
+	if got, ok := programmatic.Lookup(netip.MustParseAddr("::ffff:198.51.100.1")); ok {
+		t.Errorf("Lookup() == %q, expected a miss", got)
+	}
+}
+
+func TestLookupInherit(t *testing.T) {
+	type attributes struct {
+		Customer string
+		Region   string
+	}
+	sm := helpers.MustNewSubnetMap(map[string]attributes{
+		"::ffff:192.0.0.0/112":    {Region: "eu-west-1"},
+		"::ffff:192.0.2.0/120":    {Customer: "customer1"},
+		"::ffff:192.0.3.0/120":    {Customer: "customer2", Region: "eu-west-3"},
+		"::ffff:198.51.100.0/120": {Customer: "customer3"},
+	})
+	inherit := func(child, parent attributes) attributes {
+		if child.Customer == "" {
+			child.Customer = parent.Customer
+		}
+		if child.Region == "" {
+			child.Region = parent.Region
+		}
+		return child
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       net.IP
+		Expected attributes
+		OK       bool
+	}{
+		{helpers.Mark(), net.ParseIP("192.0.2.10"), attributes{"customer1", "eu-west-1"}, true},
+		{helpers.Mark(), net.ParseIP("192.0.3.10").To4(), attributes{"customer2", "eu-west-3"}, true},
+		{helpers.Mark(), net.ParseIP("192.0.4.10"), attributes{"", "eu-west-1"}, true},
+		{helpers.Mark(), net.ParseIP("198.51.100.10"), attributes{"customer3", ""}, true},
+		{helpers.Mark(), net.ParseIP("203.0.113.10"), attributes{}, false},
+		{helpers.Mark(), net.IP{1, 2, 3}, attributes{}, false},
+	}
+	for _, tc := range cases {
+		got, ok := sm.LookupInherit(tc.IP, inherit)
+		if diff := helpers.Diff([]any{got, ok}, []any{tc.Expected, tc.OK}); diff != "" {
+			t.Errorf("%sLookupInherit(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+}
+
+func BenchmarkSubnetMapLookupPair(b *testing.B) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"192.0.2.0/24":    "customer1",
+		"198.51.100.0/24": "customer2",
+		"2001:db8::/64":   "customer3",
+	})
+	src := net.ParseIP("192.0.2.10").To4()
+	dst := net.ParseIP("198.51.100.10")
+	b.Run("Lookup", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			srcAddr, _ := netip.AddrFromSlice(src.To16())
+			dstAddr, _ := netip.AddrFromSlice(dst.To16())
+			sm.Lookup(srcAddr)
+			sm.Lookup(dstAddr)
+		}
+	})
+	b.Run("LookupPair", func(b *testing.B) {
+		b.ReportAllocs()
+		for range b.N {
+			sm.LookupPair(src, dst)
+		}
+	})
+}
+
+func TestIndexedSubnetMap(t *testing.T) {
+	type attributes struct {
+		Name   string
+		Region string
+	}
+	values := []attributes{
+		{"customer1", "eu-west-1"},
+		{"customer2", "eu-west-3"},
+		{"customer3", "us-east-1"},
+	}
+	from := map[string]attributes{}
+	for i := range 1000 {
+		from[fmt.Sprintf("2001:db8:%x::/48", i)] = values[i%len(values)]
+	}
+	ism, err := helpers.NewIndexedSubnetMap(from)
+	if err != nil {
+		t.Fatalf("NewIndexedSubnetMap() error:\n%+v", err)
+	}
+	if len(ism.Values()) != len(values) {
+		t.Errorf("Values() should have %d values, not %d", len(values), len(ism.Values()))
+	}
+	for i := range 1000 {
+		ip := netip.MustParseAddr(fmt.Sprintf("2001:db8:%x::1", i))
+		got, ok := ism.Lookup(ip)
+		if !ok {
+			t.Fatalf("Lookup(%s) did not find anything", ip)
+		}
+		if diff := helpers.Diff(got, values[i%len(values)]); diff != "" {
+			t.Fatalf("Lookup(%s) (-got, +want):\n%s", ip, diff)
+		}
+	}
+	if _, ok := ism.Lookup(netip.MustParseAddr("2001:db9::1")); ok {
+		t.Error("Lookup(2001:db9::1) should not find anything")
+	}
+}
+
+func TestWalkLengthRange(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.0.0/112":   "v4-16",
+		"::ffff:192.0.2.0/120":   "v4-24",
+		"::ffff:192.0.2.128/121": "v4-25",
+		"::ffff:192.0.2.1/128":   "v4-32",
+		"2001:db8::/32":          "v6-32",
+		"2001:db8::/48":          "v6-48",
+	})
+	got := map[string]string{}
+	if err := sm.WalkLengthRange(20, 28, func(prefix string, v string) error {
+		got[prefix] = v
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkLengthRange() error:\n%+v", err)
+	}
+	expected := map[string]string{
+		"192.0.2.0/24":   "v4-24",
+		"192.0.2.128/25": "v4-25",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("WalkLengthRange() (-got, +want):\n%s", diff)
+	}
+
+	got = map[string]string{}
+	if err := sm.WalkLengthRange(32, 32, func(prefix string, v string) error {
+		got[prefix] = v
+		return nil
+	}); err != nil {
+		t.Fatalf("WalkLengthRange() error:\n%+v", err)
+	}
+	expected = map[string]string{
+		"192.0.2.1/32":  "v4-32",
+		"2001:db8::/32": "v6-32",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("WalkLengthRange() (-got, +want):\n%s", diff)
+	}
+
+	if err := sm.WalkLengthRange(0, 128, func(string, string) error {
+		return errors.New("stop")
+	}); err == nil {
+		t.Fatal("WalkLengthRange() did not return an error")
+	}
+}
+
+func TestDot(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.0.0/112": "region",
+		"::ffff:192.0.2.0/120": "customer1",
+		"::ffff:192.1.0.0/112": "other",
+		"2001:db8::/64":        "customer2",
+	})
+	got := sm.Dot()
+	for _, expected := range []string{
+		"digraph SubnetMap {\n",
+		`  "192.0.2.0/24" [label="192.0.2.0/24\ncustomer1"];`,
+		`  "192.0.0.0/16" -> "192.0.2.0/24";`,
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("Dot() does not contain %q:\n%s", expected, got)
+		}
+	}
+	for _, unexpected := range []string{
+		`"192.0.0.0/16" -> "192.1.0.0/16"`,
+		`-> "2001:db8::/64"`,
+	} {
+		if strings.Contains(got, unexpected) {
+			t.Errorf("Dot() contains %q:\n%s", unexpected, got)
+		}
+	}
+}
+
+func TestShrink(t *testing.T) {
+	from := map[string]string{}
+	for i := range 4096 {
+		from[fmt.Sprintf("2001:db8:%x::/48", i)] = fmt.Sprintf("customer%d", i)
+	}
+	sm := helpers.MustNewSubnetMap(from)
+	for i := range 4096 {
+		if i%64 == 0 {
+			continue
+		}
+		if _, err := sm.Delete(fmt.Sprintf("2001:db8:%x::/48", i)); err != nil {
+			t.Fatalf("Delete() error:\n%+v", err)
+		}
+	}
+	// The number of allocated nodes is not exported by the tree
+	nodes := func() int {
+		return reflect.ValueOf(sm).Elem().FieldByName("tree").Elem().FieldByName("nodes").Len()
+	}
+	before := nodes()
+	expected := sm.ToMap()
+	sm.Shrink()
+	if after := nodes(); after >= before/10 {
+		t.Errorf("Shrink() kept %d nodes out of %d", after, before)
+	}
+	if diff := helpers.Diff(sm.ToMap(), expected); diff != "" {
+		t.Errorf("ToMap() after Shrink() (-got, +want):\n%s", diff)
+	}
+	for i := range 4096 {
+		ip := netip.MustParseAddr(fmt.Sprintf("2001:db8:%x::1", i))
+		got, ok := sm.Lookup(ip)
+		if i%64 == 0 && (!ok || got != fmt.Sprintf("customer%d", i)) {
+			t.Errorf("Lookup(%s) == %q, %v", ip, got, ok)
+		} else if i%64 != 0 && ok {
+			t.Errorf("Lookup(%s) == %q, should not match", ip, got)
+		}
+	}
+}
+
+func TestToSQLCase(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:10.0.0.0/104":  "private",
+		"::ffff:10.1.0.0/112":  "customer1",
+		"::ffff:10.1.2.0/120":  "customer's lab",
+		"::ffff:192.0.2.0/120": "customer2",
+		"2001:db8::/32":        "v6",
+	})
+	got := sm.ToSQLCase("SrcAddr")
+	expected := "multiIf(" +
+		"isIPAddressInRange(toString(SrcAddr), '::ffff:10.1.2.0/120'), 'customer\\'s lab', " +
+		"isIPAddressInRange(toString(SrcAddr), '::ffff:192.0.2.0/120'), 'customer2', " +
+		"isIPAddressInRange(toString(SrcAddr), '::ffff:10.1.0.0/112'), 'customer1', " +
+		"isIPAddressInRange(toString(SrcAddr), '::ffff:10.0.0.0/104'), 'private', " +
+		"isIPAddressInRange(toString(SrcAddr), '2001:db8::/32'), 'v6', " +
+		"'')"
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Errorf("ToSQLCase() (-got, +want):\n%s", diff)
+	}
+
+	var empty *helpers.SubnetMap[string]
+	if got := empty.ToSQLCase("SrcAddr"); got != "''" {
+		t.Errorf("ToSQLCase() on empty map == %q, expected %q", got, "''")
+	}
+}
+
+func TestLookupID(t *testing.T) {
+	from := map[string]string{
+		"::ffff:192.0.2.0/120":    "customer1",
+		"::ffff:192.0.2.128/121":  "customer2",
+		"::ffff:198.51.100.0/120": "customer3",
+		"2001:db8::/64":           "customer4",
+	}
+	sm1 := helpers.MustNewSubnetMap(from)
+	sm1.AssignIDs()
+	sm2 := helpers.MustNewSubnetMap(from)
+	sm2.AssignIDs()
+
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected uint32
+		OK       bool
+	}{
+		{helpers.Mark(), "::ffff:192.0.2.10", 1, true},
+		{helpers.Mark(), "::ffff:192.0.2.130", 2, true},
+		{helpers.Mark(), "::ffff:198.51.100.1", 3, true},
+		{helpers.Mark(), "2001:db8::1", 4, true},
+		{helpers.Mark(), "::ffff:203.0.113.1", 0, false},
+		{helpers.Mark(), "192.0.2.10", 1, true},
+		{helpers.Mark(), "203.0.113.1", 0, false},
+	}
+	for _, tc := range cases {
+		ip := netip.MustParseAddr(tc.IP)
+		for _, sm := range []*helpers.SubnetMap[string]{sm1, sm2} {
+			id, ok := sm.LookupID(ip)
+			if diff := helpers.Diff([]any{id, ok}, []any{tc.Expected, tc.OK}); diff != "" {
+				t.Errorf("%sLookupID(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+			}
+		}
+	}
+
+	// Any modification drops the IDs
+	sm1.Set("::ffff:203.0.113.0/120", "customer5")
+	if _, ok := sm1.LookupID(netip.MustParseAddr("::ffff:192.0.2.10")); ok {
+		t.Error("LookupID() after Set() should not match")
+	}
+	sm1.AssignIDs()
+	if id, _ := sm1.LookupID(netip.MustParseAddr("::ffff:203.0.113.1")); id != 4 {
+		t.Errorf("LookupID() after AssignIDs() == %d, expected 4", id)
+	}
+}
+
+func TestCountByPrefix(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120":   "customer1",
+		"::ffff:192.0.2.128/121": "customer2",
+		"2001:db8::/64":          "customer3",
+		"2001:db8:1::/64":        "customer4",
+	})
+	ips := []netip.Addr{}
+	for _, ip := range []string{
+		"::ffff:192.0.2.10",
+		"::ffff:192.0.2.11",
+		"::ffff:192.0.2.130",
+		"2001:db8::1",
+		"2001:db8::2",
+		"2001:db8::3",
+		"::ffff:203.0.113.1",
+		"::ffff:198.51.100.1",
+		"2001:db8:2::1",
+		"192.0.2.12",
+		"203.0.113.2",
+	} {
+		ips = append(ips, netip.MustParseAddr(ip))
+	}
+
+	counts, other := sm.CountByPrefix(slices.Values(ips))
+	expected := map[string]uint64{
+		"192.0.2.0/24":   3,
+		"192.0.2.128/25": 1,
+		"2001:db8::/64":  3,
+	}
+	if diff := helpers.Diff(counts, expected); diff != "" {
+		t.Errorf("CountByPrefix() counts (-got, +want):\n%s", diff)
+	}
+	if other != 4 {
+		t.Errorf("CountByPrefix() other == %d, expected 4", other)
+	}
+
+	var empty *helpers.SubnetMap[string]
+	counts, other = empty.CountByPrefix(slices.Values(ips))
+	if len(counts) != 0 || other != uint64(len(ips)) {
+		t.Errorf("CountByPrefix() on empty map == %v, %d", counts, other)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	from := map[string]string{
+		"::ffff:10.0.0.0/104":    "large",
+		"::ffff:10.0.3.128/121":  "specific",
+		"2001:db8::/64":          "v6",
+		"::ffff:192.168.0.0/112": "medium",
+	}
+	for i := range 16 {
+		from[fmt.Sprintf("::ffff:10.0.%d.0/120", i)] = fmt.Sprintf("customer%d", i)
+	}
+	reference := helpers.MustNewSubnetMap(from)
+	optimized := helpers.MustNewSubnetMap(from)
+	if !optimized.Optimize() {
+		t.Fatal("Optimize() should have built the index")
+	}
+	ips := []string{"2001:db8::1", "::ffff:192.168.1.1", "::ffff:10.0.3.1", "::ffff:10.0.3.129", "::ffff:10.1.0.1"}
+	for i := range 16 {
+		ips = append(ips, fmt.Sprintf("::ffff:10.0.%d.10", i))
+	}
+	for _, ip := range ips {
+		expected, _ := reference.Lookup(netip.MustParseAddr(ip))
+		got, _ := optimized.Lookup(netip.MustParseAddr(ip))
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Errorf("Lookup(%s) (-got, +want):\n%s", ip, diff)
+		}
+	}
+
+	// Any modification drops the index
+	optimized.Set("::ffff:10.0.1.0/120", "updated")
+	if got, _ := optimized.Lookup(netip.MustParseAddr("::ffff:10.0.1.10")); got != "updated" {
+		t.Errorf("Lookup() after Set() == %q, expected %q", got, "updated")
+	}
+
+	// Not dominated by /24
+	if helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:10.0.0.0/104": "large",
+		"2001:db8::/64":       "v6",
+		"::ffff:10.0.1.0/120": "customer",
+	}).Optimize() {
+		t.Error("Optimize() should not have built the index")
+	}
+}
+
+func BenchmarkSubnetMapOptimize(b *testing.B) {
+	from := map[string]string{}
+	for i := range 10000 {
+		from[fmt.Sprintf("::ffff:10.%d.%d.0/120", i/256, i%256)] = fmt.Sprintf("customer%d", i)
+	}
+	ips := []netip.Addr{}
+	for i := range 1000 {
+		ips = append(ips, netip.MustParseAddr(fmt.Sprintf("::ffff:10.%d.%d.10", i/256, i%256)))
+	}
+	b.Run("tree", func(b *testing.B) {
+		sm := helpers.MustNewSubnetMap(from)
+		for i := range b.N {
+			sm.Lookup(ips[i%len(ips)])
+		}
+	})
+	b.Run("optimized", func(b *testing.B) {
+		sm := helpers.MustNewSubnetMap(from)
+		sm.Optimize()
+		for i := range b.N {
+			sm.Lookup(ips[i%len(ips)])
+		}
+	})
+}
+
+func TestNewSubnetMap(t *testing.T) {
+	sm, err := helpers.NewSubnetMap(map[string]string{
+		"203.0.113.0/24":       "customer1",
+		"::ffff:192.0.2.0/120": "customer2",
+		"198.51.100.1":         "customer3",
+		"2001:db8:1::/64":      "customer4",
+	})
+	if err != nil {
+		t.Fatalf("NewSubnetMap() error:\n%+v", err)
+	}
+	got := map[string]string{}
+	for _, ip := range []string{
+		"::ffff:203.0.113.10",
+		"::ffff:192.0.2.10",
+		"::ffff:198.51.100.1",
+		"::ffff:198.51.100.2",
+		"2001:db8:1::1",
+	} {
+		got[ip], _ = sm.Lookup(netip.MustParseAddr(ip))
+	}
+	expected := map[string]string{
+		"::ffff:203.0.113.10": "customer1",
+		"::ffff:192.0.2.10":   "customer2",
+		"::ffff:198.51.100.1": "customer3",
+		"::ffff:198.51.100.2": "",
+		"2001:db8:1::1":       "customer4",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("NewSubnetMap() (-got, +want):\n%s", diff)
+	}
+
+	for _, key := range []string{"192.0.2.1/38", "2001:db8::/1000", "kfgdjgkfj", "200.33.300.1"} {
+		if _, err := helpers.NewSubnetMap(map[string]string{
+			"192.0.2.0/24": "customer1",
+			key:            "customer2",
+		}); err == nil {
+			t.Errorf("NewSubnetMap(%q) did not error", key)
+		} else if !strings.Contains(err.Error(), key) {
+			t.Errorf("NewSubnetMap(%q) error does not mention the key:\n%+v", key, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustNewSubnetMap() did not panic")
+		}
+	}()
+	helpers.MustNewSubnetMap(map[string]string{"192.0.2.1/38": "customer1"})
+}
+
+func TestNewSubnetMapStrict(t *testing.T) {
+	sm, collisions, err := helpers.NewSubnetMapStrict([]helpers.SubnetEntry[string]{
+		{Prefix: "192.0.2.0/24", Value: "customer1"},
+		{Prefix: "2001:db8::/64", Value: "customer2"},
+		{Prefix: "::ffff:192.0.2.0/120", Value: "customer3"},
+		{Prefix: "2001:db8::/64", Value: "customer2"},
+	})
+	if err != nil {
+		t.Fatalf("NewSubnetMapStrict() error:\n%+v", err)
+	}
+	expectedCollisions := []helpers.Collision{
+		{Prefix: "192.0.2.0/24", Indexes: []int{0, 2}, Chosen: 2},
+	}
+	if diff := helpers.Diff(collisions, expectedCollisions); diff != "" {
+		t.Fatalf("NewSubnetMapStrict() collisions (-got, +want):\n%s", diff)
+	}
+	expected := map[string]string{
+		"192.0.2.0/24":  "customer3",
+		"2001:db8::/64": "customer2",
+	}
+	if diff := helpers.Diff(sm.ToMap(), expected); diff != "" {
+		t.Fatalf("NewSubnetMapStrict() (-got, +want):\n%s", diff)
+	}
+
+	if _, _, err := helpers.NewSubnetMapStrict([]helpers.SubnetEntry[string]{
+		{Prefix: "192.0.2.0/38", Value: "customer1"},
+	}); err == nil {
+		t.Fatal("NewSubnetMapStrict() did not return an error")
+	}
+}
+
+func TestNewSubnetMapStrictPriority(t *testing.T) {
+	// Two sources providing the same subnets
+	sm, _, err := helpers.NewSubnetMapStrict([]helpers.SubnetEntry[string]{
+		{Prefix: "192.0.2.0/24", Value: "ipam", Priority: 10},
+		{Prefix: "198.51.100.0/24", Value: "ipam", Priority: 10},
+		{Prefix: "192.0.2.0/24", Value: "peeringdb"},
+		{Prefix: "198.51.100.0/24", Value: "manual", Priority: 20},
+		{Prefix: "203.0.113.0/24", Value: "peeringdb"},
+	})
+	if err != nil {
+		t.Fatalf("NewSubnetMapStrict() error:\n%+v", err)
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected string
+	}{
+		{helpers.Mark(), "::ffff:192.0.2.10", "ipam"},
+		{helpers.Mark(), "::ffff:198.51.100.10", "manual"},
+		{helpers.Mark(), "::ffff:203.0.113.10", "peeringdb"},
+	}
+	for _, tc := range cases {
+		got, _ := sm.Lookup(netip.MustParseAddr(tc.IP))
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sLookup(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+	expected := []helpers.Collision{
+		{Prefix: "192.0.2.0/24", Indexes: []int{0, 2}, Chosen: 0},
+		{Prefix: "198.51.100.0/24", Indexes: []int{1, 3}, Chosen: 3},
+	}
+	if diff := helpers.Diff(sm.Ambiguities(), expected); diff != "" {
+		t.Errorf("Ambiguities() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestSubnetMapDisabledEntries(t *testing.T) {
+	var tree helpers.SubnetMap[string]
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:      &tree,
+		ErrorUnused: true,
+		Metadata:    nil,
+		DecodeHook:  helpers.SubnetMapUnmarshallerHook[string](),
+	})
+	if err != nil {
+		t.Fatalf("NewDecoder() error:\n%+v", err)
+	}
+	input := []gin.H{
+		{"prefix": "192.0.2.0/24", "value": "customer1", "enabled": false},
+		{"prefix": "192.0.0.0/16", "value": "customer2"},
+	}
+	if err := decoder.Decode(input); err != nil {
+		t.Fatalf("Decode() error:\n%+v", err)
+	}
+	lookup := func() string {
+		v, _ := tree.Lookup(netip.MustParseAddr("::ffff:192.0.2.10"))
+		return v
+	}
+	if diff := helpers.Diff(lookup(), "customer2"); diff != "" {
+		t.Fatalf("Lookup() (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(tree.ToDisabledMap(), map[string]string{
+		"192.0.2.0/24": "customer1",
+	}); diff != "" {
+		t.Fatalf("ToDisabledMap() (-got, +want):\n%s", diff)
+	}
+
+	// YAML should use the list form
+	buf, err := yaml.Marshal(tree)
+	if err != nil {
+		t.Fatalf("yaml.Marshal() error:\n%+v", err)
+	}
+	var got []gin.H
+	if err := yaml.Unmarshal(buf, &got); err != nil {
+		t.Fatalf("yaml.Unmarshal() error:\n%+v", err)
+	}
+	expected := []gin.H{
+		{"prefix": "192.0.0.0/16", "value": "customer2", "enabled": true},
+		{"prefix": "192.0.2.0/24", "value": "customer1", "enabled": false},
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("MarshalYAML() (-got, +want):\n%s", diff)
+	}
+
+	// Enable, then disable again
+	if ok, err := tree.Enable("192.0.2.0/24"); err != nil || !ok {
+		t.Fatalf("Enable() = %v, %v", ok, err)
+	}
+	if diff := helpers.Diff(lookup(), "customer1"); diff != "" {
+		t.Fatalf("Lookup() after Enable() (-got, +want):\n%s", diff)
+	}
+	if ok, err := tree.Disable("192.0.2.0/24"); err != nil || !ok {
+		t.Fatalf("Disable() = %v, %v", ok, err)
+	}
+	if diff := helpers.Diff(lookup(), "customer2"); diff != "" {
+		t.Fatalf("Lookup() after Disable() (-got, +want):\n%s", diff)
+	}
+	if ok, err := tree.Disable("198.51.100.0/24"); err != nil || ok {
+		t.Fatalf("Disable() = %v, %v", ok, err)
+	}
+}
+
+func TestLookupWithOrigin(t *testing.T) {
+	var tree helpers.SubnetMap[string]
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		Result:      &tree,
+		ErrorUnused: true,
+		Metadata:    nil,
+		DecodeHook:  helpers.SubnetMapUnmarshallerHook[string](),
+	})
+	if err != nil {
+		t.Fatalf("NewDecoder() error:\n%+v", err)
+	}
+	// Entries merged from two included files
+	input := []gin.H{
+		{"prefix": "192.0.0.0/16", "value": "customer1", "origin": "customers.yaml"},
+		{"prefix": "2001:db8::/32", "value": "customer2", "origin": "customers.yaml"},
+		{"prefix": "192.0.2.0/24", "value": "lab", "origin": "lab.yaml"},
+		{"prefix": "198.51.100.0/24", "value": "unknown"},
+	}
+	if err := decoder.Decode(input); err != nil {
+		t.Fatalf("Decode() error:\n%+v", err)
+	}
+
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected string
+		Origin   string
+		OK       bool
+	}{
+		{helpers.Mark(), "::ffff:192.0.1.10", "customer1", "customers.yaml", true},
+		{helpers.Mark(), "::ffff:192.0.2.10", "lab", "lab.yaml", true},
+		{helpers.Mark(), "2001:db8::1", "customer2", "customers.yaml", true},
+		{helpers.Mark(), "::ffff:198.51.100.1", "unknown", "", true},
+		{helpers.Mark(), "::ffff:203.0.113.1", "", "", false},
+		{helpers.Mark(), "192.0.2.10", "lab", "lab.yaml", true},
+		{helpers.Mark(), "203.0.113.1", "", "", false},
+	}
+	for _, tc := range cases {
+		value, origin, ok := tree.LookupWithOrigin(netip.MustParseAddr(tc.IP))
+		if diff := helpers.Diff([]any{value, origin, ok}, []any{tc.Expected, tc.Origin, tc.OK}); diff != "" {
+			t.Errorf("%sLookupWithOrigin(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+
+	// Replacing an entry drops its origin
+	tree.Set("192.0.2.0/24", "lab2")
+	if _, origin, _ := tree.LookupWithOrigin(netip.MustParseAddr("::ffff:192.0.2.10")); origin != "" {
+		t.Errorf("LookupWithOrigin() after Set() origin == %q, expected none", origin)
+	}
+	tree.SetWithOrigin("192.0.2.0/24", "lab3", "lab3.yaml")
+	if _, origin, _ := tree.LookupWithOrigin(netip.MustParseAddr("::ffff:192.0.2.10")); origin != "lab3.yaml" {
+		t.Errorf("LookupWithOrigin() after SetWithOrigin() origin == %q, expected %q", origin, "lab3.yaml")
+	}
+}
+
+func TestSubnetMapDefaultPolicy(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"::/0":                 "default6",
+		"::ffff:0.0.0.0/96":    "default4",
+		"::ffff:192.0.2.0/120": "customer1",
+	})
+	cases := []struct {
+		Pos      helpers.Pos
+		Policy   helpers.SubnetMapDefaultPolicy
+		IP       string
+		Expected string
+		OK       bool
+		Err      error
+	}{
+		{helpers.Mark(), helpers.SubnetMapDefaultMatch, "::ffff:192.0.2.10", "customer1", true, nil},
+		{helpers.Mark(), helpers.SubnetMapDefaultMatch, "::ffff:203.0.113.1", "default4", true, nil},
+		{helpers.Mark(), helpers.SubnetMapDefaultMatch, "2001:db8::1", "default6", true, nil},
+		{helpers.Mark(), helpers.SubnetMapDefaultMiss, "::ffff:192.0.2.10", "customer1", true, nil},
+		{helpers.Mark(), helpers.SubnetMapDefaultMiss, "::ffff:203.0.113.1", "", false, nil},
+		{helpers.Mark(), helpers.SubnetMapDefaultMiss, "2001:db8::1", "", false, nil},
+		{helpers.Mark(), helpers.SubnetMapDefaultError, "::ffff:192.0.2.10", "customer1", true, nil},
+		{helpers.Mark(), helpers.SubnetMapDefaultError, "::ffff:203.0.113.1", "", false, helpers.ErrSubnetMapDefaultRoute},
+		{helpers.Mark(), helpers.SubnetMapDefaultError, "2001:db8::1", "", false, helpers.ErrSubnetMapDefaultRoute},
+	}
+	for _, tc := range cases {
+		sm.SetDefaultPolicy(tc.Policy)
+		ip := netip.MustParseAddr(tc.IP)
+		got, ok := sm.Lookup(ip)
+		if diff := helpers.Diff([]any{got, ok}, []any{tc.Expected, tc.OK}); diff != "" {
+			t.Errorf("%sLookup(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+		got, ok, err := sm.LookupChecked(ip)
+		if diff := helpers.Diff([]any{got, ok}, []any{tc.Expected, tc.OK}); diff != "" {
+			t.Errorf("%sLookupChecked(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+		if !errors.Is(err, tc.Err) {
+			t.Errorf("%sLookupChecked(%s) error == %v, expected %v", tc.Pos, tc.IP, err, tc.Err)
+		}
+	}
+
+	// Without a default route, this is a regular miss
+	sm = helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "customer1",
+	})
+	sm.SetDefaultPolicy(helpers.SubnetMapDefaultError)
+	if _, ok, err := sm.LookupChecked(netip.MustParseAddr("::ffff:203.0.113.1")); ok || err != nil {
+		t.Errorf("LookupChecked() == %v, %v, expected a miss", ok, err)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	concat := func(existing, incoming string) string {
+		return fmt.Sprintf("%s+%s", existing, incoming)
+	}
+	cases := []struct {
+		Pos        helpers.Pos
+		Name       string
+		Existing   map[string]string
+		Incoming   map[string]string
+		OnConflict func(existing, incoming string) string
+		Expected   map[string]string
+	}{
+		{
+			Pos:        helpers.Mark(),
+			Name:       "identical prefixes",
+			Existing:   map[string]string{"192.0.2.0/24": "global"},
+			Incoming:   map[string]string{"192.0.2.0/24": "exporter"},
+			OnConflict: concat,
+			Expected:   map[string]string{"192.0.2.0/24": "global+exporter"},
+		}, {
+			Pos:      helpers.Mark(),
+			Name:     "identical prefixes without callback",
+			Existing: map[string]string{"192.0.2.0/24": "global"},
+			Incoming: map[string]string{"192.0.2.0/24": "exporter"},
+			Expected: map[string]string{"192.0.2.0/24": "exporter"},
+		}, {
+			Pos:        helpers.Mark(),
+			Name:       "disjoint prefixes",
+			Existing:   map[string]string{"192.0.2.0/24": "global"},
+			Incoming:   map[string]string{"2001:db8::/64": "exporter"},
+			OnConflict: concat,
+			Expected: map[string]string{
+				"192.0.2.0/24":  "global",
+				"2001:db8::/64": "exporter",
+			},
+		}, {
+			Pos:        helpers.Mark(),
+			Name:       "nested prefixes",
+			Existing:   map[string]string{"192.0.0.0/16": "global"},
+			Incoming:   map[string]string{"192.0.2.0/24": "exporter"},
+			OnConflict: concat,
+			Expected: map[string]string{
+				"192.0.0.0/16": "global",
+				"192.0.2.0/24": "exporter",
+			},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			sm := helpers.MustNewSubnetMap(tc.Existing)
+			if err := sm.Merge(helpers.MustNewSubnetMap(tc.Incoming), tc.OnConflict); err != nil {
+				t.Fatalf("%sMerge() error:\n%+v", tc.Pos, err)
+			}
+			if diff := helpers.Diff(sm.ToMap(), tc.Expected); diff != "" {
+				t.Fatalf("%sMerge() (-got, +want):\n%s", tc.Pos, diff)
+			}
+		})
+	}
+
+	// Longest prefix match is preserved
+	sm := helpers.MustNewSubnetMap(map[string]string{"192.0.0.0/16": "global"})
+	sm.Merge(helpers.MustNewSubnetMap(map[string]string{"192.0.2.0/24": "exporter"}), nil)
+	for ip, expected := range map[string]string{
+		"::ffff:192.0.2.10": "exporter",
+		"::ffff:192.0.3.10": "global",
+	} {
+		if got, _ := sm.Lookup(netip.MustParseAddr(ip)); got != expected {
+			t.Errorf("Lookup(%s) == %q, expected %q", ip, got, expected)
+		}
+	}
+
+	// Merging a nil map is a no-op
+	if err := sm.Merge(nil, concat); err != nil {
+		t.Fatalf("Merge(nil) error:\n%+v", err)
+	}
+	if got := len(sm.ToMap()); got != 2 {
+		t.Errorf("Merge(nil) changed the map, got %d entries", got)
+	}
+}
+
+func TestLookupEx(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"203.0.113.0/24":  "customer1",
+		"203.0.113.16/28": "customer2",
+		"2001:db8::/32":   "customer3",
+		"2001:db8:1::/48": "customer4",
+	})
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected string
+		Prefix   string
+		OK       bool
+	}{
+		{helpers.Mark(), "203.0.113.1", "customer1", "203.0.113.0/24", true},
+		{helpers.Mark(), "203.0.113.18", "customer2", "203.0.113.16/28", true},
+		{helpers.Mark(), "::ffff:203.0.113.18", "customer2", "203.0.113.16/28", true},
+		{helpers.Mark(), "2001:db8::1", "customer3", "2001:db8::/32", true},
+		{helpers.Mark(), "2001:db8:1::1", "customer4", "2001:db8:1::/48", true},
+		{helpers.Mark(), "198.51.100.1", "", "<nil>", false},
+	}
+	for _, tc := range cases {
+		value, prefix, ok := sm.LookupEx(net.ParseIP(tc.IP))
+		if diff := helpers.Diff([]any{value, prefix.String(), ok}, []any{tc.Expected, tc.Prefix, tc.OK}); diff != "" {
+			t.Errorf("%sLookupEx(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+	// An IPv4 network is returned for IPv4 subnets
+	_, prefix, _ := sm.LookupEx(net.ParseIP("203.0.113.1").To4())
+	if ones, bits := prefix.Mask.Size(); ones != 24 || bits != 32 || len(prefix.IP) != net.IPv4len {
+		t.Errorf("LookupEx() prefix == %#v, expected an IPv4 /24", prefix)
+	}
+}
+
+func TestSupernets(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"10.0.0.0/8":    "region",
+		"10.1.0.0/16":   "site",
+		"10.1.2.0/24":   "rack",
+		"10.1.3.0/24":   "other rack",
+		"10.2.0.0/16":   "other site",
+		"2001:db8::/32": "customer1",
+	})
+	cases := []struct {
+		Pos      helpers.Pos
+		IP       string
+		Expected []string
+	}{
+		{helpers.Mark(), "10.1.2.3", []string{"10.0.0.0/8 region", "10.1.0.0/16 site", "10.1.2.0/24 rack"}},
+		{helpers.Mark(), "::ffff:10.1.2.3", []string{"10.0.0.0/8 region", "10.1.0.0/16 site", "10.1.2.0/24 rack"}},
+		{helpers.Mark(), "10.1.4.1", []string{"10.0.0.0/8 region", "10.1.0.0/16 site"}},
+		{helpers.Mark(), "10.2.3.1", []string{"10.0.0.0/8 region", "10.2.0.0/16 other site"}},
+		{helpers.Mark(), "10.3.3.1", []string{"10.0.0.0/8 region"}},
+		{helpers.Mark(), "2001:db8::1", []string{"2001:db8::/32 customer1"}},
+		{helpers.Mark(), "192.0.2.1", []string{}},
+	}
+	for _, tc := range cases {
+		got := []string{}
+		for _, entry := range sm.Supernets(net.ParseIP(tc.IP)) {
+			got = append(got, fmt.Sprintf("%s %s", entry.Prefix.String(), entry.Value))
+		}
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sSupernets(%s) (-got, +want):\n%s", tc.Pos, tc.IP, diff)
+		}
+	}
+}
+
+func TestDeletePrefix(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"10.0.0.0/8":      "region",
+		"10.1.0.0/16":     "site",
+		"10.1.2.0/24":     "rack",
+		"2001:db8::/32":   "customer1",
+		"2001:db8:1::/48": "customer2",
+	})
+	mustParse := func(prefix string) net.IPNet {
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			t.Fatalf("ParseCIDR(%q) error:\n%+v", prefix, err)
+		}
+		return *ipNet
+	}
+	lookup := func(ip string) string {
+		value, _ := sm.Lookup(netip.MustParseAddr(ip))
+		return value
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		Prefix   string
+		Deleted  bool
+		Expected map[string]string
+	}{
+		{helpers.Mark(), "10.1.2.0/24", true, map[string]string{
+			"::ffff:10.1.2.1": "site",
+			"::ffff:10.1.3.1": "site",
+			"::ffff:10.2.0.1": "region",
+		}},
+		{helpers.Mark(), "10.1.2.0/24", false, map[string]string{
+			"::ffff:10.1.2.1": "site",
+		}},
+		{helpers.Mark(), "10.3.0.0/16", false, map[string]string{
+			"::ffff:10.3.0.1": "region",
+		}},
+		{helpers.Mark(), "::ffff:10.1.0.0/112", true, map[string]string{
+			"::ffff:10.1.2.1": "region",
+		}},
+		{helpers.Mark(), "2001:db8::/32", true, map[string]string{
+			"2001:db8::1":   "",
+			"2001:db8:1::1": "customer2",
+		}},
+		{helpers.Mark(), "2001:db8:1::/48", true, map[string]string{
+			"2001:db8:1::1": "",
+		}},
+	}
+	for _, tc := range cases {
+		if deleted := sm.DeletePrefix(mustParse(tc.Prefix)); deleted != tc.Deleted {
+			t.Errorf("%sDeletePrefix(%s) == %v, expected %v", tc.Pos, tc.Prefix, deleted, tc.Deleted)
+		}
+		got := map[string]string{}
+		for ip := range tc.Expected {
+			got[ip] = lookup(ip)
+		}
+		if diff := helpers.Diff(got, tc.Expected); diff != "" {
+			t.Errorf("%sDeletePrefix(%s) lookups (-got, +want):\n%s", tc.Pos, tc.Prefix, diff)
+		}
+	}
+	if diff := helpers.Diff(sm.ToMap(), map[string]string{"10.0.0.0/8": "region"}); diff != "" {
+		t.Errorf("ToMap() (-got, +want):\n%s", diff)
+	}
+
+	var empty helpers.SubnetMap[string]
+	if empty.DeletePrefix(mustParse("10.0.0.0/8")) {
+		t.Error("DeletePrefix() on an empty SubnetMap returned true")
+	}
+	if sm.DeletePrefix(net.IPNet{}) {
+		t.Error("DeletePrefix() with an invalid subnet returned true")
+	}
+}
+
+func TestSubnetMapClone(t *testing.T) {
+	sm := helpers.MustNewSubnetMap(map[string]string{
+		"10.0.0.0/8":    "region",
+		"10.1.0.0/16":   "site",
+		"2001:db8::/32": "customer1",
+	})
+	if err := sm.SetDisabled("192.0.2.0/24", "disabled"); err != nil {
+		t.Fatalf("SetDisabled() error:\n%+v", err)
+	}
+	original := sm.ToMap()
+	originalDisabled := sm.ToDisabledMap()
+
+	clone := sm.Clone()
+	if diff := helpers.Diff(clone.ToMap(), original); diff != "" {
+		t.Fatalf("Clone() (-got, +want):\n%s", diff)
+	}
+	if err := clone.Set("10.2.0.0/16", "other site"); err != nil {
+		t.Fatalf("Set() error:\n%+v", err)
+	}
+	if err := clone.Set("10.0.0.0/8", "other region"); err != nil {
+		t.Fatalf("Set() error:\n%+v", err)
+	}
+	if _, err := clone.Delete("2001:db8::/32"); err != nil {
+		t.Fatalf("Delete() error:\n%+v", err)
+	}
+	if _, err := clone.Enable("192.0.2.0/24"); err != nil {
+		t.Fatalf("Enable() error:\n%+v", err)
+	}
+	if diff := helpers.Diff(clone.ToMap(), map[string]string{
+		"10.0.0.0/8":   "other region",
+		"10.1.0.0/16":  "site",
+		"10.2.0.0/16":  "other site",
+		"192.0.2.0/24": "disabled",
+	}); diff != "" {
+		t.Errorf("clone.ToMap() (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(sm.ToMap(), original); diff != "" {
+		t.Errorf("ToMap() after modifying clone (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(sm.ToDisabledMap(), originalDisabled); diff != "" {
+		t.Errorf("ToDisabledMap() after modifying clone (-got, +want):\n%s", diff)
+	}
+	if got, _ := sm.Lookup(netip.MustParseAddr("::ffff:10.2.0.1")); got != "region" {
+		t.Errorf("Lookup() after modifying clone == %q, expected %q", got, "region")
+	}
+
+	// Clone of a nil SubnetMap is usable
+	var nilMap *helpers.SubnetMap[string]
+	empty := nilMap.Clone()
+	if err := empty.Set("10.0.0.0/8", "region"); err != nil {
+		t.Fatalf("Set() error:\n%+v", err)
+	}
+	if got, _ := empty.Lookup(netip.MustParseAddr("::ffff:10.0.0.1")); got != "region" {
+		t.Errorf("Lookup() on clone of nil == %q, expected %q", got, "region")
+	}
+}
+
+func TestSubnetMapJSON(t *testing.T) {
+	cases := []struct {
+		Pos      helpers.Pos
+		Input    string
+		Tests    map[string]string
+		Expected string
+		Error    bool
+	}{
+		{
+			Pos:      helpers.Mark(),
+			Input:    `{}`,
+			Expected: `{}`,
+		}, {
+			Pos:   helpers.Mark(),
+			Input: `{"203.0.113.0/24": "customer1", "2001:db8:1::/64": "customer2"}`,
+			Tests: map[string]string{
+				"::ffff:203.0.113.10": "customer1",
+				"2001:db8:1::1":       "customer2",
+				"2001:db8:2::1":       "",
+			},
+			Expected: `{"2001:db8:1::/64":"customer2","203.0.113.0/24":"customer1"}`,
+		}, {
+			Pos:   helpers.Mark(),
+			Input: `{"::ffff:192.0.2.0/120": "customer1"}`,
+			Tests: map[string]string{
+				"::ffff:192.0.2.10": "customer1",
+			},
+			Expected: `{"192.0.2.0/24":"customer1"}`,
+		}, {
+			Pos:   helpers.Mark(),
+			Input: `"customer"`,
+			Tests: map[string]string{
+				"::ffff:192.0.2.10": "customer",
+				"2001:db8:1::1":     "customer",
+			},
+			Expected: `{"::/0":"customer"}`,
+		}, {
+			Pos: helpers.Mark(),
+			Input: `[
+  {"prefix": "192.0.2.0/24", "value": "customer1", "enabled": false},
+  {"prefix": "192.0.0.0/16", "value": "customer2"}
+]`,
+			Tests: map[string]string{
+				"::ffff:192.0.2.10": "customer2",
+			},
+			Expected: `[{"enabled":true,"prefix":"192.0.0.0/16","value":"customer2"},{"enabled":false,"prefix":"192.0.2.0/24","value":"customer1"}]`,
+		}, {
+			Pos:   helpers.Mark(),
+			Input: `{"192.0.2.1/38": "customer"}`,
+			Error: true,
+		}, {
+			Pos:   helpers.Mark(),
+			Input: `{"192.0.2.1/255.0.255.0": "customer"}`,
+			Error: true,
+		}, {
+			Pos:   helpers.Mark(),
+			Input: `{"2001:db8::/1000": "customer"}`,
+			Error: true,
+		}, {
+			Pos:   helpers.Mark(),
+			Input: `{"192.0.2.0/24": `,
+			Error: true,
+		},
+	}
+	for _, tc := range cases {
+		var sm helpers.SubnetMap[string]
+		err := json.Unmarshal([]byte(tc.Input), &sm)
+		if err != nil && !tc.Error {
+			t.Errorf("%sjson.Unmarshal() error:\n%+v", tc.Pos, err)
+			continue
+		} else if err == nil && tc.Error {
+			t.Errorf("%sjson.Unmarshal() did not error", tc.Pos)
+			continue
+		} else if tc.Error {
+			continue
+		}
+		got := map[string]string{}
+		for k := range tc.Tests {
+			got[k], _ = sm.Lookup(netip.MustParseAddr(k))
+		}
+		if diff := helpers.Diff(got, tc.Tests); tc.Tests != nil && diff != "" {
+			t.Errorf("%sjson.Unmarshal() (-got, +want):\n%s", tc.Pos, diff)
+		}
+		output, err := json.Marshal(sm)
+		if err != nil {
+			t.Errorf("%sjson.Marshal() error:\n%+v", tc.Pos, err)
+			continue
+		}
+		if diff := helpers.Diff(string(output), tc.Expected); diff != "" {
+			t.Errorf("%sjson.Marshal() (-got, +want):\n%s", tc.Pos, diff)
+		}
+	}
+
+	// Within a structure
+	type someStruct struct {
+		Customers *helpers.SubnetMap[string]
+	}
+	var got someStruct
+	if err := json.Unmarshal([]byte(`{"Customers": {"192.0.2.0/24": "customer1"}}`), &got); err != nil {
+		t.Fatalf("json.Unmarshal() error:\n%+v", err)
+	}
+	output, err := json.Marshal(got)
+	if err != nil {
+		t.Fatalf("json.Marshal() error:\n%+v", err)
+	}
+	if diff := helpers.Diff(string(output), `{"Customers":{"192.0.2.0/24":"customer1"}}`); diff != "" {
+		t.Fatalf("json.Marshal() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestIterSorted(t *testing.T) {
+	from := map[string]string{
+		"2001:db8:1::/64":        "customer1",
+		"2001:db8::/32":          "customer2",
+		"::ffff:192.0.2.0/120":   "customer3",
+		"::ffff:192.0.2.128/121": "customer4",
+		"::ffff:192.0.0.0/112":   "customer5",
+		"::/0":                   "customer6",
+	}
+	expected := []string{
+		"::/0=customer6",
+		"192.0.0.0/16=customer5",
+		"192.0.2.0/24=customer3",
+		"192.0.2.128/25=customer4",
+		"2001:db8::/32=customer2",
+		"2001:db8:1::/64=customer1",
+	}
+	for range 10 {
+		sm := helpers.MustNewSubnetMap(from)
+		got := []string{}
+		sm.IterSorted(func(prefix net.IPNet, value string) bool {
+			got = append(got, fmt.Sprintf("%s=%s", prefix.String(), value))
+			return true
+		})
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Fatalf("IterSorted() (-got, +want):\n%s", diff)
+		}
+	}
+
+	// Stop early
+	got := []string{}
+	helpers.MustNewSubnetMap(from).IterSorted(func(prefix net.IPNet, value string) bool {
+		got = append(got, value)
+		return len(got) < 2
+	})
+	if diff := helpers.Diff(got, []string{"customer6", "customer5"}); diff != "" {
+		t.Fatalf("IterSorted() (-got, +want):\n%s", diff)
+	}
+
+	// Empty map
+	var empty *helpers.SubnetMap[string]
+	empty.IterSorted(func(net.IPNet, string) bool {
+		t.Fatal("IterSorted() called f on an empty map")
+		return false
+	})
+}
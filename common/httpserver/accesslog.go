@@ -0,0 +1,75 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+// AccessLogConfiguration defines the logging of HTTP requests.
+type AccessLogConfiguration struct {
+	// Enable says if requests should be logged
+	Enable bool
+	// Fields is the list of fields to include in each entry
+	Fields []string `validate:"dive,oneof=method path status duration bytes remote-address user-agent"`
+	// SkipPaths is a list of path patterns for requests not to be logged
+	SkipPaths []string
+}
+
+// DefaultAccessLogConfiguration returns the default access log configuration.
+func DefaultAccessLogConfiguration() AccessLogConfiguration {
+	return AccessLogConfiguration{
+		Enable: true,
+		Fields: []string{
+			"method", "path", "status", "duration",
+			"bytes", "remote-address", "user-agent",
+		},
+		SkipPaths: []string{
+			"/healthz",
+			"/readyz",
+			"/api/v0/healthcheck",
+			"/api/v0/*/healthcheck",
+		},
+	}
+}
+
+// accessLogHandler logs one entry for each request served by the provided
+// handler, with the configured fields.
+func (c *Component) accessLogHandler(handler http.Handler) http.Handler {
+	config := c.config.AccessLog
+	if !config.Enable {
+		return handler
+	}
+	return hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
+		for _, pattern := range config.SkipPaths {
+			if ok, _ := path.Match(pattern, r.URL.Path); ok {
+				return
+			}
+		}
+		event := hlog.FromRequest(r).Info()
+		for _, field := range config.Fields {
+			switch field {
+			case "method":
+				event = event.Str("method", r.Method)
+			case "path":
+				event = event.Str("path", r.URL.Path)
+			case "status":
+				event = event.Int("status", status)
+			case "duration":
+				event = event.Dur("duration", duration)
+			case "bytes":
+				event = event.Int("bytes", size)
+			case "remote-address":
+				event = event.Str("remote-address", r.RemoteAddr)
+			case "user-agent":
+				event = event.Str("user-agent", r.UserAgent())
+			}
+		}
+		event.Msg("HTTP request")
+	})(handler)
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+func TestAccessLog(t *testing.T) {
+	cases := []struct {
+		Description string
+		Config      func(*AccessLogConfiguration)
+		URL         string
+		Expected    []gin.H
+	}{
+		{
+			Description: "default fields",
+			Config:      func(*AccessLogConfiguration) {},
+			URL:         "/test?query=1",
+			Expected: []gin.H{
+				{
+					"level":          "info",
+					"handler":        "/test",
+					"method":         "GET",
+					"path":           "/test",
+					"status":         200.,
+					"duration":       "<duration>",
+					"bytes":          7.,
+					"remote-address": "192.0.2.1:1234",
+					"user-agent":     "akvorado-test/1.0",
+					"message":        "HTTP request",
+				},
+			},
+		}, {
+			Description: "selected fields",
+			Config: func(config *AccessLogConfiguration) {
+				config.Fields = []string{"path", "status"}
+			},
+			URL: "/test",
+			Expected: []gin.H{
+				{
+					"level":   "info",
+					"handler": "/test",
+					"path":    "/test",
+					"status":  200.,
+					"message": "HTTP request",
+				},
+			},
+		}, {
+			Description: "skipped path",
+			Config:      func(*AccessLogConfiguration) {},
+			URL:         "/healthz",
+			Expected:    []gin.H{},
+		}, {
+			Description: "disabled",
+			Config: func(config *AccessLogConfiguration) {
+				config.Enable = false
+			},
+			URL:      "/test",
+			Expected: []gin.H{},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Description, func(t *testing.T) {
+			var output bytes.Buffer
+			r := reporter.NewMock(t)
+			r.Logger.Logger = zerolog.New(&output)
+			config := DefaultConfiguration()
+			tc.Config(&config.AccessLog)
+			if err := helpers.Validate.Struct(config); err != nil {
+				t.Fatalf("validate.Struct() error:\n%+v", err)
+			}
+			c, err := New(r, config, Dependencies{Daemon: daemon.NewMock(t)})
+			if err != nil {
+				t.Fatalf("New() error:\n%+v", err)
+			}
+			c.AddHandler("/test",
+				http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+					fmt.Fprintf(w, "Hello !")
+				}))
+
+			req := httptest.NewRequest("GET", tc.URL, nil)
+			req.Header.Set("User-Agent", "akvorado-test/1.0")
+			c.mux.ServeHTTP(httptest.NewRecorder(), req)
+
+			got := []gin.H{}
+			for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+				if line == "" {
+					continue
+				}
+				var entry gin.H
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatalf("Unmarshal(%q) error:\n%+v", line, err)
+				}
+				if _, ok := entry["duration"]; ok {
+					entry["duration"] = "<duration>"
+				}
+				got = append(got, entry)
+			}
+			if diff := helpers.Diff(got, tc.Expected); diff != "" {
+				t.Fatalf("access log (-got, +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfiguration defines the compression of HTTP responses.
+type CompressionConfiguration struct {
+	// Enable says if responses should be compressed when the client accepts it
+	Enable bool
+	// MinSize is the minimum size of a response to be compressed
+	MinSize int `validate:"min=0"`
+}
+
+// supportedEncodings is the list of supported encodings, in order of
+// preference.
+var supportedEncodings = []string{"zstd", "gzip"}
+
+// incompressibleContentTypes are content types already compressed.
+var incompressibleContentTypes = []string{
+	"application/gzip",
+	"application/x-gzip",
+	"application/zip",
+	"application/zstd",
+	"application/x-xz",
+	"application/x-bzip2",
+	"application/vnd.google.protobuf",
+	"audio/",
+	"font/woff",
+	"image/",
+	"video/",
+}
+
+var (
+	gzipPool = sync.Pool{
+		New: func() any { return gzip.NewWriter(nil) },
+	}
+	zstdPool = sync.Pool{
+		New: func() any {
+			encoder, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+			return encoder
+		},
+	}
+)
+
+// negotiateEncoding returns the preferred encoding accepted by the client, or
+// an empty string if none is acceptable.
+func negotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.
+		if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+			if q, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+				quality = q
+			}
+		}
+		accepted[name] = quality > 0
+	}
+	for _, encoding := range supportedEncodings {
+		if ok, found := accepted[encoding]; found {
+			if ok {
+				return encoding
+			}
+			continue
+		}
+		if accepted["*"] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// compressible tells if a response with the provided headers can be
+// compressed.
+func compressible(header http.Header) bool {
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	for _, prefix := range incompressibleContentTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return contentType == "image/svg+xml"
+		}
+	}
+	return true
+}
+
+// compressionHandler compresses responses from the provided handler when the
+// client accepts it and the response is large enough.
+func (c *Component) compressionHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        c.config.Compression.MinSize,
+		}
+		defer cw.close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter buffers the beginning of a response until it is known to be
+// large enough to be compressed. Then, the remaining of the response is
+// streamed through the encoder.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status  int
+	buf     []byte
+	started bool
+	encoder io.WriteCloser
+}
+
+// WriteHeader records the status code. Headers are sent once we know if the
+// response is compressed.
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.started || cw.status != 0 {
+		return
+	}
+	if code >= 100 && code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.status = code
+	if code == http.StatusNoContent || code == http.StatusNotModified {
+		cw.start(false)
+	}
+}
+
+// Write buffers data until the compression threshold is reached.
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.started && !compressible(cw.Header()) {
+		cw.start(false)
+	}
+	if cw.started {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends buffered data to the client. A response flushed before reaching
+// the threshold is not compressed.
+func (cw *compressWriter) Flush() {
+	if !cw.started {
+		cw.start(false)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the original writer for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// start sends the headers and the buffered data, compressed or not.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+	header := cw.Header()
+	if compress && len(cw.buf) > 0 {
+		if header.Get("Content-Type") == "" {
+			// Sniff now, the server would sniff the compressed data
+			header.Set("Content-Type", http.DetectContentType(cw.buf))
+		}
+		compress = compressible(header)
+	} else {
+		compress = false
+	}
+	if compress {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		switch cw.encoding {
+		case "zstd":
+			encoder := zstdPool.Get().(*zstd.Encoder)
+			encoder.Reset(cw.ResponseWriter)
+			cw.encoder = encoder
+		case "gzip":
+			encoder := gzipPool.Get().(*gzip.Writer)
+			encoder.Reset(cw.ResponseWriter)
+			cw.encoder = encoder
+		}
+	}
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close flushes the remaining data and releases the encoder.
+func (cw *compressWriter) close() {
+	if !cw.started {
+		if len(cw.buf) > 0 && cw.Header().Get("Content-Length") == "" {
+			cw.Header().Set("Content-Length", strconv.Itoa(len(cw.buf)))
+		}
+		cw.start(false)
+	}
+	switch encoder := cw.encoder.(type) {
+	case *zstd.Encoder:
+		encoder.Close()
+		encoder.Reset(nil)
+		zstdPool.Put(encoder)
+	case *gzip.Writer:
+		encoder.Close()
+		encoder.Reset(nil)
+		gzipPool.Put(encoder)
+	}
+	cw.encoder = nil
+}
@@ -0,0 +1,141 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		AcceptEncoding string
+		Expected       string
+	}{
+		{"", ""},
+		{"identity", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "gzip"},
+		{"gzip, deflate, br, zstd", "zstd"},
+		{"zstd;q=0, gzip;q=0.5", "gzip"},
+		{"GZIP", "gzip"},
+		{"*", "zstd"},
+		{"*, zstd;q=0", "gzip"},
+		{"gzip;q=0", ""},
+	}
+	for _, tc := range cases {
+		if got := negotiateEncoding(tc.AcceptEncoding); got != tc.Expected {
+			t.Errorf("negotiateEncoding(%q) == %q, expected %q", tc.AcceptEncoding, got, tc.Expected)
+		}
+	}
+}
+
+func TestCompression(t *testing.T) {
+	r := reporter.NewMock(t)
+	config := DefaultConfiguration()
+	config.Listen = "127.0.0.1:0"
+	config.Compression = CompressionConfiguration{
+		Enable:  true,
+		MinSize: 1000,
+	}
+	c, err := New(r, config, Dependencies{Daemon: daemon.NewMock(t)})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	large := make([]string, 1000)
+	for i := range large {
+		large[i] = fmt.Sprintf("item %d", i)
+	}
+	largeJSON, _ := json.Marshal(large)
+	smallJSON, _ := json.Marshal([]string{"item 1"})
+	c.AddHandler("/large", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		// Write in several chunks
+		for i := 0; i < len(largeJSON); i += 100 {
+			w.Write(largeJSON[i:min(i+100, len(largeJSON))])
+		}
+	}))
+	c.AddHandler("/small", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(smallJSON)
+	}))
+	c.AddHandler("/image", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(largeJSON)
+	}))
+	helpers.StartStop(t, c)
+
+	cases := []struct {
+		URL                     string
+		AcceptEncoding          string
+		ExpectedContentEncoding string
+		ExpectedBody            []byte
+	}{
+		{"/large", "gzip", "gzip", largeJSON},
+		{"/large", "gzip, zstd", "zstd", largeJSON},
+		{"/large", "", "", largeJSON},
+		{"/small", "gzip", "", smallJSON},
+		{"/image", "gzip", "", largeJSON},
+	}
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	for _, tc := range cases {
+		t.Run(fmt.Sprintf("%s %s", tc.URL, tc.AcceptEncoding), func(t *testing.T) {
+			req, _ := http.NewRequest("GET", fmt.Sprintf("http://%s%s", c.LocalAddr(), tc.URL), nil)
+			if tc.AcceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tc.AcceptEncoding)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("GET %s error:\n%+v", tc.URL, err)
+			}
+			defer resp.Body.Close()
+			if got := resp.Header.Get("Content-Encoding"); got != tc.ExpectedContentEncoding {
+				t.Fatalf("GET %s Content-Encoding == %q, expected %q", tc.URL, got, tc.ExpectedContentEncoding)
+			}
+			if got := resp.Header.Get("Vary"); !strings.Contains(got, "Accept-Encoding") {
+				t.Errorf("GET %s Vary == %q, expected Accept-Encoding", tc.URL, got)
+			}
+			var body io.Reader = resp.Body
+			switch tc.ExpectedContentEncoding {
+			case "gzip":
+				gzipReader, err := gzip.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader() error:\n%+v", err)
+				}
+				body = gzipReader
+			case "zstd":
+				zstdReader, err := zstd.NewReader(resp.Body)
+				if err != nil {
+					t.Fatalf("zstd.NewReader() error:\n%+v", err)
+				}
+				defer zstdReader.Close()
+				body = zstdReader
+			case "":
+				// Small responses are sent with their length
+				if tc.URL == "/small" && resp.ContentLength != int64(len(tc.ExpectedBody)) {
+					t.Errorf("GET %s Content-Length == %d, expected %d",
+						tc.URL, resp.ContentLength, len(tc.ExpectedBody))
+				}
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatalf("ReadAll() error:\n%+v", err)
+			}
+			if diff := helpers.Diff(string(got), string(tc.ExpectedBody)); diff != "" {
+				t.Fatalf("GET %s (-got, +want):\n%s", tc.URL, diff)
+			}
+		})
+	}
+}
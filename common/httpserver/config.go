@@ -21,8 +21,24 @@ type Configuration struct {
 	Listen string `validate:"required,listen"`
 	// Profiler enables Go profiler as /debug
 	Profiler bool
+	// ProfilerAllowedNetworks tells which networks are allowed to access the
+	// profiler
+	ProfilerAllowedNetworks *helpers.SubnetMap[bool]
+	// DrainTimeout is how long to wait for in-flight requests to complete
+	// when shutting down before closing their connections.
+	DrainTimeout time.Duration `validate:"min=0"`
 	// Cache configuration
 	Cache CacheConfiguration
+	// TLS configuration
+	TLS TLSConfiguration
+	// Compression configuration
+	Compression CompressionConfiguration
+	// CORS configuration
+	CORS CORSConfiguration
+	// RateLimit configuration
+	RateLimit RateLimitConfiguration
+	// AccessLog configuration
+	AccessLog AccessLogConfiguration
 }
 
 // CacheConfiguration describes the configuration of the internal HTTP cache.
@@ -97,9 +113,20 @@ func DefaultConfiguration() Configuration {
 	return Configuration{
 		Listen:   ":8080",
 		Profiler: true,
+		ProfilerAllowedNetworks: helpers.MustNewSubnetMap(map[string]bool{
+			"::1/128":              true,
+			"::ffff:127.0.0.0/104": true,
+		}),
+		DrainTimeout: 5 * time.Second,
 		Cache: CacheConfiguration{
 			Config: DefaultMemoryCacheConfiguration(),
 		},
+		Compression: CompressionConfiguration{
+			MinSize: 1024,
+		},
+		CORS:      DefaultCORSConfiguration(),
+		RateLimit: DefaultRateLimitConfiguration(),
+		AccessLog: DefaultAccessLogConfiguration(),
 	}
 }
 
@@ -116,4 +143,5 @@ var cacheConfigurationMap = map[string](func() CacheBackendConfiguration){
 func init() {
 	helpers.RegisterMapstructureUnmarshallerHook(
 		helpers.ParametrizedConfigurationUnmarshallerHook(CacheConfiguration{}, cacheConfigurationMap))
+	helpers.RegisterMapstructureUnmarshallerHook(helpers.SubnetMapUnmarshallerHook[bool]())
 }
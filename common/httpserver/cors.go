@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CORSConfiguration defines the cross-origin resource sharing policy of the
+// HTTP server.
+type CORSConfiguration struct {
+	// AllowedOrigins is the list of origins allowed to make cross-origin
+	// requests. "*" allows any origin. When empty, no CORS headers are sent.
+	AllowedOrigins []string `validate:"dive,required"`
+	// AllowedMethods is the list of methods allowed for cross-origin requests
+	AllowedMethods []string `validate:"dive,required"`
+	// AllowedHeaders is the list of headers clients are allowed to send
+	AllowedHeaders []string `validate:"dive,required"`
+	// AllowCredentials allows clients to send credentials (cookies, HTTP
+	// authentication). It cannot be used with a wildcard origin.
+	AllowCredentials bool
+	// MaxAge tells how long preflight results can be cached by clients
+	MaxAge time.Duration `validate:"min=0"`
+}
+
+// DefaultCORSConfiguration returns the default CORS configuration. It is
+// disabled as there is no allowed origin.
+func DefaultCORSConfiguration() CORSConfiguration {
+	return CORSConfiguration{
+		AllowedMethods: []string{"GET", "HEAD", "POST"},
+		AllowedHeaders: []string{"Content-Type"},
+	}
+}
+
+// allowOrigin returns the value for the Access-Control-Allow-Origin header,
+// or an empty string if the origin is not allowed.
+func (config CORSConfiguration) allowOrigin(origin string) string {
+	for _, allowed := range config.AllowedOrigins {
+		if allowed == "*" {
+			return "*"
+		}
+		if strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// allowHeaders tells if all the headers requested in a preflight request are
+// allowed.
+func (config CORSConfiguration) allowHeaders(requested string) bool {
+	for _, header := range strings.Split(requested, ",") {
+		header = strings.TrimSpace(header)
+		if header == "" {
+			continue
+		}
+		if !slices.ContainsFunc(config.AllowedHeaders, func(allowed string) bool {
+			return strings.EqualFold(allowed, header)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// corsHandler adds CORS headers to responses for allowed origins and answers
+// preflight requests.
+func (c *Component) corsHandler(next http.Handler) http.Handler {
+	config := c.config.CORS
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions &&
+			r.Header.Get("Access-Control-Request-Method") != ""
+		header := w.Header()
+		header.Add("Vary", "Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		allowOrigin := config.allowOrigin(origin)
+
+		if preflight {
+			header.Add("Vary", "Access-Control-Request-Method")
+			header.Add("Vary", "Access-Control-Request-Headers")
+			if allowOrigin == "" ||
+				!slices.Contains(config.AllowedMethods, r.Header.Get("Access-Control-Request-Method")) ||
+				!config.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			header.Set("Access-Control-Allow-Origin", allowOrigin)
+			header.Set("Access-Control-Allow-Methods", strings.Join(config.AllowedMethods, ", "))
+			if len(config.AllowedHeaders) > 0 {
+				header.Set("Access-Control-Allow-Headers", strings.Join(config.AllowedHeaders, ", "))
+			}
+			if config.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+			if config.MaxAge > 0 {
+				header.Set("Access-Control-Max-Age", strconv.Itoa(int(config.MaxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowOrigin != "" {
+			header.Set("Access-Control-Allow-Origin", allowOrigin)
+			if config.AllowCredentials {
+				header.Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
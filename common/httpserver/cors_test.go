@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+)
+
+func TestCORS(t *testing.T) {
+	start := func(t *testing.T, corsConfig CORSConfiguration) *Component {
+		t.Helper()
+		r := reporter.NewMock(t)
+		config := DefaultConfiguration()
+		config.Listen = "127.0.0.1:0"
+		config.CORS = corsConfig
+		c, err := New(r, config, Dependencies{Daemon: daemon.NewMock(t)})
+		if err != nil {
+			t.Fatalf("New() error:\n%+v", err)
+		}
+		c.AddHandler("/test",
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprintf(w, "Hello !")
+			}))
+		helpers.StartStop(t, c)
+		return c
+	}
+	corsHeaders := []string{
+		"Access-Control-Allow-Origin",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Allow-Credentials",
+		"Access-Control-Max-Age",
+	}
+	type testCase struct {
+		Description     string
+		Method          string
+		Header          map[string]string
+		ExpectedStatus  int
+		ExpectedHeaders map[string]string
+	}
+	run := func(t *testing.T, c *Component, cases []testCase) {
+		t.Helper()
+		for _, tc := range cases {
+			t.Run(tc.Description, func(t *testing.T) {
+				req, _ := http.NewRequest(tc.Method, fmt.Sprintf("http://%s/test", c.LocalAddr()), nil)
+				for key, value := range tc.Header {
+					req.Header.Set(key, value)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatalf("%s /test error:\n%+v", tc.Method, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.ExpectedStatus {
+					t.Errorf("%s /test status == %d, expected %d", tc.Method, resp.StatusCode, tc.ExpectedStatus)
+				}
+				got := map[string]string{}
+				for _, header := range corsHeaders {
+					if value := resp.Header.Get(header); value != "" {
+						got[header] = value
+					}
+				}
+				if diff := helpers.Diff(got, tc.ExpectedHeaders); diff != "" {
+					t.Errorf("%s /test headers (-got, +want):\n%s", tc.Method, diff)
+				}
+			})
+		}
+	}
+
+	t.Run("origins", func(t *testing.T) {
+		config := DefaultCORSConfiguration()
+		config.AllowedOrigins = []string{"https://console.example.com"}
+		config.AllowCredentials = true
+		config.MaxAge = time.Hour
+		c := start(t, config)
+		run(t, c, []testCase{
+			{
+				Description: "preflight with allowed origin",
+				Method:      "OPTIONS",
+				Header: map[string]string{
+					"Origin":                         "https://console.example.com",
+					"Access-Control-Request-Method":  "POST",
+					"Access-Control-Request-Headers": "content-type",
+				},
+				ExpectedStatus: 204,
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin":      "https://console.example.com",
+					"Access-Control-Allow-Methods":     "GET, HEAD, POST",
+					"Access-Control-Allow-Headers":     "Content-Type",
+					"Access-Control-Allow-Credentials": "true",
+					"Access-Control-Max-Age":           "3600",
+				},
+			}, {
+				Description: "preflight with disallowed origin",
+				Method:      "OPTIONS",
+				Header: map[string]string{
+					"Origin":                        "https://evil.example.com",
+					"Access-Control-Request-Method": "GET",
+				},
+				ExpectedStatus:  403,
+				ExpectedHeaders: map[string]string{},
+			}, {
+				Description: "preflight with disallowed method",
+				Method:      "OPTIONS",
+				Header: map[string]string{
+					"Origin":                        "https://console.example.com",
+					"Access-Control-Request-Method": "DELETE",
+				},
+				ExpectedStatus:  403,
+				ExpectedHeaders: map[string]string{},
+			}, {
+				Description: "GET with allowed origin",
+				Method:      "GET",
+				Header: map[string]string{
+					"Origin": "https://console.example.com",
+				},
+				ExpectedStatus: 200,
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin":      "https://console.example.com",
+					"Access-Control-Allow-Credentials": "true",
+				},
+			}, {
+				Description: "GET with disallowed origin",
+				Method:      "GET",
+				Header: map[string]string{
+					"Origin": "https://evil.example.com",
+				},
+				ExpectedStatus:  200,
+				ExpectedHeaders: map[string]string{},
+			}, {
+				Description:     "GET without origin",
+				Method:          "GET",
+				ExpectedStatus:  200,
+				ExpectedHeaders: map[string]string{},
+			},
+		})
+	})
+
+	t.Run("wildcard", func(t *testing.T) {
+		config := DefaultCORSConfiguration()
+		config.AllowedOrigins = []string{"*"}
+		c := start(t, config)
+		run(t, c, []testCase{
+			{
+				Description: "GET with any origin",
+				Method:      "GET",
+				Header: map[string]string{
+					"Origin": "https://evil.example.com",
+				},
+				ExpectedStatus: 200,
+				ExpectedHeaders: map[string]string{
+					"Access-Control-Allow-Origin": "*",
+				},
+			},
+		})
+	})
+
+	t.Run("wildcard with credentials", func(t *testing.T) {
+		config := DefaultConfiguration()
+		config.CORS.AllowedOrigins = []string{"*"}
+		config.CORS.AllowCredentials = true
+		if _, err := New(reporter.NewMock(t), config, Dependencies{Daemon: daemon.NewMock(t)}); err == nil {
+			t.Fatal("New() did not error")
+		}
+	})
+}
@@ -12,6 +12,10 @@ type metrics struct {
 	sizes     *reporter.HistogramVec
 	cacheHit  *reporter.CounterVec
 	cacheMiss *reporter.CounterVec
+
+	routeRequests  *reporter.CounterVec
+	routeDurations *reporter.HistogramVec
+	rateLimited    reporter.Counter
 }
 
 func (c *Component) initMetrics() {
@@ -53,4 +57,23 @@ func (c *Component) initMetrics() {
 			Help: "Number of requests not served from cache",
 		}, []string{"path", "method"},
 	)
+	c.metrics.routeRequests = c.r.CounterVec(
+		reporter.CounterOpts{
+			Name: "route_requests_total",
+			Help: "Number of requests handled by an API route.",
+		}, []string{"route", "code", "method"},
+	)
+	c.metrics.routeDurations = c.r.HistogramVec(
+		reporter.HistogramOpts{
+			Name:    "route_request_duration_seconds",
+			Help:    "Latencies for requests served by an API route.",
+			Buckets: []float64{.25, .5, 1, 2.5, 5, 10},
+		}, []string{"route", "method"},
+	)
+	c.metrics.rateLimited = c.r.Counter(
+		reporter.CounterOpts{
+			Name: "rate_limited_requests_total",
+			Help: "Number of requests rejected because of rate limiting.",
+		},
+	)
 }
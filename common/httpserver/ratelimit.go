@@ -0,0 +1,150 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfiguration defines the rate limiting of HTTP requests.
+type RateLimitConfiguration struct {
+	// Enable says if requests should be rate-limited
+	Enable bool
+	// Rate is the number of requests per second allowed for each client
+	Rate rate.Limit `validate:"gt=0"`
+	// Burst is the number of requests a client can issue at once
+	Burst int `validate:"min=1"`
+	// KeyHeader is the header identifying a client, like an API token. When
+	// empty or when missing from the request, the client IP is used.
+	KeyHeader string
+	// ForwardedFor says to use the last address from X-Forwarded-For as the
+	// client IP. It should only be enabled behind a trusted proxy.
+	ForwardedFor bool
+}
+
+// DefaultRateLimitConfiguration returns the default rate limiting
+// configuration. It is disabled.
+func DefaultRateLimitConfiguration() RateLimitConfiguration {
+	return RateLimitConfiguration{
+		Rate:  10,
+		Burst: 20,
+	}
+}
+
+// RateLimitKeyFunc returns the key identifying the client of a request. Each
+// key gets its own bucket.
+type RateLimitKeyFunc func(*http.Request) string
+
+// ClientIPKey keys requests on the client IP address.
+func ClientIPKey(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ForwardedForKey keys requests on the address added by the last proxy to
+// X-Forwarded-For. When missing, the client IP is used.
+func ForwardedForKey(r *http.Request) string {
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) > 0 {
+		addresses := strings.Split(forwarded[len(forwarded)-1], ",")
+		if last := strings.TrimSpace(addresses[len(addresses)-1]); last != "" {
+			return last
+		}
+	}
+	return ClientIPKey(r)
+}
+
+// HeaderKey keys requests on the value of the provided header, falling back
+// to the provided key function when the header is absent.
+func HeaderKey(header string, fallback RateLimitKeyFunc) RateLimitKeyFunc {
+	return func(r *http.Request) string {
+		if value := r.Header.Get(header); value != "" {
+			return "header:" + value
+		}
+		return fallback(r)
+	}
+}
+
+// rateLimiter is a set of token buckets, one for each client key.
+type rateLimiter struct {
+	lock        sync.Mutex
+	key         RateLimitKeyFunc
+	limiters    map[string]*rate.Limiter
+	lastCleanup time.Time
+}
+
+// SetRateLimitKey replaces the function used to identify clients when rate
+// limiting requests. It should be called before starting the component.
+func (c *Component) SetRateLimitKey(key RateLimitKeyFunc) {
+	c.rateLimiter.lock.Lock()
+	c.rateLimiter.key = key
+	c.rateLimiter.lock.Unlock()
+}
+
+// defaultRateLimitKey returns the key function matching the configuration.
+func (config RateLimitConfiguration) defaultRateLimitKey() RateLimitKeyFunc {
+	key := ClientIPKey
+	if config.ForwardedFor {
+		key = ForwardedForKey
+	}
+	if config.KeyHeader != "" {
+		key = HeaderKey(config.KeyHeader, key)
+	}
+	return key
+}
+
+// rateLimitHandler rejects requests with 429 when the client exceeds its rate.
+// Liveness and readiness probes are never rate-limited.
+func (c *Component) rateLimitHandler(next http.Handler) http.Handler {
+	config := c.config.RateLimit
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := c.d.Clock.Now()
+		c.rateLimiter.lock.Lock()
+		// Forget clients whose bucket is full again
+		if now.Sub(c.rateLimiter.lastCleanup) > time.Minute {
+			for key, limiter := range c.rateLimiter.limiters {
+				if limiter.TokensAt(now) >= float64(config.Burst) {
+					delete(c.rateLimiter.limiters, key)
+				}
+			}
+			c.rateLimiter.lastCleanup = now
+		}
+		key := c.rateLimiter.key(r)
+		limiter, ok := c.rateLimiter.limiters[key]
+		if !ok {
+			limiter = rate.NewLimiter(config.Rate, config.Burst)
+			c.rateLimiter.limiters[key] = limiter
+		}
+		reservation := limiter.ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		if delay > 0 {
+			reservation.CancelAt(now)
+		}
+		c.rateLimiter.lock.Unlock()
+
+		if delay > 0 {
+			c.metrics.rateLimited.Inc()
+			w.Header().Set("Retry-After",
+				strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
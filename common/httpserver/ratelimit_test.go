@@ -0,0 +1,125 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestRateLimit(t *testing.T) {
+	r := reporter.NewMock(t)
+	mockClock := clock.NewMock()
+	config := DefaultConfiguration()
+	config.RateLimit = RateLimitConfiguration{
+		Enable:    true,
+		Rate:      0.5,
+		Burst:     2,
+		KeyHeader: "X-API-Token",
+	}
+	c, err := New(r, config, Dependencies{Daemon: daemon.NewMock(t), Clock: mockClock})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	handler := c.rateLimitHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	type request struct {
+		RemoteAddr         string
+		Token              string
+		ExpectedStatus     int
+		ExpectedRetryAfter string
+	}
+	check := func(t *testing.T, requests []request) {
+		t.Helper()
+		for _, req := range requests {
+			r := httptest.NewRequest("GET", "/api/v0/orchestrator/clickhouse/asns.csv", nil)
+			r.RemoteAddr = req.RemoteAddr
+			if req.Token != "" {
+				r.Header.Set("X-API-Token", req.Token)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != req.ExpectedStatus {
+				t.Errorf("GET from %s/%s: status == %d, expected %d",
+					req.RemoteAddr, req.Token, w.Code, req.ExpectedStatus)
+			}
+			if got := w.Header().Get("Retry-After"); got != req.ExpectedRetryAfter {
+				t.Errorf("GET from %s/%s: Retry-After == %q, expected %q",
+					req.RemoteAddr, req.Token, got, req.ExpectedRetryAfter)
+			}
+		}
+	}
+
+	// Consume the burst for one client, others are not affected.
+	check(t, []request{
+		{"192.0.2.1:1000", "", 200, ""},
+		{"192.0.2.1:1001", "", 200, ""},
+		{"192.0.2.1:1002", "", 429, "2"},
+		{"192.0.2.2:1000", "", 200, ""},
+		{"192.0.2.1:1003", "token", 200, ""},
+		{"192.0.2.3:1000", "token", 200, ""},
+		{"192.0.2.4:1000", "token", 429, "2"},
+	})
+
+	// After one second, half a token is available
+	mockClock.Add(time.Second)
+	check(t, []request{
+		{"192.0.2.1:1000", "", 429, "1"},
+	})
+
+	// After another second, one token is available
+	mockClock.Add(time.Second)
+	check(t, []request{
+		{"192.0.2.1:1000", "", 200, ""},
+		{"192.0.2.1:1000", "", 429, "2"},
+	})
+
+	// After a long time, the bucket is full again
+	mockClock.Add(time.Hour)
+	check(t, []request{
+		{"192.0.2.1:1000", "", 200, ""},
+		{"192.0.2.1:1000", "", 200, ""},
+		{"192.0.2.1:1000", "", 429, "2"},
+	})
+
+	gotMetrics := r.GetMetrics("akvorado_common_httpserver_", "rate_limited_")
+	expectedMetrics := map[string]string{
+		`rate_limited_requests_total`: "5",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics (-got, +want):\n%s", diff)
+	}
+}
+
+func TestForwardedForKey(t *testing.T) {
+	cases := []struct {
+		ForwardedFor []string
+		Expected     string
+	}{
+		{nil, "192.0.2.1"},
+		{[]string{"203.0.113.4"}, "203.0.113.4"},
+		{[]string{"198.51.100.1, 203.0.113.4"}, "203.0.113.4"},
+		{[]string{"198.51.100.1", "203.0.113.4"}, "203.0.113.4"},
+	}
+	for _, tc := range cases {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "192.0.2.1:1000"
+		for _, value := range tc.ForwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := ForwardedForKey(r); got != tc.Expected {
+			t.Errorf("ForwardedForKey(%v) == %q, expected %q", tc.ForwardedFor, got, tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReadinessCheck returns an error when a component is not ready to serve
+// requests yet. It is run each time the readiness endpoint is requested.
+type ReadinessCheck func(context.Context) error
+
+// RegisterReadinessCheck registers a new readiness check. The /readyz endpoint
+// returns an error until all registered checks succeed.
+func (c *Component) RegisterReadinessCheck(name string, check ReadinessCheck) {
+	c.readinessLock.Lock()
+	c.readinessChecks[name] = check
+	c.readinessLock.Unlock()
+}
+
+// livenessHandler answers as long as the HTTP server is able to serve
+// requests.
+func (c *Component) livenessHandler(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// readinessHandler runs all the readiness checks and answers with 503 if one
+// of them fails.
+func (c *Component) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	c.readinessLock.Lock()
+	checks := make(map[string]ReadinessCheck, len(c.readinessChecks)+1)
+	for name, check := range c.readinessChecks {
+		checks[name] = check
+	}
+	c.readinessLock.Unlock()
+	checks["http"] = func(context.Context) error {
+		if c.draining.Load() {
+			return errors.New("shutting down")
+		}
+		return nil
+	}
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var body strings.Builder
+	status := http.StatusOK
+	for _, name := range names {
+		if err := checks[name](ctx); err != nil {
+			status = http.StatusServiceUnavailable
+			fmt.Fprintf(&body, "%s: %s\n", name, err)
+			continue
+		}
+		fmt.Fprintf(&body, "%s: ok\n", name)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(body.String()))
+}
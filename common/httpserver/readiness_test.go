@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"akvorado/common/helpers"
+	"akvorado/common/httpserver"
+	"akvorado/common/reporter"
+)
+
+func TestReadiness(t *testing.T) {
+	r := reporter.NewMock(t)
+	h := httpserver.NewMock(t, r)
+
+	var ready atomic.Bool
+	var checks atomic.Int32
+	h.RegisterReadinessCheck("test", func(context.Context) error {
+		checks.Add(1)
+		if !ready.Load() {
+			return errors.New("not ready yet")
+		}
+		return nil
+	})
+
+	helpers.TestHTTPEndpoints(t, h.LocalAddr(), helpers.HTTPEndpointCases{
+		{
+			URL:         "/healthz",
+			ContentType: "text/plain; charset=utf-8",
+			FirstLines:  []string{"ok"},
+		}, {
+			URL:         "/readyz",
+			StatusCode:  503,
+			ContentType: "text/plain; charset=utf-8",
+			FirstLines: []string{
+				"http: ok",
+				"test: not ready yet",
+			},
+		},
+	})
+
+	ready.Store(true)
+	helpers.TestHTTPEndpoints(t, h.LocalAddr(), helpers.HTTPEndpointCases{
+		{
+			URL:         "/readyz",
+			ContentType: "text/plain; charset=utf-8",
+			FirstLines: []string{
+				"http: ok",
+				"test: ok",
+			},
+		},
+	})
+
+	// The check is run on each request, the result is not cached
+	if got := checks.Load(); got != 2 {
+		t.Fatalf("readiness check called %d times, expected 2", got)
+	}
+}
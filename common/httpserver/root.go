@@ -6,17 +6,27 @@ package httpserver
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/http/pprof"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/chenyahui/gin-cache/persist"
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog/hlog"
+	"golang.org/x/time/rate"
 	"gopkg.in/tomb.v2"
 
 	"akvorado/common/daemon"
@@ -30,9 +40,16 @@ type Component struct {
 	t      tomb.Tomb
 	config Configuration
 
-	mux     *http.ServeMux
-	metrics metrics
-	address net.Addr
+	mux      *http.ServeMux
+	metrics  metrics
+	address  net.Addr
+	draining atomic.Bool
+
+	tlsMaterial atomic.Pointer[tlsMaterial]
+
+	readinessChecks map[string]ReadinessCheck
+	readinessLock   sync.Mutex
+	rateLimiter     rateLimiter
 
 	// GinRouter is the router exposed for /api
 	GinRouter  *gin.Engine
@@ -42,11 +59,15 @@ type Component struct {
 // Dependencies define the dependencies of the HTTP component.
 type Dependencies struct {
 	Daemon daemon.Component
+	Clock  clock.Clock
 }
 
 // New creates a new HTTP component.
 func New(r *reporter.Reporter, configuration Configuration, dependencies Dependencies) (*Component, error) {
 	var err error
+	if dependencies.Clock == nil {
+		dependencies.Clock = clock.New()
+	}
 	c := Component{
 		r:      r,
 		d:      &dependencies,
@@ -54,6 +75,12 @@ func New(r *reporter.Reporter, configuration Configuration, dependencies Depende
 
 		mux:       http.NewServeMux(),
 		GinRouter: gin.New(),
+
+		readinessChecks: make(map[string]ReadinessCheck),
+		rateLimiter: rateLimiter{
+			key:      configuration.RateLimit.defaultRateLimitKey(),
+			limiters: make(map[string]*rate.Limiter),
+		},
 	}
 	c.initMetrics()
 	c.d.Daemon.Track(&c.t, "common/http")
@@ -61,14 +88,27 @@ func New(r *reporter.Reporter, configuration Configuration, dependencies Depende
 	if err != nil {
 		return nil, err
 	}
-	c.GinRouter.Use(gin.Recovery())
+	if configuration.CORS.AllowCredentials && slices.Contains(configuration.CORS.AllowedOrigins, "*") {
+		return nil, errors.New("CORS wildcard origin cannot be used with credentials")
+	}
+	if configuration.TLS.Enable {
+		if err := c.loadTLSMaterial(); err != nil {
+			return nil, err
+		}
+	}
+	c.GinRouter.Use(c.routeMetrics(), gin.Recovery())
+	if r.TracingEnabled() {
+		c.GinRouter.Use(c.routeTracing())
+	}
 	c.AddHandler("/api/", c.GinRouter)
+	c.AddHandler("/healthz", http.HandlerFunc(c.livenessHandler))
+	c.AddHandler("/readyz", http.HandlerFunc(c.readinessHandler))
 	if configuration.Profiler {
-		c.mux.HandleFunc("/debug/pprof/", pprof.Index)
-		c.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
-		c.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
-		c.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
-		c.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		c.mux.Handle("/debug/pprof/", c.profilerACL(pprof.Index))
+		c.mux.Handle("/debug/pprof/cmdline", c.profilerACL(pprof.Cmdline))
+		c.mux.Handle("/debug/pprof/profile", c.profilerACL(pprof.Profile))
+		c.mux.Handle("/debug/pprof/symbol", c.profilerACL(pprof.Symbol))
+		c.mux.Handle("/debug/pprof/trace", c.profilerACL(pprof.Trace))
 	}
 	return &c, nil
 }
@@ -76,17 +116,8 @@ func New(r *reporter.Reporter, configuration Configuration, dependencies Depende
 // AddHandler registers a new handler for the web server
 func (c *Component) AddHandler(location string, handler http.Handler) {
 	l := c.r.With().Str("handler", location).Logger()
-	handler = hlog.AccessHandler(func(r *http.Request, status, size int, duration time.Duration) {
-		hlog.FromRequest(r).Info().
-			Str("method", r.Method).
-			Stringer("url", r.URL).
-			Str("ip", r.RemoteAddr).
-			Str("user-agent", r.Header.Get("User-Agent")).
-			Int("status", status).
-			Int("size", size).
-			Dur("duration", duration).
-			Msg("HTTP request")
-	})(handler)
+	handler = c.tracingHandler(location, handler)
+	handler = c.accessLogHandler(handler)
 	handler = hlog.NewHandler(l)(handler)
 	handler = promhttp.InstrumentHandlerResponseSize(
 		c.metrics.sizes.MustCurryWith(prometheus.Labels{"handler": location}), handler)
@@ -99,12 +130,56 @@ func (c *Component) AddHandler(location string, handler http.Handler) {
 	c.mux.Handle(location, handler)
 }
 
+// routeMetrics is a middleware for the Gin router recording the number of
+// requests and their durations for each route. The route is the pattern used
+// to register the handler to keep the cardinality low.
+func (c *Component) routeMetrics() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		start := time.Now()
+		gc.Next()
+		route := gc.FullPath()
+		if route == "" {
+			route = "unknown"
+		}
+		method := strings.ToLower(gc.Request.Method)
+		c.metrics.routeRequests.WithLabelValues(route, strconv.Itoa(gc.Writer.Status()), method).Inc()
+		reporter.ObserveWithTrace(gc.Request.Context(),
+			c.metrics.routeDurations.WithLabelValues(route, method),
+			time.Since(start).Seconds())
+	}
+}
+
+// profilerACL only allows clients from the configured networks to access the
+// profiler.
+func (c *Component) profilerACL(handler http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err == nil {
+			if allowed, ok := c.config.ProfilerAllowedNetworks.LookupAddr(addrPort.Addr()); ok && allowed {
+				handler(w, r)
+				return
+			}
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
+
 // Start starts the HTTP component.
 func (c *Component) Start() error {
 	if c.config.Listen == "" {
 		return nil
 	}
-	server := &http.Server{Handler: c.mux}
+	var handler http.Handler = c.mux
+	if c.config.Compression.Enable {
+		handler = c.compressionHandler(handler)
+	}
+	if c.config.RateLimit.Enable {
+		handler = c.rateLimitHandler(handler)
+	}
+	if len(c.config.CORS.AllowedOrigins) > 0 {
+		handler = c.corsHandler(handler)
+	}
+	server := &http.Server{Handler: handler}
 
 	// Most of the time, if we have an error, it's here!
 	c.r.Info().Str("listen", c.config.Listen).Msg("starting HTTP server")
@@ -114,6 +189,10 @@ func (c *Component) Start() error {
 	}
 	c.address = listener.Addr()
 	server.Addr = listener.Addr().String()
+	if c.config.TLS.Enable {
+		listener = tls.NewListener(listener, c.tlsConfig())
+		c.t.Go(c.tlsReloader)
+	}
 
 	// Start serving requests
 	c.t.Go(func() error {
@@ -124,17 +203,35 @@ func (c *Component) Start() error {
 		return nil
 	})
 
-	// Gracefully stop when asked to
+	// Gracefully stop when asked to: stop accepting new connections and
+	// wait for in-flight requests until the drain timeout.
 	c.t.Go(func() error {
 		<-c.t.Dying()
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c.draining.Store(true)
+		c.r.Info().Dur("timeout", c.config.DrainTimeout).Msg("draining HTTP server")
+		ctx, cancel := context.WithTimeout(context.Background(), c.config.DrainTimeout)
 		defer cancel()
 		if err := server.Shutdown(ctx); err != nil {
-			c.r.Err(err).Msg("unable to shutdown HTTP server")
+			c.r.Err(err).Msg("unable to shutdown HTTP server gracefully")
+			server.Close()
 			return fmt.Errorf("unable to shutdown HTTP server: %w", err)
 		}
 		return nil
 	})
+
+	// Report unhealthy while draining
+	c.r.RegisterHealthcheck("http", func(context.Context) reporter.HealthcheckResult {
+		if c.draining.Load() {
+			return reporter.HealthcheckResult{
+				Status: reporter.HealthcheckError,
+				Reason: "shutting down",
+			}
+		}
+		return reporter.HealthcheckResult{
+			Status: reporter.HealthcheckOK,
+			Reason: "ok",
+		}
+	})
 	return nil
 }
 
@@ -4,10 +4,15 @@
 package httpserver_test
 
 import (
+	"context"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"testing"
+	"time"
 
+	"akvorado/common/daemon"
 	"akvorado/common/helpers"
 	"akvorado/common/httpserver"
 	"akvorado/common/reporter"
@@ -74,6 +79,42 @@ func TestGinRouter(t *testing.T) {
 	})
 }
 
+func TestGinRouterMetrics(t *testing.T) {
+	r := reporter.NewMock(t)
+	h := httpserver.NewMock(t, r)
+
+	h.GinRouter.GET("/api/v0/test/:id", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"id": c.Param("id")})
+	})
+
+	helpers.TestHTTPEndpoints(t, h.LocalAddr(), helpers.HTTPEndpointCases{
+		{
+			URL:        "/api/v0/test/1",
+			JSONOutput: gin.H{"id": "1"},
+		}, {
+			URL:        "/api/v0/test/2",
+			JSONOutput: gin.H{"id": "2"},
+		}, {
+			URL:         "/api/v0/missing",
+			StatusCode:  404,
+			ContentType: "text/plain",
+			FirstLines:  []string{"404 page not found"},
+		},
+	})
+
+	gotMetrics := r.GetMetrics("akvorado_common_httpserver_route_",
+		"requests_total", "request_duration_seconds_count")
+	expectedMetrics := map[string]string{
+		`requests_total{code="200",method="get",route="/api/v0/test/:id"}`:      "2",
+		`requests_total{code="404",method="get",route="unknown"}`:               "1",
+		`request_duration_seconds_count{method="get",route="/api/v0/test/:id"}`: "2",
+		`request_duration_seconds_count{method="get",route="unknown"}`:          "1",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics (-got, +want):\n%s", diff)
+	}
+}
+
 func TestGinRouterPanic(t *testing.T) {
 	r := reporter.NewMock(t)
 	h := httpserver.NewMock(t, r)
@@ -91,3 +132,150 @@ func TestGinRouterPanic(t *testing.T) {
 		},
 	})
 }
+
+func TestProfiler(t *testing.T) {
+	urls := []string{
+		"/debug/pprof/",
+		"/debug/pprof/allocs",
+		"/debug/pprof/heap",
+		"/debug/pprof/profile?seconds=1",
+	}
+	cases := []struct {
+		Description     string
+		Enable          bool
+		AllowedNetworks map[string]bool
+		ExpectedStatus  int
+	}{
+		{"disabled", false, nil, 404},
+		{"allowed", true, map[string]bool{"::ffff:127.0.0.0/104": true}, 200},
+		{"not allowed", true, map[string]bool{"::ffff:192.0.2.0/120": true}, 403},
+		{"explicitly denied", true, map[string]bool{
+			"::/0":                 true,
+			"::ffff:127.0.0.0/104": false,
+		}, 403},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Description, func(t *testing.T) {
+			r := reporter.NewMock(t)
+			config := httpserver.DefaultConfiguration()
+			config.Listen = "127.0.0.1:0"
+			config.Profiler = tc.Enable
+			if tc.AllowedNetworks != nil {
+				config.ProfilerAllowedNetworks = helpers.MustNewSubnetMap(tc.AllowedNetworks)
+			}
+			h, err := httpserver.New(r, config, httpserver.Dependencies{Daemon: daemon.NewMock(t)})
+			if err != nil {
+				t.Fatalf("New() error:\n%+v", err)
+			}
+			helpers.StartStop(t, h)
+			for _, url := range urls {
+				resp, err := http.Get(fmt.Sprintf("http://%s%s", h.LocalAddr(), url))
+				if err != nil {
+					t.Fatalf("GET %s error:\n%+v", url, err)
+				}
+				resp.Body.Close()
+				if resp.StatusCode != tc.ExpectedStatus {
+					t.Errorf("GET %s: status code %d, not %d", url, resp.StatusCode, tc.ExpectedStatus)
+				}
+			}
+		})
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	r := reporter.NewMock(t)
+	config := httpserver.DefaultConfiguration()
+	config.Listen = "127.0.0.1:0"
+	config.DrainTimeout = 5 * time.Second
+	h, err := httpserver.New(r, config, httpserver.Dependencies{Daemon: daemon.NewMock(t)})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h.AddHandler("/slow",
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			close(started)
+			<-release
+			fmt.Fprintf(w, "done")
+		}))
+	if err := h.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+
+	// Start a slow request
+	type answer struct {
+		body string
+		err  error
+	}
+	answerChan := make(chan answer, 1)
+	go func() {
+		resp, err := http.Get(fmt.Sprintf("http://%s/slow", h.LocalAddr()))
+		if err != nil {
+			answerChan <- answer{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		answerChan <- answer{string(body), err}
+	}()
+	select {
+	case <-started:
+	case <-time.After(time.Second):
+		t.Fatal("slow handler not started")
+	}
+	if got := r.RunHealthchecks(context.Background()).Details["http"].Status; got != reporter.HealthcheckOK {
+		t.Fatalf("RunHealthchecks() http status == %s, expected %s", got, reporter.HealthcheckOK)
+	}
+
+	// Shutdown while the request is in-flight
+	stopChan := make(chan error, 1)
+	go func() {
+		stopChan <- h.Stop()
+	}()
+	deadline := time.Now().Add(time.Second)
+	for r.RunHealthchecks(context.Background()).Details["http"].Status != reporter.HealthcheckError {
+		if time.Now().After(deadline) {
+			t.Fatal("RunHealthchecks() http status did not switch to error")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		conn, err := net.DialTimeout("tcp", h.LocalAddr().String(), 100*time.Millisecond)
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("Dial() still accepted while shutting down")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case err := <-stopChan:
+		t.Fatalf("Stop() returned before the in-flight request completed: %v", err)
+	default:
+	}
+
+	// Let the request complete
+	close(release)
+	select {
+	case got := <-answerChan:
+		if got.err != nil {
+			t.Fatalf("GET /slow error:\n%+v", got.err)
+		}
+		if got.body != "done" {
+			t.Fatalf("GET /slow == %q, expected %q", got.body, "done")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("GET /slow did not complete")
+	}
+	select {
+	case err := <-stopChan:
+		if err != nil {
+			t.Fatalf("Stop() error:\n%+v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stop() did not return")
+	}
+}
@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// TLSConfiguration defines the TLS configuration of the HTTP server.
+type TLSConfiguration struct {
+	// Enable says if the HTTP server should use TLS
+	Enable bool `validate:"required_with=CertFile KeyFile ClientCAFile"`
+	// CertFile tells the location of the server certificate.
+	CertFile string `validate:"required_if=Enable true"`
+	// KeyFile tells the location of the server key. If empty, the key is
+	// expected in CertFile.
+	KeyFile string
+	// ClientCAFile tells the location of the CA certificates to check client
+	// certificates. When set, clients have to present a valid certificate.
+	ClientCAFile string
+}
+
+// tlsMaterial is the certificate and the client CAs currently in use.
+type tlsMaterial struct {
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+}
+
+// loadTLSMaterial reads the certificate, the key and the client CAs from
+// disk and makes them used for new connections.
+func (c *Component) loadTLSMaterial() error {
+	config := c.config.TLS
+	keyFile := config.KeyFile
+	if keyFile == "" {
+		keyFile = config.CertFile
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot read server certificate: %w", err)
+	}
+	material := tlsMaterial{certificate: &cert}
+	if config.ClientCAFile != "" {
+		caCert, err := os.ReadFile(config.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("cannot read client CA certificate: %w", err)
+		}
+		material.clientCAs = x509.NewCertPool()
+		if ok := material.clientCAs.AppendCertsFromPEM(caCert); !ok {
+			return errors.New("cannot parse client CA certificate")
+		}
+	}
+	c.tlsMaterial.Store(&material)
+	return nil
+}
+
+// tlsConfig returns the TLS configuration for the HTTP server. The
+// certificates are fetched for each new connection, so they can be reloaded
+// without closing the listener.
+func (c *Component) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			material := c.tlsMaterial.Load()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*material.certificate},
+			}
+			if material.clientCAs != nil {
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+				config.ClientCAs = material.clientCAs
+			}
+			return config, nil
+		},
+	}
+}
+
+// tlsReloader reloads the certificates when receiving SIGHUP, until the
+// component is stopped. On error, the previous certificates are kept.
+func (c *Component) tlsReloader() error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case <-c.t.Dying():
+			return nil
+		case <-signals:
+			if err := c.loadTLSMaterial(); err != nil {
+				c.r.Err(err).Msg("unable to reload TLS certificates, keep the previous ones")
+				continue
+			}
+			c.r.Info().Msg("TLS certificates reloaded")
+		}
+	}
+}
+
+// Scheme returns the scheme to use to reach the HTTP server.
+func (c *Component) Scheme() string {
+	if c.config.TLS.Enable {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,211 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+)
+
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCertificate creates a certificate signed by the provided parent. If
+// parent is nil, the certificate is a self-signed CA.
+func newTestCertificate(t *testing.T, name string, parent *testCertificate) testCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error:\n%+v", err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("rand.Int() error:\n%+v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error:\n%+v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate() error:\n%+v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey() error:\n%+v", err)
+	}
+	return testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func writeTestFile(t *testing.T, path string, content []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatalf("WriteFile() error:\n%+v", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, "CA", nil)
+	server := newTestCertificate(t, "server", &ca)
+	client := newTestCertificate(t, "client", &ca)
+	certFile := filepath.Join(dir, "server.pem")
+	keyFile := filepath.Join(dir, "server.key")
+	caFile := filepath.Join(dir, "ca.pem")
+	writeTestFile(t, certFile, server.certPEM)
+	writeTestFile(t, keyFile, server.keyPEM)
+	writeTestFile(t, caFile, ca.certPEM)
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(ca.cert)
+	clientCert, err := tls.X509KeyPair(client.certPEM, client.keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair() error:\n%+v", err)
+	}
+
+	start := func(t *testing.T, tlsConfig TLSConfiguration) *Component {
+		t.Helper()
+		r := reporter.NewMock(t)
+		config := DefaultConfiguration()
+		config.Listen = "127.0.0.1:0"
+		config.TLS = tlsConfig
+		if err := helpers.Validate.Struct(config); err != nil {
+			t.Fatalf("validate.Struct() error:\n%+v", err)
+		}
+		c, err := New(r, config, Dependencies{Daemon: daemon.NewMock(t)})
+		if err != nil {
+			t.Fatalf("New() error:\n%+v", err)
+		}
+		c.AddHandler("/test",
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				fmt.Fprintf(w, "Hello !")
+			}))
+		helpers.StartStop(t, c)
+		return c
+	}
+	get := func(c *Component, tlsConfig *tls.Config) (*http.Response, error) {
+		httpClient := &http.Client{
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		}
+		resp, err := httpClient.Get(fmt.Sprintf("%s://%s/test", c.Scheme(), c.LocalAddr()))
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, err
+		}
+		if string(body) != "Hello !" {
+			return nil, fmt.Errorf("unexpected body %q", body)
+		}
+		return resp, nil
+	}
+
+	t.Run("plain", func(t *testing.T) {
+		c := start(t, TLSConfiguration{})
+		if c.Scheme() != "http" {
+			t.Fatalf("Scheme() == %q, expected %q", c.Scheme(), "http")
+		}
+		if _, err := get(c, nil); err != nil {
+			t.Fatalf("GET error:\n%+v", err)
+		}
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		c := start(t, TLSConfiguration{
+			Enable:   true,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		})
+		if c.Scheme() != "https" {
+			t.Fatalf("Scheme() == %q, expected %q", c.Scheme(), "https")
+		}
+		resp, err := get(c, &tls.Config{RootCAs: rootCAs})
+		if err != nil {
+			t.Fatalf("GET error:\n%+v", err)
+		}
+		if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "server" {
+			t.Fatalf("GET server certificate == %q, expected %q", got, "server")
+		}
+
+		// Reload with a new certificate, new connections should use it
+		renewed := newTestCertificate(t, "renewed", &ca)
+		writeTestFile(t, certFile, renewed.certPEM)
+		writeTestFile(t, keyFile, renewed.keyPEM)
+		if err := c.loadTLSMaterial(); err != nil {
+			t.Fatalf("loadTLSMaterial() error:\n%+v", err)
+		}
+		resp, err = get(c, &tls.Config{RootCAs: rootCAs})
+		if err != nil {
+			t.Fatalf("GET error:\n%+v", err)
+		}
+		if got := resp.TLS.PeerCertificates[0].Subject.CommonName; got != "renewed" {
+			t.Fatalf("GET server certificate == %q, expected %q", got, "renewed")
+		}
+		writeTestFile(t, certFile, server.certPEM)
+		writeTestFile(t, keyFile, server.keyPEM)
+	})
+
+	t.Run("mtls", func(t *testing.T) {
+		c := start(t, TLSConfiguration{
+			Enable:       true,
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: caFile,
+		})
+		if _, err := get(c, &tls.Config{RootCAs: rootCAs}); err == nil {
+			t.Fatal("GET without a client certificate did not error")
+		}
+		if _, err := get(c, &tls.Config{
+			RootCAs:      rootCAs,
+			Certificates: []tls.Certificate{clientCert},
+		}); err != nil {
+			t.Fatalf("GET error:\n%+v", err)
+		}
+	})
+}
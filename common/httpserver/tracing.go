@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracingHandler creates a server span for each request served by the provided
+// handler. The parent span is extracted from the W3C trace context headers.
+// When tracing is not enabled, the handler is returned as is.
+func (c *Component) tracingHandler(location string, handler http.Handler) http.Handler {
+	if !c.r.TracingEnabled() {
+		return handler
+	}
+	tracer := c.r.Tracer()
+	propagator := propagation.TraceContext{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+location,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodOriginal(r.Method),
+				semconv.URLPath(r.URL.Path),
+			))
+		defer span.End()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// routeTracing is a middleware for the Gin router naming the current span
+// after the matched route.
+func (c *Component) routeTracing() gin.HandlerFunc {
+	return func(gc *gin.Context) {
+		if route := gc.FullPath(); route != "" {
+			span := trace.SpanFromContext(gc.Request.Context())
+			span.SetName(gc.Request.Method + " " + route)
+			span.SetAttributes(semconv.HTTPRoute(route))
+		}
+		gc.Next()
+	}
+}
+
+// statusWriter records the status code sent to the client.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+// WriteHeader records the status code.
+func (sw *statusWriter) WriteHeader(code int) {
+	if !sw.wroteHeader && code >= 200 {
+		sw.status = code
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+// Write marks the header as sent.
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush sends buffered data to the client.
+func (sw *statusWriter) Flush() {
+	sw.wroteHeader = true
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the original writer for http.ResponseController.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
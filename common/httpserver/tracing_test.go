@@ -0,0 +1,63 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package httpserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+
+	"github.com/gin-gonic/gin"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	r := reporter.NewMockWithTracerProvider(t, provider)
+	c, err := New(r, DefaultConfiguration(), Dependencies{Daemon: daemon.NewMock(t)})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	c.GinRouter.GET("/api/v0/test/:id", func(gc *gin.Context) {
+		gc.String(http.StatusNotFound, "not found")
+	})
+
+	req := httptest.NewRequest("GET", "/api/v0/test/12", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	c.mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("Ended() == %d spans, expected 1", len(spans))
+	}
+	span := spans[0]
+	got := map[string]string{
+		"name":     span.Name(),
+		"kind":     span.SpanKind().String(),
+		"trace-id": span.SpanContext().TraceID().String(),
+		"parent":   span.Parent().SpanID().String(),
+	}
+	for _, kv := range span.Attributes() {
+		got[string(kv.Key)] = kv.Value.Emit()
+	}
+	expected := map[string]string{
+		"name":                         "GET /api/v0/test/:id",
+		"kind":                         "server",
+		"trace-id":                     "4bf92f3577b34da6a3ce929d0e0e4736",
+		"parent":                       "00f067aa0ba902b7",
+		"http.request.method_original": "GET",
+		"url.path":                     "/api/v0/test/12",
+		"http.route":                   "/api/v0/test/:id",
+		"http.response.status_code":    "404",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("span (-got, +want):\n%s", diff)
+	}
+}
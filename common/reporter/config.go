@@ -6,12 +6,14 @@ package reporter
 import (
 	"akvorado/common/reporter/logger"
 	"akvorado/common/reporter/metrics"
+	"akvorado/common/reporter/tracing"
 )
 
 // Configuration contains the reporter configuration.
 type Configuration struct {
 	Logging logger.Configuration
 	Metrics metrics.Configuration
+	Tracing tracing.Configuration
 }
 
 // DefaultConfiguration is the default reporter configuration.
@@ -19,5 +21,6 @@ func DefaultConfiguration() Configuration {
 	return Configuration{
 		Logging: logger.DefaultConfiguration(),
 		Metrics: metrics.DefaultConfiguration(),
+		Tracing: tracing.DefaultConfiguration(),
 	}
 }
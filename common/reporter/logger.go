@@ -7,6 +7,8 @@ import (
 	"time"
 
 	"github.com/rs/zerolog"
+
+	"akvorado/common/reporter/logger"
 )
 
 // Logger is an alias for zerolog.Logger
@@ -19,3 +21,13 @@ func BurstSampler(period time.Duration, burst uint32) zerolog.Sampler {
 		Burst:  burst,
 	}
 }
+
+// SiteSampler returns a sampler for the named log site. By default, the first
+// burst messages of each period are logged and the remaining ones are
+// dropped. The policy can be overridden from the configuration.
+func (r *Reporter) SiteSampler(site string, period time.Duration, burst uint32) zerolog.Sampler {
+	return r.Logger.Sampler(site, logger.SamplingConfiguration{
+		Period: period,
+		Burst:  burst,
+	})
+}
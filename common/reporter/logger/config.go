@@ -3,8 +3,25 @@
 
 package logger
 
-// Configuration if the configuration for logger. Currently, there is no configuration.
-type Configuration struct{}
+import "time"
+
+// Configuration if the configuration for logger.
+type Configuration struct {
+	// Sampling overrides the sampling policy of the named log sites.
+	Sampling map[string]SamplingConfiguration `validate:"dive"`
+}
+
+// SamplingConfiguration is the sampling policy for a log site. The first
+// Burst messages of each period are logged. After that, one message out of
+// Every is logged. When Every is 0, the remaining messages are dropped.
+type SamplingConfiguration struct {
+	// Period is the interval during which Burst messages are logged
+	Period time.Duration `validate:"min=1ms"`
+	// Burst is the number of messages logged during each period
+	Burst uint32
+	// Every tells to log one message out of Every once Burst is reached
+	Every uint32
+}
 
 // DefaultConfiguration is the default logging configuration.
 func DefaultConfiguration() Configuration {
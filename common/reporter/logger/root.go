@@ -3,8 +3,8 @@
 
 // Package logger handles logging for akvorado.
 //
-// This is a thin wrapper around zerolog. It is currently not
-// configurable as we don't need anything fancy yet for configuration.
+// This is a thin wrapper around zerolog. The only configurable part is the
+// sampling policy of log sites.
 //
 // It also brings some conventions like the presence of "module" in
 // each context to be able to filter logs more easily. However, this
@@ -25,13 +25,32 @@ import (
 // from zerolog by design.
 type Logger struct {
 	zerolog.Logger
+	sampling map[string]SamplingConfiguration
 }
 
 // New creates a new logger
-func New(_ Configuration) (Logger, error) {
+func New(config Configuration) (Logger, error) {
 	// Initialize the logger
 	logger := log.Logger.Hook(contextHook{})
-	return Logger{logger}, nil
+	return Logger{Logger: logger, sampling: config.Sampling}, nil
+}
+
+// Sampler returns a sampler for the named log site. The sampling policy from
+// the configuration takes precedence over the provided default one. The
+// returned sampler should be created once and reused for all messages of the
+// log site.
+func (l Logger) Sampler(site string, policy SamplingConfiguration) zerolog.Sampler {
+	if override, ok := l.sampling[site]; ok {
+		policy = override
+	}
+	sampler := &zerolog.BurstSampler{
+		Period: policy.Period,
+		Burst:  policy.Burst,
+	}
+	if policy.Every > 0 {
+		sampler.NextSampler = &zerolog.BasicSampler{N: policy.Every}
+	}
+	return sampler
 }
 
 type contextHook struct{}
@@ -4,7 +4,12 @@
 package logger
 
 import (
+	"bytes"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
 )
 
 func TestNew(t *testing.T) {
@@ -14,3 +19,33 @@ func TestNew(t *testing.T) {
 	}
 	logger.Info().Int("integer", 15).Msg("log message")
 }
+
+func TestSampler(t *testing.T) {
+	l, err := New(Configuration{
+		Sampling: map[string]SamplingConfiguration{
+			"overridden": {Period: time.Hour, Burst: 3, Every: 10},
+		},
+	})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	defaults := SamplingConfiguration{Period: time.Hour, Burst: 5}
+	cases := []struct {
+		Site     string
+		Expected int
+	}{
+		{"default", 5},
+		// 3 during the burst, then 1 out of 10 for the 97 remaining ones
+		{"overridden", 13},
+	}
+	for _, tc := range cases {
+		var buf bytes.Buffer
+		logger := zerolog.New(&buf).Sample(l.Sampler(tc.Site, defaults))
+		for range 100 {
+			logger.Error().Msg("error while decoding")
+		}
+		if got := strings.Count(buf.String(), "\n"); got != tc.Expected {
+			t.Errorf("Sampler(%q): %d messages logged, expected %d", tc.Site, got, tc.Expected)
+		}
+	}
+}
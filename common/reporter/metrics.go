@@ -45,6 +45,8 @@ type (
 	Histogram = prometheus.Histogram
 	// HistogramVec defines histogram vectors
 	HistogramVec = prometheus.HistogramVec
+	// Observer defines anything accepting observations (histograms, summaries)
+	Observer = prometheus.Observer
 	// Summary defines summarys
 	Summary = prometheus.Summary
 	// SummaryVec defines summary vectors
@@ -86,6 +88,12 @@ func (r *Reporter) GaugeVec(opts GaugeOpts, labelNames []string) *GaugeVec {
 	return r.metrics.Factory(1).NewGaugeVec(opts, labelNames)
 }
 
+// GlobalGaugeVec is like GaugeVec but the name is not prefixed with the module
+// name. This is for metrics shared by several modules.
+func (r *Reporter) GlobalGaugeVec(opts GaugeOpts, labelNames []string) *GaugeVec {
+	return r.metrics.GlobalFactory().NewGaugeVec(opts, labelNames)
+}
+
 // Histogram mimics NewHistogram from promauto package.
 func (r *Reporter) Histogram(opts HistogramOpts) Histogram {
 	return r.metrics.Factory(1).NewHistogram(opts)
@@ -48,10 +48,13 @@ func New(logger logger.Logger, configuration Configuration) (*Metrics, error) {
 	return &m, nil
 }
 
-// HTTPHandler returns an handler to server Prometheus metrics.
+// HTTPHandler returns an handler to server Prometheus metrics. The
+// OpenMetrics format, including exemplars, is used when requested by the
+// client.
 func (m *Metrics) HTTPHandler() http.Handler {
 	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{
-		ErrorLog: promHTTPLogger{m.logger},
+		ErrorLog:          promHTTPLogger{m.logger},
+		EnableOpenMetrics: true,
 	})
 }
 
@@ -100,6 +103,15 @@ func (m *Metrics) Factory(skipCallstack int) *Factory {
 	return &factory
 }
 
+// GlobalFactory returns a factory to register metrics shared by several
+// modules. Names are only prefixed with the name of the application.
+func (m *Metrics) GlobalFactory() *Factory {
+	return &Factory{
+		prefix:   getPrefix(""),
+		registry: m.registry,
+	}
+}
+
 // Desc allocates and initializes and new metric description. Like for
 // factory, names are prefixed with the module name. Unlike factory,
 // there is no cache.
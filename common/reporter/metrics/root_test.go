@@ -45,15 +45,20 @@ func TestNew(t *testing.T) {
 	m.HTTPHandler().ServeHTTP(w, req)
 	got := strings.Split(w.Body.String(), "\n")
 
-	// We expect some go_* and process_* gauges
-	expecteds := []string{"go_threads", "go_sched_goroutines_goroutines"}
+	// We expect some go_* and process_* metrics
+	expecteds := map[string]string{
+		"go_threads":                     "gauge",
+		"go_goroutines":                  "gauge",
+		"go_sched_goroutines_goroutines": "gauge",
+	}
 	if runtime.GOOS == "linux" {
-		expecteds = append(expecteds, "process_open_fds")
+		expecteds["process_open_fds"] = "gauge"
+		expecteds["process_cpu_seconds_total"] = "counter"
 	}
-	for _, expected := range expecteds {
+	for expected, kind := range expecteds {
 		found := false
 		for _, line := range got {
-			if line == fmt.Sprintf("# TYPE %s gauge", expected) {
+			if line == fmt.Sprintf("# TYPE %s %s", expected, kind) {
 				found = true
 				break
 			}
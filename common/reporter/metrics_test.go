@@ -196,3 +196,23 @@ func TestMetricCollector(t *testing.T) {
 		t.Fatalf("subsetted metrics (-got, +want):\n%s", diff)
 	}
 }
+
+func TestGlobalGaugeVec(t *testing.T) {
+	r := reporter.NewMock(t)
+	opts := reporter.GaugeOpts{
+		Name: "shared_items",
+		Help: "Number of items shared by several modules.",
+	}
+	r.GlobalGaugeVec(opts, []string{"name"}).WithLabelValues("first").Set(10)
+	// Registering twice is accepted
+	r.GlobalGaugeVec(opts, []string{"name"}).WithLabelValues("second").Set(20)
+
+	got := r.GetMetrics("akvorado_shared_")
+	expected := map[string]string{
+		`items{name="first"}`:  "10",
+		`items{name="second"}`: "20",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("GlobalGaugeVec() metrics (-got, +want):\n%s", diff)
+	}
+}
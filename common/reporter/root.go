@@ -3,7 +3,7 @@
 
 // Package reporter is a façade for reporting duties in akvorado.
 //
-// Such a façade currently includes logging and metrics.
+// Such a façade currently includes logging, metrics, and traces.
 package reporter
 
 import (
@@ -11,6 +11,7 @@ import (
 
 	"akvorado/common/reporter/logger"
 	"akvorado/common/reporter/metrics"
+	"akvorado/common/reporter/tracing"
 )
 
 // Reporter contains the state for a reporter. It also supports the
@@ -18,6 +19,7 @@ import (
 type Reporter struct {
 	logger.Logger
 	metrics *metrics.Metrics
+	tracing *tracing.Tracing
 
 	healthchecks     map[string]HealthcheckFunc
 	healthchecksLock sync.Mutex
@@ -36,9 +38,15 @@ func New(config Configuration) (*Reporter, error) {
 		return nil, err
 	}
 
+	t, err := tracing.New(config.Tracing)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Reporter{
 		Logger:       l,
 		metrics:      m,
+		tracing:      t,
 		healthchecks: make(map[string]HealthcheckFunc),
 	}, nil
 }
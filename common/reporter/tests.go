@@ -9,6 +9,10 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"akvorado/common/reporter/tracing"
 )
 
 // NewMock creates a new reporter for tests. Currently, this is the same as a production reporter.
@@ -21,6 +25,15 @@ func NewMock(t testing.TB) *Reporter {
 	return r
 }
 
+// NewMockWithTracerProvider creates a new reporter for tests, using the
+// provided tracer provider to record spans.
+func NewMockWithTracerProvider(t testing.TB, provider trace.TracerProvider) *Reporter {
+	t.Helper()
+	r := NewMock(t)
+	r.tracing = tracing.NewWithProvider(provider)
+	return r
+}
+
 // GetMetrics returns a map from metric name to its value (as a
 // string). It keeps only metrics matching the provided prefix.
 func (r *Reporter) GetMetrics(prefix string, subset ...string) map[string]string {
@@ -0,0 +1,47 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+// Tracing façade for reporter.
+
+package reporter
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer returns a tracer for the current module. When tracing is not
+// configured, it does nothing.
+func (r *Reporter) Tracer() trace.Tracer {
+	return r.tracing.Tracer(1)
+}
+
+// TracingEnabled tells if spans are exported. This can be used to skip
+// expensive instrumentation.
+func (r *Reporter) TracingEnabled() bool {
+	return r.tracing.Enabled()
+}
+
+// Stop flushes the remaining spans.
+func (r *Reporter) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return r.tracing.Shutdown(ctx)
+}
+
+// ObserveWithTrace adds an observation to the provided histogram or summary.
+// When the context carries a sampled span, its trace ID is attached to the
+// observation as an exemplar.
+func ObserveWithTrace(ctx context.Context, observer Observer, value float64) {
+	sc := trace.SpanContextFromContext(ctx)
+	if sc.IsSampled() {
+		if eo, ok := observer.(prometheus.ExemplarObserver); ok {
+			eo.ObserveWithExemplar(value, prometheus.Labels{"trace_id": sc.TraceID().String()})
+			return
+		}
+	}
+	observer.Observe(value)
+}
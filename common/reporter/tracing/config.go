@@ -0,0 +1,21 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package tracing
+
+// Configuration is the configuration for traces.
+type Configuration struct {
+	// Endpoint is the OTLP/HTTP endpoint (host and port) to send traces to.
+	// When empty, tracing is disabled.
+	Endpoint string `validate:"omitempty,hostname_port"`
+	// URLPath is the path to send traces to on the endpoint
+	URLPath string
+	// Insecure disables TLS when sending traces
+	Insecure bool
+}
+
+// DefaultConfiguration is the default tracing configuration. Tracing is
+// disabled.
+func DefaultConfiguration() Configuration {
+	return Configuration{}
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+// Package tracing handles traces for akvorado.
+//
+// This is a thin wrapper around OpenTelemetry. When no exporter is
+// configured, a no-op tracer is used.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"akvorado/common/reporter/stack"
+)
+
+// Tracing represents the internal state of the tracing subsystem.
+type Tracing struct {
+	provider trace.TracerProvider
+	enabled  bool
+	shutdown func(context.Context) error
+}
+
+// New creates a new tracer provider exporting spans to the configured
+// endpoint.
+func New(config Configuration) (*Tracing, error) {
+	if config.Endpoint == "" {
+		return &Tracing{provider: noop.NewTracerProvider()}, nil
+	}
+	options := []otlptracehttp.Option{otlptracehttp.WithEndpoint(config.Endpoint)}
+	if config.URLPath != "" {
+		options = append(options, otlptracehttp.WithURLPath(config.URLPath))
+	}
+	if config.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), options...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create OTLP exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	return &Tracing{
+		provider: provider,
+		enabled:  true,
+		shutdown: provider.Shutdown,
+	}, nil
+}
+
+// NewWithProvider creates a new tracing subsystem using the provided tracer
+// provider.
+func NewWithProvider(provider trace.TracerProvider) *Tracing {
+	return &Tracing{provider: provider, enabled: true}
+}
+
+// Enabled tells if spans are exported somewhere.
+func (t *Tracing) Enabled() bool {
+	return t.enabled
+}
+
+// Tracer returns a tracer named after the module of the caller.
+func (t *Tracing) Tracer(skipCallstack int) trace.Tracer {
+	callStack := stack.Callers()
+	call := callStack[1+skipCallstack] // Same as for metrics
+	module := call.FunctionName()
+	if !strings.HasPrefix(module, stack.ModuleName) {
+		module = stack.ModuleName
+	} else {
+		module = strings.SplitN(module, ".", 2)[0]
+	}
+	return t.provider.Tracer(module)
+}
+
+// Shutdown flushes the remaining spans and stops the exporter.
+func (t *Tracing) Shutdown(ctx context.Context) error {
+	if t.shutdown == nil {
+		return nil
+	}
+	return t.shutdown(ctx)
+}
@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package reporter_test
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"akvorado/common/reporter"
+)
+
+func TestObserveWithTrace(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	r := reporter.NewMockWithTracerProvider(t, provider)
+	histogram := r.Histogram(reporter.HistogramOpts{
+		Name:    "histogram1",
+		Help:    "Some histogram",
+		Buckets: []float64{1, 10},
+	})
+
+	// One observation outside of a span, one inside
+	reporter.ObserveWithTrace(context.Background(), histogram, 0.5)
+	ctx, span := r.Tracer().Start(context.Background(), "test")
+	reporter.ObserveWithTrace(ctx, histogram, 5)
+	span.End()
+	traceID := span.SpanContext().TraceID().String()
+
+	get := func(accept string) (string, string) {
+		req := httptest.NewRequest("GET", "/api/v0/metrics", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		r.MetricsHTTPHandler().ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Body)
+		return w.Header().Get("Content-Type"), string(body)
+	}
+	bucket := `akvorado_common_reporter_test_histogram1_bucket{le="10.0"} 2`
+	exemplar := `# {trace_id="` + traceID + `"} 5`
+
+	// Default format
+	contentType, body := get("")
+	if !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("GET /api/v0/metrics Content-Type == %q, expected text/plain", contentType)
+	}
+	if strings.Contains(body, "trace_id") {
+		t.Errorf("GET /api/v0/metrics contains an exemplar:\n%s", body)
+	}
+
+	// OpenMetrics format
+	contentType, body = get("application/openmetrics-text; version=1.0.0")
+	if !strings.HasPrefix(contentType, "application/openmetrics-text") {
+		t.Errorf("GET /api/v0/metrics Content-Type == %q, expected application/openmetrics-text", contentType)
+	}
+	found := false
+	for _, line := range strings.Split(body, "\n") {
+		if strings.HasPrefix(line, bucket) && strings.Contains(line, exemplar) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Errorf("GET /api/v0/metrics missing exemplar %q:\n%s", exemplar, body)
+	}
+}
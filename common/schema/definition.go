@@ -79,6 +79,11 @@ const (
 	DictionaryTCP string = "tcp"
 	// DictionaryUDP is the name of the UDP clickhouse dictionary
 	DictionaryUDP string = "udp"
+	// DictionaryCircuits is the name of the circuits clickhouse dictionary.
+	DictionaryCircuits string = "circuits"
+	// DictionaryExporterRoles is the name of the exporter roles clickhouse
+	// dictionary.
+	DictionaryExporterRoles string = "exporter_roles"
 )
 
 // revive:disable
@@ -172,6 +177,12 @@ const (
 	ColumnMPLS2ndLabel
 	ColumnMPLS3rdLabel
 	ColumnMPLS4thLabel
+	ColumnSrcBoundary
+	ColumnDstBoundary
+	ColumnSrcGeoLatitude
+	ColumnDstGeoLatitude
+	ColumnSrcGeoLongitude
+	ColumnDstGeoLongitude
 
 	// ColumnLast points to after the last static column, custom dictionaries
 	// (dynamic columns) come after ColumnLast
@@ -356,6 +367,30 @@ END`,
 				ClickHouseType:         "LowCardinality(String)",
 				ClickHouseGenerateFrom: "c_DstNetworks[state]",
 			},
+			{
+				Key:                     ColumnSrcGeoLatitude,
+				ClickHouseType:          "Float32",
+				ClickHouseGenerateFrom:  "c_SrcNetworks[latitude]",
+				ClickHouseNotSortingKey: true,
+			},
+			{
+				Key:                     ColumnDstGeoLatitude,
+				ClickHouseType:          "Float32",
+				ClickHouseGenerateFrom:  "c_DstNetworks[latitude]",
+				ClickHouseNotSortingKey: true,
+			},
+			{
+				Key:                     ColumnSrcGeoLongitude,
+				ClickHouseType:          "Float32",
+				ClickHouseGenerateFrom:  "c_SrcNetworks[longitude]",
+				ClickHouseNotSortingKey: true,
+			},
+			{
+				Key:                     ColumnDstGeoLongitude,
+				ClickHouseType:          "Float32",
+				ClickHouseGenerateFrom:  "c_DstNetworks[longitude]",
+				ClickHouseNotSortingKey: true,
+			},
 			{
 				Key:                ColumnDstASPath,
 				ClickHouseMainOnly: true,
@@ -570,6 +605,19 @@ END`,
 				ClickHouseAlias:    "MPLSLabels[4]",
 				ParserType:         "uint",
 			},
+			{
+				Key:                     ColumnSrcBoundary,
+				Disabled:                true,
+				ClickHouseType:          fmt.Sprintf("Enum8('undefined' = %d, 'external' = %d, 'internal' = %d)", InterfaceBoundaryUndefined, InterfaceBoundaryExternal, InterfaceBoundaryInternal),
+				ClickHouseNotSortingKey: true,
+				ProtobufType:            protoreflect.EnumKind,
+				ProtobufEnumName:        "Boundary",
+				ProtobufEnum: map[int]string{
+					int(InterfaceBoundaryUndefined): "UNDEFINED",
+					int(InterfaceBoundaryExternal):  "EXTERNAL",
+					int(InterfaceBoundaryInternal):  "INTERNAL",
+				},
+			},
 		},
 	}.finalize()
 }
@@ -62,6 +62,10 @@ func TestConfigHandler(t *testing.T) {
 					"DstGeoCity",
 					"SrcGeoState",
 					"DstGeoState",
+					"SrcGeoLatitude",
+					"DstGeoLatitude",
+					"SrcGeoLongitude",
+					"DstGeoLongitude",
 					"DstASPath",
 					"Dst1stAS",
 					"Dst2ndAS",
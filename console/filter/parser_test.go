@@ -197,6 +197,12 @@ func TestValidFilter(t *testing.T) {
 			MetaIn: Meta{ReverseDirection: true}, MetaOut: Meta{ReverseDirection: true},
 		},
 		{Input: `OutIfBoundary != internal`, Output: `OutIfBoundary != 'internal'`},
+		{Input: `SrcBoundary = internal`, Output: `SrcBoundary = 'internal'`},
+		{
+			Input: `SrcBoundary = internal`, Output: `DstBoundary = 'internal'`,
+			MetaIn: Meta{ReverseDirection: true}, MetaOut: Meta{ReverseDirection: true},
+		},
+		{Input: `DstBoundary != EXTERNAL`, Output: `DstBoundary != 'external'`},
 		{Input: `EType = ipv4`, Output: `EType = 2048`},
 		{Input: `EType != ipv6`, Output: `EType != 34525`},
 		{Input: `Proto = 1`, Output: `Proto = 1`},
@@ -104,7 +104,7 @@ func (qc Column) ToSQLSelect(sch *schema.Component) string {
 	case schema.ColumnSrcAS, schema.ColumnDstAS, schema.ColumnDst1stAS, schema.ColumnDst2ndAS, schema.ColumnDst3rdAS:
 		strValue = fmt.Sprintf(`concat(toString(%s), ': ', dictGetOrDefault('%s', 'name', %s, '???'))`,
 			qc, schema.DictionaryASNs, qc)
-	case schema.ColumnInIfBoundary, schema.ColumnOutIfBoundary:
+	case schema.ColumnInIfBoundary, schema.ColumnOutIfBoundary, schema.ColumnSrcBoundary, schema.ColumnDstBoundary:
 		strValue = fmt.Sprintf(`toString(%s)`, qc.String())
 	case schema.ColumnEType:
 		strValue = fmt.Sprintf(`if(EType = %d, 'IPv4', if(EType = %d, 'IPv6', '???'))`,
@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package core
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"akvorado/common/helpers"
+)
+
+// watchBoundaries watches the provided CSV file and reloads the boundaries each
+// time it is modified. Editors and tools often write a file in several steps,
+// so the file is only read once it has not been modified for
+// boundariesReloadDelay. When the new content is invalid, the previous
+// boundaries are kept.
+func (c *Component) watchBoundaries(path string) error {
+	path = filepath.Clean(path)
+
+	// Watch the directory as files are often replaced instead of modified.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("cannot setup watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("cannot watch directory of %s: %w", path, err)
+	}
+	c.t.Go(func() error {
+		defer watcher.Close()
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-c.t.Dying():
+				return nil
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return errors.New("boundaries watcher died")
+				}
+				c.r.Err(err).Msg("error from boundaries watcher")
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return errors.New("boundaries watcher died")
+				}
+				if !event.Has(fsnotify.Write) && !event.Has(fsnotify.Create) {
+					continue
+				}
+				if filepath.Clean(event.Name) != path {
+					continue
+				}
+				reload = c.d.Clock.After(c.boundariesReloadDelay)
+			case <-reload:
+				reload = nil
+				boundaries, err := helpers.LoadSubnetMapFile(path, validateBoundary)
+				if err != nil {
+					c.r.Err(err).Msg("cannot reload boundaries, keep the previous ones")
+					c.metrics.boundariesReloadErrors.Inc()
+					continue
+				}
+				c.r.Info().Msgf("boundaries reloaded from %s", path)
+				c.storeBoundaries(boundaries)
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,103 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package core
+
+import (
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+	"akvorado/common/schema"
+)
+
+func TestWatchBoundaries(t *testing.T) {
+	r := reporter.NewMock(t)
+	path := filepath.Join(t.TempDir(), "boundaries.csv")
+	writeBoundaries := func(content string) {
+		t.Helper()
+		// Write then rename to not expose a partial file to the watcher
+		if err := os.WriteFile(path+".tmp", []byte(content), 0o644); err != nil {
+			t.Fatalf("WriteFile() error:\n%+v", err)
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			t.Fatalf("Rename() error:\n%+v", err)
+		}
+	}
+	writeBoundaries("192.0.2.0/24,internal\n")
+	boundaries, err := helpers.LoadSubnetMapFile(path, validateBoundary)
+	if err != nil {
+		t.Fatalf("LoadSubnetMapFile() error:\n%+v", err)
+	}
+
+	config := DefaultConfiguration()
+	config.Boundaries = *boundaries
+	mockClock := clock.NewMock()
+	c, err := New(r, config, Dependencies{
+		Daemon: daemon.NewMock(t),
+		Clock:  mockClock,
+	})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	if err := c.watchBoundaries(path); err != nil {
+		t.Fatalf("watchBoundaries() error:\n%+v", err)
+	}
+	defer func() {
+		c.t.Kill(nil)
+		if err := c.t.Wait(); err != nil {
+			t.Fatalf("Wait() error:\n%+v", err)
+		}
+	}()
+
+	addr := netip.MustParseAddr("::ffff:198.51.100.10")
+	if got := c.getBoundary(addr); got != schema.InterfaceBoundaryExternal {
+		t.Fatalf("getBoundary() == %s, expected %s", got, schema.InterfaceBoundaryExternal)
+	}
+
+	// Without advancing the clock, the file is not reloaded
+	writeBoundaries("192.0.2.0/24,internal\n198.51.100.0/24,internal\n")
+	time.Sleep(100 * time.Millisecond)
+	if got := c.getBoundary(addr); got != schema.InterfaceBoundaryExternal {
+		t.Fatalf("getBoundary() before reload delay == %s, expected %s", got, schema.InterfaceBoundaryExternal)
+	}
+
+	// Once the delay has elapsed, the file is reloaded
+	for i := 0; c.getBoundary(addr) != schema.InterfaceBoundaryInternal; i++ {
+		if i == 50 {
+			t.Fatal("boundaries not reloaded")
+		}
+		mockClock.Add(c.boundariesReloadDelay)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Invalid file or invalid value, the previous boundaries are kept
+	for idx, content := range []string{
+		"192.0.2.0/24,internal\nnot a subnet,internal\n",
+		"192.0.2.0/24,internal\n198.51.100.0/24,undefined\n",
+	} {
+		writeBoundaries(content)
+		for i := 0; ; i++ {
+			gotMetrics := r.GetMetrics("akvorado_inlet_core_boundaries_")
+			if gotMetrics["reload_errors_total"] == strconv.Itoa(idx+1) {
+				break
+			}
+			if i == 50 {
+				t.Fatalf("Metrics:\n%+v", gotMetrics)
+			}
+			mockClock.Add(c.boundariesReloadDelay)
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := c.getBoundary(addr); got != schema.InterfaceBoundaryInternal {
+			t.Fatalf("getBoundary() after invalid file == %s, expected %s", got, schema.InterfaceBoundaryInternal)
+		}
+	}
+}
@@ -4,12 +4,14 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"reflect"
 	"strings"
 	"time"
 
 	"akvorado/common/helpers"
+	"akvorado/common/schema"
 
 	"github.com/go-viper/mapstructure/v2"
 )
@@ -32,6 +34,9 @@ type Configuration struct {
 	ASNProviders []ASNProvider `validate:"dive"`
 	// NetProviders defines the source used to get Prefix/Network Information
 	NetProviders []NetProvider `validate:"dive"`
+	// Boundaries maps prefixes to a boundary (internal or external) for
+	// source and destination addresses. Unmatched addresses are external.
+	Boundaries helpers.SubnetMap[schema.InterfaceBoundary]
 	// Old configuration settings
 	classifierCacheSize uint
 }
@@ -147,4 +152,14 @@ func init() {
 	helpers.RegisterMapstructureUnmarshallerHook(ASNProviderUnmarshallerHook())
 	helpers.RegisterMapstructureUnmarshallerHook(NetProviderUnmarshallerHook())
 	helpers.RegisterMapstructureUnmarshallerHook(helpers.SubnetMapUnmarshallerHook[uint]())
+	helpers.RegisterMapstructureUnmarshallerHook(
+		helpers.SubnetMapUnmarshallerHookWithValidation(validateBoundary))
+}
+
+// validateBoundary checks a boundary is either internal or external.
+func validateBoundary(_ string, boundary schema.InterfaceBoundary) error {
+	if boundary == schema.InterfaceBoundaryUndefined {
+		return errors.New("boundary should be internal or external")
+	}
+	return nil
 }
@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"akvorado/common/helpers"
+	"akvorado/common/schema"
 
 	"github.com/gin-gonic/gin"
 )
@@ -115,3 +116,47 @@ func TestConfigurationUnmarshallerHook(t *testing.T) {
 		},
 	})
 }
+
+func TestBoundariesConfiguration(t *testing.T) {
+	helpers.TestConfigurationDecode(t, helpers.ConfigurationDecodeCases{
+		{
+			Description: "valid",
+			Initial:     func() interface{} { return Configuration{} },
+			Configuration: func() interface{} {
+				return gin.H{
+					"boundaries": gin.H{
+						"192.0.2.0/24":  "internal",
+						"192.0.2.0/28":  "external",
+						"2001:db8::/64": "internal",
+					},
+				}
+			},
+			Expected: Configuration{
+				Boundaries: *helpers.MustNewSubnetMap(map[string]schema.InterfaceBoundary{
+					"::ffff:192.0.2.0/120": schema.InterfaceBoundaryInternal,
+					"::ffff:192.0.2.0/124": schema.InterfaceBoundaryExternal,
+					"2001:db8::/64":        schema.InterfaceBoundaryInternal,
+				}),
+			},
+			SkipValidation: true,
+		}, {
+			Description: "unknown boundary",
+			Initial:     func() interface{} { return Configuration{} },
+			Configuration: func() interface{} {
+				return gin.H{
+					"boundaries": gin.H{"192.0.2.0/24": "inside"},
+				}
+			},
+			Error: true,
+		}, {
+			Description: "undefined boundary",
+			Initial:     func() interface{} { return Configuration{} },
+			Configuration: func() interface{} {
+				return gin.H{
+					"boundaries": gin.H{"192.0.2.0/24": "undefined"},
+				}
+			},
+			Error: true,
+		},
+	})
+}
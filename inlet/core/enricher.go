@@ -147,6 +147,9 @@ func (c *Component) enrichFlow(exporterIP netip.Addr, exporterStr string, flow *
 			schema.ColumnDstLargeCommunitiesLocalData2, uint64(comm.LocalData2))
 	}
 
+	c.d.Schema.ProtobufAppendVarint(flow, schema.ColumnSrcBoundary, uint64(c.getBoundary(flow.SrcAddr)))
+	c.d.Schema.ProtobufAppendVarint(flow, schema.ColumnDstBoundary, uint64(c.getBoundary(flow.DstAddr)))
+
 	c.d.Schema.ProtobufAppendBytes(flow, schema.ColumnExporterName, []byte(flowExporterName))
 	c.d.Schema.ProtobufAppendVarint(flow, schema.ColumnInIfSpeed, uint64(flowInIfSpeed))
 	c.d.Schema.ProtobufAppendVarint(flow, schema.ColumnOutIfSpeed, uint64(flowOutIfSpeed))
@@ -196,6 +199,13 @@ func (c *Component) getNetMask(flowMask, bmpMask uint8) (mask uint8) {
 	return mask
 }
 
+// getBoundary returns the boundary of the most specific subnet in Boundaries
+// matching the provided address. Without a match, it returns the default of
+// Boundaries, or external when there is none.
+func (c *Component) getBoundary(addr netip.Addr) schema.InterfaceBoundary {
+	return c.boundaries.Load().LookupOrDefault(addr, schema.InterfaceBoundaryExternal)
+}
+
 func (c *Component) getNextHop(flowNextHop netip.Addr, bmpNextHop netip.Addr) (nextHop netip.Addr) {
 	nextHop = netip.IPv6Unspecified()
 	for _, provider := range c.config.NetProviders {
@@ -28,6 +28,7 @@ func TestEnrich(t *testing.T) {
 	cases := []struct {
 		Name          string
 		Configuration gin.H
+		Schema        schema.Configuration
 		InputFlow     func() *schema.FlowMessage
 		OutputFlow    *schema.FlowMessage
 	}{
@@ -531,6 +532,41 @@ ClassifyProviderRegex(Interface.Description, "^Transit: ([^ ]+)", "$1")`,
 					schema.ColumnDstNetMask:                    27,
 				},
 			},
+		}, {
+			Name: "tag boundaries",
+			Configuration: gin.H{"boundaries": gin.H{
+				"198.51.100.0/24": "internal",
+			}},
+			Schema: schema.Configuration{
+				Enabled: []schema.ColumnKey{schema.ColumnSrcBoundary, schema.ColumnDstBoundary},
+			},
+			InputFlow: func() *schema.FlowMessage {
+				return &schema.FlowMessage{
+					SamplingRate:    1000,
+					ExporterAddress: netip.MustParseAddr("::ffff:192.0.2.142"),
+					InIf:            100,
+					OutIf:           200,
+					SrcAddr:         netip.MustParseAddr("::ffff:198.51.100.10"),
+					DstAddr:         netip.MustParseAddr("::ffff:203.0.113.10"),
+				}
+			},
+			OutputFlow: &schema.FlowMessage{
+				SamplingRate:    1000,
+				ExporterAddress: netip.MustParseAddr("::ffff:192.0.2.142"),
+				SrcAddr:         netip.MustParseAddr("::ffff:198.51.100.10"),
+				DstAddr:         netip.MustParseAddr("::ffff:203.0.113.10"),
+				ProtobufDebug: map[schema.ColumnKey]interface{}{
+					schema.ColumnExporterName:     "192_0_2_142",
+					schema.ColumnInIfName:         "Gi0/0/100",
+					schema.ColumnOutIfName:        "Gi0/0/200",
+					schema.ColumnInIfDescription:  "Interface 100",
+					schema.ColumnOutIfDescription: "Interface 200",
+					schema.ColumnInIfSpeed:        1000,
+					schema.ColumnOutIfSpeed:       1000,
+					schema.ColumnSrcBoundary:      schema.InterfaceBoundaryInternal,
+					schema.ColumnDstBoundary:      schema.InterfaceBoundaryExternal,
+				},
+			},
 		},
 	}
 	for _, tc := range cases {
@@ -557,6 +593,11 @@ ClassifyProviderRegex(Interface.Description, "^Transit: ([^ ]+)", "$1")`,
 				t.Fatalf("Decode() error:\n%+v", err)
 			}
 
+			schemaComponent, err := schema.New(tc.Schema)
+			if err != nil {
+				t.Fatalf("schema.New() error:\n%+v", err)
+			}
+
 			// Instantiate and start core
 			c, err := New(r, configuration, Dependencies{
 				Daemon:   daemonComponent,
@@ -565,7 +606,7 @@ ClassifyProviderRegex(Interface.Description, "^Transit: ([^ ]+)", "$1")`,
 				Kafka:    kafkaComponent,
 				HTTP:     httpComponent,
 				Routing:  routingComponent,
-				Schema:   schema.NewMock(t),
+				Schema:   schemaComponent,
 			})
 			if err != nil {
 				t.Fatalf("New() error:\n%+v", err)
@@ -615,6 +656,13 @@ ClassifyProviderRegex(Interface.Description, "^Transit: ([^ ]+)", "$1")`,
 			if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
 				t.Fatalf("Metrics (-got, +want):\n%s", diff)
 			}
+			gotMetrics = r.GetMetrics("akvorado_subnetmap_")
+			expectedMetrics = map[string]string{
+				`entries{name="boundaries"}`: fmt.Sprint(configuration.Boundaries.Len()),
+			}
+			if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+				t.Fatalf("Metrics (-got, +want):\n%s", diff)
+			}
 		})
 	}
 }
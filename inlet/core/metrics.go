@@ -18,6 +18,9 @@ type metrics struct {
 	classifierExporterCacheSize  reporter.CounterFunc
 	classifierInterfaceCacheSize reporter.CounterFunc
 	classifierErrors             *reporter.CounterVec
+
+	boundaries             reporter.Gauge
+	boundariesReloadErrors reporter.Counter
 }
 
 func (c *Component) initMetrics() {
@@ -76,4 +79,18 @@ func (c *Component) initMetrics() {
 			Help: "Number of errors when evaluating a classifer",
 		},
 		[]string{"type", "index"})
+
+	c.metrics.boundaries = c.r.GlobalGaugeVec(
+		reporter.GaugeOpts{
+			Name: "subnetmap_entries",
+			Help: "Number of enabled subnets in a subnet map.",
+		},
+		[]string{"name"},
+	).WithLabelValues("boundaries")
+	c.metrics.boundariesReloadErrors = c.r.Counter(
+		reporter.CounterOpts{
+			Name: "boundaries_reload_errors_total",
+			Help: "Number of errors while reloading boundaries from a file.",
+		},
+	)
 }
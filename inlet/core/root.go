@@ -9,9 +9,11 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/benbjohnson/clock"
 	"gopkg.in/tomb.v2"
 
 	"akvorado/common/daemon"
+	"akvorado/common/helpers"
 	"akvorado/common/helpers/cache"
 	"akvorado/common/httpserver"
 	"akvorado/common/reporter"
@@ -39,6 +41,9 @@ type Component struct {
 	classifierExporterCache  *cache.Cache[exporterInfo, exporterClassification]
 	classifierInterfaceCache *cache.Cache[exporterAndInterfaceInfo, interfaceClassification]
 	classifierErrLogger      reporter.Logger
+
+	boundaries            atomic.Pointer[helpers.SubnetMap[schema.InterfaceBoundary]] // may be reloaded from a file
+	boundariesReloadDelay time.Duration
 }
 
 // Dependencies define the dependencies of the HTTP component.
@@ -50,10 +55,14 @@ type Dependencies struct {
 	Kafka    *kafka.Component
 	HTTP     *httpserver.Component
 	Schema   *schema.Component
+	Clock    clock.Clock
 }
 
 // New creates a new core component.
 func New(r *reporter.Reporter, configuration Configuration, dependencies Dependencies) (*Component, error) {
+	if dependencies.Clock == nil {
+		dependencies.Clock = clock.New()
+	}
 	c := Component{
 		r:      r,
 		d:      &dependencies,
@@ -66,16 +75,33 @@ func New(r *reporter.Reporter, configuration Configuration, dependencies Depende
 
 		classifierExporterCache:  cache.New[exporterInfo, exporterClassification](),
 		classifierInterfaceCache: cache.New[exporterAndInterfaceInfo, interfaceClassification](),
-		classifierErrLogger:      r.Sample(reporter.BurstSampler(10*time.Second, 3)),
+		classifierErrLogger:      r.Sample(r.SiteSampler("classifier", 10*time.Second, 3)),
+
+		boundariesReloadDelay: time.Second,
 	}
 	c.d.Daemon.Track(&c.t, "inlet/core")
 	c.initMetrics()
+	c.storeBoundaries(&c.config.Boundaries)
 	return &c, nil
 }
 
+// storeBoundaries replaces the boundaries used to classify interfaces.
+func (c *Component) storeBoundaries(boundaries *helpers.SubnetMap[schema.InterfaceBoundary]) {
+	c.boundaries.Store(boundaries)
+	c.metrics.boundaries.Set(float64(boundaries.Len()))
+}
+
 // Start starts the core component.
 func (c *Component) Start() error {
 	c.r.Info().Msg("starting core component")
+
+	// Reload boundaries when included from a file
+	if path := c.config.Boundaries.IncludedFrom(); path != "" {
+		if err := c.watchBoundaries(path); err != nil {
+			return fmt.Errorf("cannot watch boundaries: %w", err)
+		}
+	}
+
 	for i := range c.config.Workers {
 		workerID := i
 		c.t.Go(func() error {
@@ -113,6 +113,7 @@ func TestCore(t *testing.T) {
 		time.Sleep(20 * time.Millisecond)
 		gotMetrics := r.GetMetrics("akvorado_inlet_core_", "-flows_processing_")
 		expectedMetrics := map[string]string{
+			`boundaries_reload_errors_total`:                                     "0",
 			`classifier_exporter_cache_size_items`:                               "0",
 			`classifier_interface_cache_size_items`:                              "0",
 			`flows_errors_total{error="SNMP cache miss",exporter="192.0.2.142"}`: "1",
@@ -20,6 +20,13 @@ type Configuration struct {
 	// RateLimit defines a rate limit on the number of flows per
 	// second. The limit is per-exporter.
 	RateLimit rate.Limit `validate:"isdefault|min=100"`
+	// EnterpriseFields maps enterprise-specific IPFIX information elements
+	// to columns.
+	EnterpriseFields []decoder.EnterpriseField `yaml:",omitempty" validate:"dive"`
+	// SamplingRateMaxMissedRefreshes is the number of refreshes of a NetFlow
+	// v9 or IPFIX options template without options data after which the
+	// sampling rates it provided are expired. 0 is handled like 1.
+	SamplingRateMaxMissedRefreshes uint
 }
 
 // DefaultConfiguration represents the default configuration for the flow component
@@ -34,6 +41,7 @@ func DefaultConfiguration() Configuration {
 			Decoder:         "sflow",
 			Config:          udp.DefaultConfiguration(),
 		}},
+		SamplingRateMaxMissedRefreshes: 3,
 	}
 }
 
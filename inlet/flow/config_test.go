@@ -311,6 +311,7 @@ func TestMarshalYAML(t *testing.T) {
       usesrcaddrforexporteraddr: true
       workers: 3
 ratelimit: 0
+samplingratemaxmissedrefreshes: 0
 `
 	if diff := helpers.Diff(strings.Split(string(got), "\n"), strings.Split(expected, "\n")); diff != "" {
 		t.Fatalf("Marshal() (-got, +want):\n%s", diff)
@@ -3,6 +3,14 @@
 
 package decoder
 
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"akvorado/common/schema"
+)
+
 // TimestampSource defines the method to use to extract the TimeReceived for the flows
 type TimestampSource uint
 
@@ -17,3 +25,44 @@ const (
 	// from each flow "FIRST_SWITCHED" field
 	TimestampSourceNetflowFirstSwitched
 )
+
+// EnterpriseField maps an enterprise-specific IPFIX information element to a
+// column of the schema.
+type EnterpriseField struct {
+	// EnterpriseNumber is the private enterprise number of the information
+	// element.
+	EnterpriseNumber uint32 `validate:"min=1"`
+	// ElementID is the identifier of the information element, without the
+	// enterprise bit.
+	ElementID uint16 `validate:"min=1,max=32767"`
+	// Column is the column receiving the value.
+	Column schema.ColumnKey `validate:"required"`
+	// Type tells how to decode the value: uint, string or ip.
+	Type string `validate:"oneof=uint string ip"`
+}
+
+// Check verifies the column can receive a value of the configured type.
+func (ef EnterpriseField) Check(sch *schema.Component) error {
+	column, ok := sch.LookupColumnByKey(ef.Column)
+	if !ok || column.ProtobufIndex <= 0 {
+		return fmt.Errorf("column %s cannot be set from flows", ef.Column)
+	}
+	if column.Disabled {
+		return fmt.Errorf("column %s is disabled", ef.Column)
+	}
+	var compatible bool
+	switch ef.Type {
+	case "uint":
+		compatible = column.ProtobufType == protoreflect.Uint32Kind ||
+			column.ProtobufType == protoreflect.Uint64Kind ||
+			column.ProtobufType == protoreflect.EnumKind
+	case "string":
+		compatible = column.ProtobufType == protoreflect.StringKind
+	case "ip":
+		compatible = column.ProtobufType == protoreflect.BytesKind
+	}
+	if !compatible {
+		return fmt.Errorf("column %s cannot receive a value of type %s", ef.Column, ef.Type)
+	}
+	return nil
+}
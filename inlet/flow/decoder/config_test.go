@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package decoder
+
+import (
+	"testing"
+
+	"akvorado/common/schema"
+)
+
+func TestEnterpriseFieldCheck(t *testing.T) {
+	sch := schema.NewMock(t)
+	cases := []struct {
+		Column schema.ColumnKey
+		Type   string
+		Error  bool
+	}{
+		{schema.ColumnSrcPort, "uint", false},
+		{schema.ColumnInIfDescription, "string", false},
+		{schema.ColumnSrcAddr, "ip", false},
+		{schema.ColumnSrcPort, "string", true},
+		{schema.ColumnInIfDescription, "ip", true},
+		{schema.ColumnSrcAddr, "uint", true},
+		// Not in the protobuf schema
+		{schema.ColumnSrcNetPrefix, "string", true},
+		// Disabled by default
+		{schema.ColumnSrcAddrNAT, "ip", true},
+	}
+	for _, tc := range cases {
+		err := EnterpriseField{
+			EnterpriseNumber: 12356,
+			ElementID:        100,
+			Column:           tc.Column,
+			Type:             tc.Type,
+		}.Check(sch)
+		if err == nil && tc.Error {
+			t.Errorf("Check(%s, %s) did not error", tc.Column, tc.Type)
+		} else if err != nil && !tc.Error {
+			t.Errorf("Check(%s, %s) error:\n%+v", tc.Column, tc.Type, err)
+		}
+	}
+}
@@ -5,8 +5,10 @@
 package netflow
 
 import (
+	"bytes"
 	"encoding/binary"
 	"net/netip"
+	"strconv"
 
 	"akvorado/common/helpers"
 	"akvorado/common/schema"
@@ -58,7 +60,7 @@ func (nd *Decoder) decodeNFv5(packet *netflowlegacy.PacketNetFlowV5, ts, sysUpti
 	return flowMessageSet
 }
 
-func (nd *Decoder) decodeNFv9IPFIX(version uint16, obsDomainID uint32, flowSets []interface{}, samplingRateSys *samplingRateSystem, ts, sysUptime uint64) []*schema.FlowMessage {
+func (nd *Decoder) decodeNFv9IPFIX(key string, version uint16, obsDomainID uint32, flowSets []interface{}, samplingRateSys *samplingRateSystem, ts, sysUptime uint64) []*schema.FlowMessage {
 	flowMessageSet := []*schema.FlowMessage{}
 
 	// Look for sampling rate in option data flowsets
@@ -91,12 +93,12 @@ func (nd *Decoder) decodeNFv9IPFIX(version uint16, obsDomainID uint32, flowSets
 					samplingRate = (packetInterval + packetSpace) / packetInterval
 				}
 				if samplingRate > 0 {
-					samplingRateSys.SetSamplingRate(version, obsDomainID, samplerID, samplingRate)
+					samplingRateSys.SetSamplingRate(version, obsDomainID, tFlowSet.Id, samplerID, samplingRate)
 				}
 			}
 		case netflow.DataFlowSet:
 			for _, record := range tFlowSet.Records {
-				flow := nd.decodeRecord(version, obsDomainID, samplingRateSys, record.Values, ts, sysUptime)
+				flow := nd.decodeRecord(key, version, obsDomainID, samplingRateSys, record.Values, ts, sysUptime)
 				if flow != nil {
 					flowMessageSet = append(flowMessageSet, flow)
 				}
@@ -107,7 +109,7 @@ func (nd *Decoder) decodeNFv9IPFIX(version uint16, obsDomainID uint32, flowSets
 	return flowMessageSet
 }
 
-func (nd *Decoder) decodeRecord(version uint16, obsDomainID uint32, samplingRateSys *samplingRateSystem, fields []netflow.DataField, ts, sysUptime uint64) *schema.FlowMessage {
+func (nd *Decoder) decodeRecord(key string, version uint16, obsDomainID uint32, samplingRateSys *samplingRateSystem, fields []netflow.DataField, ts, sysUptime uint64) *schema.FlowMessage {
 	var etype, dstPort, srcPort uint16
 	var proto, icmpType, icmpCode uint8
 	var foundIcmpTypeCode bool
@@ -115,7 +117,11 @@ func (nd *Decoder) decodeRecord(version uint16, obsDomainID uint32, samplingRate
 	dataLinkFrameSectionIdx := -1
 	for idx, field := range fields {
 		v, ok := field.Value.([]byte)
-		if !ok || field.PenProvided {
+		if !ok {
+			continue
+		}
+		if field.PenProvided {
+			nd.decodeEnterpriseField(key, bf, field, v)
 			continue
 		}
 
@@ -304,6 +310,30 @@ func (nd *Decoder) decodeRecord(version uint16, obsDomainID uint32, samplingRate
 	return bf
 }
 
+// decodeEnterpriseField decodes an enterprise-specific field using the
+// configured mapping. Fields without a mapping are only counted.
+func (nd *Decoder) decodeEnterpriseField(key string, bf *schema.FlowMessage, field netflow.DataField, v []byte) {
+	elementID := field.Type & 0x7fff
+	ef, ok := nd.enterpriseFields[enterpriseFieldKey{
+		enterpriseNumber: field.Pen,
+		elementID:        elementID,
+	}]
+	if !ok {
+		nd.metrics.unknownEnterpriseFields.WithLabelValues(key,
+			strconv.FormatUint(uint64(field.Pen), 10),
+			strconv.FormatUint(uint64(elementID), 10)).Inc()
+		return
+	}
+	switch ef.Type {
+	case "uint":
+		nd.d.Schema.ProtobufAppendVarint(bf, ef.Column, decodeUNumber(v))
+	case "string":
+		nd.d.Schema.ProtobufAppendBytes(bf, ef.Column, bytes.TrimRight(v, "\x00"))
+	case "ip":
+		nd.d.Schema.ProtobufAppendIP(bf, ef.Column, decodeIPFromBytes(v))
+	}
+}
+
 func decodeUNumber(b []byte) uint64 {
 	var o uint64
 	l := len(b)
@@ -32,12 +32,20 @@ type Decoder struct {
 	templates   map[string]*templateSystem
 	sampling    map[string]*samplingRateSystem
 
+	// Enterprise-specific information elements to decode
+	enterpriseFields map[enterpriseFieldKey]decoder.EnterpriseField
+
+	// Number of refreshes of an options template without options data
+	// before expiring the sampling rates
+	samplingRateMaxMissedRefreshes uint
+
 	metrics struct {
-		errors             *reporter.CounterVec
-		stats              *reporter.CounterVec
-		setRecordsStatsSum *reporter.CounterVec
-		setStatsSum        *reporter.CounterVec
-		templatesStats     *reporter.CounterVec
+		errors                  *reporter.CounterVec
+		stats                   *reporter.CounterVec
+		setRecordsStatsSum      *reporter.CounterVec
+		setStatsSum             *reporter.CounterVec
+		templatesStats          *reporter.CounterVec
+		unknownEnterpriseFields *reporter.CounterVec
 	}
 	useTsFromNetflowsPacket bool
 	useTsFromFirstSwitched  bool
@@ -48,11 +56,20 @@ func New(r *reporter.Reporter, dependencies decoder.Dependencies, option decoder
 	nd := &Decoder{
 		r:                       r,
 		d:                       dependencies,
-		errLogger:               r.Sample(reporter.BurstSampler(30*time.Second, 3)),
+		errLogger:               r.Sample(r.SiteSampler("netflow", 30*time.Second, 3)),
 		templates:               map[string]*templateSystem{},
 		sampling:                map[string]*samplingRateSystem{},
 		useTsFromNetflowsPacket: option.TimestampSource == decoder.TimestampSourceNetflowPacket,
 		useTsFromFirstSwitched:  option.TimestampSource == decoder.TimestampSourceNetflowFirstSwitched,
+		enterpriseFields:        map[enterpriseFieldKey]decoder.EnterpriseField{},
+
+		samplingRateMaxMissedRefreshes: max(option.SamplingRateMaxMissedRefreshes, 1),
+	}
+	for _, field := range option.EnterpriseFields {
+		nd.enterpriseFields[enterpriseFieldKey{
+			enterpriseNumber: field.EnterpriseNumber,
+			elementID:        field.ElementID,
+		}] = field
 	}
 
 	nd.metrics.errors = nd.r.CounterVec(
@@ -90,6 +107,13 @@ func New(r *reporter.Reporter, dependencies decoder.Dependencies, option decoder
 		},
 		[]string{"exporter", "version", "obs_domain_id", "template_id", "type"},
 	)
+	nd.metrics.unknownEnterpriseFields = nd.r.CounterVec(
+		reporter.CounterOpts{
+			Name: "unknown_enterprise_fields_total",
+			Help: "IPFIX enterprise-specific fields without a mapping.",
+		},
+		[]string{"exporter", "enterprise", "element"},
+	)
 
 	return nd
 }
@@ -98,6 +122,7 @@ type templateSystem struct {
 	nd        *Decoder
 	key       string
 	templates netflow.NetFlowTemplateSystem
+	sampling  *samplingRateSystem
 }
 
 func (s *templateSystem) AddTemplate(version uint16, obsDomainID uint32, templateID uint16, template interface{}) error {
@@ -110,9 +135,11 @@ func (s *templateSystem) AddTemplate(version uint16, obsDomainID uint32, templat
 	case netflow.IPFIXOptionsTemplateRecord:
 		templateID = templateIDConv.TemplateId
 		typeStr = "options_template"
+		s.sampling.Expire(version, obsDomainID, templateID)
 	case netflow.NFv9OptionsTemplateRecord:
 		templateID = templateIDConv.TemplateId
 		typeStr = "options_template"
+		s.sampling.Expire(version, obsDomainID, templateID)
 	case netflow.TemplateRecord:
 		templateID = templateIDConv.TemplateId
 		typeStr = "template"
@@ -136,15 +163,31 @@ func (s *templateSystem) RemoveTemplate(version uint16, obsDomainID uint32, temp
 	return s.templates.RemoveTemplate(version, obsDomainID, templateID)
 }
 
+type enterpriseFieldKey struct {
+	enterpriseNumber uint32
+	elementID        uint16
+}
+
 type samplingRateKey struct {
 	version     uint16
 	obsDomainID uint32
 	samplerID   uint64
 }
 
+type samplingRate struct {
+	rate uint32
+	// templateID is the ID of the options template of the options data
+	// providing the sampling rate
+	templateID uint16
+	// refreshes is the number of refreshes of its options template since
+	// the sampling rate was set
+	refreshes uint
+}
+
 type samplingRateSystem struct {
-	lock  sync.RWMutex
-	rates map[samplingRateKey]uint32
+	lock      sync.RWMutex
+	rates     map[samplingRateKey]samplingRate
+	maxMissed uint
 }
 
 func (s *samplingRateSystem) GetSamplingRate(version uint16, obsDomainID uint32, samplerID uint64) uint32 {
@@ -155,17 +198,42 @@ func (s *samplingRateSystem) GetSamplingRate(version uint16, obsDomainID uint32,
 		obsDomainID: obsDomainID,
 		samplerID:   samplerID,
 	}]
-	return rate
+	return rate.rate
 }
 
-func (s *samplingRateSystem) SetSamplingRate(version uint16, obsDomainID uint32, samplerID uint64, samplingRate uint32) {
+func (s *samplingRateSystem) SetSamplingRate(version uint16, obsDomainID uint32, templateID uint16, samplerID uint64, rate uint32) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 	s.rates[samplingRateKey{
 		version:     version,
 		obsDomainID: obsDomainID,
 		samplerID:   samplerID,
-	}] = samplingRate
+	}] = samplingRate{rate: rate, templateID: templateID}
+}
+
+// Expire is called each time an options template is received. Options data
+// for samplers still present should follow each refresh of the options
+// template, but an exporter may send the options template several times before
+// the options data. Therefore, Expire only removes the sampling rates for the
+// provided observation domain and options template once maxMissed refreshes
+// were not followed by options data. Sampling rates provided by other options
+// templates are left untouched.
+func (s *samplingRateSystem) Expire(version uint16, obsDomainID uint32, templateID uint16) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for k, rate := range s.rates {
+		if k.version != version || k.obsDomainID != obsDomainID || rate.templateID != templateID {
+			continue
+		}
+		// A refresh is expected after the options data. Only the next
+		// ones are misses.
+		rate.refreshes++
+		if rate.refreshes > s.maxMissed {
+			delete(s.rates, k)
+			continue
+		}
+		s.rates[k] = rate
+	}
 }
 
 // Decode decodes a Netflow payload.
@@ -178,22 +246,29 @@ func (nd *Decoder) Decode(in decoder.RawFlow) []*schema.FlowMessage {
 	templates, tok := nd.templates[key]
 	sampling, sok := nd.sampling[key]
 	nd.systemsLock.RUnlock()
-	if !tok {
-		templates = &templateSystem{
-			nd:        nd,
-			templates: netflow.CreateTemplateSystem(),
-			key:       key,
-		}
+	if !tok || !sok {
+		// Both systems are created together so that the template system
+		// always references the sampling system in use. Another goroutine
+		// may have created them in the meantime.
 		nd.systemsLock.Lock()
-		nd.templates[key] = templates
-		nd.systemsLock.Unlock()
-	}
-	if !sok {
-		sampling = &samplingRateSystem{
-			rates: map[samplingRateKey]uint32{},
+		templates, tok = nd.templates[key]
+		sampling, sok = nd.sampling[key]
+		if !sok {
+			sampling = &samplingRateSystem{
+				rates:     map[samplingRateKey]samplingRate{},
+				maxMissed: nd.samplingRateMaxMissedRefreshes,
+			}
+			nd.sampling[key] = sampling
+		}
+		if !tok {
+			templates = &templateSystem{
+				nd:        nd,
+				templates: netflow.CreateTemplateSystem(),
+				key:       key,
+				sampling:  sampling,
+			}
+			nd.templates[key] = templates
 		}
-		nd.systemsLock.Lock()
-		nd.sampling[key] = sampling
 		nd.systemsLock.Unlock()
 	}
 
@@ -243,7 +318,7 @@ func (nd *Decoder) Decode(in decoder.RawFlow) []*schema.FlowMessage {
 			ts = uint64(packetNFv9.UnixSeconds)
 			sysUptime = uint64(packetNFv9.SystemUptime)
 		}
-		flowMessageSet = nd.decodeNFv9IPFIX(version, obsDomainID, flowSets, sampling, ts, sysUptime)
+		flowMessageSet = nd.decodeNFv9IPFIX(key, version, obsDomainID, flowSets, sampling, ts, sysUptime)
 	case 10:
 		var packetIPFIX netflow.IPFIXPacket
 		if err := netflow.DecodeMessageIPFIX(buf, templates, &packetIPFIX); err != nil {
@@ -261,7 +336,7 @@ func (nd *Decoder) Decode(in decoder.RawFlow) []*schema.FlowMessage {
 		if nd.useTsFromNetflowsPacket {
 			ts = uint64(packetIPFIX.ExportTime)
 		}
-		flowMessageSet = nd.decodeNFv9IPFIX(version, obsDomainID, flowSets, sampling, ts, sysUptime)
+		flowMessageSet = nd.decodeNFv9IPFIX(key, version, obsDomainID, flowSets, sampling, ts, sysUptime)
 	default:
 		nd.metrics.stats.WithLabelValues(key, "unknown").
 			Inc()
@@ -8,8 +8,11 @@ import (
 	"net"
 	"net/netip"
 	"path/filepath"
+	"sync"
 	"testing"
 
+	"github.com/netsampler/goflow2/v2/decoders/netflow"
+
 	"akvorado/common/helpers"
 	"akvorado/common/reporter"
 	"akvorado/common/schema"
@@ -346,6 +349,89 @@ func TestDecodeMultipleSamplingRates(t *testing.T) {
 	}
 }
 
+func TestDecodeSamplingRatesExpiration(t *testing.T) {
+	r := reporter.NewMock(t)
+	nfdecoder := New(r, decoder.Dependencies{Schema: schema.NewMock(t).EnableAllColumns()}, decoder.Option{
+		TimestampSource:                decoder.TimestampSourceUDP,
+		SamplingRateMaxMissedRefreshes: 2,
+	})
+	decode := func(pcap string) []*schema.FlowMessage {
+		data := helpers.ReadPcapL4(t, filepath.Join("testdata", pcap))
+		return nfdecoder.Decode(decoder.RawFlow{Payload: data, Source: net.ParseIP("127.0.0.1")})
+	}
+	samplingRates := func(flows []*schema.FlowMessage) []uint32 {
+		result := []uint32{}
+		for _, flow := range flows[:2] {
+			result = append(result, flow.SamplingRate)
+		}
+		return result
+	}
+
+	decode("multiplesamplingrates-options-template.pcap")
+	decode("multiplesamplingrates-options-data.pcap")
+	decode("multiplesamplingrates-template.pcap")
+	got := decode("multiplesamplingrates-data.pcap")
+	if diff := helpers.Diff(samplingRates(got), []uint32{4000, 2000}); diff != "" {
+		t.Fatalf("Decode() (-got, +want):\n%s", diff)
+	}
+
+	// The options template is refreshed and followed by options data: the
+	// sampling rates are kept.
+	decode("multiplesamplingrates-options-template.pcap")
+	decode("multiplesamplingrates-options-data.pcap")
+	decode("multiplesamplingrates-options-template.pcap")
+	got = decode("multiplesamplingrates-data.pcap")
+	if diff := helpers.Diff(samplingRates(got), []uint32{4000, 2000}); diff != "" {
+		t.Fatalf("Decode() after refresh (-got, +want):\n%s", diff)
+	}
+
+	// Another options template is received twice back to back: the sampling
+	// rates provided by the first options template are kept.
+	templates := nfdecoder.(*Decoder).templates["127.0.0.1"]
+	for range 2 {
+		templates.AddTemplate(9, 0, 258, netflow.NFv9OptionsTemplateRecord{TemplateId: 258})
+	}
+	got = decode("multiplesamplingrates-data.pcap")
+	if diff := helpers.Diff(samplingRates(got), []uint32{4000, 2000}); diff != "" {
+		t.Fatalf("Decode() after another options template (-got, +want):\n%s", diff)
+	}
+
+	// The options template is refreshed again before any new options data: this
+	// is a first missed refresh and the sampling rates are kept.
+	decode("multiplesamplingrates-options-template.pcap")
+	got = decode("multiplesamplingrates-data.pcap")
+	if diff := helpers.Diff(samplingRates(got), []uint32{4000, 2000}); diff != "" {
+		t.Fatalf("Decode() after a missed refresh (-got, +want):\n%s", diff)
+	}
+
+	// A second missed refresh: the sampling rates are expired.
+	decode("multiplesamplingrates-options-template.pcap")
+	got = decode("multiplesamplingrates-data.pcap")
+	if diff := helpers.Diff(samplingRates(got), []uint32{0, 0}); diff != "" {
+		t.Fatalf("Decode() after expiration (-got, +want):\n%s", diff)
+	}
+}
+
+func TestDecodeConcurrentSystems(t *testing.T) {
+	r := reporter.NewMock(t)
+	nfdecoder := New(r, decoder.Dependencies{Schema: schema.NewMock(t)}, decoder.Option{TimestampSource: decoder.TimestampSourceUDP})
+	data := helpers.ReadPcapL4(t, filepath.Join("testdata", "multiplesamplingrates-options-template.pcap"))
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			nfdecoder.Decode(decoder.RawFlow{Payload: data, Source: net.ParseIP("127.0.0.1")})
+		}()
+	}
+	wg.Wait()
+
+	nd := nfdecoder.(*Decoder)
+	if nd.templates["127.0.0.1"].sampling != nd.sampling["127.0.0.1"] {
+		t.Fatal("Decode() linked the template system to a stale sampling system")
+	}
+}
+
 func TestDecodeICMP(t *testing.T) {
 	r := reporter.NewMock(t)
 	nfdecoder := New(r, decoder.Dependencies{Schema: schema.NewMock(t).EnableAllColumns()}, decoder.Option{TimestampSource: decoder.TimestampSourceUDP})
@@ -629,3 +715,52 @@ func TestDecodeTimestampFromFirstSwitched(t *testing.T) {
 		}
 	}
 }
+
+func TestDecodeEnterpriseFields(t *testing.T) {
+	r := reporter.NewMock(t)
+	nfdecoder := New(r, decoder.Dependencies{Schema: schema.NewMock(t).EnableAllColumns()}, decoder.Option{
+		TimestampSource: decoder.TimestampSourceUDP,
+		EnterpriseFields: []decoder.EnterpriseField{
+			{EnterpriseNumber: 12356, ElementID: 100, Column: schema.ColumnSrcAddrNAT, Type: "ip"},
+			{EnterpriseNumber: 12356, ElementID: 101, Column: schema.ColumnSrcPortNAT, Type: "uint"},
+			{EnterpriseNumber: 12356, ElementID: 102, Column: schema.ColumnInIfDescription, Type: "string"},
+		},
+	})
+
+	// Template and data are in the same packet. Element 103 has no mapping.
+	data := helpers.ReadPcapL4(t, filepath.Join("testdata", "ipfix-enterprise.pcap"))
+	got := nfdecoder.Decode(decoder.RawFlow{Payload: data, Source: net.ParseIP("127.0.0.1")})
+	expectedFlows := []*schema.FlowMessage{
+		{
+			SamplingRate:    0,
+			ExporterAddress: netip.MustParseAddr("::ffff:127.0.0.1"),
+			SrcAddr:         netip.MustParseAddr("::ffff:198.51.100.10"),
+			DstAddr:         netip.MustParseAddr("::ffff:192.0.2.10"),
+			ProtobufDebug: map[schema.ColumnKey]interface{}{
+				schema.ColumnBytes:           1500,
+				schema.ColumnPackets:         10,
+				schema.ColumnProto:           6,
+				schema.ColumnSrcPort:         443,
+				schema.ColumnDstPort:         33000,
+				schema.ColumnEType:           helpers.ETypeIPv4,
+				schema.ColumnSrcAddrNAT:      netip.MustParseAddr("::ffff:203.0.113.10"),
+				schema.ColumnSrcPortNAT:      12345,
+				schema.ColumnInIfDescription: []byte("social-media"),
+			},
+		},
+	}
+	for _, f := range got {
+		f.TimeReceived = 0
+	}
+	if diff := helpers.Diff(got, expectedFlows); diff != "" {
+		t.Fatalf("Decode() (-got, +want):\n%s", diff)
+	}
+
+	gotMetrics := r.GetMetrics("akvorado_inlet_flow_decoder_netflow_", "unknown_enterprise_fields_total")
+	expectedMetrics := map[string]string{
+		`unknown_enterprise_fields_total{element="103",enterprise="12356",exporter="127.0.0.1"}`: "1",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics (-got, +want):\n%s", diff)
+	}
+}
@@ -28,6 +28,13 @@ type Decoder interface {
 type Option struct {
 	// TimestampSource is a selector for how to set the TimeReceived.
 	TimestampSource TimestampSource
+	// EnterpriseFields maps enterprise-specific IPFIX information elements
+	// to columns.
+	EnterpriseFields []EnterpriseField
+	// SamplingRateMaxMissedRefreshes is the number of refreshes of an options
+	// template without options data after which the sampling rates it
+	// provided are expired.
+	SamplingRateMaxMissedRefreshes uint
 }
 
 // Dependencies are the dependencies for the decoder
@@ -0,0 +1,269 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-FileCopyrightText: 2021 NetSampler
+// SPDX-License-Identifier: AGPL-3.0-only AND BSD-3-Clause
+
+package sflow
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/netsampler/goflow2/v2/decoders/sflow"
+	"github.com/netsampler/goflow2/v2/decoders/utils"
+)
+
+const (
+	// asPathSegmentSet is an unordered set of ASNs in the AS path
+	asPathSegmentSet = 1
+	// asPathSegmentSequence is an ordered sequence of ASNs in the AS path
+	asPathSegmentSequence = 2
+	// maxElements is the maximum number of elements accepted for any
+	// variable-length array, as a protection against crafted datagrams
+	maxElements = 1000
+)
+
+// decodeMessage decodes an sFlow v5 datagram. This is similar to
+// sflow.DecodeMessageVersion, except a malformed or truncated record is skipped
+// instead of aborting the whole datagram and extended gateway records are
+// decoded with decodeExtendedGateway. The number of skipped records, including
+// a truncated sample, is returned.
+func decodeMessage(payload *bytes.Buffer, packet *sflow.Packet) (int, error) {
+	if err := utils.BinaryDecoder(payload, &packet.Version); err != nil {
+		return 0, fmt.Errorf("version: %w", err)
+	}
+	if packet.Version != 5 {
+		return 0, fmt.Errorf("unknown version %d", packet.Version)
+	}
+	var err error
+	if packet.IPVersion, packet.AgentIP, err = sflow.DecodeIP(payload); err != nil {
+		return 0, fmt.Errorf("agent: %w", err)
+	}
+	if err := utils.BinaryDecoder(payload,
+		&packet.SubAgentId,
+		&packet.SequenceNumber,
+		&packet.Uptime,
+		&packet.SamplesCount,
+	); err != nil {
+		return 0, fmt.Errorf("header: %w", err)
+	}
+	if packet.SamplesCount > maxElements {
+		return 0, fmt.Errorf("too many samples: %d", packet.SamplesCount)
+	}
+
+	skipped := 0
+	packet.Samples = make([]interface{}, 0, int(packet.SamplesCount))
+	for i := 0; i < int(packet.SamplesCount) && payload.Len() >= 8; i++ {
+		header := sflow.SampleHeader{}
+		if err := utils.BinaryDecoder(payload, &header.Format, &header.Length); err != nil {
+			return skipped, fmt.Errorf("sample header: %w", err)
+		}
+		if int(header.Length) > payload.Len() {
+			// Truncated sample, nothing can be decoded after it
+			skipped++
+			break
+		}
+		sample, n, err := decodeSample(&header, bytes.NewBuffer(payload.Next(int(header.Length))))
+		skipped += n
+		if err != nil {
+			return skipped, &sflow.FlowError{
+				Format: header.Format,
+				Seq:    header.SampleSequenceNumber,
+				Err:    err,
+			}
+		}
+		packet.Samples = append(packet.Samples, sample)
+	}
+	return skipped, nil
+}
+
+// decodeSample decodes a sample. It returns the sample and the number of
+// skipped records.
+func decodeSample(header *sflow.SampleHeader, payload *bytes.Buffer) (interface{}, int, error) {
+	if err := utils.BinaryDecoder(payload, &header.SampleSequenceNumber); err != nil {
+		return nil, 0, fmt.Errorf("header seq: %w", err)
+	}
+	switch header.Format {
+	case sflow.SAMPLE_FORMAT_FLOW, sflow.SAMPLE_FORMAT_COUNTER:
+		// Interlaced data-source format
+		var sourceID uint32
+		if err := utils.BinaryDecoder(payload, &sourceID); err != nil {
+			return nil, 0, fmt.Errorf("header source: %w", err)
+		}
+		header.SourceIdType = sourceID >> 24
+		header.SourceIdValue = sourceID & 0x00ffffff
+	case sflow.SAMPLE_FORMAT_EXPANDED_FLOW, sflow.SAMPLE_FORMAT_EXPANDED_COUNTER, sflow.SAMPLE_FORMAT_DROP:
+		// Explicit data-source format
+		if err := utils.BinaryDecoder(payload, &header.SourceIdType, &header.SourceIdValue); err != nil {
+			return nil, 0, fmt.Errorf("header source: %w", err)
+		}
+	default:
+		return nil, 0, fmt.Errorf("unknown format %d", header.Format)
+	}
+
+	switch header.Format {
+	case sflow.SAMPLE_FORMAT_FLOW:
+		sample := sflow.FlowSample{Header: *header}
+		if err := utils.BinaryDecoder(payload,
+			&sample.SamplingRate,
+			&sample.SamplePool,
+			&sample.Drops,
+			&sample.Input,
+			&sample.Output,
+			&sample.FlowRecordsCount,
+		); err != nil {
+			return nil, 0, fmt.Errorf("flow sample: %w", err)
+		}
+		records, skipped, err := decodeRecords(payload, sample.FlowRecordsCount, decodeFlowRecord)
+		sample.Records = records
+		return sample, skipped, err
+	case sflow.SAMPLE_FORMAT_EXPANDED_FLOW:
+		sample := sflow.ExpandedFlowSample{Header: *header}
+		if err := utils.BinaryDecoder(payload,
+			&sample.SamplingRate,
+			&sample.SamplePool,
+			&sample.Drops,
+			&sample.InputIfFormat,
+			&sample.InputIfValue,
+			&sample.OutputIfFormat,
+			&sample.OutputIfValue,
+			&sample.FlowRecordsCount,
+		); err != nil {
+			return nil, 0, fmt.Errorf("expanded flow sample: %w", err)
+		}
+		records, skipped, err := decodeRecords(payload, sample.FlowRecordsCount, decodeFlowRecord)
+		sample.Records = records
+		return sample, skipped, err
+	case sflow.SAMPLE_FORMAT_DROP:
+		sample := sflow.DropSample{Header: *header}
+		if err := utils.BinaryDecoder(payload,
+			&sample.Drops,
+			&sample.Input,
+			&sample.Output,
+			&sample.Reason,
+			&sample.FlowRecordsCount,
+		); err != nil {
+			return nil, 0, fmt.Errorf("drop sample: %w", err)
+		}
+		records, skipped, err := decodeRecords(payload, sample.FlowRecordsCount, decodeFlowRecord)
+		sample.Records = records
+		return sample, skipped, err
+	default: // counter samples
+		sample := sflow.CounterSample{Header: *header}
+		if err := utils.BinaryDecoder(payload, &sample.CounterRecordsCount); err != nil {
+			return nil, 0, fmt.Errorf("counter sample: %w", err)
+		}
+		records, skipped, err := decodeRecords(payload, sample.CounterRecordsCount, sflow.DecodeCounterRecord)
+		sample.Records = records
+		return sample, skipped, err
+	}
+}
+
+// decodeRecords decodes count records with the provided function. As each
+// record has its own length, a record which cannot be decoded is skipped. It
+// returns the decoded records and the number of skipped records.
+func decodeRecords[T any](payload *bytes.Buffer, count uint32, decode func(*sflow.RecordHeader, *bytes.Buffer) (T, error)) ([]T, int, error) {
+	if count > maxElements {
+		return nil, 0, fmt.Errorf("too many records: %d", count)
+	}
+	records := make([]T, 0, count)
+	skipped := 0
+	for i := 0; i < int(count) && payload.Len() >= 8; i++ {
+		header := sflow.RecordHeader{}
+		if err := utils.BinaryDecoder(payload, &header.DataFormat, &header.Length); err != nil {
+			return records, skipped, fmt.Errorf("record header: %w", err)
+		}
+		if int(header.Length) > payload.Len() {
+			// Truncated record, nothing can be decoded after it
+			skipped++
+			break
+		}
+		record, err := decode(&header, bytes.NewBuffer(payload.Next(int(header.Length))))
+		if err != nil {
+			skipped++
+			continue
+		}
+		records = append(records, record)
+	}
+	return records, skipped, nil
+}
+
+// decodeFlowRecord decodes a flow record. Extended gateway records are handled
+// by decodeExtendedGateway, other records by sflow.DecodeFlowRecord.
+func decodeFlowRecord(header *sflow.RecordHeader, payload *bytes.Buffer) (sflow.FlowRecord, error) {
+	if header.DataFormat != sflow.FLOW_TYPE_EXT_GATEWAY {
+		return sflow.DecodeFlowRecord(header, payload)
+	}
+	extendedGateway, err := decodeExtendedGateway(payload)
+	if err != nil {
+		return sflow.FlowRecord{}, &sflow.RecordError{DataFormat: header.DataFormat, Err: err}
+	}
+	return sflow.FlowRecord{Header: *header, Data: extendedGateway}, nil
+}
+
+// decodeExtendedGateway decodes an extended gateway record. Contrary to
+// sflow.DecodeFlowRecord, all the segments of the destination AS path are
+// decoded. They are flattened into ASPath: only the first ASN of an AS set is
+// kept. ASPathType and ASPathLength are not set.
+func decodeExtendedGateway(payload *bytes.Buffer) (sflow.ExtendedGateway, error) {
+	var extendedGateway sflow.ExtendedGateway
+	var err error
+	if extendedGateway.NextHopIPVersion, extendedGateway.NextHop, err = sflow.DecodeIP(payload); err != nil {
+		return extendedGateway, fmt.Errorf("next hop: %w", err)
+	}
+	if err := utils.BinaryDecoder(payload,
+		&extendedGateway.AS,
+		&extendedGateway.SrcAS,
+		&extendedGateway.SrcPeerAS,
+		&extendedGateway.ASDestinations,
+	); err != nil {
+		return extendedGateway, err
+	}
+	if extendedGateway.ASDestinations > maxElements {
+		return extendedGateway, fmt.Errorf("too many AS path segments: %d", extendedGateway.ASDestinations)
+	}
+	for range extendedGateway.ASDestinations {
+		var segmentType uint32
+		segment, err := decodeUint32Array(payload, &segmentType)
+		if err != nil {
+			return extendedGateway, fmt.Errorf("AS path segment: %w", err)
+		}
+		switch segmentType {
+		case asPathSegmentSet:
+			if len(segment) > 0 {
+				segment = segment[:1]
+			}
+		case asPathSegmentSequence:
+		default:
+			return extendedGateway, fmt.Errorf("unknown AS path segment type %d", segmentType)
+		}
+		extendedGateway.ASPath = append(extendedGateway.ASPath, segment...)
+	}
+	if extendedGateway.Communities, err = decodeUint32Array(payload); err != nil {
+		return extendedGateway, fmt.Errorf("communities: %w", err)
+	}
+	extendedGateway.CommunitiesLength = uint32(len(extendedGateway.Communities))
+	if err := utils.BinaryDecoder(payload, &extendedGateway.LocalPref); err != nil {
+		return extendedGateway, fmt.Errorf("local pref: %w", err)
+	}
+	return extendedGateway, nil
+}
+
+// decodeUint32Array decodes a variable-length array of 32-bit integers. The
+// provided fields are decoded before the length of the array.
+func decodeUint32Array(payload *bytes.Buffer, fields ...interface{}) ([]uint32, error) {
+	var length uint32
+	if err := utils.BinaryDecoder(payload, append(fields, &length)...); err != nil {
+		return nil, err
+	}
+	if length > maxElements || int(length) > payload.Len()/4 {
+		return nil, fmt.Errorf("invalid length %d", length)
+	}
+	if length == 0 {
+		return nil, nil
+	}
+	result := make([]uint32, length)
+	if err := utils.BinaryDecoder(payload, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
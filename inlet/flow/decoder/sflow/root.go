@@ -47,7 +47,7 @@ func New(r *reporter.Reporter, dependencies decoder.Dependencies, _ decoder.Opti
 	nd := &Decoder{
 		r:         r,
 		d:         dependencies,
-		errLogger: r.Sample(reporter.BurstSampler(30*time.Second, 3)),
+		errLogger: r.Sample(r.SiteSampler("sflow", 30*time.Second, 3)),
 	}
 
 	nd.metrics.errors = nd.r.CounterVec(
@@ -89,11 +89,16 @@ func (nd *Decoder) Decode(in decoder.RawFlow) []*schema.FlowMessage {
 
 	ts := uint64(in.TimeReceived.UTC().Unix())
 	var packet sflow.Packet
-	if err := sflow.DecodeMessageVersion(buf, &packet); err != nil {
+	skipped, err := decodeMessage(buf, &packet)
+	if err != nil {
 		nd.metrics.errors.WithLabelValues(key, "sFlow decoding error").Inc()
 		nd.errLogger.Err(err).Str("exporter", key).Msg("error while decoding sFlow")
 		return nil
 	}
+	if skipped > 0 {
+		nd.metrics.errors.WithLabelValues(key, "sFlow record decoding error").Add(float64(skipped))
+		nd.errLogger.Warn().Str("exporter", key).Msgf("skipped %d malformed sFlow records", skipped)
+	}
 
 	// Update some stats
 	agent := net.IP(packet.AgentIP).String()
@@ -4,11 +4,14 @@
 package sflow
 
 import (
+	"bytes"
 	"net"
 	"net/netip"
 	"path/filepath"
 	"testing"
 
+	"github.com/netsampler/goflow2/v2/decoders/sflow"
+
 	"akvorado/common/helpers"
 	"akvorado/common/reporter"
 	"akvorado/common/schema"
@@ -540,4 +543,95 @@ func TestDecodeSamples(t *testing.T) {
 			t.Fatalf("Decode() (-got, +want):\n%s", diff)
 		}
 	})
+
+	t.Run("flow sample with extended gateway", func(t *testing.T) {
+		// The second sample has a truncated extended gateway record
+		data := helpers.ReadPcapL4(t, filepath.Join("testdata", "data-sflow-extended-gateway.pcap"))
+		got := sdecoder.Decode(decoder.RawFlow{Payload: data, Source: net.ParseIP("127.0.0.1")})
+		if got == nil {
+			t.Fatalf("Decode() error on data")
+		}
+		expectedFlows := []*schema.FlowMessage{
+			{
+				SamplingRate:    1024,
+				InIf:            10,
+				OutIf:           20,
+				SrcAddr:         netip.MustParseAddr("::ffff:198.51.100.10"),
+				DstAddr:         netip.MustParseAddr("::ffff:192.0.2.10"),
+				ExporterAddress: netip.MustParseAddr("::ffff:192.0.2.1"),
+				NextHop:         netip.MustParseAddr("::ffff:203.0.113.1"),
+				SrcAS:           64497,
+				DstAS:           64501,
+				GotASPath:       true,
+				GotCommunities:  true,
+				ProtobufDebug: map[schema.ColumnKey]interface{}{
+					schema.ColumnBytes:          1500,
+					schema.ColumnPackets:        1,
+					schema.ColumnEType:          helpers.ETypeIPv4,
+					schema.ColumnProto:          6,
+					schema.ColumnSrcPort:        443,
+					schema.ColumnDstPort:        33000,
+					schema.ColumnDstASPath:      []uint32{64499, 64500, 64501},
+					schema.ColumnDstCommunities: []uint64{4226809956, 4226810056},
+				},
+			}, {
+				SamplingRate:    1024,
+				InIf:            10,
+				OutIf:           20,
+				SrcAddr:         netip.MustParseAddr("::ffff:198.51.100.11"),
+				DstAddr:         netip.MustParseAddr("::ffff:192.0.2.11"),
+				ExporterAddress: netip.MustParseAddr("::ffff:192.0.2.1"),
+				ProtobufDebug: map[schema.ColumnKey]interface{}{
+					schema.ColumnBytes:   1500,
+					schema.ColumnPackets: 1,
+					schema.ColumnEType:   helpers.ETypeIPv4,
+					schema.ColumnProto:   6,
+					schema.ColumnSrcPort: 443,
+					schema.ColumnDstPort: 33001,
+				},
+			},
+		}
+		for _, f := range got {
+			f.TimeReceived = 0
+		}
+
+		if diff := helpers.Diff(got, expectedFlows); diff != "" {
+			t.Fatalf("Decode() (-got, +want):\n%s", diff)
+		}
+
+		gotMetrics := r.GetMetrics("akvorado_inlet_flow_decoder_sflow_", "errors_total")
+		expectedMetrics := map[string]string{
+			`errors_total{error="sFlow record decoding error",exporter="127.0.0.1"}`: "1",
+		}
+		if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+			t.Fatalf("Metrics (-got, +want):\n%s", diff)
+		}
+	})
+}
+
+func TestDecodeTruncatedSample(t *testing.T) {
+	data := helpers.ReadPcapL4(t, filepath.Join("testdata", "data-1140.pcap"))
+	var packet sflow.Packet
+	if _, err := decodeMessage(bytes.NewBuffer(data), &packet); err != nil {
+		t.Fatalf("decodeMessage() error:\n%+v", err)
+	}
+	samples := len(packet.Samples)
+	if samples < 2 {
+		t.Fatalf("decodeMessage() returned %d samples, expected at least 2", samples)
+	}
+
+	// Truncate the last sample
+	packet = sflow.Packet{}
+	skipped, err := decodeMessage(bytes.NewBuffer(data[:len(data)-1]), &packet)
+	if err != nil {
+		t.Fatalf("decodeMessage() error:\n%+v", err)
+	}
+	if diff := helpers.Diff([]int{len(packet.Samples), skipped}, []int{samples - 1, 1}); diff != "" {
+		t.Fatalf("decodeMessage() samples and skipped (-got, +want):\n%s", diff)
+	}
+	for idx, sample := range packet.Samples {
+		if sample == nil {
+			t.Fatalf("decodeMessage() sample %d is nil", idx)
+		}
+	}
 }
@@ -157,7 +157,7 @@ func (in *Input) Start() (<-chan []*schema.FlowMessage, error) {
 				Str("worker", worker).
 				Str("listen", listen).
 				Logger()
-			errLogger := l.Sample(reporter.BurstSampler(time.Minute, 1))
+			errLogger := l.Sample(in.r.SiteSampler("udp", time.Minute, 1))
 			for count := 0; ; count++ {
 				n, oobn, _, source, err := conns[workerID].ReadMsgUDP(payload, oob)
 				if err != nil {
@@ -54,6 +54,12 @@ func New(r *reporter.Reporter, configuration Configuration, dependencies Depende
 	if len(configuration.Inputs) == 0 {
 		return nil, errors.New("no input configured")
 	}
+	for _, field := range configuration.EnterpriseFields {
+		if err := field.Check(dependencies.Schema); err != nil {
+			return nil, fmt.Errorf("invalid enterprise field %d/%d: %w",
+				field.EnterpriseNumber, field.ElementID, err)
+		}
+	}
 
 	c := Component{
 		r:             r,
@@ -77,7 +83,11 @@ func New(r *reporter.Reporter, configuration Configuration, dependencies Depende
 		if !ok {
 			return nil, fmt.Errorf("unknown decoder %q", input.Decoder)
 		}
-		dec = decoderfunc(r, decoder.Dependencies{Schema: c.d.Schema}, decoder.Option{TimestampSource: input.TimestampSource})
+		dec = decoderfunc(r, decoder.Dependencies{Schema: c.d.Schema}, decoder.Option{
+			TimestampSource:                input.TimestampSource,
+			EnterpriseFields:               c.config.EnterpriseFields,
+			SamplingRateMaxMissedRefreshes: c.config.SamplingRateMaxMissedRefreshes,
+		})
 		alreadyInitialized[input.Decoder] = dec
 		decs[idx] = c.wrapDecoder(dec, input.UseSrcAddrForExporterAddr)
 	}
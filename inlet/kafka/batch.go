@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package kafka
+
+import "github.com/IBM/sarama"
+
+// batchedFlow is a flow waiting to be added to a batch.
+type batchedFlow struct {
+	exporter string
+	payload  []byte
+}
+
+// batch is a Kafka message being built from the flows of one exporter. As each
+// flow is length-delimited, they are simply concatenated.
+type batch struct {
+	payload []byte
+	flows   int
+}
+
+// runBatcher batches flows for each exporter. A batch is sent when it contains
+// BatchSize flows, when adding a flow would exceed MaxMessageBytes or after
+// Linger. When the component is dying, pending batches are sent before
+// returning. The exporter is used as a key to keep the batches of an exporter
+// in order.
+func (c *Component) runBatcher(producer sarama.AsyncProducer) error {
+	batches := map[string]*batch{}
+	flush := func(exporter string, reason string) {
+		b, ok := batches[exporter]
+		if !ok {
+			return
+		}
+		delete(batches, exporter)
+		c.metrics.batchFlushes.WithLabelValues(reason).Inc()
+		producer.Input() <- &sarama.ProducerMessage{
+			Topic: c.kafkaTopic,
+			Key:   sarama.StringEncoder(exporter),
+			Value: sarama.ByteEncoder(b.payload),
+		}
+	}
+	add := func(flow batchedFlow) {
+		b, ok := batches[flow.exporter]
+		if ok && len(b.payload)+len(flow.payload) > c.config.MaxMessageBytes {
+			flush(flow.exporter, "size")
+			ok = false
+		}
+		if !ok {
+			b = &batch{}
+			batches[flow.exporter] = b
+		}
+		b.payload = append(b.payload, flow.payload...)
+		b.flows++
+		if b.flows >= c.config.BatchSize {
+			flush(flow.exporter, "size")
+		}
+	}
+
+	ticker := c.d.Clock.Ticker(c.config.Linger)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.t.Dying():
+			// Empty the queue, then flush everything
+		drain:
+			for {
+				select {
+				case flow := <-c.batchChannel:
+					add(flow)
+				default:
+					break drain
+				}
+			}
+			for exporter := range batches {
+				flush(exporter, "shutdown")
+			}
+			return nil
+		case <-ticker.C:
+			for exporter := range batches {
+				flush(exporter, "timer")
+			}
+		case flow := <-c.batchChannel:
+			add(flow)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package kafka
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/benbjohnson/clock"
+
+	"akvorado/common/daemon"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+	"akvorado/common/schema"
+)
+
+func TestBatching(t *testing.T) {
+	r := reporter.NewMock(t)
+	configuration := DefaultConfiguration()
+	configuration.BatchSize = 3
+	configuration.Linger = time.Hour
+	c, err := New(r, configuration, Dependencies{
+		Daemon: daemon.NewMock(t),
+		Schema: schema.NewMock(t),
+	})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	// Use a fake producer recording the messages
+	var mockProducer *mocks.AsyncProducer
+	c.createKafkaProducer = func() (sarama.AsyncProducer, error) {
+		mockProducer = mocks.NewAsyncProducer(t, c.kafkaConfig)
+		return mockProducer, nil
+	}
+	if err := c.Start(); err != nil {
+		t.Fatalf("Start() error:\n%+v", err)
+	}
+	var lock sync.Mutex
+	got := []string{}
+	record := func(msg *sarama.ProducerMessage) error {
+		lock.Lock()
+		defer lock.Unlock()
+		key, _ := msg.Key.Encode()
+		value, _ := msg.Value.Encode()
+		got = append(got, fmt.Sprintf("%s: %s", key, value))
+		return nil
+	}
+	for range 3 {
+		mockProducer.ExpectInputWithMessageCheckerFunctionAndSucceed(record)
+	}
+
+	// Three flows from the same exporter are sent in one message
+	c.Send("192.0.2.1", []byte("a1,"))
+	c.Send("192.0.2.2", []byte("b1,"))
+	c.Send("192.0.2.1", []byte("a2,"))
+	c.Send("192.0.2.1", []byte("a3,"))
+	time.Sleep(20 * time.Millisecond)
+	lock.Lock()
+	if diff := helpers.Diff(got, []string{"192.0.2.1: a1,a2,a3,"}); diff != "" {
+		t.Errorf("Send() (-got, +want):\n%s", diff)
+	}
+	lock.Unlock()
+
+	// Pending flows are sent on stop
+	c.Send("192.0.2.1", []byte("a4,"))
+	if err := c.Stop(); err != nil {
+		t.Fatalf("Stop() error:\n%+v", err)
+	}
+	sort.Strings(got[1:])
+	expected := []string{
+		"192.0.2.1: a1,a2,a3,",
+		"192.0.2.1: a4,",
+		"192.0.2.2: b1,",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Errorf("Stop() (-got, +want):\n%s", diff)
+	}
+
+	gotMetrics := r.GetMetrics("akvorado_inlet_kafka_", "batch_")
+	expectedMetrics := map[string]string{
+		`batch_flushes_total{reason="size"}`:     "1",
+		`batch_flushes_total{reason="shutdown"}`: "2",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics (-got, +want):\n%s", diff)
+	}
+}
+
+func TestBatchingLinger(t *testing.T) {
+	r := reporter.NewMock(t)
+	configuration := DefaultConfiguration()
+	configuration.BatchSize = 100
+	configuration.Linger = time.Hour
+	mockClock := clock.NewMock()
+	c, err := New(r, configuration, Dependencies{
+		Daemon: daemon.NewMock(t),
+		Schema: schema.NewMock(t),
+		Clock:  mockClock,
+	})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	var mockProducer *mocks.AsyncProducer
+	c.createKafkaProducer = func() (sarama.AsyncProducer, error) {
+		mockProducer = mocks.NewAsyncProducer(t, c.kafkaConfig)
+		return mockProducer, nil
+	}
+	helpers.StartStop(t, c)
+
+	received := make(chan string, 1)
+	mockProducer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		value, _ := msg.Value.Encode()
+		received <- string(value)
+		return nil
+	})
+	c.Send("192.0.2.1", []byte("a1,"))
+	c.Send("192.0.2.1", []byte("a2,"))
+	time.Sleep(20 * time.Millisecond)
+
+	// Nothing is sent before Linger
+	mockClock.Add(configuration.Linger / 2)
+	select {
+	case got := <-received:
+		t.Fatalf("Send() sent %q before linger", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The batch is sent after Linger
+	mockClock.Add(configuration.Linger / 2)
+	select {
+	case got := <-received:
+		if diff := helpers.Diff(got, "a1,a2,"); diff != "" {
+			t.Errorf("Send() (-got, +want):\n%s", diff)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Kafka message not received")
+	}
+
+	gotMetrics := r.GetMetrics("akvorado_inlet_kafka_", "batch_")
+	expectedMetrics := map[string]string{
+		`batch_flushes_total{reason="timer"}`: "1",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics (-got, +want):\n%s", diff)
+	}
+}
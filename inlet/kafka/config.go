@@ -26,6 +26,12 @@ type Configuration struct {
 	CompressionCodec CompressionCodec
 	// QueueSize defines the size of the channel used to send to Kafka.
 	QueueSize int `validate:"min=1"`
+	// BatchSize defines the maximum number of flows from the same exporter
+	// to put in a single Kafka message. 1 disables batching.
+	BatchSize int `validate:"min=1"`
+	// Linger defines how long to wait for a batch to fill up before sending
+	// it to Kafka.
+	Linger time.Duration `validate:"min=1ms"`
 }
 
 // DefaultConfiguration represents the default configuration for the Kafka exporter.
@@ -37,6 +43,8 @@ func DefaultConfiguration() Configuration {
 		MaxMessageBytes:  1000000,
 		CompressionCodec: CompressionCodec(sarama.CompressionNone),
 		QueueSize:        32,
+		BatchSize:        1,
+		Linger:           100 * time.Millisecond,
 	}
 }
 
@@ -18,6 +18,7 @@ type metrics struct {
 	messagesSent *reporter.CounterVec
 	bytesSent    *reporter.CounterVec
 	errors       *reporter.CounterVec
+	batchFlushes *reporter.CounterVec
 
 	kafkaIncomingByteRate  *reporter.MetricDesc
 	kafkaOutgoingByteRate  *reporter.MetricDesc
@@ -57,6 +58,13 @@ func (c *Component) initMetrics() {
 		},
 		[]string{"error"},
 	)
+	c.metrics.batchFlushes = c.r.CounterVec(
+		reporter.CounterOpts{
+			Name: "batch_flushes_total",
+			Help: "Number of batches sent, by reason (size, timer or shutdown).",
+		},
+		[]string{"reason"},
+	)
 
 	c.metrics.kafkaIncomingByteRate = c.r.MetricDesc(
 		"brokers_incoming_byte_rate",
@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/IBM/sarama"
+	"github.com/benbjohnson/clock"
 	"gopkg.in/tomb.v2"
 
 	"akvorado/common/daemon"
@@ -31,6 +32,7 @@ type Component struct {
 	kafkaConfig         *sarama.Config
 	kafkaProducer       sarama.AsyncProducer
 	createKafkaProducer func() (sarama.AsyncProducer, error)
+	batchChannel        chan batchedFlow // nil when batching is disabled
 	metrics             metrics
 }
 
@@ -38,6 +40,7 @@ type Component struct {
 type Dependencies struct {
 	Daemon daemon.Component
 	Schema *schema.Component
+	Clock  clock.Clock
 }
 
 // New creates a new Kafka exporter component.
@@ -59,6 +62,9 @@ func New(reporter *reporter.Reporter, configuration Configuration, dependencies
 	if err := kafkaConfig.Validate(); err != nil {
 		return nil, fmt.Errorf("cannot validate Kafka configuration: %w", err)
 	}
+	if dependencies.Clock == nil {
+		dependencies.Clock = clock.New()
+	}
 
 	c := Component{
 		r:      reporter,
@@ -68,6 +74,9 @@ func New(reporter *reporter.Reporter, configuration Configuration, dependencies
 		kafkaConfig: kafkaConfig,
 		kafkaTopic:  fmt.Sprintf("%s-%s", configuration.Topic, dependencies.Schema.ProtobufMessageHash()),
 	}
+	if configuration.BatchSize > 1 {
+		c.batchChannel = make(chan batchedFlow, configuration.QueueSize)
+	}
 	c.initMetrics()
 	c.createKafkaProducer = func() (sarama.AsyncProducer, error) {
 		return sarama.NewAsyncProducer(c.config.Brokers, c.kafkaConfig)
@@ -91,6 +100,17 @@ func (c *Component) Start() error {
 	}
 	c.kafkaProducer = kafkaProducer
 
+	// Batching. The producer is closed once pending batches are sent.
+	stop := c.t.Dying()
+	if c.batchChannel != nil {
+		batcherDone := make(chan struct{})
+		c.t.Go(func() error {
+			defer close(batcherDone)
+			return c.runBatcher(kafkaProducer)
+		})
+		stop = batcherDone
+	}
+
 	// Main loop
 	c.t.Go(func() error {
 		defer kafkaProducer.Close()
@@ -98,7 +118,7 @@ func (c *Component) Start() error {
 		errLogger := c.r.Sample(reporter.BurstSampler(10*time.Second, 3))
 		for {
 			select {
-			case <-c.t.Dying():
+			case <-stop:
 				c.r.Debug().Msg("stop error logger")
 				return nil
 			case msg := <-kafkaProducer.Errors():
@@ -131,6 +151,10 @@ func (c *Component) Stop() error {
 func (c *Component) Send(exporter string, payload []byte) {
 	c.metrics.bytesSent.WithLabelValues(exporter).Add(float64(len(payload)))
 	c.metrics.messagesSent.WithLabelValues(exporter).Inc()
+	if c.batchChannel != nil {
+		c.batchChannel <- batchedFlow{exporter: exporter, payload: payload}
+		return
+	}
 	key := make([]byte, 4)
 	binary.BigEndian.PutUint32(key, rand.Uint32())
 	c.kafkaProducer.Input() <- &sarama.ProducerMessage{
@@ -5,6 +5,7 @@ package metadata
 
 import (
 	"net/netip"
+	"sync"
 	"time"
 
 	"akvorado/common/helpers/cache"
@@ -20,18 +21,25 @@ type metadataCache struct {
 	r     *reporter.Reporter
 	cache *cache.Cache[provider.Query, provider.Answer]
 
+	// Negative entries, with the time until which the query should not be
+	// attempted again
+	negativeLock sync.Mutex
+	negative     map[provider.Query]time.Time
+
 	metrics struct {
-		cacheHit     reporter.Counter
-		cacheMiss    reporter.Counter
-		cacheExpired reporter.Counter
-		cacheSize    reporter.GaugeFunc
+		cacheHit         reporter.Counter
+		cacheMiss        reporter.Counter
+		cacheNegativeHit reporter.Counter
+		cacheExpired     reporter.Counter
+		cacheSize        reporter.GaugeFunc
 	}
 }
 
 func newMetadataCache(r *reporter.Reporter) *metadataCache {
 	sc := &metadataCache{
-		r:     r,
-		cache: cache.New[provider.Query, provider.Answer](),
+		r:        r,
+		cache:    cache.New[provider.Query, provider.Answer](),
+		negative: map[provider.Query]time.Time{},
 	}
 	sc.metrics.cacheHit = r.Counter(
 		reporter.CounterOpts{
@@ -43,6 +51,11 @@ func newMetadataCache(r *reporter.Reporter) *metadataCache {
 			Name: "cache_misses_total",
 			Help: "Number of lookup miss.",
 		})
+	sc.metrics.cacheNegativeHit = r.Counter(
+		reporter.CounterOpts{
+			Name: "cache_negative_hits_total",
+			Help: "Number of lookup miss for a recently failed query.",
+		})
 	sc.metrics.cacheExpired = r.Counter(
 		reporter.CounterOpts{
 			Name: "cache_expired_entries_total",
@@ -73,6 +86,29 @@ func (sc *metadataCache) Lookup(t time.Time, query provider.Query) (provider.Ans
 // Put a new entry in the cache.
 func (sc *metadataCache) Put(t time.Time, query provider.Query, answer provider.Answer) {
 	sc.cache.Put(t, query, answer)
+	sc.negativeLock.Lock()
+	delete(sc.negative, query)
+	sc.negativeLock.Unlock()
+}
+
+// PutNegative records a failed query. It should not be attempted again until
+// the provided time.
+func (sc *metadataCache) PutNegative(until time.Time, query provider.Query) {
+	sc.negativeLock.Lock()
+	defer sc.negativeLock.Unlock()
+	sc.negative[query] = until
+}
+
+// IsNegative tells if the provided query has recently failed.
+func (sc *metadataCache) IsNegative(t time.Time, query provider.Query) bool {
+	sc.negativeLock.Lock()
+	until, ok := sc.negative[query]
+	sc.negativeLock.Unlock()
+	if !ok || !t.Before(until) {
+		return false
+	}
+	sc.metrics.cacheNegativeHit.Inc()
+	return true
 }
 
 // Expire expire entries whose last access is before the provided time
@@ -82,6 +118,18 @@ func (sc *metadataCache) Expire(before time.Time) int {
 	return expired
 }
 
+// ExpireNegative removes negative entries which are not valid anymore at the
+// provided time.
+func (sc *metadataCache) ExpireNegative(t time.Time) {
+	sc.negativeLock.Lock()
+	defer sc.negativeLock.Unlock()
+	for query, until := range sc.negative {
+		if !t.Before(until) {
+			delete(sc.negative, query)
+		}
+	}
+}
+
 // NeedUpdates returns a map of interface entries that would need to
 // be updated. It relies on last update.
 func (sc *metadataCache) NeedUpdates(before time.Time) map[netip.Addr][]uint {
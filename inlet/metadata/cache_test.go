@@ -64,6 +64,7 @@ func TestGetEmpty(t *testing.T) {
 		`expired_entries_total`: "0",
 		`hits_total`:            "0",
 		`misses_total`:          "1",
+		`negative_hits_total`:   "0",
 		`size_entries`:          "0",
 	}
 	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
@@ -95,6 +96,7 @@ func TestSimpleLookup(t *testing.T) {
 		`expired_entries_total`: "0",
 		`hits_total`:            "1",
 		`misses_total`:          "2",
+		`negative_hits_total`:   "0",
 		`size_entries`:          "1",
 	}
 	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
@@ -179,6 +181,7 @@ func TestExpire(t *testing.T) {
 		`expired_entries_total`: "3",
 		`hits_total`:            "7",
 		`misses_total`:          "6",
+		`negative_hits_total`:   "0",
 		`size_entries`:          "1",
 	}
 	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
@@ -21,6 +21,9 @@ type Configuration struct {
 	CacheRefresh time.Duration `validate:"eq=0|min=1m,eq=0|gtefield=CacheDuration"`
 	// CacheRefreshInterval defines the interval to check for expiration/refresh
 	CacheCheckInterval time.Duration `validate:"ltefield=CacheRefresh,min=1s"`
+	// CacheNegativeDuration defines how long to wait before querying again an
+	// entry after a failure
+	CacheNegativeDuration time.Duration `validate:"eq=0|min=1s"`
 	// CachePersist defines a file to store cache and survive restarts
 	CachePersistFile string
 
@@ -36,12 +39,13 @@ type Configuration struct {
 // DefaultConfiguration represents the default configuration for the metadata provider.
 func DefaultConfiguration() Configuration {
 	return Configuration{
-		CacheDuration:      30 * time.Minute,
-		CacheRefresh:       time.Hour,
-		CacheCheckInterval: 2 * time.Minute,
-		CachePersistFile:   "",
-		Workers:            1,
-		MaxBatchRequests:   10,
+		CacheDuration:         30 * time.Minute,
+		CacheRefresh:          time.Hour,
+		CacheCheckInterval:    2 * time.Minute,
+		CacheNegativeDuration: time.Minute,
+		CachePersistFile:      "",
+		Workers:               1,
+		MaxBatchRequests:      10,
 	}
 }
 
@@ -24,6 +24,7 @@ type Provider struct {
 	exportersMap           map[string][]exporterInfo
 	exporters              atomic.Pointer[helpers.SubnetMap[ExporterConfiguration]]
 	exportersLock          sync.Mutex
+	exportersEntries       reporter.Gauge
 	put                    func(provider.Update)
 }
 
@@ -35,6 +36,14 @@ func (configuration Configuration) New(r *reporter.Reporter, put func(provider.U
 		put:          put,
 	}
 	p.exporters.Store(configuration.Exporters)
+	p.exportersEntries = r.GlobalGaugeVec(
+		reporter.GaugeOpts{
+			Name: "subnetmap_entries",
+			Help: "Number of enabled subnets in a subnet map.",
+		},
+		[]string{"name"},
+	).WithLabelValues("static-exporters")
+	p.exportersEntries.Set(float64(configuration.Exporters.Len()))
 	p.initStaticExporters()
 	var err error
 	p.exporterSourcesFetcher, err = remotedatasourcefetcher.New[exporterInfo](r, p.UpdateRemoteDataSource, "metadata", configuration.ExporterSources)
@@ -105,5 +105,6 @@ func (p *Provider) UpdateRemoteDataSource(ctx context.Context, name string, sour
 		return 0, err
 	}
 	p.exporters.Swap(exporters)
+	p.exportersEntries.Set(float64(exporters.Len()))
 	return len(results), nil
 }
@@ -219,17 +219,31 @@ func TestRemoteExporterSources(t *testing.T) {
 	if diff := helpers.Diff(got, expected); diff != "" {
 		t.Fatalf("static provider - before remote source load (-got, +want):\n%s", diff)
 	}
+	gotMetrics := r.GetMetrics("akvorado_subnetmap_")
+	expectedMetrics := map[string]string{
+		`entries{name="static-exporters"}`: "1",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics before remote source load (-got, +want):\n%s", diff)
+	}
 
 	close(ready)
 	time.Sleep(50 * time.Millisecond)
 
-	gotMetrics := r.GetMetrics("akvorado_common_remotedatasourcefetcher_data_")
-	expectedMetrics := map[string]string{
+	gotMetrics = r.GetMetrics("akvorado_common_remotedatasourcefetcher_data_")
+	expectedMetrics = map[string]string{
 		`total{source="local",type="metadata"}`: "3",
 	}
 	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
 		t.Fatalf("Metrics (-got, +want):\n%s", diff)
 	}
+	gotMetrics = r.GetMetrics("akvorado_subnetmap_")
+	expectedMetrics = map[string]string{
+		`entries{name="static-exporters"}`: "3",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics after remote source load (-got, +want):\n%s", diff)
+	}
 
 	// We now should be able to resolve our new exporter from remote source
 	p.Query(context.Background(), provider.BatchQuery{
@@ -231,7 +231,7 @@ func (c *Component) Stop() error {
 func (c *Component) Lookup(t time.Time, exporterIP netip.Addr, ifIndex uint) (provider.Answer, bool) {
 	query := provider.Query{ExporterIP: exporterIP, IfIndex: ifIndex}
 	answer, ok := c.sc.Lookup(t, query)
-	if !ok {
+	if !ok && !c.sc.IsNegative(t, query) {
 		select {
 		case c.dispatcherChannel <- query:
 		default:
@@ -293,7 +293,7 @@ func (c *Component) providerIncomingRequest(request provider.BatchQuery) {
 	}
 	c.providerBreakersLock.Unlock()
 
-	if err := providerBreaker.Run(func() error {
+	err := providerBreaker.Run(func() error {
 		ctx := c.t.Context(nil)
 		for _, p := range c.providers {
 			// Query providers in the order they are defined and stop on the
@@ -306,7 +306,18 @@ func (c *Component) providerIncomingRequest(request provider.BatchQuery) {
 			return nil
 		}
 		return nil
-	}); err == breaker.ErrBreakerOpen {
+	})
+	if err != nil && c.config.CacheNegativeDuration > 0 {
+		// Do not query these interfaces again before some time
+		until := c.d.Clock.Now().Add(c.config.CacheNegativeDuration)
+		for _, ifIndex := range request.IfIndexes {
+			c.sc.PutNegative(until, provider.Query{
+				ExporterIP: request.ExporterIP,
+				IfIndex:    ifIndex,
+			})
+		}
+	}
+	if err == breaker.ErrBreakerOpen {
 		c.metrics.providerBreakerOpenCount.WithLabelValues(request.ExporterIP.Unmap().String()).Inc()
 		c.providerBreakersLock.Lock()
 		l, ok := c.providerBreakerLoggers[request.ExporterIP]
@@ -325,6 +336,7 @@ func (c *Component) providerIncomingRequest(request provider.BatchQuery) {
 // expireCache handles cache expiration and refresh.
 func (c *Component) expireCache() {
 	c.sc.Expire(c.d.Clock.Now().Add(-c.config.CacheDuration))
+	c.sc.ExpireNegative(c.d.Clock.Now())
 	if c.config.CacheRefresh > 0 {
 		c.r.Debug().Msg("refresh metadata cache")
 		c.metrics.cacheRefreshRuns.Inc()
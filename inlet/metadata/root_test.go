@@ -8,6 +8,7 @@ import (
 	"errors"
 	"net/netip"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -139,6 +140,7 @@ func TestAutoRefresh(t *testing.T) {
 			`expired_entries_total`: "0",
 			`hits_total`:            "4",
 			`misses_total`:          "1",
+			`negative_hits_total`:   "0",
 			`size_entries`:          "1",
 			`refresh_runs_total`:    runs,
 			`refreshs`:              "1",
@@ -217,6 +219,7 @@ func TestProviderBreaker(t *testing.T) {
 			r := reporter.NewMock(t)
 			configuration := DefaultConfiguration()
 			configuration.MaxBatchRequests = 0
+			configuration.CacheNegativeDuration = 0
 			configuration.Providers = []ProviderConfiguration{{Config: tc.ProviderConfiguration}}
 			c := NewMock(t, r, configuration, Dependencies{Daemon: daemon.NewMock(t)})
 			c.metrics.providerBreakerOpenCount.WithLabelValues("127.0.0.1").Add(0)
@@ -240,6 +243,99 @@ func TestProviderBreaker(t *testing.T) {
 	}
 }
 
+type flakyProvider struct {
+	config *flakyProviderConfiguration
+	put    func(provider.Update)
+}
+
+func (fp *flakyProvider) Query(_ context.Context, query provider.BatchQuery) error {
+	fp.config.lock.Lock()
+	fp.config.queries++
+	failing := fp.config.failing
+	fp.config.lock.Unlock()
+	if failing {
+		return errors.New("unreachable")
+	}
+	for _, ifIndex := range query.IfIndexes {
+		fp.put(provider.Update{
+			Query:  provider.Query{ExporterIP: query.ExporterIP, IfIndex: ifIndex},
+			Answer: provider.Answer{Exporter: provider.Exporter{Name: "exporter"}},
+		})
+	}
+	return nil
+}
+
+type flakyProviderConfiguration struct {
+	lock    sync.Mutex
+	failing bool
+	queries int
+}
+
+func (fpc *flakyProviderConfiguration) New(_ *reporter.Reporter, put func(provider.Update)) (provider.Provider, error) {
+	return &flakyProvider{config: fpc, put: put}, nil
+}
+
+func (fpc *flakyProviderConfiguration) Queries() int {
+	fpc.lock.Lock()
+	defer fpc.lock.Unlock()
+	return fpc.queries
+}
+
+func TestNegativeCache(t *testing.T) {
+	r := reporter.NewMock(t)
+	mockClock := clock.NewMock()
+	fpc := &flakyProviderConfiguration{failing: true}
+	configuration := DefaultConfiguration()
+	configuration.Providers = []ProviderConfiguration{{Config: fpc}}
+	c := NewMock(t, r, configuration, Dependencies{Daemon: daemon.NewMock(t), Clock: mockClock})
+	exporter := netip.MustParseAddr("::ffff:127.0.0.1")
+
+	// The first lookup fails
+	c.Lookup(mockClock.Now(), exporter, 765)
+	time.Sleep(30 * time.Millisecond)
+	if got := fpc.Queries(); got != 1 {
+		t.Fatalf("Query() called %d times, expected 1", got)
+	}
+
+	// The provider is not queried again until the negative entry expires
+	for range 5 {
+		if _, ok := c.Lookup(mockClock.Now(), exporter, 765); ok {
+			t.Fatal("Lookup() should not return a result")
+		}
+	}
+	mockClock.Add(59 * time.Second)
+	c.Lookup(mockClock.Now(), exporter, 765)
+	time.Sleep(30 * time.Millisecond)
+	if got := fpc.Queries(); got != 1 {
+		t.Fatalf("Query() called %d times, expected 1", got)
+	}
+
+	// Once expired, the provider is queried again
+	fpc.lock.Lock()
+	fpc.failing = false
+	fpc.lock.Unlock()
+	mockClock.Add(time.Second)
+	c.Lookup(mockClock.Now(), exporter, 765)
+	time.Sleep(30 * time.Millisecond)
+	if got := fpc.Queries(); got != 2 {
+		t.Fatalf("Query() called %d times, expected 2", got)
+	}
+	answer, ok := c.Lookup(mockClock.Now(), exporter, 765)
+	if !ok || answer.Exporter.Name != "exporter" {
+		t.Fatalf("Lookup() == %+v, %v", answer, ok)
+	}
+
+	gotMetrics := r.GetMetrics("akvorado_inlet_metadata_cache_", "hits_total", "misses_total", "negative_hits_total")
+	expectedMetrics := map[string]string{
+		`hits_total`:          "1",
+		`misses_total`:        "8",
+		`negative_hits_total`: "6",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics (-got, +want):\n%s", diff)
+	}
+}
+
 type batchProvider struct {
 	config *batchProviderConfiguration
 }
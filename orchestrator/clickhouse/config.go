@@ -4,6 +4,7 @@
 package clickhouse
 
 import (
+	"net/netip"
 	"reflect"
 	"time"
 
@@ -37,6 +38,12 @@ type Configuration struct {
 	// ASNs is a mapping from AS numbers to names. It replaces or
 	// extends the builtin list of AS numbers.
 	ASNs map[uint32]string
+	// ASNsReloadInterval tells how often the ASNs dictionary should be
+	// reloaded. When 0, it is only reloaded by ClickHouse when it expires.
+	ASNsReloadInterval time.Duration `validate:"isdefault|min=1m"`
+	// Protocols is a mapping from IP protocol numbers to names and
+	// descriptions. It replaces or extends the builtin list of protocols.
+	Protocols map[uint8]ProtocolAttributes `validate:"dive"`
 	// Networks is a mapping from IP networks to attributes. It is used
 	// to instantiate the SrcNet* and DstNet* columns.
 	Networks *helpers.SubnetMap[NetworkAttributes] `validate:"omitempty,dive"`
@@ -51,9 +58,120 @@ type Configuration struct {
 	// OrchestratorURL allows one to override URL to reach
 	// orchestrator from ClickHouse
 	OrchestratorURL string `validate:"isdefault|url"`
+	// OrchestratorURLProbe is the address used to detect the IP address of
+	// the orchestrator when OrchestratorURL is not set. Nothing is sent to it.
+	OrchestratorURLProbe string `validate:"required,hostname_port"`
 	// OrchestratorBasicAuth holds optional basic auth credentials to reach
 	// orchestrator from ClickHouse
 	OrchestratorBasicAuth *ConfigurationBasicAuth
+	// ProtocolColumns maps column names to IP protocol numbers. For each of
+	// them, a boolean materialized column is added to the flows table.
+	ProtocolColumns map[string]uint8 `validate:"dive,keys,alphanum,endkeys"`
+	// SampledFlowsRatio enables the flows_sampled table when not 0. One flow
+	// out of this ratio is copied from the flows table.
+	SampledFlowsRatio uint64 `validate:"isdefault|min=2"`
+	// DailyAggregateKeys enables the flows_agg_daily table when not empty.
+	// Flows are aggregated by day and by these columns.
+	DailyAggregateKeys []string `validate:"dive,required"`
+	// HourlyASView enables the flows_hourly_as table. Bytes and packets are
+	// summed by hour, exporter and AS numbers.
+	HourlyASView bool
+	// ColumnCodecs maps column names to the compression codec to enforce on
+	// the flows tables. It overrides the codec from the schema.
+	ColumnCodecs map[string]string `validate:"dive,keys,required,endkeys,required"`
+	// QueryLogTTL enables the query_log_akvorado table when not 0. It keeps
+	// a copy of the queries executed by QueryLogUsername for this duration.
+	QueryLogTTL time.Duration `validate:"isdefault|min=1h"`
+	// QueryLogUsername is the user whose queries are copied into
+	// query_log_akvorado. When empty, Username is used.
+	QueryLogUsername string
+	// FlowSamplesTopic is the Kafka topic with sampled packet headers. When
+	// not empty, they are stored in the flow_samples table.
+	FlowSamplesTopic string
+	// FlowSamplesTTL is how long the packet headers are kept in the
+	// flow_samples table.
+	FlowSamplesTTL time.Duration `validate:"min=1h"`
+	// ASNPathsTopic is the Kafka topic with the BGP paths collected with BMP.
+	// When not empty, they are stored in the asn_paths table.
+	ASNPathsTopic string
+	// ExportersMetaTopic is the Kafka topic with the metadata of the exporters
+	// from SNMP. When not empty, they are stored in the exporters_meta table.
+	ExportersMetaTopic string
+	// ReceiveDelayFrom is the name of the column with the flow timestamp set
+	// by the exporter. When not empty and present in the schema, a
+	// ReceiveDelay materialized column is added to the flows table.
+	ReceiveDelayFrom string
+	// NetNameColumns adds SrcNetName and DstNetName materialized columns
+	// to the flows table, using the networks dictionary. Columns already
+	// present in the schema are left untouched.
+	NetNameColumns bool
+	// Circuits is a list of circuits attached to exporter interfaces. When
+	// not empty, a circuits dictionary is created.
+	Circuits []CircuitConfiguration `validate:"dive"`
+	// CircuitsLifetime is how long ClickHouse can keep the circuits
+	// dictionary before refreshing it.
+	CircuitsLifetime time.Duration `validate:"min=1m"`
+	// ExporterRoles maps exporter subnets to a role (core, edge, peering).
+	// When not empty, an exporter_roles dictionary is created.
+	ExporterRoles *helpers.SubnetMap[string] `validate:"omitempty,dive,required"`
+	// ExporterRolesLifetime is how long ClickHouse can keep the exporter
+	// roles dictionary before refreshing it.
+	ExporterRolesLifetime time.Duration `validate:"min=1m"`
+	// FlowsSwap enables the replacement of the main flows table by the
+	// flows_new table once it is marked as backfilled in migrations_audit.
+	// Meanwhile, the main flows table is not updated.
+	FlowsSwap bool
+	// SplitFlowsByDirection enables the flows_in and flows_out tables
+	// receiving respectively the incoming and the outgoing flows.
+	SplitFlowsByDirection bool
+	// RowPolicies restricts the flows visible to some ClickHouse users or
+	// roles to the ones of some tenants.
+	RowPolicies []RowPolicyConfiguration `validate:"dive"`
+	// RowPolicyColumn is the column containing the tenant of a flow.
+	RowPolicyColumn string `validate:"required"`
+	// ExporterTTLs maps exporter subnets to a TTL overriding the TTL of the
+	// main flows table for the flows of the matching exporters.
+	ExporterTTLs *helpers.SubnetMap[time.Duration] `validate:"omitempty,dive,min=1h"`
+	// CompressionStats enables the flows_compression_stats view exposing the
+	// compression ratio of each column of the flows table.
+	CompressionStats bool
+	// KafkaLagThreshold enables the kafka_consumers_lag view when not 0. The
+	// lag of each partition is compared to this threshold.
+	KafkaLagThreshold uint64
+	// ErrorsQuarantineTTL enables the flows_raw_errors_quarantine table when
+	// not 0. It keeps a copy of the decoding errors for this duration.
+	ErrorsQuarantineTTL time.Duration `validate:"isdefault|min=1h"`
+	// ErrorsQuarantineInterval enables the flows_raw_errors_quarantine_stats
+	// view when not 0. Decoding errors are counted by this interval.
+	ErrorsQuarantineInterval time.Duration `validate:"isdefault|min=1s"`
+	// TTLOnlyDropParts sets ttl_only_drop_parts on the flows tables to drop
+	// whole parts once all their rows are expired instead of deleting rows.
+	TTLOnlyDropParts bool
+	// MinAgeToForceMerge is the minimum age of the parts of the flows tables
+	// to force their merge. 0 disables this setting.
+	MinAgeToForceMerge time.Duration `validate:"isdefault|min=1m"`
+	// DeduplicateInserts enables the deduplication of retried inserts into
+	// the flows tables, including the blocks inserted by the materialized
+	// views fed from them.
+	DeduplicateInserts bool
+	// DryRun logs the migration steps which would be applied instead of
+	// applying them.
+	DryRun bool
+	// VerifySchema compares the columns of existing optional tables with the
+	// expected ones and logs a warning listing the differences.
+	VerifySchema bool
+	// MigrationsRetryAttempts is the maximum number of attempts for a
+	// migration step failing with a retryable error.
+	MigrationsRetryAttempts int `validate:"min=1"`
+	// MigrationsRetryDelay is the delay before retrying a migration step. It
+	// is doubled after each attempt.
+	MigrationsRetryDelay time.Duration `validate:"min=0"`
+	// MigrationsRetryableCodes is the list of ClickHouse error codes for
+	// which a migration step is retried.
+	MigrationsRetryableCodes []int32
+	// MigrationsConcurrency is the maximum number of independent migration
+	// steps to run at the same time.
+	MigrationsConcurrency int `validate:"min=1"`
 }
 
 // ConfigurationBasicAuth holds Username and Password subfields
@@ -63,6 +181,27 @@ type ConfigurationBasicAuth struct {
 	Password string `validate:"min=1"`
 }
 
+// CircuitConfiguration describes a circuit attached to an exporter interface.
+type CircuitConfiguration struct {
+	// ExporterAddress is the IP address of the exporter.
+	ExporterAddress netip.Addr `validate:"required"`
+	// IfIndex is the index of the interface.
+	IfIndex uint32
+	// CircuitID is the identifier of the circuit.
+	CircuitID string `validate:"required"`
+	// Provider is the provider of the circuit.
+	Provider string
+}
+
+// RowPolicyConfiguration describes the tenants a ClickHouse user or role can
+// see.
+type RowPolicyConfiguration struct {
+	// Role is the ClickHouse user or role the policy applies to.
+	Role string `validate:"required"`
+	// Tenants is the list of tenants the role can see.
+	Tenants []string `validate:"min=1"`
+}
+
 // ResolutionConfiguration describes a consolidation interval.
 type ResolutionConfiguration struct {
 	// Interval is the consolidation interval for this
@@ -85,6 +224,10 @@ type KafkaConfiguration struct {
 	// EngineSettings allows one to set arbitrary settings for Kafka engine in
 	// ClickHouse.
 	EngineSettings []string
+	// CALocation is the location, on the ClickHouse servers, of the CA
+	// certificate used to check Kafka brokers. When not empty, ClickHouse
+	// connects to Kafka using TLS.
+	CALocation string `validate:"omitempty,startswith=/"`
 }
 
 // DefaultConfiguration represents the default configuration for the ClickHouse configurator.
@@ -102,8 +245,24 @@ func DefaultConfiguration() Configuration {
 			{time.Hour, 12 * 30 * 24 * time.Hour},      // 1 year
 		},
 		MaxPartitions:         50,
+		OrchestratorURLProbe:  "1.1.1.1:80",
 		NetworkSourcesTimeout: 10 * time.Second,
 		SystemLogTTL:          30 * 24 * time.Hour, // 30 days
+		CircuitsLifetime:      time.Hour,
+		ExporterRolesLifetime: time.Hour,
+		FlowSamplesTTL:        24 * time.Hour,
+		TTLOnlyDropParts:      true,
+		RowPolicyColumn:       "ExporterTenant",
+
+		MigrationsConcurrency:   1,
+		MigrationsRetryAttempts: 3,
+		MigrationsRetryDelay:    time.Second,
+		MigrationsRetryableCodes: []int32{
+			209, // SOCKET_TIMEOUT
+			210, // NETWORK_ERROR
+			242, // TABLE_IS_READ_ONLY
+			999, // KEEPER_EXCEPTION
+		},
 	}
 }
 
@@ -128,6 +287,18 @@ type NetworkAttributes struct {
 	Tenant string
 	// ASN is the AS number associated to the network.
 	ASN uint32
+	// Latitude is the approximate latitude of the network.
+	Latitude float64
+	// Longitude is the approximate longitude of the network.
+	Longitude float64
+}
+
+// ProtocolAttributes is a set of attributes attached to an IP protocol number.
+type ProtocolAttributes struct {
+	// Name is the short name of the protocol (GRE, ESP).
+	Name string `validate:"required"`
+	// Description is a longer description of the protocol.
+	Description string
 }
 
 // NetworkAttributesUnmarshallerHook decodes network attributes. It
@@ -151,4 +322,7 @@ func init() {
 	helpers.RegisterMapstructureUnmarshallerHook(helpers.SubnetMapUnmarshallerHook[NetworkAttributes]())
 	helpers.RegisterMapstructureUnmarshallerHook(NetworkAttributesUnmarshallerHook())
 	helpers.RegisterSubnetMapValidation[NetworkAttributes]()
+	helpers.RegisterMapstructureUnmarshallerHook(helpers.SubnetMapUnmarshallerHook[time.Duration]())
+	helpers.RegisterSubnetMapValidation[time.Duration]()
+	helpers.RegisterMapstructureUnmarshallerHook(helpers.SubnetMapUnmarshallerHook[string]())
 }
@@ -9,12 +9,17 @@ import (
 	"embed"
 	"encoding/csv"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"net/http"
+	"net/netip"
 	"os"
+	"sort"
 	"strconv"
 	"text/template"
 	"time"
+
+	"akvorado/common/schema"
 )
 
 var (
@@ -45,6 +50,11 @@ cat > /etc/clickhouse-server/config.d/akvorado.xml <<'EOCONFIG'
  </{{ $table }}>
 {{- end }}
 {{- end }}
+{{- if ne .KafkaCALocation "" }}
+ <kafka>
+  <ssl_ca_location>{{ .KafkaCALocation }}</ssl_ca_location>
+ </kafka>
+{{- end }}
 {{- if ne .PrometheusEndpoint "" }}
  <prometheus>
   <endpoint>{{ .PrometheusEndpoint }}</endpoint>
@@ -55,6 +65,23 @@ cat > /etc/clickhouse-server/config.d/akvorado.xml <<'EOCONFIG'
 {{- end }}
 </clickhouse>
 EOCONFIG
+{{- if .InsertDeduplicationSettings }}
+
+# Alter ClickHouse default profile
+mkdir -p /etc/clickhouse-server/users.d
+echo "Add Akvorado-specific settings to ClickHouse default profile"
+cat > /etc/clickhouse-server/users.d/akvorado.xml <<'EOUSERS'
+<clickhouse>
+ <profiles>
+  <default>
+{{- range $setting := .InsertDeduplicationSettings }}
+   <{{ $setting }}>1</{{ $setting }}>
+{{- end }}
+  </default>
+ </profiles>
+</clickhouse>
+EOUSERS
+{{- end }}
 `))
 )
 
@@ -64,6 +91,24 @@ type initShVariables struct {
 	SystemLogTTL       int
 	SystemLogTables    []string
 	PrometheusEndpoint string
+	KafkaCALocation    string
+
+	InsertDeduplicationSettings []string
+}
+
+// protocolsHash returns a hash of the custom protocols.
+func (c *Component) protocolsHash() string {
+	protos := make([]int, 0, len(c.config.Protocols))
+	for proto := range c.config.Protocols {
+		protos = append(protos, int(proto))
+	}
+	sort.Ints(protos)
+	hash := fnv.New64a()
+	for _, proto := range protos {
+		attributes := c.config.Protocols[uint8(proto)]
+		fmt.Fprintf(hash, "%d\x00%s\x00%s\x00", proto, attributes.Name, attributes.Description)
+	}
+	return fmt.Sprintf("%016x", hash.Sum64())
 }
 
 func (c *Component) addHandlerEmbedded(url string, path string) {
@@ -87,7 +132,7 @@ func (c *Component) registerHTTPHandlers() error {
 	c.d.HTTP.AddHandler("/api/v0/orchestrator/clickhouse/init.sh",
 		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
 			var result bytes.Buffer
-			if err := initShTemplate.Execute(&result, initShVariables{
+			variables := initShVariables{
 				FlowSchemaHash: c.d.Schema.ProtobufMessageHash(),
 				FlowSchema:     c.d.Schema.ProtobufDefinition(),
 				SystemLogTTL:   int(c.config.SystemLogTTL.Seconds()),
@@ -105,7 +150,12 @@ func (c *Component) registerHTTPHandlers() error {
 					"trace_log",
 				},
 				PrometheusEndpoint: c.config.PrometheusEndpoint,
-			}); err != nil {
+				KafkaCALocation:    c.config.Kafka.CALocation,
+			}
+			if c.config.DeduplicateInserts {
+				variables.InsertDeduplicationSettings = insertDeduplicationSettings
+			}
+			if err := initShTemplate.Execute(&result, variables); err != nil {
 				c.r.Err(err).Msg("unable to serialize init.sh")
 				http.Error(w, fmt.Sprintf("Unable to serialize init.sh"), http.StatusInternalServerError)
 				return
@@ -189,6 +239,46 @@ func (c *Component) registerHTTPHandlers() error {
 			}
 		}))
 
+	// circuits.csv (when there are some circuits)
+	if len(c.config.Circuits) != 0 {
+		c.d.HTTP.AddHandler(fmt.Sprintf("/api/v0/orchestrator/clickhouse/%s.csv", schema.DictionaryCircuits),
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				w.WriteHeader(http.StatusOK)
+				wr := csv.NewWriter(w)
+				wr.Write([]string{"exporter_address", "ifindex", "circuit_id", "provider"})
+				for _, circuit := range c.config.Circuits {
+					wr.Write([]string{
+						netip.AddrFrom16(circuit.ExporterAddress.As16()).String(),
+						strconv.FormatUint(uint64(circuit.IfIndex), 10),
+						circuit.CircuitID,
+						circuit.Provider,
+					})
+				}
+				wr.Flush()
+			}))
+	}
+
+	// exporter_roles.csv (when there are some exporter roles)
+	if roles := c.config.ExporterRoles.ToMap(); len(roles) != 0 {
+		networks := make([]string, 0, len(roles))
+		for network := range roles {
+			networks = append(networks, network)
+		}
+		sort.Strings(networks)
+		c.d.HTTP.AddHandler(fmt.Sprintf("/api/v0/orchestrator/clickhouse/%s.csv", schema.DictionaryExporterRoles),
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				w.WriteHeader(http.StatusOK)
+				wr := csv.NewWriter(w)
+				wr.Write([]string{"network", "role"})
+				for _, network := range networks {
+					wr.Write([]string{network, roles[network]})
+				}
+				wr.Flush()
+			}))
+	}
+
 	// asns.csv (when there are some custom-defined ASNs)
 	if len(c.config.ASNs) != 0 {
 		c.d.HTTP.AddHandler("/api/v0/orchestrator/clickhouse/asns.csv",
@@ -237,6 +327,60 @@ func (c *Component) registerHTTPHandlers() error {
 			}))
 	}
 
+	// protocols.csv (when there are some custom-defined protocols)
+	if len(c.config.Protocols) != 0 {
+		c.d.HTTP.AddHandler(fmt.Sprintf("/api/v0/orchestrator/clickhouse/%s.csv", schema.DictionaryProtocols),
+			http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				f, err := data.Open("data/protocols.csv")
+				if err != nil {
+					c.r.Err(err).Msg("unable to open data/protocols.csv")
+					http.Error(w, "Unable to open protocol file.",
+						http.StatusInternalServerError)
+					return
+				}
+				defer f.Close()
+				rd := csv.NewReader(f)
+				rd.FieldsPerRecord = 3
+				protocols := map[uint8]ProtocolAttributes{}
+				for count := 0; ; count++ {
+					record, err := rd.Read()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						c.r.Err(err).Msgf("unable to parse data/protocols.csv (line %d)", count)
+						continue
+					}
+					if count == 0 {
+						continue
+					}
+					proto, err := strconv.ParseUint(record[0], 10, 8)
+					if err != nil {
+						c.r.Err(err).Msgf("invalid protocol number (line %d)", count)
+						continue
+					}
+					protocols[uint8(proto)] = ProtocolAttributes{
+						Name:        record[1],
+						Description: record[2],
+					}
+				}
+				// Custom protocols
+				for proto, attributes := range c.config.Protocols {
+					protocols[proto] = attributes
+				}
+				w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+				w.WriteHeader(http.StatusOK)
+				wr := csv.NewWriter(w)
+				wr.Write([]string{"proto", "name", "description"})
+				for proto := 0; proto <= 255; proto++ {
+					if attributes, ok := protocols[uint8(proto)]; ok {
+						wr.Write([]string{strconv.Itoa(proto), attributes.Name, attributes.Description})
+					}
+				}
+				wr.Flush()
+			}))
+	}
+
 	// Static CSV files
 	entries, err := data.ReadDir("data")
 	if err != nil {
@@ -249,6 +393,9 @@ func (c *Component) registerHTTPHandlers() error {
 		if entry.Name() == "asns.csv" && len(c.config.ASNs) != 0 {
 			continue
 		}
+		if entry.Name() == "protocols.csv" && len(c.config.Protocols) != 0 {
+			continue
+		}
 		url := fmt.Sprintf("/api/v0/orchestrator/clickhouse/%s", entry.Name())
 		path := fmt.Sprintf("data/%s", entry.Name())
 		c.addHandlerEmbedded(url, path)
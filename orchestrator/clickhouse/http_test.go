@@ -4,7 +4,11 @@
 package clickhouse
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 
 	"akvorado/common/clickhousedb"
@@ -24,6 +28,10 @@ func TestHTTPEndpoints(t *testing.T) {
 	config.Networks = helpers.MustNewSubnetMap(map[string]NetworkAttributes{
 		"::ffff:192.0.2.0/120": {Name: "infra"},
 	})
+	config.ExporterRoles = helpers.MustNewSubnetMap(map[string]string{
+		"::ffff:192.0.2.0/120": "core",
+		"2001:db8::/64":        "edge",
+	})
 	// setup schema config for custom dicts
 	schemaConfig := schema.DefaultConfiguration()
 	schemaConfig.CustomDictionaries = make(map[string]schema.CustomDict)
@@ -71,8 +79,16 @@ func TestHTTPEndpoints(t *testing.T) {
 			URL:         "/api/v0/orchestrator/clickhouse/networks.csv",
 			ContentType: "text/csv; charset=utf-8",
 			FirstLines: []string{
-				`network,name,role,site,region,country,state,city,tenant,asn`,
-				`192.0.2.0/24,infra,,,,,,,,`,
+				`network,name,role,site,region,country,state,city,tenant,asn,latitude,longitude`,
+				`192.0.2.0/24,infra,,,,,,,,,,`,
+			},
+		}, {
+			URL:         "/api/v0/orchestrator/clickhouse/exporter_roles.csv",
+			ContentType: "text/csv; charset=utf-8",
+			FirstLines: []string{
+				`network,role`,
+				`192.0.2.0/24,core`,
+				`2001:db8::/64,edge`,
 			},
 		}, {
 			URL:         "/api/v0/orchestrator/clickhouse/init.sh",
@@ -111,6 +127,47 @@ func TestHTTPEndpoints(t *testing.T) {
 	helpers.TestHTTPEndpoints(t, c.d.HTTP.LocalAddr(), cases)
 }
 
+func TestInitShKafkaCALocation(t *testing.T) {
+	var result bytes.Buffer
+	if err := initShTemplate.Execute(&result, initShVariables{
+		KafkaCALocation: "/etc/clickhouse-server/kafka-ca.pem",
+	}); err != nil {
+		t.Fatalf("Execute() error:\n%+v", err)
+	}
+	expected := `
+ <kafka>
+  <ssl_ca_location>/etc/clickhouse-server/kafka-ca.pem</ssl_ca_location>
+ </kafka>
+`
+	if !strings.Contains(result.String(), expected) {
+		t.Errorf("init.sh does not contain %q:\n%s", expected, result.String())
+	}
+}
+
+func TestInitShInsertDeduplication(t *testing.T) {
+	var result bytes.Buffer
+	if err := initShTemplate.Execute(&result, initShVariables{
+		InsertDeduplicationSettings: insertDeduplicationSettings,
+	}); err != nil {
+		t.Fatalf("Execute() error:\n%+v", err)
+	}
+	expected := `
+cat > /etc/clickhouse-server/users.d/akvorado.xml <<'EOUSERS'
+<clickhouse>
+ <profiles>
+  <default>
+   <insert_deduplicate>1</insert_deduplicate>
+   <deduplicate_blocks_in_dependent_materialized_views>1</deduplicate_blocks_in_dependent_materialized_views>
+  </default>
+ </profiles>
+</clickhouse>
+EOUSERS
+`
+	if !strings.Contains(result.String(), expected) {
+		t.Errorf("init.sh does not contain %q:\n%s", expected, result.String())
+	}
+}
+
 func TestAdditionalASNs(t *testing.T) {
 	r := reporter.NewMock(t)
 	clickhouseComponent := clickhousedb.SetupClickHouse(t, r, false)
@@ -143,3 +200,48 @@ func TestAdditionalASNs(t *testing.T) {
 
 	helpers.TestHTTPEndpoints(t, c.d.HTTP.LocalAddr(), cases)
 }
+
+func TestAdditionalProtocols(t *testing.T) {
+	r := reporter.NewMock(t)
+	clickhouseComponent := clickhousedb.SetupClickHouse(t, r, false)
+	config := DefaultConfiguration()
+	config.Protocols = map[uint8]ProtocolAttributes{
+		1:   {Name: "ICMPv4", Description: "Internet Control Message Protocol"},
+		253: {Name: "CUSTOM", Description: "Private protocol"},
+	}
+	c, err := New(r, config, Dependencies{
+		Daemon:     daemon.NewMock(t),
+		HTTP:       httpserver.NewMock(t, r),
+		Schema:     schema.NewMock(t),
+		GeoIP:      geoip.NewMock(t, r, false),
+		ClickHouse: clickhouseComponent,
+	})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+
+	got := []string{}
+	resp, err := http.Get(fmt.Sprintf("http://%s/api/v0/orchestrator/clickhouse/protocols.csv",
+		c.d.HTTP.LocalAddr()))
+	if err != nil {
+		t.Fatalf("GET protocols.csv:\n%+v", err)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		got = append(got, scanner.Text())
+	}
+	if len(got) < 4 {
+		t.Fatalf("GET protocols.csv returned too few lines:\n%s", strings.Join(got, "\n"))
+	}
+	if diff := helpers.Diff(got[:3], []string{
+		"proto,name,description",
+		"0,HOPOPT,IPv6 Hop-by-Hop Option",
+		"1,ICMPv4,Internet Control Message Protocol",
+	}); diff != "" {
+		t.Errorf("GET protocols.csv (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(got[len(got)-1], "253,CUSTOM,Private protocol"); diff != "" {
+		t.Errorf("GET protocols.csv (-got, +want):\n%s", diff)
+	}
+}
@@ -9,8 +9,12 @@ type metrics struct {
 	migrationsRunning    reporter.Gauge
 	migrationsApplied    reporter.Counter
 	migrationsNotApplied reporter.Counter
+	migrationsPending    reporter.Gauge
+	migrationsProgress   reporter.Gauge
 
-	networksReload reporter.Counter
+	networksReload  reporter.Counter
+	networksEntries reporter.Gauge
+	asnsReload      *reporter.CounterVec
 }
 
 func (c *Component) initMetrics() {
@@ -32,10 +36,36 @@ func (c *Component) initMetrics() {
 			Help: "Number of migration steps not applied.",
 		},
 	)
+	c.metrics.migrationsPending = c.r.Gauge(
+		reporter.GaugeOpts{
+			Name: "migrations_pending_steps",
+			Help: "Number of migration steps which would be applied in dry-run mode.",
+		},
+	)
+	c.metrics.migrationsProgress = c.r.Gauge(
+		reporter.GaugeOpts{
+			Name: "migrations_progress_ratio",
+			Help: "Progress of the running database migration, between 0 and 1.",
+		},
+	)
 	c.metrics.networksReload = c.r.Counter(
 		reporter.CounterOpts{
 			Name: "networks_dictionary_reload_total",
 			Help: "Number of reloads triggered for networks dictionary.",
 		},
 	)
+	c.metrics.networksEntries = c.r.GlobalGaugeVec(
+		reporter.GaugeOpts{
+			Name: "subnetmap_entries",
+			Help: "Number of enabled subnets in a subnet map.",
+		},
+		[]string{"name"},
+	).WithLabelValues("networks")
+	c.metrics.asnsReload = c.r.CounterVec(
+		reporter.CounterOpts{
+			Name: "asns_dictionary_reload_total",
+			Help: "Number of periodic reloads of the ASNs dictionary.",
+		},
+		[]string{"status"},
+	)
 }
@@ -4,45 +4,33 @@
 package clickhouse
 
 import (
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"net"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/ClickHouse/clickhouse-go/v2"
-
-	"akvorado/common/reporter"
 	"akvorado/common/schema"
 )
 
-type migrationStep struct {
-	// CheckQuery to execute to check if the step is needed.
-	CheckQuery string
-	// Arguments to use for the query
-	Args []interface{}
-	// Function to execute if the query returns no row or returns `0'.
-	Do func() error
-}
-
-type migrationStepFunc func(context.Context, reporter.Logger, clickhouse.Conn) migrationStep
-
-type migrationStepWithDescription struct {
-	Description string
-	Step        migrationStepFunc
-}
-
 // migrateDatabase execute database migration
 func (c *Component) migrateDatabase() error {
 	ctx := c.t.Context(nil)
+	c.metrics.migrationsPending.Set(0)
+	c.metrics.migrationsProgress.Set(0)
 
 	// Set orchestrator URL
 	if c.config.OrchestratorURL == "" {
-		baseURL, err := c.getHTTPBaseURL("1.1.1.1:80")
+		baseURL, err := c.getHTTPBaseURL(c.config.OrchestratorURLProbe)
 		if err != nil {
 			return err
 		}
 		c.config.OrchestratorURL = baseURL
 	}
+	c.r.Info().Str("url", c.config.OrchestratorURL).Msg("orchestrator URL used by ClickHouse")
 
 	// Grab some information about the database
 	var threads uint8
@@ -76,35 +64,128 @@ func (c *Component) migrateDatabase() error {
 		c.shards = int(shardNum)
 	}
 
-	// Create dictionaries
-	err := c.wrapMigrations(
-		ctx,
-		func(ctx context.Context) error {
-			return c.createDictionary(ctx, schema.DictionaryASNs, "hashed",
-				"`asn` UInt32 INJECTIVE, `name` String", "asn")
-		}, func(ctx context.Context) error {
-			return c.createDictionary(ctx, schema.DictionaryProtocols, "hashed",
-				"`proto` UInt8 INJECTIVE, `name` String, `description` String", "proto")
-		}, func(ctx context.Context) error {
-			return c.createDictionary(ctx, schema.DictionaryICMP, "complex_key_hashed",
-				"`proto` UInt8, `type` UInt8, `code` UInt8, `name` String", "proto, type, code")
-		}, func(ctx context.Context) error {
-			return c.createDictionary(ctx, schema.DictionaryNetworks, "ip_trie",
-				"`network` String, `name` String, `role` String, `site` String, `region` String, `city` String, `state` String, `country` String, `tenant` String, `asn` UInt32",
-				"network")
-		}, func(ctx context.Context) error {
-			return c.createDictionary(ctx, schema.DictionaryTCP, "hashed",
-				"`port` UInt16 INJECTIVE, `name` String", "port")
-		}, func(ctx context.Context) error {
-			return c.createDictionary(ctx, schema.DictionaryUDP, "hashed",
-				"`port` UInt16 INJECTIVE, `name` String", "port")
-		})
-	if err != nil {
+	migrations := c.migrationSteps()
+	if c.config.MigrationsConcurrency > 1 && !c.config.DryRun {
+		if err := c.runMigrationGraph(ctx, c.config.MigrationsConcurrency, migrations); err != nil {
+			return err
+		}
+	} else if err := c.wrapMigrations(ctx, migrations...); err != nil {
 		return err
 	}
 
-	// Prepare custom dictionary migrations
-	var dictMigrations []func(context.Context) error
+	close(c.migrationsDone)
+	c.metrics.migrationsRunning.Set(0)
+	if c.config.DryRun {
+		c.r.Info().Msg("database migration dry-run done")
+		return nil
+	}
+	c.r.Info().Msg("database migration done")
+
+	// Reload dictionaries
+	if err := c.d.ClickHouse.ExecOnCluster(ctx, "SYSTEM RELOAD DICTIONARIES"); err != nil {
+		c.r.Err(err).Msg("unable to reload dictionaries after migration")
+	}
+
+	return nil
+}
+
+// migrateDatabaseDown reverts the migration steps after toStep, in reverse
+// order. toStep itself is kept. Nothing is reverted when one of these steps
+// cannot be reverted.
+func (c *Component) migrateDatabaseDown(ctx context.Context, toStep string) error {
+	steps := c.migrationSteps()
+	target := slices.IndexFunc(steps, func(step migrationStep) bool {
+		return step.Description == toStep
+	})
+	if target == -1 {
+		return fmt.Errorf("unknown migration step %q", toStep)
+	}
+	steps = steps[target+1:]
+	slices.Reverse(steps)
+	for _, step := range steps {
+		if step.Undo == nil {
+			return fmt.Errorf("cannot revert to migration step %q: step %q cannot be reverted",
+				toStep, step.Description)
+		}
+	}
+	for _, step := range steps {
+		c.r.Info().Str("step", step.Description).Msg("revert migration step")
+		if err := step.Undo(ctx); err != nil {
+			return fmt.Errorf("cannot revert migration step %q: %w", step.Description, err)
+		}
+	}
+	c.r.Info().Str("step", toStep).Msg("database migration reverted")
+	return nil
+}
+
+// migrationSteps returns the steps to migrate the database. They are listed
+// in the order to use when running them serially. Each step depends on the
+// steps which should be completed first, so that independent steps can run
+// concurrently.
+func (c *Component) migrationSteps() []migrationStep {
+	// Create dictionaries
+	migrations := []migrationStep{
+		{
+			Description: "create asns dictionary",
+			Fn: func(ctx context.Context) error {
+				return c.createDictionary(ctx, schema.DictionaryASNs, "hashed",
+					"`asn` UInt32 INJECTIVE, `name` String", "asn")
+			},
+			Undo: c.dropDictionary(schema.DictionaryASNs),
+		}, {
+			Description: "create protocols dictionary",
+			Fn: func(ctx context.Context) error {
+				return c.createDictionary(ctx, schema.DictionaryProtocols, "hashed",
+					"`proto` UInt8 INJECTIVE, `name` String, `description` String", "proto")
+			},
+			Undo: c.dropDictionary(schema.DictionaryProtocols),
+		}, {
+			Description: "create icmp dictionary",
+			Fn: func(ctx context.Context) error {
+				return c.createDictionary(ctx, schema.DictionaryICMP, "complex_key_hashed",
+					"`proto` UInt8, `type` UInt8, `code` UInt8, `name` String", "proto, type, code")
+			},
+			Undo: c.dropDictionary(schema.DictionaryICMP),
+		}, {
+			Description: "create networks dictionary",
+			Fn: func(ctx context.Context) error {
+				return c.createDictionary(ctx, schema.DictionaryNetworks, "ip_trie",
+					"`network` String, `name` String, `role` String, `site` String, `region` String, `city` String, `state` String, `country` String, `tenant` String, `asn` UInt32, `latitude` Float64, `longitude` Float64",
+					"network")
+			},
+			Undo: c.dropDictionary(schema.DictionaryNetworks),
+		}, {
+			Description: "create tcp dictionary",
+			Fn: func(ctx context.Context) error {
+				return c.createDictionary(ctx, schema.DictionaryTCP, "hashed",
+					"`port` UInt16 INJECTIVE, `name` String", "port")
+			},
+			Undo: c.dropDictionary(schema.DictionaryTCP),
+		}, {
+			Description: "create udp dictionary",
+			Fn: func(ctx context.Context) error {
+				return c.createDictionary(ctx, schema.DictionaryUDP, "hashed",
+					"`port` UInt16 INJECTIVE, `name` String", "port")
+			},
+			Undo: c.dropDictionary(schema.DictionaryUDP),
+		},
+	}
+
+	// Create optional dictionaries
+	migrations = append(migrations,
+		migrationStep{
+			Description: "create circuits dictionary",
+			Fn:          c.createCircuitsDictionary,
+			Undo:        c.dropDictionary(schema.DictionaryCircuits),
+		},
+		migrationStep{
+			Description: "create exporter roles dictionary",
+			Fn:          c.createExporterRolesDictionary,
+			Undo:        c.dropDictionary(schema.DictionaryExporterRoles),
+		},
+	)
+
+	// Create custom dictionaries
 	for k, v := range c.d.Schema.GetCustomDictConfig() {
 		var schemaStr []string
 		var keys []string
@@ -123,66 +204,304 @@ func (c *Component) migrateDatabase() error {
 			schemaStr = append(schemaStr, fmt.Sprintf("`%s` %s DEFAULT %s",
 				a.Name, a.Type, quoteString(defaultValue)))
 		}
-		dictMigrations = append(dictMigrations, func(ctx context.Context) error {
-			return c.createDictionary(
-				ctx,
-				fmt.Sprintf("custom_dict_%s", k),
-				v.Layout,
-				strings.Join(schemaStr[:], ", "),
-				strings.Join(keys[:], ", "))
+		migrations = append(migrations, migrationStep{
+			Description: fmt.Sprintf("create custom_dict_%s dictionary", k),
+			Fn: func(ctx context.Context) error {
+				return c.createDictionary(
+					ctx,
+					fmt.Sprintf("custom_dict_%s", k),
+					v.Layout,
+					strings.Join(schemaStr[:], ", "),
+					strings.Join(keys[:], ", "))
+			},
+			Undo: c.dropDictionary(fmt.Sprintf("custom_dict_%s", k)),
 		})
 	}
-	// Create custom dictionaries
-	err = c.wrapMigrations(ctx, dictMigrations...)
-	if err != nil {
-		return err
-	}
+	// Dictionaries do not depend on each other, but flows tables may use them
+	dictionaries := migrationDescriptions(migrations)
 
-	// Create the various non-raw flow tables
-	for _, resolution := range c.config.Resolutions {
-		err := c.wrapMigrations(ctx,
-			func(ctx context.Context) error {
-				return c.createOrUpdateFlowsTable(ctx, resolution)
-			}, func(ctx context.Context) error {
-				if resolution.Interval == 0 {
-					return c.createDistributedTable(ctx, "flows")
-				}
-				return c.createDistributedTable(ctx, fmt.Sprintf("flows_%s", resolution.Interval))
-			}, func(ctx context.Context) error {
-				return c.createFlowsConsumerView(ctx, resolution)
+	// Optional swap of the main flows table
+	migrations = append(migrations, chainMigrationSteps(dictionaries,
+		migrationStep{Description: "create migrations audit table", Fn: c.createMigrationsAuditTable},
+		migrationStep{Description: "create new flows table", Fn: c.createFlowsNewTable},
+		migrationStep{Description: "exchange flows tables", Fn: c.exchangeFlowsTables},
+	)...)
+
+	// Create the various non-raw flow tables, starting with the main one as
+	// the other ones are fed from it.
+	resolutions := slices.Clone(c.config.Resolutions)
+	slices.SortStableFunc(resolutions, func(a, b ResolutionConfiguration) int {
+		// Only the main resolution has no interval
+		return cmp.Compare(min(a.Interval, 1), min(b.Interval, 1))
+	})
+	var flowsReady []string     // the main flows table is ready
+	var flowsConsumers []string // steps to complete before feeding the main flows table
+	for _, resolution := range resolutions {
+		table := "flows"
+		dependsOn := []string{"exchange flows tables"}
+		var consumerDependsOn []string
+		if resolution.Interval != 0 {
+			table = fmt.Sprintf("flows_%s", resolution.Interval)
+			dependsOn = dictionaries
+			consumerDependsOn = flowsReady
+		}
+		steps := chainMigrationSteps(dependsOn,
+			migrationStep{
+				Description: fmt.Sprintf("create or update %s table", table),
+				Fn: func(ctx context.Context) error {
+					return c.createOrUpdateFlowsTable(ctx, resolution)
+				},
+			}, migrationStep{
+				Description: fmt.Sprintf("create or update %s materialized columns", table),
+				Fn: func(ctx context.Context) error {
+					return c.createOrUpdateMaterializedColumns(ctx, resolution)
+				},
+			}, migrationStep{
+				Description: fmt.Sprintf("enforce %s column codecs", table),
+				Fn: func(ctx context.Context) error {
+					return c.enforceFlowsColumnCodecs(ctx, resolution)
+				},
+			}, migrationStep{
+				Description: fmt.Sprintf("create %s distributed table", table),
+				Fn: func(ctx context.Context) error {
+					return c.createDistributedTable(ctx, table)
+				},
+			}, migrationStep{
+				Description: fmt.Sprintf("create %s consumer view", table),
+				Fn: func(ctx context.Context) error {
+					return c.createFlowsConsumerView(ctx, resolution)
+				},
+				DependsOn: consumerDependsOn,
+			}, migrationStep{
+				Description: fmt.Sprintf("create %s row policies", table),
+				Fn: func(ctx context.Context) error {
+					return c.createRowPolicies(ctx, c.distributedTable(table))
+				},
 			})
-		if err != nil {
-			return err
+		if resolution.Interval == 0 {
+			flowsReady = []string{fmt.Sprintf("create %s distributed table", table)}
 		}
+		flowsConsumers = append(flowsConsumers, steps[len(steps)-1].Description)
+		migrations = append(migrations, steps...)
 	}
 
-	// Remaining tables
-	err = c.wrapMigrations(ctx,
-		c.createExportersTable,
-		c.createExportersConsumerView,
-		c.createRawFlowsTable,
-		c.createRawFlowsConsumerView,
-		c.createRawFlowsErrors,
-		func(ctx context.Context) error {
-			return c.createDistributedTable(ctx, "flows_raw_errors")
+	// Optional sampled flows table
+	migrations = append(migrations, chainMigrationSteps(dictionaries,
+		migrationStep{Description: "create flows_sampled table", Fn: c.createFlowsSampledTable},
+		migrationStep{
+			Description: "create flows_sampled distributed table",
+			Fn: func(ctx context.Context) error {
+				if c.config.SampledFlowsRatio == 0 {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "flows_sampled")
+			},
 		},
-		c.createRawFlowsErrorsConsumerView,
-		c.deleteOldRawFlowsErrorsView,
-	)
-	if err != nil {
-		return err
-	}
+		migrationStep{
+			Description: "create flows_sampled consumer view",
+			Fn:          c.createFlowsSampledConsumerView,
+			DependsOn:   flowsReady,
+		},
+	)...)
+	flowsConsumers = append(flowsConsumers, "create flows_sampled consumer view")
 
-	close(c.migrationsDone)
-	c.metrics.migrationsRunning.Set(0)
-	c.r.Info().Msg("database migration done")
+	// Optional daily aggregated flows table
+	migrations = append(migrations, chainMigrationSteps(dictionaries,
+		migrationStep{Description: "create flows_agg_daily table", Fn: c.createFlowsAggDailyTable},
+		migrationStep{
+			Description: "create flows_agg_daily distributed table",
+			Fn: func(ctx context.Context) error {
+				if len(c.config.DailyAggregateKeys) == 0 {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "flows_agg_daily")
+			},
+		},
+		migrationStep{
+			Description: "create flows_agg_daily consumer view",
+			Fn:          c.createFlowsAggDailyConsumerView,
+			DependsOn:   flowsReady,
+		},
+	)...)
+	flowsConsumers = append(flowsConsumers, "create flows_agg_daily consumer view")
 
-	// Reload dictionaries
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, "SYSTEM RELOAD DICTIONARIES"); err != nil {
-		c.r.Err(err).Msg("unable to reload dictionaries after migration")
+	// Optional hourly flows table aggregated by exporter and AS
+	migrations = append(migrations, chainMigrationSteps(dictionaries,
+		migrationStep{Description: "create flows_hourly_as table", Fn: c.createFlowsHourlyASTable},
+		migrationStep{
+			Description: "create flows_hourly_as distributed table",
+			Fn: func(ctx context.Context) error {
+				if !c.config.HourlyASView {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "flows_hourly_as")
+			},
+		},
+		migrationStep{
+			Description: "create flows_hourly_as consumer view",
+			Fn:          c.createFlowsHourlyASConsumerView,
+			DependsOn:   flowsReady,
+		},
+	)...)
+	flowsConsumers = append(flowsConsumers, "create flows_hourly_as consumer view")
+
+	// Optional tables split by direction
+	for _, table := range []string{"flows_in", "flows_out"} {
+		migrations = append(migrations, chainMigrationSteps(dictionaries,
+			migrationStep{
+				Description: fmt.Sprintf("create %s table", table),
+				Fn: func(ctx context.Context) error {
+					return c.createFlowsDirectionTable(ctx, table)
+				},
+			}, migrationStep{
+				Description: fmt.Sprintf("create %s distributed table", table),
+				Fn: func(ctx context.Context) error {
+					if !c.config.SplitFlowsByDirection {
+						return errSkipStep
+					}
+					return c.createDistributedTable(ctx, table)
+				},
+			}, migrationStep{
+				Description: fmt.Sprintf("create %s consumer view", table),
+				Fn: func(ctx context.Context) error {
+					return c.createFlowsDirectionConsumerView(ctx, table)
+				},
+				DependsOn: flowsReady,
+			},
+		)...)
+		flowsConsumers = append(flowsConsumers, fmt.Sprintf("create %s consumer view", table))
 	}
 
-	return nil
+	// Optional query log table
+	migrations = append(migrations, chainMigrationSteps(nil,
+		migrationStep{Description: "create query_log_akvorado table", Fn: c.createQueryLogTable},
+		migrationStep{
+			Description: "create query_log_akvorado distributed table",
+			Fn: func(ctx context.Context) error {
+				if c.config.QueryLogTTL == 0 {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "query_log_akvorado")
+			},
+		},
+		migrationStep{Description: "create query_log_akvorado consumer view", Fn: c.createQueryLogConsumerView},
+	)...)
+
+	// Optional flow samples table
+	migrations = append(migrations, chainMigrationSteps(nil,
+		migrationStep{Description: "create flow_samples table", Fn: c.createFlowSamplesTable},
+		migrationStep{
+			Description: "create flow_samples distributed table",
+			Fn: func(ctx context.Context) error {
+				if c.config.FlowSamplesTopic == "" {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "flow_samples")
+			},
+		},
+		migrationStep{Description: "create flow_samples raw table", Fn: c.createFlowSamplesRawTable},
+		migrationStep{Description: "create flow_samples consumer view", Fn: c.createFlowSamplesConsumerView},
+	)...)
+
+	// Optional BGP paths table
+	migrations = append(migrations, chainMigrationSteps(nil,
+		migrationStep{Description: "create asn_paths table", Fn: c.createASNPathsTable},
+		migrationStep{
+			Description: "create asn_paths distributed table",
+			Fn: func(ctx context.Context) error {
+				if c.config.ASNPathsTopic == "" {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "asn_paths")
+			},
+		},
+		migrationStep{Description: "create asn_paths raw table", Fn: c.createASNPathsRawTable},
+		migrationStep{Description: "create asn_paths consumer view", Fn: c.createASNPathsConsumerView},
+	)...)
+
+	// Optional exporters metadata table
+	migrations = append(migrations, chainMigrationSteps(nil,
+		migrationStep{Description: "create exporters_meta table", Fn: c.createExportersMetaTable},
+		migrationStep{
+			Description: "create exporters_meta distributed table",
+			Fn: func(ctx context.Context) error {
+				if c.config.ExportersMetaTopic == "" {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "exporters_meta")
+			},
+		},
+		migrationStep{Description: "create exporters_meta raw table", Fn: c.createExportersMetaRawTable},
+		migrationStep{Description: "create exporters_meta consumer view", Fn: c.createExportersMetaConsumerView},
+	)...)
+
+	// Exporters table
+	migrations = append(migrations, chainMigrationSteps(nil,
+		migrationStep{Description: "create exporters table", Fn: c.createExportersTable},
+		migrationStep{
+			Description: "create exporters consumer view",
+			Fn:          c.createExportersConsumerView,
+			DependsOn:   flowsReady,
+		},
+	)...)
+	flowsConsumers = append(flowsConsumers, "create exporters consumer view")
+
+	// Raw tables. Flows are only fed once everything consuming them is ready.
+	migrations = append(migrations, chainMigrationSteps(nil,
+		migrationStep{Description: "create raw flows table", Fn: c.createRawFlowsTable},
+		migrationStep{Description: "check insert deduplication", Fn: c.checkInsertDeduplication},
+		migrationStep{
+			Description: "create raw flows consumer view",
+			Fn:          c.createRawFlowsConsumerView,
+			DependsOn:   append(slices.Clone(dictionaries), flowsConsumers...),
+		},
+		migrationStep{Description: "create flows_raw_errors table", Fn: c.createRawFlowsErrors},
+		migrationStep{
+			Description: "create flows_raw_errors distributed table",
+			Fn: func(ctx context.Context) error {
+				return c.createDistributedTable(ctx, "flows_raw_errors")
+			},
+		},
+		migrationStep{Description: "create flows_raw_errors consumer view", Fn: c.createRawFlowsErrorsConsumerView},
+		migrationStep{
+			Description: "delete old flows_raw_errors view",
+			Fn:          c.deleteOldRawFlowsErrorsView,
+			CheckQuery:  `SELECT count() = 0 FROM system.tables WHERE name = $1 AND database = $2`,
+			CheckArgs:   []any{c.oldRawFlowsErrorsView(), c.config.Database},
+		},
+		migrationStep{Description: "create flows_raw_errors_quarantine table", Fn: c.createErrorsQuarantineTable},
+		migrationStep{
+			Description: "create flows_raw_errors_quarantine distributed table",
+			Fn: func(ctx context.Context) error {
+				if c.config.ErrorsQuarantineTTL == 0 {
+					return errSkipStep
+				}
+				return c.createDistributedTable(ctx, "flows_raw_errors_quarantine")
+			},
+		},
+		migrationStep{Description: "create flows_raw_errors_quarantine consumer view", Fn: c.createErrorsQuarantineConsumerView},
+		migrationStep{
+			Description: "create flows_raw_errors_quarantine stats view",
+			Fn:          c.createErrorsQuarantineStatsView,
+			Undo:        c.dropView("flows_raw_errors_quarantine_stats"),
+		},
+	)...)
+
+	// Views on system tables
+	migrations = append(migrations,
+		migrationStep{
+			Description: "create flows_compression_stats view",
+			Fn:          c.createCompressionStatsView,
+			Undo:        c.dropView("flows_compression_stats"),
+		},
+		migrationStep{
+			Description: "create kafka_consumers_lag view",
+			Fn:          c.createKafkaLagView,
+			Undo:        c.dropView("kafka_consumers_lag"),
+		},
+	)
+
+	return migrations
 }
 
 // getHTTPBaseURL tries to guess the appropriate URL to access our
@@ -190,9 +509,9 @@ func (c *Component) migrateDatabase() error {
 // UDP socket.
 func (c *Component) getHTTPBaseURL(address string) (string, error) {
 	// Get IP address
-	conn, err := net.Dial("udp", address)
+	conn, err := c.dial("udp", address)
 	if err != nil {
-		return "", fmt.Errorf("cannot get our IP address: %w", err)
+		return "", fmt.Errorf("cannot get our IP address using %s: %w", address, err)
 	}
 	defer conn.Close()
 	localAddr := conn.LocalAddr().(*net.UDPAddr)
@@ -202,7 +521,7 @@ func (c *Component) getHTTPBaseURL(address string) (string, error) {
 	if err != nil {
 		return "", fmt.Errorf("cannot get HTTP port: %w", err)
 	}
-	base := fmt.Sprintf("http://%s",
+	base := fmt.Sprintf("%s://%s", c.d.HTTP.Scheme(),
 		net.JoinHostPort(localAddr.IP.String(), port))
 	c.r.Debug().Msgf("detected base URL is %s", base)
 	return base, nil
@@ -212,3 +531,52 @@ func (c *Component) getHTTPBaseURL(address string) (string, error) {
 func (c *Component) ReloadDictionary(ctx context.Context, dictName string) error {
 	return c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf("SYSTEM RELOAD DICTIONARY %s.%s", c.config.Database, dictName))
 }
+
+// readinessCheck tells if the orchestrator is ready: migrations should be done
+// and ClickHouse should answer. ClickHouse is pinged on each call.
+func (c *Component) readinessCheck(ctx context.Context) error {
+	if !c.config.SkipMigrations {
+		select {
+		case <-c.migrationsDone:
+		default:
+			return errors.New("database migration not done")
+		}
+	}
+	if err := c.d.ClickHouse.Ping(ctx); err != nil {
+		return fmt.Errorf("cannot ping ClickHouse: %w", err)
+	}
+	return nil
+}
+
+// asnsDictionaryRefresher periodically reloads the ASNs dictionary until the
+// component is stopped.
+func (c *Component) asnsDictionaryRefresher() {
+	// Wait for migrations
+	if !c.config.SkipMigrations {
+		select {
+		case <-c.t.Dying():
+			return
+		case <-c.migrationsDone:
+		}
+	}
+
+	ticker := c.d.Clock.Ticker(c.config.ASNsReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.t.Dying():
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(c.t.Context(nil), time.Minute)
+		err := c.ReloadDictionary(ctx, schema.DictionaryASNs)
+		cancel()
+		if err != nil {
+			c.r.Err(err).Msg("failed to reload ASNs dictionary")
+			c.metrics.asnsReload.WithLabelValues("failure").Inc()
+			continue
+		}
+		c.metrics.asnsReload.WithLabelValues("success").Inc()
+	}
+}
@@ -9,31 +9,319 @@ import (
 	"errors"
 	"fmt"
 	"regexp"
+	"slices"
 	"strings"
+	"syscall"
 	"text/template"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/gin-gonic/gin"
-	"golang.org/x/exp/slices"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"akvorado/common/schema"
 )
 
 var errSkipStep = errors.New("migration: skip this step")
 
-// wrapMigrations can be used to wrap migration functions. It will keep the
+// migrationStep is a migration function with its description. The
+// description is used in logs and traces. It also identifies the step in the
+// dependencies of the other steps.
+type migrationStep struct {
+	Description string
+	Fn          func(context.Context) error
+	// DependsOn lists the descriptions of the steps to complete before
+	// running this one. They should come before it in the list of steps.
+	DependsOn []string
+	// Undo reverts the step. It should be idempotent. When nil, the step
+	// cannot be reverted.
+	Undo func(context.Context) error
+	// CheckQuery is executed with CheckArgs before Fn. When it returns a
+	// non-zero value, the step is skipped.
+	CheckQuery string
+	CheckArgs  []any
+}
+
+// migrationCheckResult is the result of the CheckQuery of a migration step.
+// It accepts any integer or boolean type as ClickHouse types the result of
+// count() as UInt64 while comparisons return an UInt8. NULL is like 0.
+type migrationCheckResult uint64
+
+// Scan implements sql.Scanner.
+func (r *migrationCheckResult) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*r = 0
+	case bool:
+		if v {
+			*r = 1
+		} else {
+			*r = 0
+		}
+	case uint8:
+		*r = migrationCheckResult(v)
+	case uint16:
+		*r = migrationCheckResult(v)
+	case uint32:
+		*r = migrationCheckResult(v)
+	case uint64:
+		*r = migrationCheckResult(v)
+	case int8:
+		return r.Scan(v != 0)
+	case int16:
+		return r.Scan(v != 0)
+	case int32:
+		return r.Scan(v != 0)
+	case int64:
+		return r.Scan(v != 0)
+	default:
+		return fmt.Errorf("unsupported type %T for check result", src)
+	}
+	return nil
+}
+
+// applyMigrationStep runs the CheckQuery of the provided step, if any, then
+// its function. errSkipStep is returned when the check tells the step is not
+// needed. No row or a NULL result means the step is needed.
+func (c *Component) applyMigrationStep(ctx context.Context, step migrationStep) error {
+	if step.CheckQuery != "" {
+		var result migrationCheckResult
+		row := c.d.ClickHouse.QueryRow(ctx, step.CheckQuery, step.CheckArgs...)
+		if err := row.Scan(&result); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("cannot parse check result: %w", err)
+		} else if err == nil && result != 0 {
+			return errSkipStep
+		}
+	}
+	return step.Fn(ctx)
+}
+
+// chainMigrationSteps makes each of the provided steps depend on the previous
+// one, the first one depending on the provided steps. Dependencies already
+// set on a step are kept.
+func chainMigrationSteps(dependsOn []string, steps ...migrationStep) []migrationStep {
+	previous := dependsOn
+	for idx := range steps {
+		steps[idx].DependsOn = append(steps[idx].DependsOn, previous...)
+		previous = []string{steps[idx].Description}
+	}
+	return steps
+}
+
+// migrationDescriptions returns the descriptions of the provided steps.
+func migrationDescriptions(steps []migrationStep) []string {
+	descriptions := make([]string, len(steps))
+	for idx, step := range steps {
+		descriptions[idx] = step.Description
+	}
+	return descriptions
+}
+
+// wrapMigrations can be used to wrap migration steps. It will keep the
 // metrics up-to-date as long as the migration function returns `errSkipStep`
-// when a step is skipped.
-func (c *Component) wrapMigrations(ctx context.Context, fns ...func(context.Context) error) error {
-	for _, fn := range fns {
-		if err := fn(ctx); err == nil {
+// when a step is skipped. The progress is reported after each step.
+func (c *Component) wrapMigrations(ctx context.Context, steps ...migrationStep) error {
+	if c.config.DryRun {
+		return c.dryRunMigrations(ctx, steps...)
+	}
+	total := len(steps)
+	for idx, step := range steps {
+		if err := c.runMigrationStep(ctx, step); err == nil {
 			c.metrics.migrationsApplied.Inc()
+			c.r.Info().
+				Str("step", step.Description).
+				Msgf("applied step %d/%d", idx+1, total)
 		} else if err == errSkipStep {
 			c.metrics.migrationsNotApplied.Inc()
 		} else {
 			return err
 		}
+		c.metrics.migrationsProgress.Set(float64(idx+1) / float64(total))
+	}
+	return nil
+}
+
+// runMigrationGraph runs the provided migration steps, running up to
+// `workers` steps at the same time. A step is started once all its
+// dependencies are completed. On the first error, no new step is started,
+// the context of the running steps is canceled and the error is returned once
+// they are done. Like for wrapMigrations, metrics and progress are updated
+// after each step.
+func (c *Component) runMigrationGraph(ctx context.Context, workers int, steps []migrationStep) error {
+	total := len(steps)
+	pending := make([]int, total)
+	dependents := make([][]int, total)
+	ready := []int{}
+	indexes := make(map[string]int, total)
+	for idx, step := range steps {
+		if _, ok := indexes[step.Description]; ok {
+			return fmt.Errorf("duplicate migration step %q", step.Description)
+		}
+		for _, dep := range step.DependsOn {
+			depIdx, ok := indexes[dep]
+			if !ok {
+				return fmt.Errorf("migration step %q cannot depend on step %q", step.Description, dep)
+			}
+			dependents[depIdx] = append(dependents[depIdx], idx)
+		}
+		indexes[step.Description] = idx
+		pending[idx] = len(step.DependsOn)
+		if pending[idx] == 0 {
+			ready = append(ready, idx)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		idx int
+		err error
+	}
+	results := make(chan result)
+	running, done := 0, 0
+	var firstErr error
+	for {
+		for firstErr == nil && running < workers && len(ready) > 0 {
+			idx := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				results <- result{idx, c.runMigrationStep(ctx, steps[idx])}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		res := <-results
+		running--
+		done++
+		switch res.err {
+		case nil:
+			c.metrics.migrationsApplied.Inc()
+			c.r.Info().
+				Str("step", steps[res.idx].Description).
+				Msgf("applied step %d/%d", done, total)
+		case errSkipStep:
+			c.metrics.migrationsNotApplied.Inc()
+		default:
+			if firstErr == nil {
+				firstErr = res.err
+				cancel()
+			}
+			continue
+		}
+		c.metrics.migrationsProgress.Set(float64(done) / float64(total))
+		for _, dependent := range dependents[res.idx] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	return firstErr
+}
+
+// runMigrationStep runs a migration step inside a span. When it fails
+// with a retryable error, it is retried with an exponential backoff.
+func (c *Component) runMigrationStep(ctx context.Context, step migrationStep) error {
+	ctx, span := c.r.Tracer().Start(ctx, "migration step",
+		trace.WithAttributes(attribute.String("migration.step", step.Description)))
+	defer span.End()
+	err := c.retryMigrationStep(ctx, step)
+	switch {
+	case err == nil:
+		span.SetAttributes(attribute.String("migration.status", "applied"))
+	case errors.Is(err, errSkipStep):
+		span.SetAttributes(attribute.String("migration.status", "skipped"))
+	default:
+		span.SetAttributes(attribute.String("migration.status", "failed"))
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// retryMigrationStep runs a migration step and retries it with an
+// exponential backoff when it fails with a retryable error.
+func (c *Component) retryMigrationStep(ctx context.Context, step migrationStep) error {
+	delay := c.config.MigrationsRetryDelay
+	for attempt := 1; ; attempt++ {
+		err := c.applyMigrationStep(ctx, step)
+		if err == nil || errors.Is(err, errSkipStep) ||
+			attempt >= c.config.MigrationsRetryAttempts || !c.isRetryableError(err) {
+			return err
+		}
+		c.r.Warn().Err(err).
+			Str("step", step.Description).
+			Msgf("migration step failed, retry in %s", delay)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-c.d.Clock.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isRetryableError tells if the provided error is transient. This is the case
+// for a reset connection or for a ClickHouse exception whose code is in
+// MigrationsRetryableCodes.
+func (c *Component) isRetryableError(err error) bool {
+	if errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var exception *clickhouse.Exception
+	if errors.As(err, &exception) {
+		return slices.Contains(c.config.MigrationsRetryableCodes, exception.Code)
+	}
+	return false
+}
+
+// execOnCluster executes a migration statement on the whole cluster. In
+// dry-run mode, the statement is only logged.
+func (c *Component) execOnCluster(ctx context.Context, query string, args ...any) error {
+	if c.config.DryRun {
+		return c.dryRunExec(query)
+	}
+	return c.d.ClickHouse.ExecOnCluster(ctx, query, args...)
+}
+
+// exec executes a migration statement. In dry-run mode, the statement is only
+// logged.
+func (c *Component) exec(ctx context.Context, query string, args ...any) error {
+	if c.config.DryRun {
+		return c.dryRunExec(query)
+	}
+	return c.d.ClickHouse.Exec(ctx, query, args...)
+}
+
+// dryRunExec logs a statement instead of executing it.
+func (c *Component) dryRunExec(query string) error {
+	c.r.Debug().Str("query", query).Msg("would execute")
+	c.dryRunExecuted.Add(1)
+	return nil
+}
+
+// dryRunMigrations runs the migration steps without executing statements.
+// Queries are still executed. A step executing a statement or returning no
+// error would be applied. As the previous steps are not applied, a step may
+// fail: the error is logged and the migration continues.
+func (c *Component) dryRunMigrations(ctx context.Context, steps ...migrationStep) error {
+	for idx, step := range steps {
+		c.dryRunExecuted.Store(0)
+		err := c.applyMigrationStep(ctx, step)
+		switch {
+		case err == nil || c.dryRunExecuted.Load() > 0:
+			c.r.Info().Str("step", step.Description).Msg("would apply")
+			c.metrics.migrationsPending.Inc()
+		case err == errSkipStep:
+			c.r.Info().Str("step", step.Description).Msg("would skip")
+		default:
+			c.r.Warn().Err(err).Str("step", step.Description).Msg("cannot check if step would apply")
+		}
+		c.metrics.migrationsProgress.Set(float64(idx+1) / float64(len(steps)))
 	}
 	return nil
 }
@@ -126,7 +414,69 @@ func (c *Component) localTable(table string) string {
 
 // createDictionary creates the provided dictionary.
 func (c *Component) createDictionary(ctx context.Context, name, layout, schema, primary string) error {
+	return c.createDictionaryWithLifetime(ctx, name, layout, schema, primary, time.Hour)
+}
+
+// createDictionaryWithLifetime creates the provided dictionary with the
+// provided maximum lifetime.
+func (c *Component) createDictionaryWithLifetime(ctx context.Context, name, layout, schema, primary string, lifetime time.Duration) error {
+	createQuery, err := c.dictionaryCreateQuery(name, layout, schema, primary, lifetime)
+	if err != nil {
+		return fmt.Errorf("cannot build query to create dictionary %s: %w", name, err)
+	}
+
+	// Check if dictionary exists and create it if not
+	if ok, err := c.tableAlreadyExists(ctx, name, "create_table_query", createQuery); err != nil {
+		return err
+	} else if ok {
+		c.r.Info().Msgf("dictionary %s already exists, skip migration", name)
+		return errSkipStep
+	}
+	c.r.Info().Msgf("create dictionary %s", name)
+	createOrReplaceQuery := strings.Replace(createQuery, "CREATE ", "CREATE OR REPLACE ", 1)
+	if err := c.execOnCluster(ctx, createOrReplaceQuery); err != nil {
+		return fmt.Errorf("cannot create dictionary %s: %w", name, err)
+	}
+	return nil
+}
+
+// dropDictionary returns a function dropping the provided dictionary, to
+// revert its creation.
+func (c *Component) dropDictionary(name string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP DICTIONARY IF EXISTS %s SYNC`, name)); err != nil {
+			return fmt.Errorf("cannot drop dictionary %s: %w", name, err)
+		}
+		return nil
+	}
+}
+
+// dropView returns a function dropping the provided view, to revert its
+// creation.
+func (c *Component) dropView(name string) func(context.Context) error {
+	return func(ctx context.Context) error {
+		if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP VIEW IF EXISTS %s SYNC`, name)); err != nil {
+			return fmt.Errorf("cannot drop view %s: %w", name, err)
+		}
+		return nil
+	}
+}
+
+// dictionaryURL returns the URL ClickHouse uses to fetch the content of the
+// provided dictionary. For the protocols dictionary, a hash of the custom
+// protocols is appended: when they change, the dictionary definition changes
+// too and the dictionary is recreated and reloaded.
+func (c *Component) dictionaryURL(name string) string {
 	url := fmt.Sprintf("%s/api/v0/orchestrator/clickhouse/%s.csv", c.config.OrchestratorURL, name)
+	if name == schema.DictionaryProtocols && len(c.config.Protocols) != 0 {
+		url = fmt.Sprintf("%s?hash=%s", url, c.protocolsHash())
+	}
+	return url
+}
+
+// dictionaryCreateQuery returns the query to create the provided dictionary.
+func (c *Component) dictionaryCreateQuery(name, layout, schema, primary string, lifetime time.Duration) (string, error) {
+	url := c.dictionaryURL(name)
 	sourceParams := []string{
 		fmt.Sprintf("URL %s", quoteString(url)),
 		"FORMAT 'CSVWithNames'",
@@ -139,11 +489,11 @@ func (c *Component) createDictionary(ctx context.Context, name, layout, schema,
 	}
 	source := fmt.Sprintf(`SOURCE(HTTP(%s))`, strings.Join(sourceParams, " "))
 	settings := `SETTINGS(format_csv_allow_single_quotes = 0)`
-	createQuery, err := stemplate(`
+	return stemplate(`
 CREATE DICTIONARY {{ .Database }}.{{ .Name }} ({{ .Schema }})
 PRIMARY KEY {{ .PrimaryKey}}
 {{ .Source }}
-LIFETIME(MIN 0 MAX 3600)
+LIFETIME(MIN 0 MAX {{ .Lifetime }})
 LAYOUT({{ .Layout }}())
 {{ .Settings }}
 `, gin.H{
@@ -154,24 +504,8 @@ LAYOUT({{ .Layout }}())
 		"Layout":     strings.ToUpper(layout),
 		"Source":     source,
 		"Settings":   settings,
+		"Lifetime":   uint64(lifetime.Seconds()),
 	})
-	if err != nil {
-		return fmt.Errorf("cannot build query to create dictionary %s: %w", name, err)
-	}
-
-	// Check if dictionary exists and create it if not
-	if ok, err := c.tableAlreadyExists(ctx, name, "create_table_query", createQuery); err != nil {
-		return err
-	} else if ok {
-		c.r.Info().Msgf("dictionary %s already exists, skip migration", name)
-		return errSkipStep
-	}
-	c.r.Info().Msgf("create dictionary %s", name)
-	createOrReplaceQuery := strings.Replace(createQuery, "CREATE ", "CREATE OR REPLACE ", 1)
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, createOrReplaceQuery); err != nil {
-		return fmt.Errorf("cannot create dictionary %s: %w", name, err)
-	}
-	return nil
 }
 
 // createExportersTable creates the exporters table. This table is always local.
@@ -221,7 +555,7 @@ TTL TimeReceived + toIntervalDay(1)`,
 		"allow_suspicious_low_cardinality_types": 1,
 	}))
 	createOrReplaceQuery := strings.Replace(createQuery, "CREATE ", "CREATE OR REPLACE ", 1)
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, createOrReplaceQuery); err != nil {
+	if err := c.execOnCluster(ctx, createOrReplaceQuery); err != nil {
 		return fmt.Errorf("cannot create exporters table: %w", err)
 	}
 
@@ -267,10 +601,10 @@ func (c *Component) createExportersConsumerView(ctx context.Context) error {
 
 	// Drop existing table and recreate
 	c.r.Info().Msg("create exporters view")
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, `DROP TABLE IF EXISTS exporters_consumer SYNC`); err != nil {
+	if err := c.execOnCluster(ctx, `DROP TABLE IF EXISTS exporters_consumer SYNC`); err != nil {
 		return fmt.Errorf("cannot drop existing exporters view: %w", err)
 	}
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf(`
+	if err := c.execOnCluster(ctx, fmt.Sprintf(`
 CREATE MATERIALIZED VIEW exporters_consumer TO %s AS %s
 `, "exporters", selectQuery)); err != nil {
 		return fmt.Errorf("cannot create exporters view: %w", err)
@@ -279,39 +613,64 @@ CREATE MATERIALIZED VIEW exporters_consumer TO %s AS %s
 	return nil
 }
 
-// createRawFlowsTable creates the raw flow table
-func (c *Component) createRawFlowsTable(ctx context.Context) error {
-	hash := c.d.Schema.ProtobufMessageHash()
-	tableName := fmt.Sprintf("flows_%s_raw", hash)
+// kafkaEngine returns the engine clause for a Kafka table consuming the
+// provided topic with the provided consumer group. The provided settings are
+// added after the common ones and before the user-provided ones. As the CA
+// location is set in the ClickHouse configuration, it is recorded in a comment
+// to recreate the table when it changes.
+func (c *Component) kafkaEngine(topic string, groupName string, settings ...string) string {
 	kafkaSettings := []string{
 		fmt.Sprintf(`kafka_broker_list = %s`,
 			quoteString(strings.Join(c.config.Kafka.Brokers, ","))),
-		fmt.Sprintf(`kafka_topic_list = %s`,
-			quoteString(fmt.Sprintf("%s-%s", c.config.Kafka.Topic, hash))),
-		fmt.Sprintf(`kafka_group_name = %s`, quoteString(c.config.Kafka.GroupName)),
+		fmt.Sprintf(`kafka_topic_list = %s`, quoteString(topic)),
+		fmt.Sprintf(`kafka_group_name = %s`, quoteString(groupName)),
+	}
+	kafkaSettings = append(kafkaSettings, settings...)
+	if c.config.Kafka.CALocation != "" && !slices.ContainsFunc(c.config.Kafka.EngineSettings,
+		func(setting string) bool {
+			name, _, _ := strings.Cut(setting, "=")
+			return strings.TrimSpace(name) == "kafka_security_protocol"
+		}) {
+		kafkaSettings = append(kafkaSettings, `kafka_security_protocol = 'ssl'`)
+	}
+	kafkaSettings = append(kafkaSettings, c.config.Kafka.EngineSettings...)
+	engine := fmt.Sprintf("Kafka SETTINGS %s", strings.Join(kafkaSettings, ", "))
+	if c.config.Kafka.CALocation != "" {
+		engine = fmt.Sprintf("%s COMMENT %s", engine,
+			quoteString(fmt.Sprintf("ssl_ca_location: %s", c.config.Kafka.CALocation)))
+	}
+	return engine
+}
+
+// rawFlowsCreateQuery returns the query to create the raw flows table.
+func (c *Component) rawFlowsCreateQuery() (string, error) {
+	hash := c.d.Schema.ProtobufMessageHash()
+	kafkaEngine := c.kafkaEngine(
+		fmt.Sprintf("%s-%s", c.config.Kafka.Topic, hash),
+		c.config.Kafka.GroupName,
 		`kafka_format = 'Protobuf'`,
 		fmt.Sprintf(`kafka_schema = 'flow-%s.proto:FlowMessagev%s'`, hash, hash),
 		fmt.Sprintf(`kafka_num_consumers = %d`, c.config.Kafka.Consumers),
 		`kafka_thread_per_consumer = 1`,
-		`kafka_handle_error_mode = 'stream'`,
-	}
-	for _, setting := range c.config.Kafka.EngineSettings {
-		kafkaSettings = append(kafkaSettings, setting)
-	}
-	kafkaEngine := fmt.Sprintf("Kafka SETTINGS %s", strings.Join(kafkaSettings, ", "))
+		`kafka_handle_error_mode = 'stream'`)
 
-	// Build CREATE query
-	createQuery, err := stemplate(
+	return stemplate(
 		`CREATE TABLE {{ .Database }}.{{ .Table }} ({{ .Schema }}) ENGINE = {{ .Engine }}`,
 		gin.H{
 			"Database": c.config.Database,
-			"Table":    tableName,
+			"Table":    fmt.Sprintf("flows_%s_raw", hash),
 			"Schema": c.d.Schema.ClickHouseCreateTable(
 				schema.ClickHouseSkipGeneratedColumns,
 				schema.ClickHouseUseTransformFromType,
 				schema.ClickHouseSkipAliasedColumns),
 			"Engine": kafkaEngine,
 		})
+}
+
+// createRawFlowsTable creates the raw flow table
+func (c *Component) createRawFlowsTable(ctx context.Context) error {
+	tableName := fmt.Sprintf("flows_%s_raw", c.d.Schema.ProtobufMessageHash())
+	createQuery, err := c.rawFlowsCreateQuery()
 	if err != nil {
 		return fmt.Errorf("cannot build query to create raw flows table: %w", err)
 	}
@@ -331,14 +690,14 @@ func (c *Component) createRawFlowsTable(ctx context.Context) error {
 		fmt.Sprintf("%s_errors", tableName),
 		tableName,
 	} {
-		if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, table)); err != nil {
+		if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, table)); err != nil {
 			return fmt.Errorf("cannot drop %s: %w", table, err)
 		}
 	}
 	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
 		"allow_suspicious_low_cardinality_types": 1,
 	}))
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, createQuery); err != nil {
+	if err := c.execOnCluster(ctx, createQuery); err != nil {
 		return fmt.Errorf("cannot create raw flows table: %w", err)
 	}
 
@@ -433,10 +792,10 @@ func (c *Component) createRawFlowsConsumerView(ctx context.Context) error {
 
 	// Drop and create
 	c.r.Info().Msg("create raw flows consumer view")
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
+	if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
 		return fmt.Errorf("cannot drop table %s: %w", viewName, err)
 	}
-	if err := c.d.ClickHouse.ExecOnCluster(ctx,
+	if err := c.execOnCluster(ctx,
 		fmt.Sprintf("CREATE MATERIALIZED VIEW %s TO %s AS %s",
 			viewName, c.distributedTable("flows"), selectQuery)); err != nil {
 		return fmt.Errorf("cannot create raw flows consumer view: %w", err)
@@ -474,7 +833,7 @@ TTL timestamp + toIntervalDay(1)
 	}
 	c.r.Info().Msgf("create table %s", name)
 	createOrReplaceQuery := strings.Replace(createQuery, "CREATE ", "CREATE OR REPLACE ", 1)
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, createOrReplaceQuery); err != nil {
+	if err := c.execOnCluster(ctx, createOrReplaceQuery); err != nil {
 		return fmt.Errorf("cannot create table %s: %w", name, err)
 	}
 	return nil
@@ -512,10 +871,10 @@ WHERE length(_error) > 0`, gin.H{
 
 	// Drop and create
 	c.r.Info().Msg("create raw flows errors view")
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
+	if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
 		return fmt.Errorf("cannot drop table %s: %w", viewName, err)
 	}
-	if err := c.d.ClickHouse.ExecOnCluster(ctx,
+	if err := c.execOnCluster(ctx,
 		fmt.Sprintf(`CREATE MATERIALIZED VIEW %s TO %s AS %s`,
 			viewName, c.distributedTable("flows_raw_errors"), selectQuery)); err != nil {
 		return fmt.Errorf("cannot create raw flows errors view: %w", err)
@@ -524,26 +883,70 @@ WHERE length(_error) > 0`, gin.H{
 	return nil
 }
 
-func (c *Component) deleteOldRawFlowsErrorsView(ctx context.Context) error {
-	tableName := fmt.Sprintf("flows_%s_raw", c.d.Schema.ProtobufMessageHash())
-	viewName := fmt.Sprintf("%s_errors", tableName)
-
-	// Check the existing one
-	if ok, err := c.tableAlreadyExists(ctx, viewName, "name", viewName); err != nil {
-		return err
-	} else if !ok {
-		c.r.Debug().Msg("old raw flows errors view does not exist, skip migration")
-		return errSkipStep
-	}
+// oldRawFlowsErrorsView returns the name of the view previously used to
+// collect raw flows errors.
+func (c *Component) oldRawFlowsErrorsView() string {
+	return fmt.Sprintf("flows_%s_raw_errors", c.d.Schema.ProtobufMessageHash())
+}
 
-	// Drop
+// deleteOldRawFlowsErrorsView deletes the view previously used to collect raw
+// flows errors. The step is skipped by its check query when the view does not
+// exist.
+func (c *Component) deleteOldRawFlowsErrorsView(ctx context.Context) error {
+	viewName := c.oldRawFlowsErrorsView()
 	c.r.Info().Msg("delete old raw flows errors view")
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
+	if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
 		return fmt.Errorf("cannot drop table %s: %w", viewName, err)
 	}
 	return nil
 }
 
+// flowsCreateQuery returns the query to create the flows table for the
+// provided resolution with the provided name.
+func (c *Component) flowsCreateQuery(tableName string, resolution ResolutionConfiguration) (string, error) {
+	partitionInterval := uint64((resolution.TTL / time.Duration(c.config.MaxPartitions)).Seconds())
+	ttl, err := c.flowsTTLExpression(resolution)
+	if err != nil {
+		return "", err
+	}
+	settings := c.flowsTableSettings()
+	if resolution.Interval == 0 {
+		return stemplate(`
+CREATE TABLE {{ .Table }} ({{ .Schema }})
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMMDDhhmmss(toStartOfInterval(TimeReceived, INTERVAL {{ .PartitionInterval }} second))
+ORDER BY (toStartOfFiveMinutes(TimeReceived), ExporterAddress, InIfName, OutIfName)
+TTL {{ .TTL }}
+SETTINGS {{ .Settings }}
+`, gin.H{
+			"Table":             tableName,
+			"Schema":            c.d.Schema.ClickHouseCreateTable(),
+			"PartitionInterval": partitionInterval,
+			"TTL":               ttl,
+			"Engine":            c.mergeTreeEngine(tableName, ""),
+			"Settings":          settings,
+		})
+	}
+	return stemplate(`
+CREATE TABLE {{ .Table }} ({{ .Schema }})
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMMDDhhmmss(toStartOfInterval(TimeReceived, INTERVAL {{ .PartitionInterval }} second))
+PRIMARY KEY ({{ .PrimaryKey }})
+ORDER BY ({{ .SortingKey }})
+TTL {{ .TTL }}
+SETTINGS {{ .Settings }}
+`, gin.H{
+		"Table":             tableName,
+		"Schema":            c.d.Schema.ClickHouseCreateTable(schema.ClickHouseSkipMainOnlyColumns),
+		"PartitionInterval": partitionInterval,
+		"PrimaryKey":        strings.Join(c.d.Schema.ClickHousePrimaryKeys(), ", "),
+		"SortingKey":        strings.Join(c.d.Schema.ClickHouseSortingKeys(), ", "),
+		"TTL":               ttl,
+		"Engine":            c.mergeTreeEngine(tableName, "Summing", "(Bytes, Packets)"),
+		"Settings":          settings,
+	})
+}
+
 func (c *Component) createOrUpdateFlowsTable(ctx context.Context, resolution ResolutionConfiguration) error {
 	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
 		"allow_suspicious_low_cardinality_types": 1,
@@ -555,60 +958,29 @@ func (c *Component) createOrUpdateFlowsTable(ctx context.Context, resolution Res
 		tableName = fmt.Sprintf("flows_%s", resolution.Interval)
 	}
 	tableName = c.localTable(tableName)
-	partitionInterval := uint64((resolution.TTL / time.Duration(c.config.MaxPartitions)).Seconds())
-	ttl := uint64(resolution.TTL.Seconds())
-	settings := `index_granularity = 8192, ttl_only_drop_parts = 1`
+	settings := c.flowsTableSettings()
+	if c.ttlOnlyDropPartsIneffective(resolution) {
+		c.r.Warn().Msgf("ttl_only_drop_parts is enabled on %s but its rows do not expire together, "+
+			"expired rows are kept until the whole part expires", tableName)
+	}
 
 	// Create table if it does not exist
 	if ok, err := c.tableAlreadyExists(ctx, tableName, "name", tableName); err != nil {
 		return err
 	} else if !ok {
-		var createQuery string
-		var err error
-		if resolution.Interval == 0 {
-			createQuery, err = stemplate(`
-CREATE TABLE {{ .Table }} ({{ .Schema }})
-ENGINE = {{ .Engine }}
-PARTITION BY toYYYYMMDDhhmmss(toStartOfInterval(TimeReceived, INTERVAL {{ .PartitionInterval }} second))
-ORDER BY (toStartOfFiveMinutes(TimeReceived), ExporterAddress, InIfName, OutIfName)
-TTL TimeReceived + toIntervalSecond({{ .TTL }})
-SETTINGS {{ .Settings }}
-`, gin.H{
-				"Table":             tableName,
-				"Schema":            c.d.Schema.ClickHouseCreateTable(),
-				"PartitionInterval": partitionInterval,
-				"TTL":               ttl,
-				"Engine":            c.mergeTreeEngine(tableName, ""),
-				"Settings":          settings,
-			})
-		} else {
-			createQuery, err = stemplate(`
-CREATE TABLE {{ .Table }} ({{ .Schema }})
-ENGINE = {{ .Engine }}
-PARTITION BY toYYYYMMDDhhmmss(toStartOfInterval(TimeReceived, INTERVAL {{ .PartitionInterval }} second))
-PRIMARY KEY ({{ .PrimaryKey }})
-ORDER BY ({{ .SortingKey }})
-TTL TimeReceived + toIntervalSecond({{ .TTL }})
-SETTINGS {{ .Settings }}
-`, gin.H{
-				"Table":             tableName,
-				"Schema":            c.d.Schema.ClickHouseCreateTable(schema.ClickHouseSkipMainOnlyColumns),
-				"PartitionInterval": partitionInterval,
-				"PrimaryKey":        strings.Join(c.d.Schema.ClickHousePrimaryKeys(), ", "),
-				"SortingKey":        strings.Join(c.d.Schema.ClickHouseSortingKeys(), ", "),
-				"TTL":               ttl,
-				"Engine":            c.mergeTreeEngine(tableName, "Summing", "(Bytes, Packets)"),
-				"Settings":          settings,
-			})
-		}
+		createQuery, err := c.flowsCreateQuery(tableName, resolution)
 		if err != nil {
 			return fmt.Errorf("cannot build create table statement for %s: %w", tableName, err)
 		}
-		if err := c.d.ClickHouse.ExecOnCluster(ctx, createQuery); err != nil {
+		if err := c.execOnCluster(ctx, createQuery); err != nil {
 			return fmt.Errorf("cannot create %s: %w", tableName, err)
 		}
 		return nil
 	}
+	if resolution.Interval == 0 && c.config.FlowsSwap {
+		c.r.Info().Msgf("%s is replaced through flows_new, skip migration", tableName)
+		return errSkipStep
+	}
 
 	// Get existing columns
 	var existingColumns []struct {
@@ -649,7 +1021,8 @@ outer:
 							tableName, wantedColumn.Name, existingColumn.Type, wantedColumn.ClickHouseType)
 					}
 				}
-				if wantedColumn.ClickHouseCodec != "" {
+				if _, ok := c.config.ColumnCodecs[wantedColumn.Name]; !ok && wantedColumn.ClickHouseCodec != "" {
+					// Columns with a configured codec are handled by enforceColumnCodecs()
 					wantedCodec := fmt.Sprintf("CODEC(%s)", wantedColumn.ClickHouseCodec)
 					if wantedCodec != existingColumn.CompressionCodec {
 						modifyTypeOrCodec = true
@@ -659,7 +1032,7 @@ outer:
 				if (wantedColumn.ClickHouseAlias != "") != (existingColumn.DefaultKind == "ALIAS") {
 					// either the column was an alias and should be none, or the other way around. Either way, we need to recreate.
 					c.r.Debug().Msg(fmt.Sprintf("column %s alias content has changed, recreating. New ALIAS: %s", existingColumn.Name, wantedColumn.ClickHouseAlias))
-					err := c.d.ClickHouse.ExecOnCluster(ctx,
+					err := c.execOnCluster(ctx,
 						fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", tableName, existingColumn.Name))
 					if err != nil {
 						return fmt.Errorf("cannot drop %s from %s to cleanup aliasing: %w",
@@ -676,7 +1049,7 @@ outer:
 				}
 				if resolution.Interval > 0 && !wantedColumn.ClickHouseNotSortingKey && existingColumn.IsSortingKey == 0 {
 					// That's something we can fix, but we need to drop it before recreating it
-					err := c.d.ClickHouse.ExecOnCluster(ctx,
+					err := c.execOnCluster(ctx,
 						fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", tableName, existingColumn.Name))
 					if err != nil {
 						return fmt.Errorf("cannot drop %s from %s to fix ordering: %w",
@@ -714,11 +1087,11 @@ outer:
 		if resolution.Interval > 0 {
 			// Drop the view
 			viewName := fmt.Sprintf("%s_consumer", tableName)
-			if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
+			if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
 				return fmt.Errorf("cannot drop %s: %w", viewName, err)
 			}
 		}
-		err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf("ALTER TABLE %s %s", tableName, strings.Join(modifications, ", ")))
+		err := c.execOnCluster(ctx, fmt.Sprintf("ALTER TABLE %s %s", tableName, strings.Join(modifications, ", ")))
 		if err != nil {
 			return fmt.Errorf("cannot update table %s: %w", tableName, err)
 		}
@@ -731,23 +1104,16 @@ outer:
 		return err
 	} else if !ok {
 		c.r.Info().Msgf("updating settings of %s to %s", tableName, resolution.Interval)
-		if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf("ALTER TABLE %s MODIFY SETTING %s", tableName, settings)); err != nil {
+		if err := c.execOnCluster(ctx, fmt.Sprintf("ALTER TABLE %s MODIFY SETTING %s", tableName, settings)); err != nil {
 			return fmt.Errorf("cannot modify settings for table %s: %w", tableName, err)
 		}
 		modified = true
 	}
 
 	// Check if we need to update the TTL
-	ttlClause := fmt.Sprintf("TTL TimeReceived + toIntervalSecond(%d)", ttl)
-	ttlClauseLike := fmt.Sprintf("CAST(engine_full LIKE '%% %s %%', 'String')", ttlClause)
-	if ok, err := c.tableAlreadyExists(ctx, tableName, ttlClauseLike, "1"); err != nil {
+	if ttlModified, err := c.updateFlowsTTL(ctx, tableName, resolution); err != nil {
 		return err
-	} else if !ok {
-		c.r.Warn().
-			Msgf("updating TTL of %s with interval %s, this can take a long time", tableName, resolution.Interval)
-		if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf("ALTER TABLE %s MODIFY %s", tableName, ttlClause)); err != nil {
-			return fmt.Errorf("cannot modify TTL for table %s: %w", tableName, err)
-		}
+	} else if ttlModified {
 		modified = true
 	}
 
@@ -757,6 +1123,30 @@ outer:
 	return errSkipStep
 }
 
+// updateFlowsTTL updates the TTL of an existing flows table when it does not
+// match the TTL of the provided resolution. It returns true when the table was
+// modified.
+func (c *Component) updateFlowsTTL(ctx context.Context, tableName string, resolution ResolutionConfiguration) (bool, error) {
+	ttlExpression, err := c.flowsTTLExpression(resolution)
+	if err != nil {
+		return false, err
+	}
+	ttlClause := fmt.Sprintf("TTL %s", ttlExpression)
+	ttlClauseLike := fmt.Sprintf("CAST(engine_full LIKE '%% %s %%', 'String')",
+		strings.ReplaceAll(ttlClause, "'", `\'`))
+	if ok, err := c.tableAlreadyExists(ctx, tableName, ttlClauseLike, "1"); err != nil {
+		return false, err
+	} else if ok {
+		return false, nil
+	}
+	c.r.Warn().
+		Msgf("updating TTL of %s with interval %s, this can take a long time", tableName, resolution.Interval)
+	if err := c.execOnCluster(ctx, fmt.Sprintf("ALTER TABLE %s MODIFY %s", tableName, ttlClause)); err != nil {
+		return false, fmt.Errorf("cannot modify TTL for table %s: %w", tableName, err)
+	}
+	return true, nil
+}
+
 func (c *Component) createFlowsConsumerView(ctx context.Context, resolution ResolutionConfiguration) error {
 	if resolution.Interval == 0 {
 		// The consumer for the main table is created elsewhere.
@@ -793,10 +1183,10 @@ FROM {{ .Database }}.{{ .Table }}`, gin.H{
 
 	// Drop and create
 	c.r.Info().Msgf("create %s", viewName)
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
+	if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
 		return fmt.Errorf("cannot drop table %s: %w", viewName, err)
 	}
-	if err := c.d.ClickHouse.ExecOnCluster(ctx,
+	if err := c.execOnCluster(ctx,
 		fmt.Sprintf(`CREATE MATERIALIZED VIEW %s TO %s AS %s`, viewName,
 			c.localTable(tableName), selectQuery)); err != nil {
 		return fmt.Errorf("cannot create %s: %w", viewName, err)
@@ -869,8 +1259,207 @@ ENGINE = Distributed('{{ .Cluster }}', '{{ .Database}}', '{{ .Source }}', rand()
 	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
 		"allow_suspicious_low_cardinality_types": 1,
 	}))
-	if err := c.d.ClickHouse.ExecOnCluster(ctx, createOrReplaceQuery); err != nil {
+	if err := c.execOnCluster(ctx, createOrReplaceQuery); err != nil {
 		return fmt.Errorf("cannot create %s: %w", c.distributedTable(source), err)
 	}
 	return nil
 }
+
+// materializedColumn is a column computed by ClickHouse when inserting rows.
+type materializedColumn struct {
+	Name       string
+	Type       string
+	Expression string
+}
+
+// definition returns the definition of the column for ClickHouse.
+func (column materializedColumn) definition() string {
+	return fmt.Sprintf("`%s` %s MATERIALIZED %s", column.Name, column.Type, column.Expression)
+}
+
+// ensureMaterializedColumns adds or updates the provided materialized columns
+// in the given table. Each column is checked against system.columns and only
+// missing or different columns are altered.
+func (c *Component) ensureMaterializedColumns(ctx context.Context, table string, columns []materializedColumn) error {
+	var existingColumns []struct {
+		Name              string `ch:"name"`
+		Type              string `ch:"type"`
+		DefaultKind       string `ch:"default_kind"`
+		DefaultExpression string `ch:"default_expression"`
+	}
+	if err := c.d.ClickHouse.Select(ctx, &existingColumns, `
+SELECT name, type, default_kind, default_expression
+FROM system.columns
+WHERE database = $1 AND table = $2
+`, c.config.Database, table); err != nil {
+		return fmt.Errorf("cannot query columns table: %w", err)
+	}
+
+	modifications := []string{}
+outer:
+	for _, wantedColumn := range columns {
+		for _, existingColumn := range existingColumns {
+			if existingColumn.Name != wantedColumn.Name {
+				continue
+			}
+			if existingColumn.Type != wantedColumn.Type ||
+				existingColumn.DefaultKind != "MATERIALIZED" ||
+				existingColumn.DefaultExpression != wantedColumn.Expression {
+				modifications = append(modifications,
+					fmt.Sprintf("MODIFY COLUMN %s", wantedColumn.definition()))
+			}
+			continue outer
+		}
+		modifications = append(modifications,
+			fmt.Sprintf("ADD COLUMN %s", wantedColumn.definition()))
+	}
+	if len(modifications) == 0 {
+		c.r.Info().Msgf("materialized columns of %s are up-to-date, skip migration", table)
+		return errSkipStep
+	}
+
+	c.r.Info().Msgf("apply %d materialized column modifications to %s", len(modifications), table)
+	if err := c.execOnCluster(ctx,
+		fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(modifications, ", "))); err != nil {
+		return fmt.Errorf("cannot update materialized columns of %s: %w", table, err)
+	}
+	return nil
+}
+
+var showCreateTableColumnRegex = regexp.MustCompile(
+	"^\\s*`([^`]+)` (.+?)(?: CODEC\\((.*)\\))?,?$")
+
+// columnCodecModifications parses the output of SHOW CREATE TABLE and returns
+// the modifications needed to get the provided codecs. Columns with a default
+// expression are left untouched.
+func columnCodecModifications(createQuery string, codecs map[string]string) []string {
+	normalize := func(codec string) string {
+		return strings.ReplaceAll(codec, " ", "")
+	}
+	modifications := []string{}
+	for _, line := range strings.Split(createQuery, "\n") {
+		match := showCreateTableColumnRegex.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		name, columnType, existingCodec := match[1], match[2], match[3]
+		wantedCodec, ok := codecs[name]
+		if !ok {
+			continue
+		}
+		if strings.Contains(columnType, " DEFAULT ") ||
+			strings.Contains(columnType, " MATERIALIZED ") ||
+			strings.Contains(columnType, " ALIAS ") {
+			continue
+		}
+		if normalize(existingCodec) == normalize(wantedCodec) {
+			continue
+		}
+		modifications = append(modifications,
+			fmt.Sprintf("MODIFY COLUMN `%s` %s CODEC(%s)", name, columnType, wantedCodec))
+	}
+	return modifications
+}
+
+// enforceColumnCodecs modifies the columns of the provided table to use the
+// configured codecs. Only mismatched columns are modified.
+func (c *Component) enforceColumnCodecs(ctx context.Context, table string) error {
+	if len(c.config.ColumnCodecs) == 0 {
+		return errSkipStep
+	}
+	var createQuery string
+	row := c.d.ClickHouse.QueryRow(ctx,
+		fmt.Sprintf("SHOW CREATE TABLE %s.%s", c.config.Database, table))
+	if err := row.Scan(&createQuery); err != nil {
+		return fmt.Errorf("cannot get definition of %s: %w", table, err)
+	}
+	modifications := columnCodecModifications(createQuery, c.config.ColumnCodecs)
+	if len(modifications) == 0 {
+		c.r.Info().Msgf("codecs of %s are up-to-date, skip migration", table)
+		return errSkipStep
+	}
+	c.r.Info().Msgf("apply %d codec modifications to %s", len(modifications), table)
+	if err := c.execOnCluster(ctx,
+		fmt.Sprintf("ALTER TABLE %s %s", table, strings.Join(modifications, ", "))); err != nil {
+		return fmt.Errorf("cannot update codecs of %s: %w", table, err)
+	}
+	return nil
+}
+
+var createTableColumnRegex = regexp.MustCompile("^ `?([[:word:]]+)`? ")
+
+// createTableColumns returns the names of the columns declared in the
+// provided CREATE TABLE query. It expects one column per line, as in the
+// queries built by this package.
+func createTableColumns(createQuery string) []string {
+	columns := []string{}
+	inside := false
+	for _, line := range strings.Split(createQuery, "\n") {
+		if !inside {
+			inside = strings.HasPrefix(line, "CREATE TABLE ") && strings.HasSuffix(line, " (")
+			continue
+		}
+		if strings.HasPrefix(line, ")") {
+			break
+		}
+		if match := createTableColumnRegex.FindStringSubmatch(line); match != nil {
+			columns = append(columns, match[1])
+		}
+	}
+	return columns
+}
+
+// schemaDrift returns the columns of the provided create query which are
+// missing from the existing table and the columns of the existing table
+// which are not in the create query.
+func (c *Component) schemaDrift(ctx context.Context, tableName string, createQuery string) ([]string, []string, error) {
+	var existingColumns []struct {
+		Name string `ch:"name"`
+	}
+	if err := c.d.ClickHouse.Select(ctx, &existingColumns, `
+SELECT name
+FROM system.columns
+WHERE database = $1 AND table = $2
+`, c.config.Database, tableName); err != nil {
+		return nil, nil, fmt.Errorf("cannot query columns table: %w", err)
+	}
+	existing := map[string]bool{}
+	for _, column := range existingColumns {
+		existing[column.Name] = true
+	}
+	missing := []string{}
+	for _, column := range createTableColumns(createQuery) {
+		if !existing[column] {
+			missing = append(missing, column)
+		}
+		delete(existing, column)
+	}
+	extra := []string{}
+	for _, column := range existingColumns {
+		if existing[column.Name] {
+			extra = append(extra, column.Name)
+		}
+	}
+	return missing, extra, nil
+}
+
+// warnOnSchemaDrift logs a warning when the columns of the provided existing
+// table differ from the ones in the create query. It never fails.
+func (c *Component) warnOnSchemaDrift(ctx context.Context, tableName string, createQuery func() (string, error)) {
+	query, err := createQuery()
+	if err != nil {
+		c.r.Err(err).Msgf("cannot build create table statement for %s", tableName)
+		return
+	}
+	missing, extra, err := c.schemaDrift(ctx, tableName, query)
+	if err != nil {
+		c.r.Err(err).Msgf("cannot verify schema of %s", tableName)
+		return
+	}
+	if len(missing) > 0 || len(extra) > 0 {
+		c.r.Warn().
+			Strs("missing", missing).
+			Strs("extra", extra).
+			Msgf("schema of %s differs from the expected one", tableName)
+	}
+}
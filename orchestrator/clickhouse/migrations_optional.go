@@ -0,0 +1,1319 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package clickhouse
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/gin-gonic/gin"
+
+	"akvorado/common/helpers"
+	"akvorado/common/schema"
+)
+
+// This file contains optional migration steps. They are only applied when
+// enabled in the configuration.
+
+// flowsMaterializedColumns returns the optional materialized columns for the
+// main flows table.
+func (c *Component) flowsMaterializedColumns() []materializedColumn {
+	columns := []materializedColumn{}
+
+	// Protocol columns
+	names := make([]string, 0, len(c.config.ProtocolColumns))
+	for name := range c.config.ProtocolColumns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		columns = append(columns, materializedColumn{
+			Name:       name,
+			Type:       "Bool",
+			Expression: fmt.Sprintf("Proto = %d", c.config.ProtocolColumns[name]),
+		})
+	}
+
+	// Receive delay column
+	if c.config.ReceiveDelayFrom != "" {
+		if column, ok := c.d.Schema.LookupColumnByName(c.config.ReceiveDelayFrom); !ok || column.Disabled {
+			c.r.Warn().Msgf("column %s not found, skip ReceiveDelay column", c.config.ReceiveDelayFrom)
+		} else {
+			columns = append(columns, receiveDelayColumn(c.config.ReceiveDelayFrom))
+		}
+	}
+
+	return columns
+}
+
+// receiveDelayColumn returns the materialized column with the difference
+// between the reception time and the provided flow timestamp column.
+func receiveDelayColumn(from string) materializedColumn {
+	return materializedColumn{
+		Name:       "ReceiveDelay",
+		Type:       "Int32",
+		Expression: fmt.Sprintf("toInt32(TimeReceived) - toInt32(%s)", from),
+	}
+}
+
+// flowsNetNameColumns returns the SrcNetName and DstNetName materialized
+// columns when enabled. A column already populated through the schema is
+// skipped.
+func (c *Component) flowsNetNameColumns() []materializedColumn {
+	columns := []materializedColumn{}
+	if !c.config.NetNameColumns {
+		return columns
+	}
+	for _, key := range []schema.ColumnKey{schema.ColumnSrcNetName, schema.ColumnDstNetName} {
+		if column, ok := c.d.Schema.LookupColumnByKey(key); ok && !column.Disabled {
+			c.r.Warn().Msgf("column %s already in schema, skip materialized column", column.Name)
+			continue
+		}
+		columns = append(columns, netNameColumn(strings.TrimSuffix(key.String(), "NetName")))
+	}
+	return columns
+}
+
+// netNameColumn returns the materialized column with the network name of the
+// source or destination address, looked up in the networks dictionary.
+func netNameColumn(direction string) materializedColumn {
+	return materializedColumn{
+		Name: fmt.Sprintf("%sNetName", direction),
+		Type: "LowCardinality(String)",
+		Expression: fmt.Sprintf("dictGetOrDefault('%s', 'name', %sAddr, '')",
+			schema.DictionaryNetworks, direction),
+	}
+}
+
+// createOrUpdateMaterializedColumns adds the optional materialized columns to
+// the main flows table.
+func (c *Component) createOrUpdateMaterializedColumns(ctx context.Context, resolution ResolutionConfiguration) error {
+	if resolution.Interval != 0 {
+		return errSkipStep
+	}
+	columns := c.flowsMaterializedColumns()
+	if netNameColumns := c.flowsNetNameColumns(); len(netNameColumns) > 0 {
+		if ok, err := c.tableAlreadyExists(ctx, schema.DictionaryNetworks, "name", schema.DictionaryNetworks); err != nil {
+			return err
+		} else if !ok {
+			c.r.Warn().Msg("networks dictionary not found, skip network name columns")
+		} else {
+			columns = append(columns, netNameColumns...)
+		}
+	}
+	if len(columns) == 0 {
+		return errSkipStep
+	}
+	return c.ensureMaterializedColumns(ctx, c.localTable("flows"), columns)
+}
+
+// flowsTTLExpression returns the TTL expression for the flows table of the
+// provided resolution. For the main flows table, the TTL of the exporters
+// matching ExporterTTLs is overridden, the most specific subnet first.
+func (c *Component) flowsTTLExpression(resolution ResolutionConfiguration) (string, error) {
+	ttl := uint64(resolution.TTL.Seconds())
+	overrides := c.config.ExporterTTLs.ToMap()
+	if resolution.Interval != 0 || len(overrides) == 0 {
+		return fmt.Sprintf("TimeReceived + toIntervalSecond(%d)", ttl), nil
+	}
+	type override struct {
+		prefix netip.Prefix
+		ttl    uint64
+	}
+	sorted := make([]override, 0, len(overrides))
+	for subnet, ttl := range overrides {
+		key, err := helpers.SubnetMapParseKey(subnet)
+		if err != nil {
+			return "", fmt.Errorf("invalid exporter TTL subnet %q: %w", subnet, err)
+		}
+		prefix, err := netip.ParsePrefix(key)
+		if err != nil {
+			return "", fmt.Errorf("invalid exporter TTL subnet %q: %w", subnet, err)
+		}
+		sorted = append(sorted, override{prefix, uint64(ttl.Seconds())})
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].prefix.Bits() != sorted[j].prefix.Bits() {
+			return sorted[i].prefix.Bits() > sorted[j].prefix.Bits()
+		}
+		return sorted[i].prefix.Addr().Less(sorted[j].prefix.Addr())
+	})
+	conditions := []string{}
+	for _, o := range sorted {
+		conditions = append(conditions,
+			fmt.Sprintf("isIPAddressInRange(toString(ExporterAddress), %s), %d",
+				quoteString(o.prefix.String()), o.ttl))
+	}
+	return fmt.Sprintf("TimeReceived + toIntervalSecond(multiIf(%s, %d))",
+		strings.Join(conditions, ", "), ttl), nil
+}
+
+// flowsTableSettings returns the settings for the flows tables.
+func (c *Component) flowsTableSettings() string {
+	ttlOnlyDropParts := 0
+	if c.config.TTLOnlyDropParts {
+		ttlOnlyDropParts = 1
+	}
+	settings := fmt.Sprintf(`index_granularity = 8192, ttl_only_drop_parts = %d`, ttlOnlyDropParts)
+	if c.config.MinAgeToForceMerge > 0 {
+		settings = fmt.Sprintf("%s, min_age_to_force_merge_seconds = %d",
+			settings, uint64(c.config.MinAgeToForceMerge.Seconds()))
+	}
+	if c.config.DeduplicateInserts && c.config.Cluster == "" {
+		// Replicated tables are already deduplicated
+		settings = fmt.Sprintf("%s, non_replicated_deduplication_window = %d",
+			settings, insertDeduplicationWindow)
+	}
+	return settings
+}
+
+// insertDeduplicationWindow is the number of recent blocks whose hash is kept
+// to deduplicate inserts into non-replicated tables. This is the default for
+// replicated tables.
+const insertDeduplicationWindow = 1000
+
+// insertDeduplicationSettings are the user settings needed to deduplicate
+// retried inserts, including in dependent materialized views.
+var insertDeduplicationSettings = []string{
+	"insert_deduplicate",
+	"deduplicate_blocks_in_dependent_materialized_views",
+}
+
+// checkInsertDeduplication checks if the user settings to deduplicate inserts
+// are enabled. They cannot be set from here as the inserts from the Kafka
+// engine use the default profile: they are set by init.sh.
+func (c *Component) checkInsertDeduplication(ctx context.Context) error {
+	if !c.config.DeduplicateInserts {
+		return errSkipStep
+	}
+	var settings []struct {
+		Name  string `ch:"name"`
+		Value string `ch:"value"`
+	}
+	if err := c.d.ClickHouse.Select(ctx, &settings,
+		`SELECT name, value FROM system.settings WHERE name IN ($1, $2)`,
+		insertDeduplicationSettings[0], insertDeduplicationSettings[1]); err != nil {
+		return fmt.Errorf("cannot query settings: %w", err)
+	}
+	for _, setting := range settings {
+		if setting.Value != "1" {
+			c.r.Warn().Msgf("setting %s is not enabled in the default profile, retried inserts may be duplicated",
+				setting.Name)
+		}
+	}
+	return errSkipStep
+}
+
+// ttlOnlyDropPartsIneffective tells if ttl_only_drop_parts is enabled while
+// the rows of a partition of the flows table for the provided resolution do not
+// expire together. In this case, expired rows are kept until the whole part
+// expires.
+func (c *Component) ttlOnlyDropPartsIneffective(resolution ResolutionConfiguration) bool {
+	return c.config.TTLOnlyDropParts && resolution.Interval == 0 && len(c.config.ExporterTTLs.ToMap()) > 0
+}
+
+// enforceFlowsColumnCodecs enforces the configured column codecs on the flows
+// table for the provided resolution.
+func (c *Component) enforceFlowsColumnCodecs(ctx context.Context, resolution ResolutionConfiguration) error {
+	if resolution.Interval == 0 {
+		return c.enforceColumnCodecs(ctx, c.localTable("flows"))
+	}
+	return c.enforceColumnCodecs(ctx, c.localTable(fmt.Sprintf("flows_%s", resolution.Interval)))
+}
+
+// mainResolution returns the configuration of the main flows table.
+func (c *Component) mainResolution() ResolutionConfiguration {
+	for _, resolution := range c.config.Resolutions {
+		if resolution.Interval == 0 {
+			return resolution
+		}
+	}
+	return ResolutionConfiguration{}
+}
+
+// flowsCopyCreateQuery returns the query to create a table receiving a copy
+// of some flows from the main flows table. It uses the same schema, TTL and
+// settings as the main flows table.
+func (c *Component) flowsCopyCreateQuery(table string) (string, error) {
+	ttl := c.mainResolution().TTL
+	tableName := c.localTable(table)
+	partitionInterval := uint64((ttl / time.Duration(c.config.MaxPartitions)).Seconds())
+	return stemplate(`
+CREATE TABLE {{ .Table }} ({{ .Schema }})
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMMDDhhmmss(toStartOfInterval(TimeReceived, INTERVAL {{ .PartitionInterval }} second))
+ORDER BY (toStartOfFiveMinutes(TimeReceived), ExporterAddress, InIfName, OutIfName)
+TTL TimeReceived + toIntervalSecond({{ .TTL }})
+SETTINGS {{ .Settings }}
+`, gin.H{
+		"Table":             tableName,
+		"Schema":            c.d.Schema.ClickHouseCreateTable(),
+		"PartitionInterval": partitionInterval,
+		"TTL":               uint64(ttl.Seconds()),
+		"Engine":            c.mergeTreeEngine(tableName, ""),
+		"Settings":          c.flowsTableSettings(),
+	})
+}
+
+// flowsCopySelectQuery returns the select query used by the consumer of a
+// table receiving a copy of the flows matching the provided predicate. The
+// provided substitutions replace the matching columns.
+func (c *Component) flowsCopySelectQuery(where string, substitutions map[string]string) (string, error) {
+	columns := c.d.Schema.ClickHouseSelectColumns(schema.ClickHouseSkipAliasedColumns)
+	for idx, column := range columns {
+		if substitution, ok := substitutions[column]; ok {
+			columns[idx] = fmt.Sprintf("%s AS %s", substitution, column)
+		}
+	}
+	return stemplate(`
+SELECT
+ {{ .Columns }}
+FROM {{ .Database }}.{{ .Table }}
+WHERE {{ .Where }}`, gin.H{
+		"Database": c.config.Database,
+		"Table":    c.localTable("flows"),
+		"Where":    where,
+		"Columns":  strings.Join(columns, ",\n "),
+	})
+}
+
+// createFlowsCopyTable creates a table receiving a copy of some flows from the
+// main flows table if it does not exist.
+func (c *Component) createFlowsCopyTable(ctx context.Context, table string) error {
+	tableName := c.localTable(table)
+	if ok, err := c.tableAlreadyExists(ctx, tableName, "name", tableName); err != nil {
+		return err
+	} else if ok {
+		c.r.Info().Msgf("%s already exists, skip migration", tableName)
+		return errSkipStep
+	}
+	createQuery, err := c.flowsCopyCreateQuery(table)
+	if err != nil {
+		return fmt.Errorf("cannot build create table statement for %s: %w", tableName, err)
+	}
+	c.r.Info().Msgf("create %s", tableName)
+	if err := c.execOnCluster(ctx, createQuery); err != nil {
+		return fmt.Errorf("cannot create %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// createConsumerView creates the materialized view feeding the provided table
+// using the provided select query.
+func (c *Component) createConsumerView(ctx context.Context, table string, selectQuery string) error {
+	viewName := fmt.Sprintf("%s_consumer", table)
+
+	// Check the existing one
+	if ok, err := c.tableAlreadyExists(ctx, viewName, "as_select", selectQuery); err != nil {
+		return err
+	} else if ok {
+		c.r.Info().Msgf("%s already exists, skip migration", viewName)
+		return errSkipStep
+	}
+
+	// Drop and create
+	c.r.Info().Msgf("create %s", viewName)
+	if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, viewName)); err != nil {
+		return fmt.Errorf("cannot drop table %s: %w", viewName, err)
+	}
+	if err := c.execOnCluster(ctx,
+		fmt.Sprintf(`CREATE MATERIALIZED VIEW %s TO %s AS %s`, viewName,
+			c.localTable(table), selectQuery)); err != nil {
+		return fmt.Errorf("cannot create %s: %w", viewName, err)
+	}
+	return nil
+}
+
+// flowsSampledSelectQuery returns the select query used by the consumer of the
+// flows_sampled table. The sampling rate is scaled by the configured ratio.
+func (c *Component) flowsSampledSelectQuery() (string, error) {
+	return c.flowsCopySelectQuery(
+		fmt.Sprintf("(rand() %% %d) = 0", c.config.SampledFlowsRatio),
+		map[string]string{
+			"SamplingRate": fmt.Sprintf("SamplingRate * %d", c.config.SampledFlowsRatio),
+		})
+}
+
+// createFlowsSampledTable creates the flows_sampled table if it does not exist.
+func (c *Component) createFlowsSampledTable(ctx context.Context) error {
+	if c.config.SampledFlowsRatio == 0 {
+		return errSkipStep
+	}
+	return c.createFlowsCopyTable(ctx, "flows_sampled")
+}
+
+// createFlowsSampledConsumerView creates the materialized view copying one
+// flow out of SampledFlowsRatio from the flows table to the flows_sampled
+// table.
+func (c *Component) createFlowsSampledConsumerView(ctx context.Context) error {
+	if c.config.SampledFlowsRatio == 0 {
+		return errSkipStep
+	}
+	selectQuery, err := c.flowsSampledSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for consumer flows_sampled_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "flows_sampled", selectQuery)
+}
+
+// flowsAggDailyKeys returns the key columns of the flows_agg_daily table
+// with their types.
+func (c *Component) flowsAggDailyKeys() ([]string, error) {
+	keys := []string{}
+	for _, key := range c.config.DailyAggregateKeys {
+		column, ok := c.d.Schema.LookupColumnByName(key)
+		if !ok || column.Disabled {
+			return nil, fmt.Errorf("unknown column %q", key)
+		}
+		keys = append(keys, fmt.Sprintf("`%s` %s", column.Name, column.ClickHouseType))
+	}
+	return keys, nil
+}
+
+// flowsAggDailyCreateQuery returns the query to create the flows_agg_daily
+// table. Besides the configured keys, it stores aggregate function states
+// to be merged at query time with the matching -Merge functions.
+func (c *Component) flowsAggDailyCreateQuery() (string, error) {
+	keys, err := c.flowsAggDailyKeys()
+	if err != nil {
+		return "", err
+	}
+	tableName := c.localTable("flows_agg_daily")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ TimeReceived DateTime CODEC(DoubleDelta, LZ4),
+ {{ range .Keys }}{{ . }},
+ {{ end }}Bytes AggregateFunction(sum, UInt64),
+ Packets AggregateFunction(sum, UInt64),
+ SrcAddrs AggregateFunction(uniq, IPv6),
+ DstAddrs AggregateFunction(uniq, IPv6)
+)
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMM(TimeReceived)
+ORDER BY (TimeReceived{{ range .Names }}, {{ . }}{{ end }})
+`, gin.H{
+		"Table":  tableName,
+		"Keys":   keys,
+		"Names":  c.config.DailyAggregateKeys,
+		"Engine": c.mergeTreeEngine(tableName, "Aggregating"),
+	})
+}
+
+// flowsAggDailySelectQuery returns the select query used by the consumer of
+// the flows_agg_daily table.
+func (c *Component) flowsAggDailySelectQuery() (string, error) {
+	return stemplate(`
+SELECT
+ toStartOfDay(TimeReceived) AS TimeReceived,
+ {{ range .Names }}{{ . }},
+ {{ end }}sumState(Bytes * SamplingRate) AS Bytes,
+ sumState(Packets * SamplingRate) AS Packets,
+ uniqState(SrcAddr) AS SrcAddrs,
+ uniqState(DstAddr) AS DstAddrs
+FROM {{ .Database }}.{{ .Table }}
+GROUP BY TimeReceived{{ range .Names }}, {{ . }}{{ end }}`, gin.H{
+		"Database": c.config.Database,
+		"Table":    c.localTable("flows"),
+		"Names":    c.config.DailyAggregateKeys,
+	})
+}
+
+// createFlowsAggDailyTable creates the flows_agg_daily table if it does not
+// exist. As it contains aggregated data, it is never recreated: when the keys
+// change, the table has to be dropped manually.
+func (c *Component) createFlowsAggDailyTable(ctx context.Context) error {
+	if len(c.config.DailyAggregateKeys) == 0 {
+		return errSkipStep
+	}
+	tableName := c.localTable("flows_agg_daily")
+	sortingKey := strings.Join(append([]string{"TimeReceived"}, c.config.DailyAggregateKeys...), ", ")
+	if ok, err := c.tableAlreadyExists(ctx, tableName, "name", tableName); err != nil {
+		return err
+	} else if ok {
+		if ok, err := c.tableAlreadyExists(ctx, tableName, "sorting_key", sortingKey); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%s already exists with different keys, drop it to change them", tableName)
+		}
+		c.r.Info().Msgf("%s already exists, skip migration", tableName)
+		return errSkipStep
+	}
+	createQuery, err := c.flowsAggDailyCreateQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build create table statement for %s: %w", tableName, err)
+	}
+	c.r.Info().Msgf("create %s", tableName)
+	if err := c.execOnCluster(ctx, createQuery); err != nil {
+		return fmt.Errorf("cannot create %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// createFlowsAggDailyConsumerView creates the materialized view aggregating
+// the flows from the flows table to the flows_agg_daily table.
+func (c *Component) createFlowsAggDailyConsumerView(ctx context.Context) error {
+	if len(c.config.DailyAggregateKeys) == 0 {
+		return errSkipStep
+	}
+	selectQuery, err := c.flowsAggDailySelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for consumer flows_agg_daily_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "flows_agg_daily", selectQuery)
+}
+
+// flowsHourlyASCreateQuery returns the query to create the flows_hourly_as
+// table. Bytes and packets are summed by hour, exporter and AS numbers.
+func (c *Component) flowsHourlyASCreateQuery() (string, error) {
+	keys := []string{}
+	for _, key := range []schema.ColumnKey{
+		schema.ColumnExporterAddress,
+		schema.ColumnSrcAS,
+		schema.ColumnDstAS,
+	} {
+		column, ok := c.d.Schema.LookupColumnByKey(key)
+		if !ok || column.Disabled {
+			return "", fmt.Errorf("unknown column %q", key)
+		}
+		keys = append(keys, fmt.Sprintf("`%s` %s", column.Name, column.ClickHouseType))
+	}
+	tableName := c.localTable("flows_hourly_as")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ TimeReceived DateTime CODEC(DoubleDelta, LZ4),
+ {{ range .Keys }}{{ . }},
+ {{ end }}Bytes UInt64,
+ Packets UInt64
+)
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMM(TimeReceived)
+ORDER BY (TimeReceived, ExporterAddress, SrcAS, DstAS)
+`, gin.H{
+		"Table":  tableName,
+		"Keys":   keys,
+		"Engine": c.mergeTreeEngine(tableName, "Summing", "(Bytes, Packets)"),
+	})
+}
+
+// flowsHourlyASSelectQuery returns the select query used by the consumer of
+// the flows_hourly_as table.
+func (c *Component) flowsHourlyASSelectQuery() (string, error) {
+	return stemplate(`
+SELECT
+ toStartOfHour(TimeReceived) AS TimeReceived,
+ ExporterAddress,
+ SrcAS,
+ DstAS,
+ sum(Bytes * SamplingRate) AS Bytes,
+ sum(Packets * SamplingRate) AS Packets
+FROM {{ .Database }}.{{ .Table }}
+GROUP BY TimeReceived, ExporterAddress, SrcAS, DstAS`, gin.H{
+		"Database": c.config.Database,
+		"Table":    c.localTable("flows"),
+	})
+}
+
+// createFlowsHourlyASTable creates the flows_hourly_as table if it does not
+// exist.
+func (c *Component) createFlowsHourlyASTable(ctx context.Context) error {
+	if !c.config.HourlyASView {
+		return errSkipStep
+	}
+	return c.createTableIfNotExists(ctx, c.localTable("flows_hourly_as"), c.flowsHourlyASCreateQuery)
+}
+
+// createFlowsHourlyASConsumerView creates the materialized view aggregating
+// the flows from the flows table to the flows_hourly_as table.
+func (c *Component) createFlowsHourlyASConsumerView(ctx context.Context) error {
+	if !c.config.HourlyASView {
+		return errSkipStep
+	}
+	selectQuery, err := c.flowsHourlyASSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for consumer flows_hourly_as_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "flows_hourly_as", selectQuery)
+}
+
+// flowsDirectionPredicates returns the predicates used to route flows to the
+// flows_in and flows_out tables.
+func flowsDirectionPredicates() map[string]string {
+	return map[string]string{
+		"flows_in":  "InIfBoundary = 'external'",
+		"flows_out": "OutIfBoundary = 'external'",
+	}
+}
+
+// createFlowsDirectionTable creates the flows_in or the flows_out table if it
+// does not exist.
+func (c *Component) createFlowsDirectionTable(ctx context.Context, table string) error {
+	if !c.config.SplitFlowsByDirection {
+		return errSkipStep
+	}
+	return c.createFlowsCopyTable(ctx, table)
+}
+
+// createFlowsDirectionConsumerView creates the materialized view routing
+// incoming or outgoing flows to the flows_in or the flows_out table.
+func (c *Component) createFlowsDirectionConsumerView(ctx context.Context, table string) error {
+	if !c.config.SplitFlowsByDirection {
+		return errSkipStep
+	}
+	selectQuery, err := c.flowsCopySelectQuery(flowsDirectionPredicates()[table], nil)
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for consumer %s_consumer: %w", table, err)
+	}
+	return c.createConsumerView(ctx, table, selectQuery)
+}
+
+// queryLogCreateQuery returns the query to create the query_log_akvorado table.
+func (c *Component) queryLogCreateQuery() (string, error) {
+	tableName := c.localTable("query_log_akvorado")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ event_time DateTime,
+ query_id String,
+ user String,
+ type LowCardinality(String),
+ query_duration_ms UInt64,
+ read_rows UInt64,
+ read_bytes UInt64,
+ result_rows UInt64,
+ query String CODEC(ZSTD(1)),
+ exception String CODEC(ZSTD(1))
+)
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMMDD(event_time)
+ORDER BY event_time
+TTL event_time + toIntervalSecond({{ .TTL }})
+`, gin.H{
+		"Table":  tableName,
+		"Engine": c.mergeTreeEngine(tableName, ""),
+		"TTL":    uint64(c.config.QueryLogTTL.Seconds()),
+	})
+}
+
+// queryLogSelectQuery returns the select query used by the consumer of the
+// query_log_akvorado table.
+func (c *Component) queryLogSelectQuery() (string, error) {
+	username := c.config.QueryLogUsername
+	if username == "" {
+		username = c.config.Username
+	}
+	return stemplate(`
+SELECT
+ event_time,
+ query_id,
+ user,
+ toString(type) AS type,
+ query_duration_ms,
+ read_rows,
+ read_bytes,
+ result_rows,
+ query,
+ exception
+FROM system.query_log
+WHERE user = {{ .Username }} AND type != 'QueryStart' AND query_kind = 'Select'`, gin.H{
+		"Username": quoteString(username),
+	})
+}
+
+// createQueryLogTable creates the query_log_akvorado table. When it already
+// exists, only the TTL is updated.
+func (c *Component) createQueryLogTable(ctx context.Context) error {
+	if c.config.QueryLogTTL == 0 {
+		return errSkipStep
+	}
+	return c.createTableOrUpdateTTL(ctx, c.localTable("query_log_akvorado"),
+		fmt.Sprintf("TTL event_time + toIntervalSecond(%d)", uint64(c.config.QueryLogTTL.Seconds())),
+		c.queryLogCreateQuery)
+}
+
+// createTableOrUpdateTTL creates the provided table using the provided create
+// query when it does not exist. Otherwise, only the TTL is updated.
+func (c *Component) createTableOrUpdateTTL(ctx context.Context, tableName, ttlClause string, createQuery func() (string, error)) error {
+	if ok, err := c.tableAlreadyExists(ctx, tableName, "name", tableName); err != nil {
+		return err
+	} else if !ok {
+		query, err := createQuery()
+		if err != nil {
+			return fmt.Errorf("cannot build create table statement for %s: %w", tableName, err)
+		}
+		c.r.Info().Msgf("create %s", tableName)
+		if err := c.execOnCluster(ctx, query); err != nil {
+			return fmt.Errorf("cannot create %s: %w", tableName, err)
+		}
+		return nil
+	}
+
+	// Check if we need to update the TTL
+	ttlClauseLike := fmt.Sprintf("CAST(engine_full LIKE '%% %s %%', 'String')", ttlClause)
+	if ok, err := c.tableAlreadyExists(ctx, tableName, ttlClauseLike, "1"); err != nil {
+		return err
+	} else if ok {
+		c.r.Info().Msgf("%s already exists, skip migration", tableName)
+		return errSkipStep
+	}
+	c.r.Info().Msgf("updating TTL of %s", tableName)
+	if err := c.execOnCluster(ctx, fmt.Sprintf("ALTER TABLE %s MODIFY %s", tableName, ttlClause)); err != nil {
+		return fmt.Errorf("cannot modify TTL for table %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// createQueryLogConsumerView creates the materialized view copying the
+// queries from system.query_log to the query_log_akvorado table.
+func (c *Component) createQueryLogConsumerView(ctx context.Context) error {
+	if c.config.QueryLogTTL == 0 {
+		return errSkipStep
+	}
+	selectQuery, err := c.queryLogSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for query_log_akvorado_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "query_log_akvorado", selectQuery)
+}
+
+// flowSamplesCreateQuery returns the query to create the flow_samples table.
+func (c *Component) flowSamplesCreateQuery() (string, error) {
+	tableName := c.localTable("flow_samples")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ TimeReceived DateTime CODEC(DoubleDelta, LZ4),
+ ExporterAddress LowCardinality(IPv6),
+ Header String CODEC(ZSTD(1))
+)
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMMDDhhmmss(toStartOfHour(TimeReceived))
+ORDER BY (ExporterAddress, TimeReceived)
+TTL TimeReceived + toIntervalSecond({{ .TTL }})
+`, gin.H{
+		"Table":  tableName,
+		"Engine": c.mergeTreeEngine(tableName, ""),
+		"TTL":    uint64(c.config.FlowSamplesTTL.Seconds()),
+	})
+}
+
+// flowSamplesRawCreateQuery returns the query to create the Kafka table
+// receiving the flow samples. Each message is a raw packet header and its key
+// is the address of the exporter. It uses its own consumer group to not
+// interfere with the consumers of the flows.
+func (c *Component) flowSamplesRawCreateQuery() (string, error) {
+	return stemplate(
+		`CREATE TABLE {{ .Database }}.flow_samples_raw (Header String) ENGINE = {{ .Engine }}`,
+		gin.H{
+			"Database": c.config.Database,
+			"Engine": c.kafkaEngine(c.config.FlowSamplesTopic,
+				fmt.Sprintf("%s-flow-samples", c.config.Kafka.GroupName),
+				`kafka_format = 'RawBLOB'`),
+		})
+}
+
+// flowSamplesSelectQuery returns the select query used by the consumer of the
+// flow_samples table.
+func (c *Component) flowSamplesSelectQuery() (string, error) {
+	return stemplate(
+		`SELECT _timestamp AS TimeReceived, toIPv6(_key) AS ExporterAddress, Header FROM {{ .Database }}.flow_samples_raw`,
+		gin.H{"Database": c.config.Database})
+}
+
+// createFlowSamplesTable creates the flow_samples table. When it already
+// exists, only the TTL is updated.
+func (c *Component) createFlowSamplesTable(ctx context.Context) error {
+	if c.config.FlowSamplesTopic == "" {
+		return errSkipStep
+	}
+	return c.createTableOrUpdateTTL(ctx, c.localTable("flow_samples"),
+		fmt.Sprintf("TTL TimeReceived + toIntervalSecond(%d)", uint64(c.config.FlowSamplesTTL.Seconds())),
+		c.flowSamplesCreateQuery)
+}
+
+// createFlowSamplesRawTable creates the Kafka table receiving the flow
+// samples. It is recreated, with its consumer, when its definition changes.
+func (c *Component) createFlowSamplesRawTable(ctx context.Context) error {
+	if c.config.FlowSamplesTopic == "" {
+		return errSkipStep
+	}
+	createQuery, err := c.flowSamplesRawCreateQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build query to create flow_samples_raw: %w", err)
+	}
+	return c.createKafkaTable(ctx, "flow_samples", createQuery)
+}
+
+// createKafkaTable creates the Kafka table feeding the provided table, named
+// after it with a "_raw" suffix. When its definition changes, it is recreated
+// and its consumer is dropped to be recreated by a later step.
+func (c *Component) createKafkaTable(ctx context.Context, table string, createQuery string) error {
+	tableName := fmt.Sprintf("%s_raw", table)
+	if ok, err := c.tableAlreadyExists(ctx, tableName, "create_table_query", createQuery); err != nil {
+		return err
+	} else if ok {
+		c.r.Info().Msgf("%s already exists, skip migration", tableName)
+		return errSkipStep
+	}
+	c.r.Info().Msgf("create %s", tableName)
+	for _, drop := range []string{fmt.Sprintf("%s_consumer", table), tableName} {
+		if err := c.execOnCluster(ctx, fmt.Sprintf(`DROP TABLE IF EXISTS %s SYNC`, drop)); err != nil {
+			return fmt.Errorf("cannot drop %s: %w", drop, err)
+		}
+	}
+	if err := c.execOnCluster(ctx, createQuery); err != nil {
+		return fmt.Errorf("cannot create %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// createFlowSamplesConsumerView creates the materialized view copying the
+// flow samples from the Kafka table to the flow_samples table.
+func (c *Component) createFlowSamplesConsumerView(ctx context.Context) error {
+	if c.config.FlowSamplesTopic == "" {
+		return errSkipStep
+	}
+	selectQuery, err := c.flowSamplesSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for flow_samples_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "flow_samples", selectQuery)
+}
+
+// Events recorded in the migrations_audit table for the swap of the flows table.
+const (
+	auditBackfillComplete = "backfill_complete"
+	auditExchanged        = "exchanged"
+)
+
+// migrationsAuditCreateQuery returns the query to create the migrations_audit
+// table.
+func (c *Component) migrationsAuditCreateQuery() (string, error) {
+	tableName := c.localTable("migrations_audit")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ time DateTime64(3) DEFAULT now64(3),
+ table_name LowCardinality(String),
+ event LowCardinality(String)
+)
+ENGINE = {{ .Engine }}
+ORDER BY (table_name, time)
+`, gin.H{
+		"Table":  tableName,
+		"Engine": c.mergeTreeEngine(tableName, ""),
+	})
+}
+
+// createMigrationsAuditTable creates the migrations_audit table recording the
+// steps of the swap of the flows table.
+func (c *Component) createMigrationsAuditTable(ctx context.Context) error {
+	if !c.config.FlowsSwap {
+		return errSkipStep
+	}
+	return c.createTableIfNotExists(ctx, c.localTable("migrations_audit"), c.migrationsAuditCreateQuery)
+}
+
+// createTableIfNotExists creates the provided table using the provided create
+// query when it does not exist. When it exists and VerifySchema is enabled,
+// its columns are compared with the ones from the create query.
+func (c *Component) createTableIfNotExists(ctx context.Context, tableName string, createQuery func() (string, error)) error {
+	if ok, err := c.tableAlreadyExists(ctx, tableName, "name", tableName); err != nil {
+		return err
+	} else if ok {
+		if c.config.VerifySchema {
+			c.warnOnSchemaDrift(ctx, tableName, createQuery)
+		}
+		c.r.Info().Msgf("%s already exists, skip migration", tableName)
+		return errSkipStep
+	}
+	query, err := createQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build create table statement for %s: %w", tableName, err)
+	}
+	c.r.Info().Msgf("create %s", tableName)
+	if err := c.execOnCluster(ctx, query); err != nil {
+		return fmt.Errorf("cannot create %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// createFlowsNewTable creates the flows_new table with the current schema. It
+// should be backfilled before being swapped with the main flows table.
+func (c *Component) createFlowsNewTable(ctx context.Context) error {
+	if !c.config.FlowsSwap {
+		return errSkipStep
+	}
+	tableName := c.localTable("flows_new")
+	if ok, err := c.tableAlreadyExists(ctx, tableName, "name", tableName); err != nil {
+		return err
+	} else if ok {
+		c.r.Info().Msgf("%s already exists, skip migration", tableName)
+		return errSkipStep
+	}
+	if ok, err := c.tableAlreadyExists(ctx, c.localTable("flows"), "name", c.localTable("flows")); err != nil {
+		return err
+	} else if !ok {
+		c.r.Info().Msg("no flows table to replace, skip migration")
+		return errSkipStep
+	}
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"allow_suspicious_low_cardinality_types": 1,
+	}))
+	createQuery, err := c.flowsCreateQuery(tableName, c.mainResolution())
+	if err != nil {
+		return fmt.Errorf("cannot build create table statement for %s: %w", tableName, err)
+	}
+	c.r.Info().Msgf("create %s", tableName)
+	if err := c.execOnCluster(ctx, createQuery); err != nil {
+		return fmt.Errorf("cannot create %s: %w", tableName, err)
+	}
+	return nil
+}
+
+// exchangeFlowsTables atomically swaps the main flows table and the flows_new
+// table when the last event recorded for flows_new in migrations_audit tells
+// it has been backfilled.
+func (c *Component) exchangeFlowsTables(ctx context.Context) error {
+	if !c.config.FlowsSwap {
+		return errSkipStep
+	}
+	flowsTable := c.localTable("flows")
+	newTable := c.localTable("flows_new")
+	auditTable := c.localTable("migrations_audit")
+	var events []struct {
+		Event string `ch:"event"`
+	}
+	if err := c.d.ClickHouse.Select(ctx, &events, fmt.Sprintf(`
+SELECT event
+FROM %s
+WHERE table_name = $1
+ORDER BY time DESC
+LIMIT 1`, auditTable), newTable); err != nil {
+		return fmt.Errorf("cannot query %s: %w", auditTable, err)
+	}
+	if len(events) == 0 || events[0].Event != auditBackfillComplete {
+		c.r.Info().Msgf("%s is not marked as backfilled, skip migration", newTable)
+		return errSkipStep
+	}
+	c.r.Info().Msgf("exchange %s and %s", flowsTable, newTable)
+	if err := c.execOnCluster(ctx,
+		fmt.Sprintf("EXCHANGE TABLES %s AND %s", flowsTable, newTable)); err != nil {
+		return fmt.Errorf("cannot exchange %s and %s: %w", flowsTable, newTable, err)
+	}
+	if err := c.exec(ctx,
+		fmt.Sprintf("INSERT INTO %s (table_name, event) VALUES ($1, $2)", auditTable),
+		newTable, auditExchanged); err != nil {
+		return fmt.Errorf("cannot record exchange in %s: %w", auditTable, err)
+	}
+	return nil
+}
+
+// createCircuitsDictionary creates the circuits dictionary, keyed by exporter
+// address and interface index.
+func (c *Component) createCircuitsDictionary(ctx context.Context) error {
+	if len(c.config.Circuits) == 0 {
+		return errSkipStep
+	}
+	return c.createDictionaryWithLifetime(ctx, schema.DictionaryCircuits, "complex_key_hashed",
+		"`exporter_address` IPv6, `ifindex` UInt32, `circuit_id` String, `provider` String",
+		"exporter_address, ifindex", c.config.CircuitsLifetime)
+}
+
+// createExporterRolesDictionary creates the exporter roles dictionary, keyed
+// by exporter subnet.
+func (c *Component) createExporterRolesDictionary(ctx context.Context) error {
+	if len(c.config.ExporterRoles.ToMap()) == 0 {
+		return errSkipStep
+	}
+	return c.createDictionaryWithLifetime(ctx, schema.DictionaryExporterRoles, "ip_trie",
+		"`network` String, `role` String",
+		"network", c.config.ExporterRolesLifetime)
+}
+
+// rowPolicyFilter returns the filter of the row policy for the provided
+// configuration.
+func (c *Component) rowPolicyFilter(policy RowPolicyConfiguration) string {
+	tenants := make([]string, 0, len(policy.Tenants))
+	for _, tenant := range policy.Tenants {
+		tenants = append(tenants, quoteString(tenant))
+	}
+	return fmt.Sprintf("%s IN (%s)", c.config.RowPolicyColumn, strings.Join(tenants, ", "))
+}
+
+// rowPolicyCreateQuery returns the query to create the row policy for the
+// provided configuration on the provided table.
+func (c *Component) rowPolicyCreateQuery(policy RowPolicyConfiguration, table string) string {
+	return fmt.Sprintf("CREATE ROW POLICY OR REPLACE `akvorado_%s` ON %s.%s FOR SELECT USING %s TO `%s`",
+		policy.Role, c.config.Database, table, c.rowPolicyFilter(policy), policy.Role)
+}
+
+// createRowPolicies creates the row policies restricting the flows visible by
+// the configured roles on the provided table.
+func (c *Component) createRowPolicies(ctx context.Context, table string) error {
+	if len(c.config.RowPolicies) == 0 {
+		return errSkipStep
+	}
+	modified := false
+	for _, policy := range c.config.RowPolicies {
+		name := fmt.Sprintf("akvorado_%s", policy.Role)
+		var existing string
+		row := c.d.ClickHouse.QueryRow(ctx, `
+SELECT select_filter
+FROM system.row_policies
+WHERE short_name = $1 AND database = $2 AND table = $3`,
+			name, c.config.Database, table)
+		if err := row.Scan(&existing); err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("cannot check if row policy %s exists: %w", name, err)
+		}
+		if existing == c.rowPolicyFilter(policy) {
+			continue
+		}
+		c.r.Info().Msgf("create row policy %s on %s", name, table)
+		if err := c.execOnCluster(ctx, c.rowPolicyCreateQuery(policy, table)); err != nil {
+			return fmt.Errorf("cannot create row policy %s on %s: %w", name, table, err)
+		}
+		modified = true
+	}
+	if !modified {
+		c.r.Info().Msgf("row policies on %s are up-to-date, skip migration", table)
+		return errSkipStep
+	}
+	return nil
+}
+
+// compressionStatsSelectQuery returns the select query for the
+// flows_compression_stats view.
+func (c *Component) compressionStatsSelectQuery() (string, error) {
+	return stemplate(`
+SELECT
+ column,
+ sum(column_data_compressed_bytes) AS compressed,
+ sum(column_data_uncompressed_bytes) AS uncompressed,
+ round(uncompressed / compressed, 2) AS ratio
+FROM system.parts_columns
+WHERE (database = {{ .Database }}) AND (table = {{ .Table }}) AND active
+GROUP BY column
+ORDER BY compressed DESC`, gin.H{
+		"Database": quoteString(c.config.Database),
+		"Table":    quoteString(c.localTable("flows")),
+	})
+}
+
+// createCompressionStatsView creates the flows_compression_stats view.
+func (c *Component) createCompressionStatsView(ctx context.Context) error {
+	if !c.config.CompressionStats {
+		return errSkipStep
+	}
+	selectQuery, err := c.compressionStatsSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for flows_compression_stats: %w", err)
+	}
+	return c.createView(ctx, "flows_compression_stats", selectQuery)
+}
+
+// kafkaLagSelectQuery returns the select query for the kafka_consumers_lag
+// view. The lag and the committed offset are extracted from the librdkafka
+// statistics of each consumer. ClickHouse only commits offsets once a block is
+// inserted, so uncommitted is the number of consumed messages not yet
+// acknowledged.
+func (c *Component) kafkaLagSelectQuery() (string, error) {
+	return stemplate(`
+SELECT
+ table,
+ consumer_id,
+ topic,
+ partition,
+ current_offset,
+ JSONExtractInt(rdkafka_stat, 'topics', topic, 'partitions', toString(partition), 'consumer_lag') AS lag,
+ JSONExtractInt(rdkafka_stat, 'topics', topic, 'partitions', toString(partition), 'committed_offset') AS committed_offset,
+ current_offset - committed_offset AS uncommitted,
+ {{ .Threshold }} AS threshold,
+ lag > threshold AS alert
+FROM system.kafka_consumers
+ARRAY JOIN
+ assignments.topic AS topic,
+ assignments.partition_id AS partition,
+ assignments.current_offset AS current_offset
+WHERE database = {{ .Database }}`, gin.H{
+		"Database":  quoteString(c.config.Database),
+		"Threshold": c.config.KafkaLagThreshold,
+	})
+}
+
+// createKafkaLagView creates the kafka_consumers_lag view.
+func (c *Component) createKafkaLagView(ctx context.Context) error {
+	if c.config.KafkaLagThreshold == 0 {
+		return errSkipStep
+	}
+	selectQuery, err := c.kafkaLagSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for kafka_consumers_lag: %w", err)
+	}
+	return c.createView(ctx, "kafka_consumers_lag", selectQuery)
+}
+
+// createView creates or replaces the provided view when its select query
+// differs from the provided one.
+func (c *Component) createView(ctx context.Context, viewName, selectQuery string) error {
+	if ok, err := c.tableAlreadyExists(ctx, viewName, "as_select", selectQuery); err != nil {
+		return err
+	} else if ok {
+		c.r.Info().Msgf("%s already exists, skip migration", viewName)
+		return errSkipStep
+	}
+	c.r.Info().Msgf("create %s", viewName)
+	if err := c.execOnCluster(ctx,
+		fmt.Sprintf("CREATE OR REPLACE VIEW %s.%s AS %s", c.config.Database, viewName, selectQuery)); err != nil {
+		return fmt.Errorf("cannot create %s: %w", viewName, err)
+	}
+	return nil
+}
+
+// asnPathsCreateQuery returns the query to create the asn_paths table. Only
+// the most recent path for each prefix is kept.
+func (c *Component) asnPathsCreateQuery() (string, error) {
+	tableName := c.localTable("asn_paths")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ TimeReceived DateTime CODEC(DoubleDelta, LZ4),
+ Prefix String,
+ ASPath Array(UInt32),
+ Communities Array(UInt32),
+ NextHop IPv6
+)
+ENGINE = {{ .Engine }}
+ORDER BY Prefix
+`, gin.H{
+		"Table":  tableName,
+		"Engine": c.mergeTreeEngine(tableName, "Replacing", "TimeReceived"),
+	})
+}
+
+// asnPathsRawCreateQuery returns the query to create the Kafka table receiving
+// the BGP paths. Each message is a JSON object with the prefix, the AS path,
+// the communities and the next hop. It uses its own consumer group.
+func (c *Component) asnPathsRawCreateQuery() (string, error) {
+	return stemplate(
+		`CREATE TABLE {{ .Database }}.asn_paths_raw (Prefix String, ASPath Array(UInt32), Communities Array(UInt32), NextHop String) ENGINE = {{ .Engine }}`,
+		gin.H{
+			"Database": c.config.Database,
+			"Engine": c.kafkaEngine(c.config.ASNPathsTopic,
+				fmt.Sprintf("%s-asn-paths", c.config.Kafka.GroupName),
+				`kafka_format = 'JSONEachRow'`),
+		})
+}
+
+// asnPathsSelectQuery returns the select query used by the consumer of the
+// asn_paths table.
+func (c *Component) asnPathsSelectQuery() (string, error) {
+	return stemplate(
+		`SELECT _timestamp AS TimeReceived, Prefix, ASPath, Communities, toIPv6(NextHop) AS NextHop FROM {{ .Database }}.asn_paths_raw`,
+		gin.H{"Database": c.config.Database})
+}
+
+// createASNPathsTable creates the asn_paths table if it does not exist.
+func (c *Component) createASNPathsTable(ctx context.Context) error {
+	if c.config.ASNPathsTopic == "" {
+		return errSkipStep
+	}
+	return c.createTableIfNotExists(ctx, c.localTable("asn_paths"), c.asnPathsCreateQuery)
+}
+
+// createASNPathsRawTable creates the Kafka table receiving the BGP paths. It
+// is recreated, with its consumer, when its definition changes.
+func (c *Component) createASNPathsRawTable(ctx context.Context) error {
+	if c.config.ASNPathsTopic == "" {
+		return errSkipStep
+	}
+	createQuery, err := c.asnPathsRawCreateQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build query to create asn_paths_raw: %w", err)
+	}
+	return c.createKafkaTable(ctx, "asn_paths", createQuery)
+}
+
+// createASNPathsConsumerView creates the materialized view copying the BGP
+// paths from the Kafka table to the asn_paths table.
+func (c *Component) createASNPathsConsumerView(ctx context.Context) error {
+	if c.config.ASNPathsTopic == "" {
+		return errSkipStep
+	}
+	selectQuery, err := c.asnPathsSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for asn_paths_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "asn_paths", selectQuery)
+}
+
+// exportersMetaCreateQuery returns the query to create the exporters_meta
+// table. Only the most recent version of the metadata of each exporter is
+// kept.
+func (c *Component) exportersMetaCreateQuery() (string, error) {
+	tableName := c.localTable("exporters_meta")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ ExporterAddress IPv6,
+ SysName String,
+ SysDescr String,
+ Location String,
+ Version UInt64
+)
+ENGINE = {{ .Engine }}
+ORDER BY ExporterAddress
+`, gin.H{
+		"Table":  tableName,
+		"Engine": c.mergeTreeEngine(tableName, "Replacing", "Version"),
+	})
+}
+
+// exportersMetaRawCreateQuery returns the query to create the Kafka table
+// receiving the metadata of the exporters. Each message is a JSON object with
+// the address of the exporter, its metadata and a version. It uses its own
+// consumer group.
+func (c *Component) exportersMetaRawCreateQuery() (string, error) {
+	return stemplate(
+		`CREATE TABLE {{ .Database }}.exporters_meta_raw (ExporterAddress String, SysName String, SysDescr String, Location String, Version UInt64) ENGINE = {{ .Engine }}`,
+		gin.H{
+			"Database": c.config.Database,
+			"Engine": c.kafkaEngine(c.config.ExportersMetaTopic,
+				fmt.Sprintf("%s-exporters-meta", c.config.Kafka.GroupName),
+				`kafka_format = 'JSONEachRow'`),
+		})
+}
+
+// exportersMetaSelectQuery returns the select query used by the consumer of
+// the exporters_meta table.
+func (c *Component) exportersMetaSelectQuery() (string, error) {
+	return stemplate(
+		`SELECT toIPv6(ExporterAddress) AS ExporterAddress, SysName, SysDescr, Location, Version FROM {{ .Database }}.exporters_meta_raw`,
+		gin.H{"Database": c.config.Database})
+}
+
+// createExportersMetaTable creates the exporters_meta table if it does not
+// exist.
+func (c *Component) createExportersMetaTable(ctx context.Context) error {
+	if c.config.ExportersMetaTopic == "" {
+		return errSkipStep
+	}
+	return c.createTableIfNotExists(ctx, c.localTable("exporters_meta"), c.exportersMetaCreateQuery)
+}
+
+// createExportersMetaRawTable creates the Kafka table receiving the metadata
+// of the exporters. It is recreated, with its consumer, when its definition
+// changes.
+func (c *Component) createExportersMetaRawTable(ctx context.Context) error {
+	if c.config.ExportersMetaTopic == "" {
+		return errSkipStep
+	}
+	createQuery, err := c.exportersMetaRawCreateQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build query to create exporters_meta_raw: %w", err)
+	}
+	return c.createKafkaTable(ctx, "exporters_meta", createQuery)
+}
+
+// createExportersMetaConsumerView creates the materialized view copying the
+// metadata of the exporters from the Kafka table to the exporters_meta table.
+func (c *Component) createExportersMetaConsumerView(ctx context.Context) error {
+	if c.config.ExportersMetaTopic == "" {
+		return errSkipStep
+	}
+	selectQuery, err := c.exportersMetaSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for exporters_meta_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "exporters_meta", selectQuery)
+}
+
+// errorsQuarantineCreateQuery returns the query to create the
+// flows_raw_errors_quarantine table.
+func (c *Component) errorsQuarantineCreateQuery() (string, error) {
+	tableName := c.localTable("flows_raw_errors_quarantine")
+	return stemplate(`
+CREATE TABLE {{ .Table }} (
+ timestamp DateTime,
+ topic LowCardinality(String),
+ `+"`partition`"+` UInt64,
+ `+"`offset`"+` UInt64,
+ raw String CODEC(ZSTD(1)),
+ error String
+)
+ENGINE = {{ .Engine }}
+PARTITION BY toYYYYMMDD(timestamp)
+ORDER BY (timestamp, topic, partition, offset)
+TTL timestamp + toIntervalSecond({{ .TTL }})
+`, gin.H{
+		"Table":  tableName,
+		"Engine": c.mergeTreeEngine(tableName, ""),
+		"TTL":    uint64(c.config.ErrorsQuarantineTTL.Seconds()),
+	})
+}
+
+// errorsQuarantineSelectQuery returns the select query used by the consumer
+// of the flows_raw_errors_quarantine table.
+func (c *Component) errorsQuarantineSelectQuery() (string, error) {
+	return stemplate(
+		"SELECT timestamp, topic, `partition`, `offset`, raw, error FROM {{ .Database }}.{{ .Table }}",
+		gin.H{
+			"Database": c.config.Database,
+			"Table":    c.localTable("flows_raw_errors"),
+		})
+}
+
+// errorsQuarantineStatsSelectQuery returns the select query of the
+// flows_raw_errors_quarantine_stats view.
+func (c *Component) errorsQuarantineStatsSelectQuery() (string, error) {
+	return stemplate(`
+SELECT
+ toStartOfInterval(timestamp, toIntervalSecond({{ .Interval }})) AS time,
+ topic,
+ count() AS errors,
+ any(error) AS sample
+FROM {{ .Database }}.flows_raw_errors_quarantine
+GROUP BY time, topic`, gin.H{
+		"Database": c.config.Database,
+		"Interval": uint64(c.config.ErrorsQuarantineInterval.Seconds()),
+	})
+}
+
+// createErrorsQuarantineTable creates the flows_raw_errors_quarantine table.
+// When it already exists, only the TTL is updated.
+func (c *Component) createErrorsQuarantineTable(ctx context.Context) error {
+	if c.config.ErrorsQuarantineTTL == 0 {
+		return errSkipStep
+	}
+	return c.createTableOrUpdateTTL(ctx, c.localTable("flows_raw_errors_quarantine"),
+		fmt.Sprintf("TTL timestamp + toIntervalSecond(%d)", uint64(c.config.ErrorsQuarantineTTL.Seconds())),
+		c.errorsQuarantineCreateQuery)
+}
+
+// createErrorsQuarantineConsumerView creates the materialized view copying
+// the decoding errors from the flows_raw_errors table to the
+// flows_raw_errors_quarantine table.
+func (c *Component) createErrorsQuarantineConsumerView(ctx context.Context) error {
+	if c.config.ErrorsQuarantineTTL == 0 {
+		return errSkipStep
+	}
+	selectQuery, err := c.errorsQuarantineSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for flows_raw_errors_quarantine_consumer: %w", err)
+	}
+	return c.createConsumerView(ctx, "flows_raw_errors_quarantine", selectQuery)
+}
+
+// createErrorsQuarantineStatsView creates the flows_raw_errors_quarantine_stats
+// view counting the decoding errors by interval, to be used for alerting.
+func (c *Component) createErrorsQuarantineStatsView(ctx context.Context) error {
+	if c.config.ErrorsQuarantineTTL == 0 || c.config.ErrorsQuarantineInterval == 0 {
+		return errSkipStep
+	}
+	selectQuery, err := c.errorsQuarantineStatsSelectQuery()
+	if err != nil {
+		return fmt.Errorf("cannot build select statement for flows_raw_errors_quarantine_stats: %w", err)
+	}
+	return c.createView(ctx, "flows_raw_errors_quarantine_stats", selectQuery)
+}
@@ -0,0 +1,980 @@
+// SPDX-FileCopyrightText: 2025 Free Mobile
+// SPDX-License-Identifier: AGPL-3.0-only
+
+package clickhouse
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/mock/gomock"
+
+	"akvorado/common/clickhousedb"
+	"akvorado/common/clickhousedb/mocks"
+	"akvorado/common/helpers"
+	"akvorado/common/reporter"
+	"akvorado/common/schema"
+)
+
+func TestFlowsMaterializedColumns(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	if got := c.flowsMaterializedColumns(); len(got) != 0 {
+		t.Fatalf("flowsMaterializedColumns() should be empty by default, got %v", got)
+	}
+
+	c.config.ProtocolColumns = map[string]uint8{
+		"IsUDP":  17,
+		"IsTCP":  6,
+		"IsICMP": 1,
+	}
+	got := []string{}
+	for _, column := range c.flowsMaterializedColumns() {
+		got = append(got, column.definition())
+	}
+	expected := []string{
+		"`IsICMP` Bool MATERIALIZED Proto = 1",
+		"`IsTCP` Bool MATERIALIZED Proto = 6",
+		"`IsUDP` Bool MATERIALIZED Proto = 17",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("flowsMaterializedColumns() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestReceiveDelayColumn(t *testing.T) {
+	got := receiveDelayColumn("TimeFlowStart").definition()
+	expected := "`ReceiveDelay` Int32 MATERIALIZED toInt32(TimeReceived) - toInt32(TimeFlowStart)"
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("receiveDelayColumn() (-got, +want):\n%s", diff)
+	}
+
+	// Skipped when the column is not in the schema
+	c := Component{
+		r:      reporter.NewMock(t),
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+	c.config.ReceiveDelayFrom = "TimeFlowStart"
+	if got := c.flowsMaterializedColumns(); len(got) != 0 {
+		t.Fatalf("flowsMaterializedColumns() should be empty, got %v", got)
+	}
+}
+
+func TestFlowsNetNameColumns(t *testing.T) {
+	// Skipped when the columns are in the schema
+	c := Component{
+		r:      reporter.NewMock(t),
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+	c.config.NetNameColumns = true
+	if got := c.flowsNetNameColumns(); len(got) != 0 {
+		t.Fatalf("flowsNetNameColumns() should be empty, got %v", got)
+	}
+
+	// Added when disabled in the schema
+	sch, err := schema.New(schema.Configuration{
+		Disabled: []schema.ColumnKey{schema.ColumnSrcNetName, schema.ColumnDstNetName},
+	})
+	if err != nil {
+		t.Fatalf("schema.New() error:\n%+v", err)
+	}
+	c.d.Schema = sch
+	got := []string{}
+	for _, column := range c.flowsNetNameColumns() {
+		got = append(got, column.definition())
+	}
+	expected := []string{
+		"`SrcNetName` LowCardinality(String) MATERIALIZED dictGetOrDefault('networks', 'name', SrcAddr, '')",
+		"`DstNetName` LowCardinality(String) MATERIALIZED dictGetOrDefault('networks', 'name', DstAddr, '')",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("flowsNetNameColumns() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestFlowsSampledQueries(t *testing.T) {
+	c := Component{
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+	c.config.SampledFlowsRatio = 10
+	c.config.TTLOnlyDropParts = false
+
+	createQuery, err := c.flowsCopyCreateQuery("flows_sampled")
+	if err != nil {
+		t.Fatalf("flowsCopyCreateQuery() error:\n%+v", err)
+	}
+	selectQuery, err := c.flowsSampledSelectQuery()
+	if err != nil {
+		t.Fatalf("flowsSampledSelectQuery() error:\n%+v", err)
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		Query    string
+		Expected string
+	}{
+		{helpers.Mark(), createQuery, "CREATE TABLE flows_sampled ("},
+		{helpers.Mark(), createQuery, "ENGINE = MergeTree\n"},
+		{helpers.Mark(), createQuery, "TTL TimeReceived + toIntervalSecond(1296000)\n"},
+		{helpers.Mark(), createQuery, "SETTINGS index_granularity = 8192, ttl_only_drop_parts = 0\n"},
+		{helpers.Mark(), selectQuery, "SamplingRate * 10 AS SamplingRate"},
+		{helpers.Mark(), selectQuery, "FROM default.flows\nWHERE (rand() % 10) = 0"},
+	}
+	for _, tc := range cases {
+		if !strings.Contains(tc.Query, tc.Expected) {
+			t.Errorf("%squery does not contain %q:\n%s", tc.Pos, tc.Expected, tc.Query)
+		}
+	}
+}
+
+func TestColumnCodecModifications(t *testing.T) {
+	createQuery := "CREATE TABLE default.flows\n" +
+		"(\n" +
+		"    `TimeReceived` DateTime CODEC(DoubleDelta, LZ4),\n" +
+		"    `SamplingRate` UInt64,\n" +
+		"    `ExporterAddress` LowCardinality(IPv6),\n" +
+		"    `Bytes` UInt64 CODEC(T64, LZ4),\n" +
+		"    `Packets` UInt64 CODEC(T64, LZ4),\n" +
+		"    `IsTCP` Bool MATERIALIZED Proto = 6\n" +
+		")\n" +
+		"ENGINE = MergeTree\n" +
+		"ORDER BY TimeReceived\n"
+	got := columnCodecModifications(createQuery, map[string]string{
+		"TimeReceived":    "DoubleDelta,LZ4",
+		"SamplingRate":    "ZSTD(1)",
+		"Bytes":           "T64, ZSTD(1)",
+		"Packets":         "T64, LZ4",
+		"IsTCP":           "ZSTD(1)",
+		"UnknownColumn":   "ZSTD(1)",
+		"ExporterAddress": "ZSTD(3)",
+	})
+	expected := []string{
+		"MODIFY COLUMN `SamplingRate` UInt64 CODEC(ZSTD(1))",
+		"MODIFY COLUMN `ExporterAddress` LowCardinality(IPv6) CODEC(ZSTD(3))",
+		"MODIFY COLUMN `Bytes` UInt64 CODEC(T64, ZSTD(1))",
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("columnCodecModifications() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestFlowsDirectionQueries(t *testing.T) {
+	c := Component{
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+	c.config.SplitFlowsByDirection = true
+
+	for _, tc := range []struct {
+		Pos   helpers.Pos
+		Table string
+		Where string
+	}{
+		{helpers.Mark(), "flows_in", "WHERE InIfBoundary = 'external'"},
+		{helpers.Mark(), "flows_out", "WHERE OutIfBoundary = 'external'"},
+	} {
+		createQuery, err := c.flowsCopyCreateQuery(tc.Table)
+		if err != nil {
+			t.Fatalf("%sflowsCopyCreateQuery() error:\n%+v", tc.Pos, err)
+		}
+		if expected := fmt.Sprintf("CREATE TABLE %s (", tc.Table); !strings.Contains(createQuery, expected) {
+			t.Errorf("%sflowsCopyCreateQuery() does not contain %q:\n%s", tc.Pos, expected, createQuery)
+		}
+		selectQuery, err := c.flowsCopySelectQuery(flowsDirectionPredicates()[tc.Table], nil)
+		if err != nil {
+			t.Fatalf("%sflowsCopySelectQuery() error:\n%+v", tc.Pos, err)
+		}
+		if expected := "FROM default.flows\n" + tc.Where; !strings.HasSuffix(selectQuery, expected) {
+			t.Errorf("%sflowsCopySelectQuery() does not end with %q:\n%s", tc.Pos, expected, selectQuery)
+		}
+	}
+}
+
+func TestQueryLogQueries(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.QueryLogTTL = 7 * 24 * time.Hour
+	c.config.QueryLogUsername = "console"
+
+	createQuery, err := c.queryLogCreateQuery()
+	if err != nil {
+		t.Fatalf("queryLogCreateQuery() error:\n%+v", err)
+	}
+	selectQuery, err := c.queryLogSelectQuery()
+	if err != nil {
+		t.Fatalf("queryLogSelectQuery() error:\n%+v", err)
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		Query    string
+		Expected string
+	}{
+		{helpers.Mark(), createQuery, "CREATE TABLE query_log_akvorado ("},
+		{helpers.Mark(), createQuery, "ENGINE = MergeTree\n"},
+		{helpers.Mark(), createQuery, "TTL event_time + toIntervalSecond(604800)\n"},
+		{helpers.Mark(), selectQuery, "FROM system.query_log\n"},
+		{helpers.Mark(), selectQuery, "WHERE user = 'console' AND"},
+	}
+	for _, tc := range cases {
+		if !strings.Contains(tc.Query, tc.Expected) {
+			t.Errorf("%squery does not contain %q:\n%s", tc.Pos, tc.Expected, tc.Query)
+		}
+	}
+
+	// Default to the configured username
+	c.config.QueryLogUsername = ""
+	selectQuery, err = c.queryLogSelectQuery()
+	if err != nil {
+		t.Fatalf("queryLogSelectQuery() error:\n%+v", err)
+	}
+	if !strings.Contains(selectQuery, "WHERE user = 'default' AND") {
+		t.Errorf("queryLogSelectQuery() does not filter on default user:\n%s", selectQuery)
+	}
+}
+
+func TestFlowsAggDailyQueries(t *testing.T) {
+	c := Component{
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+	c.config.DailyAggregateKeys = []string{"ExporterName", "SrcAS"}
+
+	createQuery, err := c.flowsAggDailyCreateQuery()
+	if err != nil {
+		t.Fatalf("flowsAggDailyCreateQuery() error:\n%+v", err)
+	}
+	expected := `
+CREATE TABLE flows_agg_daily (
+ TimeReceived DateTime CODEC(DoubleDelta, LZ4),
+ ` + "`ExporterName` LowCardinality(String)" + `,
+ ` + "`SrcAS` UInt32" + `,
+ Bytes AggregateFunction(sum, UInt64),
+ Packets AggregateFunction(sum, UInt64),
+ SrcAddrs AggregateFunction(uniq, IPv6),
+ DstAddrs AggregateFunction(uniq, IPv6)
+)
+ENGINE = AggregatingMergeTree
+PARTITION BY toYYYYMM(TimeReceived)
+ORDER BY (TimeReceived, ExporterName, SrcAS)
+`
+	if diff := helpers.Diff(createQuery, expected); diff != "" {
+		t.Errorf("flowsAggDailyCreateQuery() (-got, +want):\n%s", diff)
+	}
+
+	selectQuery, err := c.flowsAggDailySelectQuery()
+	if err != nil {
+		t.Fatalf("flowsAggDailySelectQuery() error:\n%+v", err)
+	}
+	expected = `
+SELECT
+ toStartOfDay(TimeReceived) AS TimeReceived,
+ ExporterName,
+ SrcAS,
+ sumState(Bytes * SamplingRate) AS Bytes,
+ sumState(Packets * SamplingRate) AS Packets,
+ uniqState(SrcAddr) AS SrcAddrs,
+ uniqState(DstAddr) AS DstAddrs
+FROM default.flows
+GROUP BY TimeReceived, ExporterName, SrcAS`
+	if diff := helpers.Diff(selectQuery, expected); diff != "" {
+		t.Errorf("flowsAggDailySelectQuery() (-got, +want):\n%s", diff)
+	}
+
+	c.config.DailyAggregateKeys = []string{"ExporterName", "Unknown"}
+	if _, err := c.flowsAggDailyCreateQuery(); err == nil {
+		t.Error("flowsAggDailyCreateQuery() with an unknown column did not error")
+	}
+}
+
+func TestFlowsHourlyASQueries(t *testing.T) {
+	c := Component{
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+
+	createQuery, err := c.flowsHourlyASCreateQuery()
+	if err != nil {
+		t.Fatalf("flowsHourlyASCreateQuery() error:\n%+v", err)
+	}
+	expected := `
+CREATE TABLE flows_hourly_as (
+ TimeReceived DateTime CODEC(DoubleDelta, LZ4),
+ ` + "`ExporterAddress` LowCardinality(IPv6)" + `,
+ ` + "`SrcAS` UInt32" + `,
+ ` + "`DstAS` UInt32" + `,
+ Bytes UInt64,
+ Packets UInt64
+)
+ENGINE = SummingMergeTree((Bytes, Packets))
+PARTITION BY toYYYYMM(TimeReceived)
+ORDER BY (TimeReceived, ExporterAddress, SrcAS, DstAS)
+`
+	if diff := helpers.Diff(createQuery, expected); diff != "" {
+		t.Errorf("flowsHourlyASCreateQuery() (-got, +want):\n%s", diff)
+	}
+
+	selectQuery, err := c.flowsHourlyASSelectQuery()
+	if err != nil {
+		t.Fatalf("flowsHourlyASSelectQuery() error:\n%+v", err)
+	}
+	expected = `
+SELECT
+ toStartOfHour(TimeReceived) AS TimeReceived,
+ ExporterAddress,
+ SrcAS,
+ DstAS,
+ sum(Bytes * SamplingRate) AS Bytes,
+ sum(Packets * SamplingRate) AS Packets
+FROM default.flows
+GROUP BY TimeReceived, ExporterAddress, SrcAS, DstAS`
+	if diff := helpers.Diff(selectQuery, expected); diff != "" {
+		t.Errorf("flowsHourlyASSelectQuery() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestCreateFlowsHourlyASTable(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch, Schema: schema.NewMock(t)},
+	}
+	ctx := context.Background()
+
+	// Disabled
+	if err := c.createFlowsHourlyASTable(ctx); err != errSkipStep {
+		t.Fatalf("createFlowsHourlyASTable() error:\n%+v", err)
+	}
+
+	// Already existing
+	c.config.HourlyASView = true
+	ctrl := gomock.NewController(t)
+	mockRow := mocks.NewMockRow(ctrl)
+	mockRow.EXPECT().Scan(gomock.Any()).SetArg(0, "flows_hourly_as").Return(nil)
+	mockConn.EXPECT().
+		QueryRow(gomock.Any(),
+			"SELECT name FROM system.tables WHERE name = $1 AND database = $2",
+			"flows_hourly_as", "default").
+		Return(mockRow)
+	if err := c.createFlowsHourlyASTable(ctx); err != errSkipStep {
+		t.Fatalf("createFlowsHourlyASTable() error:\n%+v", err)
+	}
+}
+
+func TestSchemaDrift(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch, Schema: schema.NewMock(t)},
+	}
+	c.config.HourlyASView = true
+	c.config.VerifySchema = true
+	ctx := context.Background()
+
+	createQuery, err := c.flowsHourlyASCreateQuery()
+	if err != nil {
+		t.Fatalf("flowsHourlyASCreateQuery() error:\n%+v", err)
+	}
+	if diff := helpers.Diff(createTableColumns(createQuery), []string{
+		"TimeReceived", "ExporterAddress", "SrcAS", "DstAS", "Bytes", "Packets",
+	}); diff != "" {
+		t.Fatalf("createTableColumns() (-got, +want):\n%s", diff)
+	}
+
+	ctrl := gomock.NewController(t)
+	mockRow := mocks.NewMockRow(ctrl)
+	mockRow.EXPECT().Scan(gomock.Any()).SetArg(0, "flows_hourly_as").Return(nil)
+	mockConn.EXPECT().
+		QueryRow(gomock.Any(),
+			"SELECT name FROM system.tables WHERE name = $1 AND database = $2",
+			"flows_hourly_as", "default").
+		Return(mockRow)
+	mockConn.EXPECT().
+		Select(gomock.Any(), gomock.Any(), gomock.Any(), "default", "flows_hourly_as").
+		SetArg(1, []struct {
+			Name string `ch:"name"`
+		}{
+			{"TimeReceived"}, {"ExporterAddress"}, {"SrcAS"}, {"Bytes"}, {"Packets"}, {"Flows"},
+		}).
+		Return(nil).
+		Times(2)
+
+	// The migration step is still skipped
+	if err := c.createFlowsHourlyASTable(ctx); err != errSkipStep {
+		t.Fatalf("createFlowsHourlyASTable() error:\n%+v", err)
+	}
+
+	missing, extra, err := c.schemaDrift(ctx, "flows_hourly_as", createQuery)
+	if err != nil {
+		t.Fatalf("schemaDrift() error:\n%+v", err)
+	}
+	if diff := helpers.Diff(missing, []string{"DstAS"}); diff != "" {
+		t.Errorf("schemaDrift() missing (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(extra, []string{"Flows"}); diff != "" {
+		t.Errorf("schemaDrift() extra (-got, +want):\n%s", diff)
+	}
+}
+
+func TestFlowSamplesQueries(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.Kafka.Brokers = []string{"kafka:9092"}
+	c.config.FlowSamplesTopic = "flow-samples"
+	c.config.FlowSamplesTTL = 6 * time.Hour
+	c.config.Kafka.EngineSettings = []string{"kafka_max_block_size = 100"}
+
+	createQuery, err := c.flowSamplesCreateQuery()
+	if err != nil {
+		t.Fatalf("flowSamplesCreateQuery() error:\n%+v", err)
+	}
+	rawQuery, err := c.flowSamplesRawCreateQuery()
+	if err != nil {
+		t.Fatalf("flowSamplesRawCreateQuery() error:\n%+v", err)
+	}
+	selectQuery, err := c.flowSamplesSelectQuery()
+	if err != nil {
+		t.Fatalf("flowSamplesSelectQuery() error:\n%+v", err)
+	}
+	cases := []struct {
+		Pos      helpers.Pos
+		Query    string
+		Expected string
+	}{
+		{helpers.Mark(), createQuery, "CREATE TABLE flow_samples ("},
+		{helpers.Mark(), createQuery, " Header String CODEC(ZSTD(1))\n"},
+		{helpers.Mark(), createQuery, "ENGINE = MergeTree\n"},
+		{helpers.Mark(), createQuery, "TTL TimeReceived + toIntervalSecond(21600)\n"},
+		{helpers.Mark(), rawQuery, "CREATE TABLE default.flow_samples_raw (Header String) ENGINE = Kafka SETTINGS "},
+		{helpers.Mark(), rawQuery, "kafka_topic_list = 'flow-samples'"},
+		{helpers.Mark(), rawQuery, "kafka_broker_list = 'kafka:9092'"},
+		{helpers.Mark(), rawQuery, "kafka_group_name = 'clickhouse-flow-samples'"},
+		{helpers.Mark(), rawQuery, "kafka_format = 'RawBLOB', kafka_max_block_size = 100"},
+		{helpers.Mark(), selectQuery, "toIPv6(_key) AS ExporterAddress"},
+		{helpers.Mark(), selectQuery, "FROM default.flow_samples_raw"},
+	}
+	for _, tc := range cases {
+		if !strings.Contains(tc.Query, tc.Expected) {
+			t.Errorf("%squery does not contain %q:\n%s", tc.Pos, tc.Expected, tc.Query)
+		}
+	}
+}
+
+func TestASNPathsQueries(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.Kafka.Brokers = []string{"kafka:9092"}
+	c.config.ASNPathsTopic = "asn-paths"
+	c.config.Kafka.CALocation = "/etc/clickhouse-server/kafka-ca.pem"
+	c.config.Kafka.EngineSettings = []string{"kafka_max_block_size = 100"}
+
+	createQuery, err := c.asnPathsCreateQuery()
+	if err != nil {
+		t.Fatalf("asnPathsCreateQuery() error:\n%+v", err)
+	}
+	expected := `
+CREATE TABLE asn_paths (
+ TimeReceived DateTime CODEC(DoubleDelta, LZ4),
+ Prefix String,
+ ASPath Array(UInt32),
+ Communities Array(UInt32),
+ NextHop IPv6
+)
+ENGINE = ReplacingMergeTree(TimeReceived)
+ORDER BY Prefix
+`
+	if diff := helpers.Diff(createQuery, expected); diff != "" {
+		t.Errorf("asnPathsCreateQuery() (-got, +want):\n%s", diff)
+	}
+
+	rawQuery, err := c.asnPathsRawCreateQuery()
+	if err != nil {
+		t.Fatalf("asnPathsRawCreateQuery() error:\n%+v", err)
+	}
+	expected = "CREATE TABLE default.asn_paths_raw (Prefix String, ASPath Array(UInt32), Communities Array(UInt32), NextHop String) " +
+		"ENGINE = Kafka SETTINGS kafka_broker_list = 'kafka:9092', kafka_topic_list = 'asn-paths', " +
+		"kafka_group_name = 'clickhouse-asn-paths', kafka_format = 'JSONEachRow', " +
+		"kafka_security_protocol = 'ssl', kafka_max_block_size = 100 " +
+		"COMMENT 'ssl_ca_location: /etc/clickhouse-server/kafka-ca.pem'"
+	if diff := helpers.Diff(rawQuery, expected); diff != "" {
+		t.Errorf("asnPathsRawCreateQuery() (-got, +want):\n%s", diff)
+	}
+
+	selectQuery, err := c.asnPathsSelectQuery()
+	if err != nil {
+		t.Fatalf("asnPathsSelectQuery() error:\n%+v", err)
+	}
+	expected = "SELECT _timestamp AS TimeReceived, Prefix, ASPath, Communities, toIPv6(NextHop) AS NextHop FROM default.asn_paths_raw"
+	if diff := helpers.Diff(selectQuery, expected); diff != "" {
+		t.Errorf("asnPathsSelectQuery() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestExportersMetaQueries(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.Kafka.Brokers = []string{"kafka:9092"}
+	c.config.ExportersMetaTopic = "exporters-meta"
+	c.config.Kafka.EngineSettings = []string{"kafka_poll_timeout_ms = 1000"}
+
+	createQuery, err := c.exportersMetaCreateQuery()
+	if err != nil {
+		t.Fatalf("exportersMetaCreateQuery() error:\n%+v", err)
+	}
+	expected := `
+CREATE TABLE exporters_meta (
+ ExporterAddress IPv6,
+ SysName String,
+ SysDescr String,
+ Location String,
+ Version UInt64
+)
+ENGINE = ReplacingMergeTree(Version)
+ORDER BY ExporterAddress
+`
+	if diff := helpers.Diff(createQuery, expected); diff != "" {
+		t.Errorf("exportersMetaCreateQuery() (-got, +want):\n%s", diff)
+	}
+
+	rawQuery, err := c.exportersMetaRawCreateQuery()
+	if err != nil {
+		t.Fatalf("exportersMetaRawCreateQuery() error:\n%+v", err)
+	}
+	expected = "CREATE TABLE default.exporters_meta_raw (ExporterAddress String, SysName String, SysDescr String, Location String, Version UInt64) " +
+		"ENGINE = Kafka SETTINGS kafka_broker_list = 'kafka:9092', kafka_topic_list = 'exporters-meta', " +
+		"kafka_group_name = 'clickhouse-exporters-meta', kafka_format = 'JSONEachRow', " +
+		"kafka_poll_timeout_ms = 1000"
+	if diff := helpers.Diff(rawQuery, expected); diff != "" {
+		t.Errorf("exportersMetaRawCreateQuery() (-got, +want):\n%s", diff)
+	}
+
+	selectQuery, err := c.exportersMetaSelectQuery()
+	if err != nil {
+		t.Fatalf("exportersMetaSelectQuery() error:\n%+v", err)
+	}
+	expected = "SELECT toIPv6(ExporterAddress) AS ExporterAddress, SysName, SysDescr, Location, Version FROM default.exporters_meta_raw"
+	if diff := helpers.Diff(selectQuery, expected); diff != "" {
+		t.Errorf("exportersMetaSelectQuery() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestErrorsQuarantine(t *testing.T) {
+	c := Component{
+		r:      reporter.NewMock(t),
+		config: DefaultConfiguration(),
+	}
+	ctx := context.Background()
+
+	// Disabled by default
+	for _, step := range []func(context.Context) error{
+		c.createErrorsQuarantineTable,
+		c.createErrorsQuarantineConsumerView,
+		c.createErrorsQuarantineStatsView,
+	} {
+		if err := step(ctx); err != errSkipStep {
+			t.Fatalf("step should skip when disabled, got %v", err)
+		}
+	}
+	c.config.ErrorsQuarantineTTL = 7 * 24 * time.Hour
+	if err := c.createErrorsQuarantineStatsView(ctx); err != errSkipStep {
+		t.Fatalf("createErrorsQuarantineStatsView() should skip without interval, got %v", err)
+	}
+	c.config.ErrorsQuarantineInterval = time.Minute
+
+	createQuery, err := c.errorsQuarantineCreateQuery()
+	if err != nil {
+		t.Fatalf("errorsQuarantineCreateQuery() error:\n%+v", err)
+	}
+	for _, expected := range []string{
+		"CREATE TABLE flows_raw_errors_quarantine (",
+		"ENGINE = MergeTree\n",
+		"TTL timestamp + toIntervalSecond(604800)\n",
+	} {
+		if !strings.Contains(createQuery, expected) {
+			t.Errorf("errorsQuarantineCreateQuery() does not contain %q:\n%s", expected, createQuery)
+		}
+	}
+
+	selectQuery, err := c.errorsQuarantineStatsSelectQuery()
+	if err != nil {
+		t.Fatalf("errorsQuarantineStatsSelectQuery() error:\n%+v", err)
+	}
+	expected := `
+SELECT
+ toStartOfInterval(timestamp, toIntervalSecond(60)) AS time,
+ topic,
+ count() AS errors,
+ any(error) AS sample
+FROM default.flows_raw_errors_quarantine
+GROUP BY time, topic`
+	if diff := helpers.Diff(selectQuery, expected); diff != "" {
+		t.Errorf("errorsQuarantineStatsSelectQuery() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestExchangeFlowsTables(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch},
+	}
+	ctx := context.Background()
+	if err := c.exchangeFlowsTables(ctx); err != errSkipStep {
+		t.Fatalf("exchangeFlowsTables() should skip when disabled, got %v", err)
+	}
+	c.config.FlowsSwap = true
+
+	type auditEvent = struct {
+		Event string `ch:"event"`
+	}
+	lastEvent := func(events ...auditEvent) *gomock.Call {
+		return mockConn.EXPECT().
+			Select(gomock.Any(), gomock.Any(), gomock.Any(), "flows_new").
+			Return(nil).
+			SetArg(1, append([]auditEvent{}, events...))
+	}
+
+	// No marker: no exchange
+	lastEvent()
+	if err := c.exchangeFlowsTables(ctx); err != errSkipStep {
+		t.Fatalf("exchangeFlowsTables() without marker should skip, got %v", err)
+	}
+
+	// Backfill complete: exchange, then record it
+	gomock.InOrder(
+		lastEvent(auditEvent{"backfill_complete"}),
+		mockConn.EXPECT().
+			Exec(gomock.Any(), "EXCHANGE TABLES flows AND flows_new").
+			Return(nil),
+		mockConn.EXPECT().
+			Exec(gomock.Any(), "INSERT INTO migrations_audit (table_name, event) VALUES ($1, $2)",
+				"flows_new", "exchanged").
+			Return(nil),
+	)
+	if err := c.exchangeFlowsTables(ctx); err != nil {
+		t.Fatalf("exchangeFlowsTables() error:\n%+v", err)
+	}
+
+	// Already exchanged: no exchange
+	lastEvent(auditEvent{"exchanged"})
+	if err := c.exchangeFlowsTables(ctx); err != errSkipStep {
+		t.Fatalf("exchangeFlowsTables() after exchange should skip, got %v", err)
+	}
+}
+
+func TestCircuitsDictionaryQuery(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.OrchestratorURL = "http://orchestrator:8080"
+	got, err := c.dictionaryCreateQuery(schema.DictionaryCircuits, "complex_key_hashed",
+		"`exporter_address` IPv6, `ifindex` UInt32, `circuit_id` String, `provider` String",
+		"exporter_address, ifindex", 10*time.Minute)
+	if err != nil {
+		t.Fatalf("dictionaryCreateQuery() error:\n%+v", err)
+	}
+	expected := `
+CREATE DICTIONARY default.circuits (` + "`exporter_address` IPv6, `ifindex` UInt32, `circuit_id` String, `provider` String" + `)
+PRIMARY KEY exporter_address, ifindex
+SOURCE(HTTP(URL 'http://orchestrator:8080/api/v0/orchestrator/clickhouse/circuits.csv' FORMAT 'CSVWithNames'))
+LIFETIME(MIN 0 MAX 600)
+LAYOUT(COMPLEX_KEY_HASHED())
+SETTINGS(format_csv_allow_single_quotes = 0)
+`
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("dictionaryCreateQuery() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestProtocolsDictionaryQuery(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.OrchestratorURL = "http://orchestrator:8080"
+	query := func() string {
+		got, err := c.dictionaryCreateQuery(schema.DictionaryProtocols, "hashed",
+			"`proto` UInt8 INJECTIVE, `name` String, `description` String", "proto", time.Hour)
+		if err != nil {
+			t.Fatalf("dictionaryCreateQuery() error:\n%+v", err)
+		}
+		return got
+	}
+
+	// Default
+	got := query()
+	expected := "SOURCE(HTTP(URL 'http://orchestrator:8080/api/v0/orchestrator/clickhouse/protocols.csv' FORMAT 'CSVWithNames'))\n"
+	if !strings.Contains(got, expected) {
+		t.Fatalf("dictionaryCreateQuery() does not contain %q:\n%s", expected, got)
+	}
+
+	// Custom protocols
+	c.config.Protocols = map[uint8]ProtocolAttributes{
+		253: {Name: "CUSTOM", Description: "Private protocol"},
+	}
+	got1 := query()
+	if !strings.Contains(got1, "/protocols.csv?hash=") {
+		t.Fatalf("dictionaryCreateQuery() does not contain a hash:\n%s", got1)
+	}
+	c.config.Protocols[253] = ProtocolAttributes{Name: "CUSTOM", Description: "Another protocol"}
+	got2 := query()
+	if got1 == got2 {
+		t.Fatalf("dictionaryCreateQuery() did not change with custom protocols:\n%s", got2)
+	}
+}
+
+func TestExporterRolesDictionaryQuery(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.OrchestratorURL = "http://orchestrator:8080"
+	got, err := c.dictionaryCreateQuery(schema.DictionaryExporterRoles, "ip_trie",
+		"`network` String, `role` String", "network", c.config.ExporterRolesLifetime)
+	if err != nil {
+		t.Fatalf("dictionaryCreateQuery() error:\n%+v", err)
+	}
+	expected := `
+CREATE DICTIONARY default.exporter_roles (` + "`network` String, `role` String" + `)
+PRIMARY KEY network
+SOURCE(HTTP(URL 'http://orchestrator:8080/api/v0/orchestrator/clickhouse/exporter_roles.csv' FORMAT 'CSVWithNames'))
+LIFETIME(MIN 0 MAX 3600)
+LAYOUT(IP_TRIE())
+SETTINGS(format_csv_allow_single_quotes = 0)
+`
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("dictionaryCreateQuery() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestRowPolicyCreateQuery(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	got := c.rowPolicyCreateQuery(RowPolicyConfiguration{
+		Role:    "customer1",
+		Tenants: []string{"customer1", "customer1-bis"},
+	}, "flows_1m0s")
+	expected := "CREATE ROW POLICY OR REPLACE `akvorado_customer1` ON default.flows_1m0s " +
+		"FOR SELECT USING ExporterTenant IN ('customer1', 'customer1-bis') TO `customer1`"
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("rowPolicyCreateQuery() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestFlowsTTLExpression(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	mainResolution := ResolutionConfiguration{Interval: 0, TTL: 15 * 24 * time.Hour}
+	consolidated := ResolutionConfiguration{Interval: time.Minute, TTL: 7 * 24 * time.Hour}
+	check := func(resolution ResolutionConfiguration, expected string) {
+		t.Helper()
+		got, err := c.flowsTTLExpression(resolution)
+		if err != nil {
+			t.Fatalf("flowsTTLExpression() error:\n%+v", err)
+		}
+		if diff := helpers.Diff(got, expected); diff != "" {
+			t.Fatalf("flowsTTLExpression() (-got, +want):\n%s", diff)
+		}
+	}
+	check(mainResolution, "TimeReceived + toIntervalSecond(1296000)")
+
+	c.config.ExporterTTLs = helpers.MustNewSubnetMap(map[string]time.Duration{
+		"::ffff:192.0.2.0/120":    60 * 24 * time.Hour,
+		"::ffff:192.0.2.128/121":  30 * 24 * time.Hour,
+		"::ffff:198.51.100.0/120": 2 * 24 * time.Hour,
+	})
+	check(mainResolution, "TimeReceived + toIntervalSecond(multiIf("+
+		"isIPAddressInRange(toString(ExporterAddress), '::ffff:192.0.2.128/121'), 2592000, "+
+		"isIPAddressInRange(toString(ExporterAddress), '::ffff:192.0.2.0/120'), 5184000, "+
+		"isIPAddressInRange(toString(ExporterAddress), '::ffff:198.51.100.0/120'), 172800, "+
+		"1296000))")
+	check(consolidated, "TimeReceived + toIntervalSecond(604800)")
+}
+
+func TestFlowsTTLMigration(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch, Schema: schema.NewMock(t)},
+	}
+	ctx := context.Background()
+	resolution := ResolutionConfiguration{Interval: 0, TTL: 15 * 24 * time.Hour}
+
+	// Initial creation
+	createQuery, err := c.flowsCreateQuery("flows", resolution)
+	if err != nil {
+		t.Fatalf("flowsCreateQuery() error:\n%+v", err)
+	}
+	if !strings.Contains(createQuery, "\nTTL TimeReceived + toIntervalSecond(1296000)\n") {
+		t.Errorf("flowsCreateQuery() does not contain the TTL:\n%s", createQuery)
+	}
+
+	ctrl := gomock.NewController(t)
+	expectTTL := func(ttl uint64, matching string) {
+		mockRow := mocks.NewMockRow(ctrl)
+		mockRow.EXPECT().Scan(gomock.Any()).SetArg(0, matching).Return(nil)
+		mockConn.EXPECT().
+			QueryRow(gomock.Any(),
+				fmt.Sprintf("SELECT CAST(engine_full LIKE '%% TTL TimeReceived + toIntervalSecond(%d) %%', 'String') "+
+					"FROM system.tables WHERE name = $1 AND database = $2", ttl),
+				"flows", "default").
+			Return(mockRow)
+	}
+
+	// Same TTL
+	expectTTL(1296000, "1")
+	if modified, err := c.updateFlowsTTL(ctx, "flows", resolution); err != nil {
+		t.Fatalf("updateFlowsTTL() error:\n%+v", err)
+	} else if modified {
+		t.Fatal("updateFlowsTTL() modified the table with the same TTL")
+	}
+
+	// TTL change
+	resolution.TTL = 30 * 24 * time.Hour
+	expectTTL(2592000, "0")
+	mockConn.EXPECT().
+		Exec(gomock.Any(), "ALTER TABLE flows MODIFY TTL TimeReceived + toIntervalSecond(2592000)").
+		Return(nil)
+	if modified, err := c.updateFlowsTTL(ctx, "flows", resolution); err != nil {
+		t.Fatalf("updateFlowsTTL() error:\n%+v", err)
+	} else if !modified {
+		t.Fatal("updateFlowsTTL() did not modify the table with a new TTL")
+	}
+}
+
+func TestCompressionStatsSelectQuery(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	got, err := c.compressionStatsSelectQuery()
+	if err != nil {
+		t.Fatalf("compressionStatsSelectQuery() error:\n%+v", err)
+	}
+	for _, expected := range []string{
+		"FROM system.parts_columns\n",
+		"WHERE (database = 'default') AND (table = 'flows') AND active\n",
+		"round(uncompressed / compressed, 2) AS ratio\n",
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("compressionStatsSelectQuery() does not contain %q:\n%s", expected, got)
+		}
+	}
+}
+
+func TestKafkaLagSelectQuery(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	c.config.KafkaLagThreshold = 10000
+	got, err := c.kafkaLagSelectQuery()
+	if err != nil {
+		t.Fatalf("kafkaLagSelectQuery() error:\n%+v", err)
+	}
+	for _, expected := range []string{
+		"FROM system.kafka_consumers\n",
+		"'consumer_lag') AS lag,\n",
+		"'committed_offset') AS committed_offset,\n",
+		" current_offset - committed_offset AS uncommitted,\n",
+		" 10000 AS threshold,\n",
+		" lag > threshold AS alert\n",
+		"WHERE database = 'default'",
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("kafkaLagSelectQuery() does not contain %q:\n%s", expected, got)
+		}
+	}
+}
+
+func TestFlowsTableSettings(t *testing.T) {
+	c := Component{config: DefaultConfiguration()}
+	if diff := helpers.Diff(c.flowsTableSettings(),
+		"index_granularity = 8192, ttl_only_drop_parts = 1"); diff != "" {
+		t.Fatalf("flowsTableSettings() (-got, +want):\n%s", diff)
+	}
+	c.config.MinAgeToForceMerge = time.Hour
+	if diff := helpers.Diff(c.flowsTableSettings(),
+		"index_granularity = 8192, ttl_only_drop_parts = 1, min_age_to_force_merge_seconds = 3600"); diff != "" {
+		t.Fatalf("flowsTableSettings() (-got, +want):\n%s", diff)
+	}
+	c.config.TTLOnlyDropParts = false
+	if diff := helpers.Diff(c.flowsTableSettings(),
+		"index_granularity = 8192, ttl_only_drop_parts = 0, min_age_to_force_merge_seconds = 3600"); diff != "" {
+		t.Fatalf("flowsTableSettings() (-got, +want):\n%s", diff)
+	}
+	c.config.DeduplicateInserts = true
+	if diff := helpers.Diff(c.flowsTableSettings(),
+		"index_granularity = 8192, ttl_only_drop_parts = 0, min_age_to_force_merge_seconds = 3600, "+
+			"non_replicated_deduplication_window = 1000"); diff != "" {
+		t.Fatalf("flowsTableSettings() (-got, +want):\n%s", diff)
+	}
+	c.config.Cluster = "akvorado"
+	if diff := helpers.Diff(c.flowsTableSettings(),
+		"index_granularity = 8192, ttl_only_drop_parts = 0, min_age_to_force_merge_seconds = 3600"); diff != "" {
+		t.Fatalf("flowsTableSettings() (-got, +want):\n%s", diff)
+	}
+}
+
+func TestTTLOnlyDropPartsIneffective(t *testing.T) {
+	main := ResolutionConfiguration{Interval: 0, TTL: 15 * 24 * time.Hour}
+	consolidated := ResolutionConfiguration{Interval: time.Minute, TTL: 7 * 24 * time.Hour}
+	c := Component{config: DefaultConfiguration()}
+	if c.ttlOnlyDropPartsIneffective(main) {
+		t.Error("ttlOnlyDropPartsIneffective() should be false without exporter TTLs")
+	}
+	c.config.ExporterTTLs = helpers.MustNewSubnetMap(map[string]time.Duration{
+		"::ffff:192.0.2.0/120": 60 * 24 * time.Hour,
+	})
+	if !c.ttlOnlyDropPartsIneffective(main) {
+		t.Error("ttlOnlyDropPartsIneffective() should be true with exporter TTLs")
+	}
+	if c.ttlOnlyDropPartsIneffective(consolidated) {
+		t.Error("ttlOnlyDropPartsIneffective() should be false for consolidated tables")
+	}
+	c.config.TTLOnlyDropParts = false
+	if c.ttlOnlyDropPartsIneffective(main) {
+		t.Error("ttlOnlyDropPartsIneffective() should be false when disabled")
+	}
+}
+
+func TestClusterDDL(t *testing.T) {
+	cases := []struct {
+		Pos      helpers.Pos
+		Cluster  string
+		Shards   int
+		Expected string
+	}{
+		{
+			Pos: helpers.Mark(),
+			Expected: "CREATE TABLE asn_paths (" +
+				" TimeReceived DateTime CODEC(DoubleDelta, LZ4), Prefix String, ASPath Array(UInt32), Communities Array(UInt32), NextHop IPv6 )" +
+				" ENGINE = ReplacingMergeTree(TimeReceived) ORDER BY Prefix",
+		}, {
+			Pos:     helpers.Mark(),
+			Cluster: "akvorado",
+			Shards:  1,
+			Expected: "CREATE TABLE asn_paths ON CLUSTER akvorado (" +
+				" TimeReceived DateTime CODEC(DoubleDelta, LZ4), Prefix String, ASPath Array(UInt32), Communities Array(UInt32), NextHop IPv6 )" +
+				" ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/shard-{shard}/asn_paths', 'replica-{replica}', TimeReceived)" +
+				" ORDER BY Prefix",
+		}, {
+			Pos:     helpers.Mark(),
+			Cluster: "akvorado",
+			Shards:  2,
+			Expected: "CREATE TABLE asn_paths_local ON CLUSTER akvorado (" +
+				" TimeReceived DateTime CODEC(DoubleDelta, LZ4), Prefix String, ASPath Array(UInt32), Communities Array(UInt32), NextHop IPv6 )" +
+				" ENGINE = ReplicatedReplacingMergeTree('/clickhouse/tables/shard-{shard}/asn_paths_local', 'replica-{replica}', TimeReceived)" +
+				" ORDER BY Prefix",
+		},
+	}
+	for _, tc := range cases {
+		c := Component{config: DefaultConfiguration(), shards: tc.Shards}
+		c.config.Cluster = tc.Cluster
+		query, err := c.asnPathsCreateQuery()
+		if err != nil {
+			t.Fatalf("%sasnPathsCreateQuery() error:\n%+v", tc.Pos, err)
+		}
+		// This is what ExecOnCluster() does
+		if tc.Cluster != "" {
+			query = clickhousedb.TransformQueryOnCluster(query, tc.Cluster)
+		} else {
+			query = strings.TrimSpace(regexp.MustCompile(`\s+`).ReplaceAllString(query, " "))
+		}
+		if diff := helpers.Diff(query, tc.Expected); diff != "" {
+			t.Errorf("%sasnPathsCreateQuery() (-got, +want):\n%s", tc.Pos, diff)
+		}
+	}
+}
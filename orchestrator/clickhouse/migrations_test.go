@@ -5,18 +5,25 @@ package clickhouse
 
 import (
 	"context"
+	"database/sql"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/url"
 	"os"
 	"path"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"akvorado/common/clickhousedb"
+	"akvorado/common/clickhousedb/mocks"
 	"akvorado/common/daemon"
 	"akvorado/common/helpers"
 	"akvorado/common/httpserver"
@@ -26,6 +33,10 @@ import (
 	"akvorado/orchestrator/geoip"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/benbjohnson/clock"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/mock/gomock"
 )
 
 type tableWithSchema struct {
@@ -206,6 +217,51 @@ func TestGetHTTPBaseURL(t *testing.T) {
 	}
 }
 
+// probeConn is a fake UDP connection with a fixed local address.
+type probeConn struct {
+	net.Conn
+	local *net.UDPAddr
+}
+
+func (pc probeConn) LocalAddr() net.Addr { return pc.local }
+func (pc probeConn) Close() error        { return nil }
+
+func TestGetHTTPBaseURLWithDialer(t *testing.T) {
+	r := reporter.NewMock(t)
+	http := httpserver.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{HTTP: http},
+	}
+	var dialed string
+	c.dial = func(network, address string) (net.Conn, error) {
+		dialed = fmt.Sprintf("%s/%s", network, address)
+		if address == "192.0.2.1:53" {
+			return nil, errors.New("network unreachable")
+		}
+		return probeConn{local: &net.UDPAddr{IP: net.ParseIP("198.51.100.10"), Port: 45678}}, nil
+	}
+	_, port, _ := net.SplitHostPort(http.LocalAddr().String())
+
+	got, err := c.getHTTPBaseURL(c.config.OrchestratorURLProbe)
+	if err != nil {
+		t.Fatalf("getHTTPBaseURL() error:\n%+v", err)
+	}
+	if diff := helpers.Diff(dialed, "udp/1.1.1.1:80"); diff != "" {
+		t.Errorf("getHTTPBaseURL() dialed address (-got, +want):\n%s", diff)
+	}
+	if diff := helpers.Diff(got, fmt.Sprintf("http://198.51.100.10:%s", port)); diff != "" {
+		t.Errorf("getHTTPBaseURL() (-got, +want):\n%s", diff)
+	}
+
+	if _, err := c.getHTTPBaseURL("192.0.2.1:53"); err == nil {
+		t.Error("getHTTPBaseURL() did not error")
+	} else if !strings.Contains(err.Error(), "192.0.2.1:53") {
+		t.Errorf("getHTTPBaseURL() error does not contain the probed address: %v", err)
+	}
+}
+
 func testMigrationFromPreviousStates(t *testing.T, cluster bool) {
 	var lastRun []tableWithSchema
 	var lastSteps int
@@ -555,3 +611,711 @@ func TestQuoteString(t *testing.T) {
 		}
 	}
 }
+
+func TestRawFlowsCreateQuery(t *testing.T) {
+	c := Component{
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+	got, err := c.rawFlowsCreateQuery()
+	if err != nil {
+		t.Fatalf("rawFlowsCreateQuery() error:\n%+v", err)
+	}
+	if strings.Contains(got, "kafka_security_protocol") {
+		t.Errorf("rawFlowsCreateQuery() should not use TLS by default:\n%s", got)
+	}
+
+	c.config.Kafka.CALocation = "/etc/clickhouse-server/kafka-ca.pem"
+	got, err = c.rawFlowsCreateQuery()
+	if err != nil {
+		t.Fatalf("rawFlowsCreateQuery() error:\n%+v", err)
+	}
+	if !strings.HasSuffix(got, "kafka_handle_error_mode = 'stream', kafka_security_protocol = 'ssl' "+
+		"COMMENT 'ssl_ca_location: /etc/clickhouse-server/kafka-ca.pem'") {
+		t.Errorf("rawFlowsCreateQuery() does not use TLS:\n%s", got)
+	}
+
+	c.config.Kafka.EngineSettings = []string{"kafka_security_protocol = 'sasl_ssl'"}
+	got, err = c.rawFlowsCreateQuery()
+	if err != nil {
+		t.Fatalf("rawFlowsCreateQuery() error:\n%+v", err)
+	}
+	if !strings.HasSuffix(got, "kafka_handle_error_mode = 'stream', kafka_security_protocol = 'sasl_ssl' "+
+		"COMMENT 'ssl_ca_location: /etc/clickhouse-server/kafka-ca.pem'") {
+		t.Errorf("rawFlowsCreateQuery() does not use the provided security protocol:\n%s", got)
+	}
+}
+
+func TestDryRunMigrations(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch},
+	}
+	c.initMetrics()
+	c.config.DryRun = true
+	ctx := context.Background()
+
+	mockConn.EXPECT().
+		Select(gomock.Any(), gomock.Any(), "SELECT 1").
+		Return(nil)
+	called := []string{}
+	err := c.wrapMigrations(ctx,
+		migrationStep{
+			Description: "create",
+			Fn: func(ctx context.Context) error {
+				called = append(called, "create")
+				return c.execOnCluster(ctx, "CREATE TABLE foo (a UInt8) ENGINE = Memory")
+			},
+		},
+		migrationStep{
+			Description: "check",
+			Fn: func(ctx context.Context) error {
+				called = append(called, "check")
+				var result []struct{}
+				if err := c.d.ClickHouse.Select(ctx, &result, "SELECT 1"); err != nil {
+					return err
+				}
+				return errSkipStep
+			},
+		},
+		migrationStep{
+			Description: "fail",
+			Fn: func(context.Context) error {
+				called = append(called, "fail")
+				return errors.New("table foo does not exist")
+			},
+		},
+		migrationStep{
+			Description: "nothing",
+			Fn: func(context.Context) error {
+				called = append(called, "nothing")
+				return nil
+			},
+		},
+	)
+	if err != nil {
+		t.Fatalf("wrapMigrations() error:\n%+v", err)
+	}
+	if diff := helpers.Diff(called, []string{"create", "check", "fail", "nothing"}); diff != "" {
+		t.Errorf("wrapMigrations() (-got, +want):\n%s", diff)
+	}
+	gotMetrics := r.GetMetrics("akvorado_orchestrator_clickhouse_migrations_", "pending_steps")
+	expectedMetrics := map[string]string{
+		"pending_steps": "2",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Errorf("Metrics (-got, +want):\n%s", diff)
+	}
+}
+
+func TestMigrationsProgress(t *testing.T) {
+	r := reporter.NewMock(t)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+	}
+	c.initMetrics()
+	progress := func() float64 {
+		gotMetrics := r.GetMetrics("akvorado_orchestrator_clickhouse_migrations_", "progress_ratio")
+		value, err := strconv.ParseFloat(gotMetrics["progress_ratio"], 64)
+		if err != nil {
+			t.Fatalf("ParseFloat() error:\n%+v", err)
+		}
+		return value
+	}
+	values := []float64{}
+	step := func(err error) migrationStep {
+		return migrationStep{
+			Description: "step",
+			Fn: func(context.Context) error {
+				values = append(values, progress())
+				return err
+			},
+		}
+	}
+	if err := c.wrapMigrations(context.Background(),
+		step(nil), step(errSkipStep), step(nil), step(nil),
+	); err != nil {
+		t.Fatalf("wrapMigrations() error:\n%+v", err)
+	}
+	values = append(values, progress())
+	if diff := helpers.Diff(values, []float64{0, 0.25, 0.5, 0.75, 1}); diff != "" {
+		t.Fatalf("migrationsProgress (-got, +want):\n%s", diff)
+	}
+}
+
+func TestMigrationStepRetry(t *testing.T) {
+	r := reporter.NewMock(t)
+	mockClock := clock.NewMock()
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Clock: mockClock},
+	}
+	c.initMetrics()
+	c.config.MigrationsRetryDelay = 10 * time.Second
+	readOnly := &clickhouse.Exception{Code: 242, Name: "DB::Exception", Message: "Table is in readonly mode"}
+	unknownTable := &clickhouse.Exception{Code: 60, Name: "DB::Exception", Message: "Table does not exist"}
+	cases := []struct {
+		Pos      helpers.Pos
+		Errors   []error
+		Calls    []time.Duration
+		Expected error
+	}{
+		{helpers.Mark(), []error{nil}, []time.Duration{0}, nil},
+		{helpers.Mark(), []error{errSkipStep}, []time.Duration{0}, errSkipStep},
+		{helpers.Mark(), []error{readOnly, readOnly, nil}, []time.Duration{0, 10 * time.Second, 30 * time.Second}, nil},
+		{helpers.Mark(), []error{fmt.Errorf("cannot exec: %w", syscall.ECONNRESET), nil}, []time.Duration{0, 10 * time.Second}, nil},
+		{helpers.Mark(), []error{fmt.Errorf("cannot exec: %w", readOnly), errSkipStep}, []time.Duration{0, 10 * time.Second}, errSkipStep},
+		{helpers.Mark(), []error{unknownTable, nil}, []time.Duration{0}, unknownTable},
+		{helpers.Mark(), []error{readOnly, readOnly, readOnly, nil}, []time.Duration{0, 10 * time.Second, 30 * time.Second}, readOnly},
+	}
+	for _, tc := range cases {
+		start := mockClock.Now()
+		calls := []time.Duration{}
+		called := make(chan bool)
+		done := make(chan error)
+		go func() {
+			done <- c.runMigrationStep(context.Background(), migrationStep{
+				Description: "step",
+				Fn: func(context.Context) error {
+					err := tc.Errors[len(calls)]
+					calls = append(calls, mockClock.Since(start))
+					called <- true
+					return err
+				},
+			})
+		}()
+		delay := c.config.MigrationsRetryDelay
+		for range tc.Calls[1:] {
+			<-called
+			time.Sleep(10 * time.Millisecond)
+			mockClock.Add(delay)
+			delay *= 2
+		}
+		<-called
+		err := <-done
+		if !errors.Is(err, tc.Expected) {
+			t.Errorf("%srunMigrationStep() error == %v, expected %v", tc.Pos, err, tc.Expected)
+		}
+		if diff := helpers.Diff(calls, tc.Calls); diff != "" {
+			t.Errorf("%srunMigrationStep() calls (-got, +want):\n%s", tc.Pos, diff)
+		}
+	}
+}
+
+func TestMigrationStepSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	r := reporter.NewMockWithTracerProvider(t, provider)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+	}
+	c.initMetrics()
+	if err := c.wrapMigrations(context.Background(),
+		migrationStep{
+			Description: "applied step",
+			Fn:          func(context.Context) error { return nil },
+		},
+		migrationStep{
+			Description: "skipped step",
+			Fn:          func(context.Context) error { return errSkipStep },
+		},
+	); err != nil {
+		t.Fatalf("wrapMigrations() error:\n%+v", err)
+	}
+	if err := c.runMigrationStep(context.Background(), migrationStep{
+		Description: "failed step",
+		Fn:          func(context.Context) error { return errors.New("failure") },
+	}); err == nil {
+		t.Fatal("runMigrationStep() did not error")
+	}
+
+	got := []map[string]string{}
+	for _, span := range recorder.Ended() {
+		attributes := map[string]string{
+			"name":   span.Name(),
+			"status": span.Status().Code.String(),
+		}
+		for _, kv := range span.Attributes() {
+			attributes[string(kv.Key)] = kv.Value.Emit()
+		}
+		got = append(got, attributes)
+	}
+	expected := []map[string]string{
+		{
+			"name":             "migration step",
+			"status":           "Unset",
+			"migration.step":   "applied step",
+			"migration.status": "applied",
+		}, {
+			"name":             "migration step",
+			"status":           "Unset",
+			"migration.step":   "skipped step",
+			"migration.status": "skipped",
+		}, {
+			"name":             "migration step",
+			"status":           "Error",
+			"migration.step":   "failed step",
+			"migration.status": "failed",
+		},
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("spans (-got, +want):\n%s", diff)
+	}
+}
+
+func TestASNsDictionaryRefresher(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	mockClock := clock.NewMock()
+	c := Component{
+		r:              r,
+		config:         DefaultConfiguration(),
+		d:              &Dependencies{ClickHouse: ch, Clock: mockClock},
+		migrationsDone: make(chan bool),
+	}
+	c.initMetrics()
+	c.config.ASNsReloadInterval = time.Hour
+	close(c.migrationsDone)
+
+	gomock.InOrder(
+		mockConn.EXPECT().
+			Exec(gomock.Any(), "SYSTEM RELOAD DICTIONARY default.asns").
+			Return(nil),
+		mockConn.EXPECT().
+			Exec(gomock.Any(), "SYSTEM RELOAD DICTIONARY default.asns").
+			Return(errors.New("unavailable")),
+	)
+	c.t.Go(func() error {
+		c.asnsDictionaryRefresher()
+		return nil
+	})
+
+	time.Sleep(30 * time.Millisecond)
+	mockClock.Add(30 * time.Minute)
+	time.Sleep(30 * time.Millisecond)
+	mockClock.Add(30 * time.Minute)
+	time.Sleep(30 * time.Millisecond)
+	mockClock.Add(time.Hour)
+	time.Sleep(30 * time.Millisecond)
+
+	c.t.Kill(nil)
+	if err := c.t.Wait(); err != nil {
+		t.Fatalf("Wait() error:\n%+v", err)
+	}
+
+	gotMetrics := r.GetMetrics("akvorado_orchestrator_clickhouse_asns_")
+	expectedMetrics := map[string]string{
+		`dictionary_reload_total{status="failure"}`: "1",
+		`dictionary_reload_total{status="success"}`: "1",
+	}
+	if diff := helpers.Diff(gotMetrics, expectedMetrics); diff != "" {
+		t.Fatalf("Metrics (-got, +want):\n%s", diff)
+	}
+}
+
+func TestReadinessCheck(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:              r,
+		config:         DefaultConfiguration(),
+		d:              &Dependencies{ClickHouse: ch},
+		migrationsDone: make(chan bool),
+	}
+	ctx := context.Background()
+
+	// Not ready until migrations are done
+	if err := c.readinessCheck(ctx); err == nil {
+		t.Fatal("readinessCheck() did not error before migrations")
+	}
+	close(c.migrationsDone)
+
+	// Then, ClickHouse is pinged on each check
+	gomock.InOrder(
+		mockConn.EXPECT().Ping(gomock.Any()).Return(errors.New("unavailable")),
+		mockConn.EXPECT().Ping(gomock.Any()).Return(nil),
+	)
+	if err := c.readinessCheck(ctx); err == nil {
+		t.Fatal("readinessCheck() did not error with ClickHouse unavailable")
+	}
+	if err := c.readinessCheck(ctx); err != nil {
+		t.Fatalf("readinessCheck() error:\n%+v", err)
+	}
+}
+
+func TestRunMigrationGraph(t *testing.T) {
+	r := reporter.NewMock(t)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+	}
+	c.initMetrics()
+	ctx := context.Background()
+
+	t.Run("ordering", func(t *testing.T) {
+		var lock sync.Mutex
+		events := []string{}
+		record := func(event string) {
+			lock.Lock()
+			events = append(events, event)
+			lock.Unlock()
+		}
+		aStarted := make(chan struct{})
+		bStarted := make(chan struct{})
+		steps := []migrationStep{
+			{Description: "a", Fn: func(context.Context) error {
+				close(aStarted)
+				select {
+				case <-bStarted:
+				case <-time.After(time.Second):
+					return errors.New("a and b did not run concurrently")
+				}
+				record("a")
+				return nil
+			}},
+			{Description: "b", Fn: func(context.Context) error {
+				close(bStarted)
+				<-aStarted
+				record("b")
+				return errSkipStep
+			}},
+			{Description: "c", Fn: func(context.Context) error {
+				record("c")
+				return nil
+			}, DependsOn: []string{"a", "b"}},
+			{Description: "d", Fn: func(context.Context) error {
+				record("d")
+				return nil
+			}, DependsOn: []string{"c"}},
+		}
+		if err := c.runMigrationGraph(ctx, 2, steps); err != nil {
+			t.Fatalf("runMigrationGraph() error:\n%+v", err)
+		}
+		if len(events) != 4 {
+			t.Fatalf("runMigrationGraph() events == %v", events)
+		}
+		if diff := helpers.Diff(events[2:], []string{"c", "d"}); diff != "" {
+			t.Fatalf("runMigrationGraph() events (-got, +want):\n%s", diff)
+		}
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		failure := errors.New("failure")
+		called := false
+		steps := []migrationStep{
+			{Description: "a", Fn: func(context.Context) error {
+				return failure
+			}},
+			{Description: "b", Fn: func(ctx context.Context) error {
+				select {
+				case <-ctx.Done():
+					return errSkipStep
+				case <-time.After(time.Second):
+					return errors.New("context not canceled")
+				}
+			}},
+			{Description: "c", Fn: func(context.Context) error {
+				called = true
+				return nil
+			}, DependsOn: []string{"a", "b"}},
+		}
+		if err := c.runMigrationGraph(ctx, 2, steps); !errors.Is(err, failure) {
+			t.Fatalf("runMigrationGraph() error == %v, expected %v", err, failure)
+		}
+		if called {
+			t.Fatal("runMigrationGraph() ran a step depending on a failed one")
+		}
+	})
+
+	t.Run("invalid dependency", func(t *testing.T) {
+		steps := []migrationStep{
+			{Description: "a", Fn: func(context.Context) error { return nil }, DependsOn: []string{"b"}},
+			{Description: "b", Fn: func(context.Context) error { return nil }},
+		}
+		if err := c.runMigrationGraph(ctx, 2, steps); err == nil {
+			t.Fatal("runMigrationGraph() did not error on a forward dependency")
+		}
+	})
+
+	t.Run("duplicate step", func(t *testing.T) {
+		steps := []migrationStep{
+			{Description: "a", Fn: func(context.Context) error { return nil }},
+			{Description: "a", Fn: func(context.Context) error { return nil }},
+		}
+		if err := c.runMigrationGraph(ctx, 2, steps); err == nil {
+			t.Fatal("runMigrationGraph() did not error on a duplicate step")
+		}
+	})
+
+	t.Run("chain", func(t *testing.T) {
+		steps := chainMigrationSteps([]string{"x"},
+			migrationStep{Description: "a"},
+			migrationStep{Description: "b", DependsOn: []string{"y"}},
+			migrationStep{Description: "c"},
+		)
+		got := [][]string{}
+		for _, step := range steps {
+			got = append(got, step.DependsOn)
+		}
+		if diff := helpers.Diff(got, [][]string{{"x"}, {"y", "a"}, {"b"}}); diff != "" {
+			t.Fatalf("chainMigrationSteps() (-got, +want):\n%s", diff)
+		}
+	})
+}
+
+func TestMigrationSteps(t *testing.T) {
+	r := reporter.NewMock(t)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{Schema: schema.NewMock(t)},
+	}
+	c.initMetrics()
+	// Main resolution last to check it is handled first anyway
+	c.config.Resolutions = append(c.config.Resolutions[1:], c.config.Resolutions[0])
+	steps := c.migrationSteps()
+
+	dependencies := map[string][]string{}
+	for idx := range steps {
+		dependencies[steps[idx].Description] = steps[idx].DependsOn
+		steps[idx].Fn = func(context.Context) error { return nil }
+		steps[idx].CheckQuery = ""
+	}
+	if err := c.runMigrationGraph(context.Background(), 4, steps); err != nil {
+		t.Fatalf("runMigrationGraph() error:\n%+v", err)
+	}
+
+	for _, tc := range []struct {
+		Step      string
+		DependsOn []string
+	}{
+		{"create asns dictionary", nil},
+		{"create query_log_akvorado table", nil},
+		{"create flow_samples table", nil},
+		{"create flows_compression_stats view", nil},
+		{"create flows_sampled distributed table", []string{"create flows_sampled table"}},
+		{"create flows_sampled consumer view", []string{
+			"create flows distributed table",
+			"create flows_sampled distributed table",
+		}},
+		{"create or update flows table", []string{"exchange flows tables"}},
+	} {
+		if diff := helpers.Diff(dependencies[tc.Step], tc.DependsOn); diff != "" {
+			t.Errorf("migrationSteps() %q dependencies (-got, +want):\n%s", tc.Step, diff)
+		}
+	}
+	if !slices.Contains(dependencies["create raw flows consumer view"], "create flows_1m0s row policies") {
+		t.Error("migrationSteps(): raw flows consumer view does not depend on flows_1m0s")
+	}
+}
+
+func TestFlowsTableAddBoundaryColumns(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	sch, err := schema.New(schema.Configuration{
+		Enabled: []schema.ColumnKey{schema.ColumnSrcBoundary, schema.ColumnDstBoundary},
+	})
+	if err != nil {
+		t.Fatalf("schema.New() error:\n%+v", err)
+	}
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch, Schema: sch},
+	}
+	ctx := context.Background()
+	resolution := ResolutionConfiguration{Interval: 0, TTL: 15 * 24 * time.Hour}
+
+	// The existing table has all the columns, except the boundary ones.
+	type existingColumn = struct {
+		Name             string `ch:"name"`
+		Type             string `ch:"type"`
+		CompressionCodec string `ch:"compression_codec"`
+		IsSortingKey     uint8  `ch:"is_in_sorting_key"`
+		IsPrimaryKey     uint8  `ch:"is_in_primary_key"`
+		DefaultKind      string `ch:"default_kind"`
+	}
+	existingColumns := []existingColumn{}
+	for _, column := range sch.Columns() {
+		if column.Key == schema.ColumnSrcBoundary || column.Key == schema.ColumnDstBoundary {
+			continue
+		}
+		existing := existingColumn{Name: column.Name, Type: column.ClickHouseType}
+		if column.ClickHouseCodec != "" {
+			existing.CompressionCodec = fmt.Sprintf("CODEC(%s)", column.ClickHouseCodec)
+		}
+		if column.ClickHouseAlias != "" {
+			existing.DefaultKind = "ALIAS"
+		}
+		existingColumns = append(existingColumns, existing)
+	}
+
+	ctrl := gomock.NewController(t)
+	tableRow := mocks.NewMockRow(ctrl)
+	tableRow.EXPECT().Scan(gomock.Any()).SetArg(0, "flows").Return(nil)
+	mockConn.EXPECT().
+		QueryRow(gomock.Any(),
+			"SELECT name FROM system.tables WHERE name = $1 AND database = $2",
+			"flows", "default").
+		Return(tableRow)
+	mockConn.EXPECT().
+		Select(gomock.Any(), gomock.Any(), gomock.Any(), "default", "flows").
+		SetArg(1, existingColumns).
+		Return(nil)
+	mockConn.EXPECT().
+		Exec(gomock.Any(), "ALTER TABLE flows "+
+			"ADD COLUMN `SrcBoundary` Enum8('undefined' = 0, 'external' = 1, 'internal' = 2) AFTER ForwardingStatus, "+
+			"ADD COLUMN `DstBoundary` Enum8('undefined' = 0, 'external' = 1, 'internal' = 2) AFTER SrcBoundary").
+		Return(nil)
+	// Settings and TTL are up-to-date
+	upToDateRow := mocks.NewMockRow(ctrl)
+	upToDateRow.EXPECT().Scan(gomock.Any()).SetArg(0, "1").Return(nil).Times(2)
+	mockConn.EXPECT().
+		QueryRow(gomock.Any(), gomock.Any(), "flows", "default").
+		Return(upToDateRow).
+		Times(2)
+
+	if err := c.createOrUpdateFlowsTable(ctx, resolution); err != nil {
+		t.Fatalf("createOrUpdateFlowsTable() error:\n%+v", err)
+	}
+}
+
+func TestMigrateDatabaseDown(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch, Schema: schema.NewMock(t)},
+	}
+	c.initMetrics()
+	ctx := context.Background()
+
+	// Unknown step
+	if err := c.migrateDatabaseDown(ctx, "create nothing"); err == nil {
+		t.Fatal("migrateDatabaseDown() did not error on an unknown step")
+	}
+
+	// Tables cannot be reverted: nothing is reverted
+	err := c.migrateDatabaseDown(ctx, "create udp dictionary")
+	if err == nil || !strings.Contains(err.Error(), `"create flows_raw_errors_quarantine consumer view"`) {
+		t.Fatalf("migrateDatabaseDown() should be blocked by the quarantine consumer view, got %v", err)
+	}
+
+	// Views are reverted in reverse order
+	reverted := []string{}
+	record := func(_ context.Context, query string, _ ...any) error {
+		reverted = append(reverted, query)
+		return nil
+	}
+	mockConn.EXPECT().Exec(gomock.Any(), gomock.Any()).DoAndReturn(record).Times(3)
+	if err := c.migrateDatabaseDown(ctx, "create flows_raw_errors_quarantine consumer view"); err != nil {
+		t.Fatalf("migrateDatabaseDown() error:\n%+v", err)
+	}
+	expected := []string{
+		"DROP VIEW IF EXISTS kafka_consumers_lag SYNC",
+		"DROP VIEW IF EXISTS flows_compression_stats SYNC",
+		"DROP VIEW IF EXISTS flows_raw_errors_quarantine_stats SYNC",
+	}
+	if diff := helpers.Diff(reverted, expected); diff != "" {
+		t.Fatalf("migrateDatabaseDown() (-got, +want):\n%s", diff)
+	}
+
+	// Stop on the first error
+	mockConn.EXPECT().
+		Exec(gomock.Any(), "DROP VIEW IF EXISTS kafka_consumers_lag SYNC").
+		Return(errors.New("oops"))
+	if err := c.migrateDatabaseDown(ctx, "create flows_compression_stats view"); err == nil {
+		t.Fatal("migrateDatabaseDown() did not return an error")
+	}
+
+	// Nothing to revert
+	if err := c.migrateDatabaseDown(ctx, "create kafka_consumers_lag view"); err != nil {
+		t.Fatalf("migrateDatabaseDown() error:\n%+v", err)
+	}
+
+	// Dictionaries can be reverted
+	mockConn.EXPECT().
+		Exec(gomock.Any(), "DROP DICTIONARY IF EXISTS asns SYNC").
+		Return(nil)
+	steps := c.migrationSteps()
+	if steps[0].Undo == nil {
+		t.Fatalf("migration step %q cannot be reverted", steps[0].Description)
+	}
+	if err := steps[0].Undo(ctx); err != nil {
+		t.Fatalf("Undo() error:\n%+v", err)
+	}
+}
+
+func TestApplyMigrationStepCheckQuery(t *testing.T) {
+	r := reporter.NewMock(t)
+	ch, mockConn := clickhousedb.NewMock(t, r)
+	c := Component{
+		r:      r,
+		config: DefaultConfiguration(),
+		d:      &Dependencies{ClickHouse: ch},
+	}
+	ctx := context.Background()
+	ctrl := gomock.NewController(t)
+	applied := false
+	step := migrationStep{
+		Description: "create flows table",
+		Fn: func(context.Context) error {
+			applied = true
+			return nil
+		},
+		CheckQuery: "SELECT count() FROM system.tables WHERE name = $1",
+		CheckArgs:  []any{"flows"},
+	}
+	cases := []struct {
+		Pos     helpers.Pos
+		Result  any
+		Error   error
+		Applied bool
+	}{
+		{helpers.Mark(), uint8(0), nil, true},
+		{helpers.Mark(), uint8(1), nil, false},
+		{helpers.Mark(), uint64(0), nil, true},
+		{helpers.Mark(), uint64(42), nil, false},
+		{helpers.Mark(), int64(-1), nil, false},
+		{helpers.Mark(), true, nil, false},
+		{helpers.Mark(), nil, nil, true},
+		{helpers.Mark(), nil, sql.ErrNoRows, true},
+	}
+	for _, tc := range cases {
+		row := mocks.NewMockRow(ctrl)
+		row.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...any) error {
+			if tc.Error != nil {
+				return tc.Error
+			}
+			return dest[0].(sql.Scanner).Scan(tc.Result)
+		})
+		mockConn.EXPECT().QueryRow(gomock.Any(), step.CheckQuery, "flows").Return(row)
+		applied = false
+		err := c.applyMigrationStep(ctx, step)
+		if tc.Applied && err != nil {
+			t.Errorf("%sapplyMigrationStep() error:\n%+v", tc.Pos, err)
+		} else if !tc.Applied && !errors.Is(err, errSkipStep) {
+			t.Errorf("%sapplyMigrationStep() should skip the step, got %v", tc.Pos, err)
+		}
+		if applied != tc.Applied {
+			t.Errorf("%sapplyMigrationStep() applied == %v, expected %v", tc.Pos, applied, tc.Applied)
+		}
+	}
+
+	// Unsupported type
+	row := mocks.NewMockRow(ctrl)
+	row.EXPECT().Scan(gomock.Any()).DoAndReturn(func(dest ...any) error {
+		return dest[0].(sql.Scanner).Scan("1")
+	})
+	mockConn.EXPECT().QueryRow(gomock.Any(), step.CheckQuery, "flows").Return(row)
+	if err := c.applyMigrationStep(ctx, step); err == nil || errors.Is(err, errSkipStep) {
+		t.Errorf("applyMigrationStep() did not error on a string result, got %v", err)
+	}
+}
@@ -77,9 +77,11 @@ func (c *Component) networksCSVRefresher() {
 				return err
 			}
 			attrs := NetworkAttributes{
-				State:   data.State,
-				Country: data.Country,
-				City:    data.City,
+				State:     data.State,
+				Country:   data.Country,
+				City:      data.City,
+				Latitude:  data.Latitude,
+				Longitude: data.Longitude,
 			}
 			return networks.Update(subV6Str, attrs, overrideNetworkAttrs(attrs))
 		})
@@ -123,6 +125,8 @@ func (c *Component) networksCSVRefresher() {
 			}
 		}
 
+		c.metrics.networksEntries.Set(float64(networks.Len()))
+
 		// Clean up old files
 		oldFiles, err := filepath.Glob(filepath.Join(os.TempDir(), networksCSVPattern))
 		if err == nil {
@@ -141,7 +145,7 @@ func (c *Component) networksCSVRefresher() {
 		// Write a gzip dump to the disk
 		gzipWriter := gzip.NewWriter(tmpfile)
 		csvWriter := csv.NewWriter(gzipWriter)
-		csvWriter.Write([]string{"network", "name", "role", "site", "region", "country", "state", "city", "tenant", "asn"})
+		csvWriter.Write([]string{"network", "name", "role", "site", "region", "country", "state", "city", "tenant", "asn", "latitude", "longitude"})
 		networks.Iter(func(address patricia.IPv6Address, tags [][]NetworkAttributes) error {
 			current := NetworkAttributes{}
 			for _, nodeTags := range tags {
@@ -150,10 +154,14 @@ func (c *Component) networksCSVRefresher() {
 				}
 			}
 
-			var asnVal string
+			var asnVal, latitudeVal, longitudeVal string
 			if current.ASN != 0 {
 				asnVal = strconv.Itoa(int(current.ASN))
 			}
+			if current.Latitude != 0 || current.Longitude != 0 {
+				latitudeVal = strconv.FormatFloat(current.Latitude, 'f', -1, 64)
+				longitudeVal = strconv.FormatFloat(current.Longitude, 'f', -1, 64)
+			}
 			csvWriter.Write([]string{
 				address.String(),
 				current.Name,
@@ -165,6 +173,8 @@ func (c *Component) networksCSVRefresher() {
 				current.City,
 				current.Tenant,
 				asnVal,
+				latitudeVal,
+				longitudeVal,
 			})
 			return nil
 		})
@@ -227,5 +237,10 @@ func mergeNetworkAttrs(existing, newAttrs NetworkAttributes) NetworkAttributes {
 	if newAttrs.City != "" {
 		existing.City = newAttrs.City
 	}
+	// Coordinates only make sense together
+	if newAttrs.Latitude != 0 || newAttrs.Longitude != 0 {
+		existing.Latitude = newAttrs.Latitude
+		existing.Longitude = newAttrs.Longitude
+	}
 	return existing
 }
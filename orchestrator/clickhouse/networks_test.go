@@ -43,23 +43,23 @@ func TestNetworksCSVWithGeoip(t *testing.T) {
 				URL:         "/api/v0/orchestrator/clickhouse/networks.csv",
 				ContentType: "text/csv; charset=utf-8",
 				FirstLines: []string{
-					"network,name,role,site,region,country,state,city,tenant,asn",
-					"1.0.0.0/24,,,,,,,,,15169",
-					"1.128.0.0/11,,,,,,,,,1221",
-					"2.19.4.136/30,,,,,SG,,,,32787",
-					"2.19.4.140/32,,,,,SG,,,,32787",
-					"2.125.160.216/29,,,,,GB,,,,",
-					"12.81.92.0/22,,,,,,,,,7018",
-					"12.81.96.0/19,,,,,,,,,7018",
-					"12.81.128.0/17,,,,,,,,,7018",
-					"12.82.0.0/15,,,,,,,,,7018",
-					"12.84.0.0/14,,,,,,,,,7018",
-					"12.88.0.0/13,,,,,,,,,7018",
-					"12.96.0.0/20,,,,,,,,,7018",
-					"12.96.16.0/24,,,,,,,,,7018",
-					"15.0.0.0/8,,,,,,,,,71",
-					"16.0.0.0/8,,,,,,,,,71",
-					"18.0.0.0/8,,,,,,,,,3",
+					"network,name,role,site,region,country,state,city,tenant,asn,latitude,longitude",
+					"1.0.0.0/24,,,,,,,,,15169,,",
+					"1.128.0.0/11,,,,,,,,,1221,,",
+					"2.19.4.136/30,,,,,SG,,,,32787,,",
+					"2.19.4.140/32,,,,,SG,,,,32787,,",
+					"2.125.160.216/29,,,,,GB,,,,,,",
+					"12.81.92.0/22,,,,,,,,,7018,,",
+					"12.81.96.0/19,,,,,,,,,7018,,",
+					"12.81.128.0/17,,,,,,,,,7018,,",
+					"12.82.0.0/15,,,,,,,,,7018,,",
+					"12.84.0.0/14,,,,,,,,,7018,,",
+					"12.88.0.0/13,,,,,,,,,7018,,",
+					"12.96.0.0/20,,,,,,,,,7018,,",
+					"12.96.16.0/24,,,,,,,,,7018,,",
+					"15.0.0.0/8,,,,,,,,,71,,",
+					"16.0.0.0/8,,,,,,,,,71,,",
+					"18.0.0.0/8,,,,,,,,,3,,",
 				},
 			},
 		})
@@ -91,26 +91,26 @@ func TestNetworksCSVWithGeoip(t *testing.T) {
 				URL:         "/api/v0/orchestrator/clickhouse/networks.csv",
 				ContentType: "text/csv; charset=utf-8",
 				FirstLines: []string{
-					"network,name,role,site,region,country,state,city,tenant,asn",
-					"1.0.0.0/24,,,,,,,,,15169",
-					"1.128.0.0/11,,,,,,,,,1221",
-					"2.19.4.136/30,,,,,SG,,,,32787",
-					"2.19.4.140/32,,,,,SG,,,,32787",
-					"2.125.160.216/29,,,,,GB,,,,",
-					"12.80.0.0/16,infra,,,,,,,,", // not covered by GeoIP
-					"12.81.92.0/22,,,,,,,,,7018",
-					"12.81.96.0/19,infra,,,,,,,,7018",       // matching a GeoIP entry
-					"12.81.96.0/24,infra,,,,,,,Alfred,7018", // nested in previous one
-					"12.81.128.0/17,,,,,,,,,7018",
-					"12.82.0.0/15,,,,,,,,,7018",
-					"12.84.0.0/14,,,,,,,,,7018",
-					"12.88.0.0/13,,,,,,,,,7018",
-					"12.96.0.0/20,,,,,,,,,7018",
-					"12.96.16.0/24,,,,,,,,,7018",
-					"14.0.0.0/7,,,,,,,,Alfred,",   // not covered by GeoIP
-					"15.0.0.0/8,,,,,,,,Alfred,71", // but covers GeoIP entries
-					"16.0.0.0/8,,,,,,,,,71",
-					"18.0.0.0/8,,,,,,,,,3",
+					"network,name,role,site,region,country,state,city,tenant,asn,latitude,longitude",
+					"1.0.0.0/24,,,,,,,,,15169,,",
+					"1.128.0.0/11,,,,,,,,,1221,,",
+					"2.19.4.136/30,,,,,SG,,,,32787,,",
+					"2.19.4.140/32,,,,,SG,,,,32787,,",
+					"2.125.160.216/29,,,,,GB,,,,,,",
+					"12.80.0.0/16,infra,,,,,,,,,,", // not covered by GeoIP
+					"12.81.92.0/22,,,,,,,,,7018,,",
+					"12.81.96.0/19,infra,,,,,,,,7018,,",       // matching a GeoIP entry
+					"12.81.96.0/24,infra,,,,,,,Alfred,7018,,", // nested in previous one
+					"12.81.128.0/17,,,,,,,,,7018,,",
+					"12.82.0.0/15,,,,,,,,,7018,,",
+					"12.84.0.0/14,,,,,,,,,7018,,",
+					"12.88.0.0/13,,,,,,,,,7018,,",
+					"12.96.0.0/20,,,,,,,,,7018,,",
+					"12.96.16.0/24,,,,,,,,,7018,,",
+					"14.0.0.0/7,,,,,,,,Alfred,,,",   // not covered by GeoIP
+					"15.0.0.0/8,,,,,,,,Alfred,71,,", // but covers GeoIP entries
+					"16.0.0.0/8,,,,,,,,,71,,",
+					"18.0.0.0/8,,,,,,,,,3,,",
 				},
 			},
 		})
@@ -140,7 +140,7 @@ func TestNetworksCSVWithGeoip(t *testing.T) {
 				URL:         "/api/v0/orchestrator/clickhouse/networks.csv",
 				ContentType: "text/csv; charset=utf-8",
 				FirstLines: []string{
-					"network,name,role,site,region,country,state,city,tenant,asn",
+					"network,name,role,site,region,country,state,city,tenant,asn,latitude,longitude",
 				},
 			},
 		})
@@ -6,13 +6,16 @@ package clickhouse
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"akvorado/common/remotedatasourcefetcher"
 
+	"github.com/benbjohnson/clock"
 	"github.com/cenkalti/backoff/v4"
 	"gopkg.in/tomb.v2"
 
@@ -33,6 +36,9 @@ type Component struct {
 	metrics metrics
 
 	shards int // number of shards if in a cluster
+	dial   func(network, address string) (net.Conn, error)
+
+	dryRunExecuted atomic.Int64 // statements skipped by the current dry-run step
 
 	migrationsDone        chan bool // closed when migrations are done
 	migrationsOnce        chan bool // closed after first attempt to migrate
@@ -53,14 +59,19 @@ type Dependencies struct {
 	ClickHouse *clickhousedb.Component
 	Schema     *schema.Component
 	GeoIP      *geoip.Component
+	Clock      clock.Clock
 }
 
 // New creates a new ClickHouse component.
 func New(r *reporter.Reporter, configuration Configuration, dependencies Dependencies) (*Component, error) {
+	if dependencies.Clock == nil {
+		dependencies.Clock = clock.New()
+	}
 	c := Component{
 		r:                     r,
 		d:                     &dependencies,
 		config:                configuration,
+		dial:                  net.Dial,
 		migrationsDone:        make(chan bool),
 		migrationsOnce:        make(chan bool),
 		networkSources:        make(map[string][]externalNetworkAttributes),
@@ -78,6 +89,7 @@ func New(r *reporter.Reporter, configuration Configuration, dependencies Depende
 	if err := c.registerHTTPHandlers(); err != nil {
 		return nil, err
 	}
+	c.d.HTTP.RegisterReadinessCheck("clickhouse", c.readinessCheck)
 
 	// Ensure resolutions are sorted and we have a 0-interval resolution first.
 	sort.Slice(c.config.Resolutions, func(i, j int) bool {
@@ -166,6 +178,14 @@ func (c *Component) Start() error {
 		return nil
 	})
 
+	// ASNs dictionary reload
+	if c.config.ASNsReloadInterval > 0 {
+		c.t.Go(func() error {
+			c.asnsDictionaryRefresher()
+			return nil
+		})
+	}
+
 	c.r.Info().Msg("ClickHouse component started")
 	return nil
 }
@@ -127,10 +127,10 @@ func TestNetworkSources(t *testing.T) {
 			URL:         "/api/v0/orchestrator/clickhouse/networks.csv",
 			ContentType: "text/csv; charset=utf-8",
 			FirstLines: []string{
-				`network,name,role,site,region,country,state,city,tenant,asn`,
-				`3.2.34.0/26,,amazon,,af-south-1,,,,amazon,`,
-				`2600:1f14:fff:f800::/56,,route53_healthchecks,,us-west-2,,,,amazon,`,
-				`2600:1ff2:4000::/40,,amazon,,us-west-2,,,,amazon,`,
+				`network,name,role,site,region,country,state,city,tenant,asn,latitude,longitude`,
+				`3.2.34.0/26,,amazon,,af-south-1,,,,amazon,,,`,
+				`2600:1f14:fff:f800::/56,,route53_healthchecks,,us-west-2,,,,amazon,,,`,
+				`2600:1ff2:4000::/40,,amazon,,us-west-2,,,,amazon,,,`,
 			},
 		},
 	})
@@ -9,9 +9,11 @@ import (
 
 // GeoInfo describes geographical data of a geo the database.
 type GeoInfo struct {
-	Country string
-	City    string
-	State   string
+	Country   string
+	City      string
+	State     string
+	Latitude  float64
+	Longitude float64
 }
 
 // ASNInfo describes ASN data of an asn database.
@@ -23,6 +23,10 @@ type maxmindDBCountry struct {
 	Subdivisions []struct {
 		IsoCode string `maxminddb:"iso_code"`
 	} `maxminddb:"subdivisions"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
 }
 
 type maxmindDB struct {
@@ -67,9 +71,11 @@ func (mmdb *maxmindDB) IterGeoDatabase(f GeoIterFunc) error {
 		}
 
 		if err := f(subnet, GeoInfo{
-			Country: geoInfo.Country.IsoCode,
-			State:   state,
-			City:    geoInfo.City.Names["en"],
+			Country:   geoInfo.Country.IsoCode,
+			State:     state,
+			City:      geoInfo.City.Names["en"],
+			Latitude:  geoInfo.Location.Latitude,
+			Longitude: geoInfo.Location.Longitude,
 		}); err != nil {
 			return err
 		}
@@ -99,6 +99,38 @@ func TestIterDatabase(t *testing.T) {
 	}
 }
 
+func TestIterCityDatabase(t *testing.T) {
+	// city_sample.mmdb is a small City database mimicking a few entries of
+	// GeoLite2-City-Test.json.
+	config := DefaultConfiguration()
+	config.GeoDatabase = []string{filepath.Join("testdata", "city_sample.mmdb")}
+	r := reporter.NewMock(t)
+	c, err := New(r, config, Dependencies{Daemon: daemon.NewMock(t)})
+	if err != nil {
+		t.Fatalf("New() error:\n%+v", err)
+	}
+	helpers.StartStop(t, c)
+
+	got := map[string]GeoInfo{}
+	if err := c.IterGeoDatabases(func(n *net.IPNet, a GeoInfo) error {
+		got[n.String()] = a
+		return nil
+	}); err != nil {
+		t.Fatalf("IterGeoDatabases() error:\n%+v", err)
+	}
+	expected := map[string]GeoInfo{
+		"2.125.160.216/29": {Country: "GB", State: "ENG", City: "Boxford", Latitude: 51.75, Longitude: -1.25},
+		"81.2.69.142/31":   {Country: "GB", State: "ENG", City: "London", Latitude: 51.5142, Longitude: -0.0931},
+		"89.160.20.112/28": {Country: "SE", State: "E", City: "Linköping", Latitude: 58.4167, Longitude: 15.6167},
+		"216.160.83.56/29": {Country: "US", State: "WA", City: "Milton", Latitude: 47.2513, Longitude: -122.3149},
+		"2a02:d280::/29":   {Country: "CZ", Latitude: 49.75, Longitude: 15.5},
+		"2001:218::/32":    {Country: "JP"},
+	}
+	if diff := helpers.Diff(got, expected); diff != "" {
+		t.Fatalf("IterGeoDatabases() (-got, +want):\n%s", diff)
+	}
+}
+
 func TestIterNonExistingDatabase(t *testing.T) {
 	dir := t.TempDir()
 	config := DefaultConfiguration()